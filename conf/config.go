@@ -7,12 +7,102 @@ import (
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/micro/go-config"
 	"github.com/micro/go-config/source/env"
+	"time"
 )
 
 const (
 	environmentVariablePrefix = "hosts"
 )
 
+// PasswordHashConfig selects the hasher of new passwords and its parameters
+type PasswordHashConfig struct {
+	// Algorithm is "argon2id" (default) or "bcrypt"
+	Algorithm string
+
+	// Memory in KiB, Iterations and Parallelism are the argon2id costs
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+
+	// BcryptCost is the bcrypt cost
+	BcryptCost int
+}
+
+// PasswordPolicyConfig sets the rules new passwords must meet
+type PasswordPolicyConfig struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol each require a character of the class
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// BlockPersonalInfo rejects passwords containing the user's name or email
+	BlockPersonalInfo bool
+
+	// BlockBreached rejects passwords found in the breached password list
+	BlockBreached bool
+
+	// BreachedFile is a breached password list replacing the bundled one, one SHA1[:COUNT] per line
+	BreachedFile string
+}
+
+// LoginLimitConfig sets how failed logins are backed off and locked out
+type LoginLimitConfig struct {
+	// MaxEmailFailures and MaxIPFailures are the failures that lock out an email or a client IP
+	MaxEmailFailures int
+	MaxIPFailures    int
+
+	// Backoff is the wait after the first failure of an email, doubled by every further failure up to MaxBackoff,
+	// client IPs are not backed off, only locked out
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Lockout is how long an email or client IP is locked out
+	Lockout time.Duration
+
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// TOTPConfig sets up two-factor authentication
+type TOTPConfig struct {
+	// Issuer names the service in authenticator apps
+	Issuer string
+}
+
+// TokenSigningConfig selects how auth tokens are signed
+type TokenSigningConfig struct {
+	// Algorithm signs with every new secret, "HMAC" (default) shares the secret with every service verifying tokens,
+	// "RS256" and "EdDSA" sign with a private key and publish the public key
+	Algorithm string
+}
+
+// CryptoConfig sets up the master key encrypting secrets at rest
+type CryptoConfig struct {
+	// MasterKey is the base64 AES-256 key sealing the data key of every secret, read from MasterKeyFile if empty
+	MasterKey string
+
+	// MasterKeyFile is a file holding the base64 master key, ie a mounted secret
+	MasterKeyFile string
+
+	// PreviousMasterKeys are comma separated base64 master keys that still open data keys,
+	// until the reencrypt command seals them with MasterKey
+	PreviousMasterKeys string
+}
+
+// SecretRotationConfig sets how the auth secret is rotated before it expires
+type SecretRotationConfig struct {
+	// Interval is how often the active secret is reloaded from the store and checked for rotation
+	Interval time.Duration
+
+	// Lead is how long before the active secret expires it is rotated,
+	// raised to at least an auth token lifetime plus Interval so tokens expire before their secret
+	Lead time.Duration
+}
+
 var (
 	// GRPCHost contains server configs grabbed from env vars
 	GRPCHost hosts.Host
@@ -23,6 +113,43 @@ var (
 	// EmailHost contains smtp configs grabbed from env vars
 	EmailHost hosts.SMTPHost
 
+	// StoreBackend selects where users are stored, "postgres" (default) or "memory"
+	StoreBackend string
+
+	// StoreHealthCheckInterval is how often the store is pinged to enter or leave degraded mode, 5s by default
+	StoreHealthCheckInterval time.Duration
+
+	// PasswordHash configures how new passwords are hashed, older hashes are replaced on login
+	PasswordHash PasswordHashConfig
+
+	// PasswordPolicy sets the rules checked when a password is created, updated or reset
+	PasswordPolicy PasswordPolicyConfig
+
+	// LoginLimit configures the failed login backoff and lockout of AuthenticateUser
+	LoginLimit LoginLimitConfig
+
+	// TOTP configures two-factor authentication
+	TOTP TOTPConfig
+
+	// RefreshTokenLifetime is how long a refresh token can be swapped for a new access token, 30 days by default
+	RefreshTokenLifetime time.Duration
+
+	// TokenSigning configures the secrets auth tokens are signed with
+	TokenSigning TokenSigningConfig
+
+	// Crypto configures the master key secrets, email tokens, TOTP secrets and private keys are encrypted with
+	Crypto CryptoConfig
+
+	// SecretRotation configures the scheduled rotation of the auth secret
+	SecretRotation SecretRotationConfig
+
+	// ServiceKeys are comma separated keys downstream services send in the service-key metadata,
+	// to get the auth secret verifying HMAC auth tokens without an ADMIN auth token
+	ServiceKeys string
+
+	// ShutdownTimeout bounds how long in-flight RPCs and emails are drained on SIGTERM, 30s by default
+	ShutdownTimeout time.Duration
+
 	// DummyAccount reads from environment variables, and it is used for creating accounts
 	DummyAccount pblib.User
 )
@@ -59,6 +186,52 @@ func init() {
 		logger.Fatal(consts.UserServiceTag, "Failed to get smtp email configurations", err.Error())
 	}
 
+	StoreBackend = conf.Get("hosts", "store", "backend").String("postgres")
+	StoreHealthCheckInterval = conf.Get("hosts", "store", "healthcheck").Duration(5 * time.Second)
+	PasswordHash = PasswordHashConfig{
+		Algorithm:   conf.Get("hosts", "password", "algorithm").String("argon2id"),
+		Memory:      uint32(conf.Get("hosts", "password", "memory").Int(19 * 1024)),
+		Iterations:  uint32(conf.Get("hosts", "password", "iterations").Int(2)),
+		Parallelism: uint8(conf.Get("hosts", "password", "parallelism").Int(1)),
+		BcryptCost:  conf.Get("hosts", "password", "bcryptcost").Int(12),
+	}
+	PasswordPolicy = PasswordPolicyConfig{
+		MinLength:         conf.Get("hosts", "passwordpolicy", "minlength").Int(8),
+		RequireUpper:      conf.Get("hosts", "passwordpolicy", "upper").Bool(false),
+		RequireLower:      conf.Get("hosts", "passwordpolicy", "lower").Bool(false),
+		RequireDigit:      conf.Get("hosts", "passwordpolicy", "digit").Bool(false),
+		RequireSymbol:     conf.Get("hosts", "passwordpolicy", "symbol").Bool(false),
+		BlockPersonalInfo: conf.Get("hosts", "passwordpolicy", "personalinfo").Bool(true),
+		BlockBreached:     conf.Get("hosts", "passwordpolicy", "breached").Bool(true),
+		BreachedFile:      conf.Get("hosts", "passwordpolicy", "breachedfile").String(""),
+	}
+	LoginLimit = LoginLimitConfig{
+		MaxEmailFailures: conf.Get("hosts", "login", "maxemailfailures").Int(5),
+		MaxIPFailures:    conf.Get("hosts", "login", "maxipfailures").Int(20),
+		Backoff:          conf.Get("hosts", "login", "backoff").Duration(time.Second),
+		MaxBackoff:       conf.Get("hosts", "login", "maxbackoff").Duration(time.Minute),
+		Lockout:          conf.Get("hosts", "login", "lockout").Duration(15 * time.Minute),
+		Window:           conf.Get("hosts", "login", "window").Duration(15 * time.Minute),
+	}
+	TOTP = TOTPConfig{
+		Issuer: conf.Get("hosts", "totp", "issuer").String("Humpback Whale Social Call"),
+	}
+	RefreshTokenLifetime = conf.Get("hosts", "refreshtoken", "lifetime").Duration(30 * 24 * time.Hour)
+	TokenSigning = TokenSigningConfig{
+		Algorithm: conf.Get("hosts", "signing", "algorithm").String("HMAC"),
+	}
+	Crypto = CryptoConfig{
+		MasterKey:          conf.Get("hosts", "crypto", "masterkey").String(""),
+		MasterKeyFile:      conf.Get("hosts", "crypto", "masterkeyfile").String(""),
+		PreviousMasterKeys: conf.Get("hosts", "crypto", "previousmasterkeys").String(""),
+	}
+	SecretRotation = SecretRotationConfig{
+		Interval: conf.Get("hosts", "secret", "interval").Duration(time.Minute),
+		Lead:     conf.Get("hosts", "secret", "rotatebefore").Duration(24 * time.Hour),
+	}
+	ServiceKeys = conf.Get("hosts", "service", "keys").String("")
+	ShutdownTimeout = conf.Get("hosts", "shutdown", "timeout").Duration(30 * time.Second)
+
 	if err := conf.Get("hosts", "dummy").Scan(&DummyAccount); err != nil {
 		logger.Fatal(consts.UserServiceTag, "Failed to get dummy account configurations", err.Error())
 	}
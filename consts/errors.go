@@ -23,6 +23,15 @@ const (
 	MsgErrSecret                    string = "failed to insert new secret into db:"
 	MsgErrGetActiveSecret           string = "failed to get active secret row from db:"
 	MsgErrLookUpActiveSecret        string = "failed to look up active secret from db"
+	MsgErrRotateSecret              string = "failed to rotate auth secret:"
+	MsgErrWatchSecret               string = "failed to watch active secret:"
+	MsgErrListSigningKeys           string = "failed to list signing keys:"
+	MsgErrReEncrypt                 string = "failed to re-encrypt data keys:"
+	MsgErrEvaluatePolicy            string = "failed to evaluate policy:"
+	MsgErrGrantRole                 string = "failed to grant role:"
+	MsgErrRevokeRole                string = "failed to revoke role:"
+	MsgErrSuspendUser               string = "failed to suspend user:"
+	MsgErrReactivateUser            string = "failed to reactivate user:"
 	MsgErrPermissionMismatch        string = "permission level does not match"
 	MsgErrValidatingIdentity        string = "failed to validate identity:"
 	MsgErrValidatingToken           string = "failed to match token with db:"
@@ -30,6 +39,18 @@ const (
 	MsgErrDeletingEmailToken        string = "failed to delete email token:"
 	MsgErrRetrieveEmailTokenRow     string = "failed to retrieve matched email token row"
 	MsgErrUpdatePermLevel           string = "failed to update permission level of user:"
+	MsgErrListUsers                 string = "failed to list users:"
+	MsgErrGetDocumentRow            string = "failed to get document row:"
+	MsgErrShareDocument             string = "failed to share document:"
+	MsgErrResolveShareRecipients    string = "failed to resolve share recipients:"
+	MsgErrUnshareDocument           string = "failed to unshare document:"
+	MsgErrListDocuments             string = "failed to list documents:"
+	MsgErrUpdateDocumentVisibility  string = "failed to update document visibility:"
+	MsgErrGeneratingResetLink       string = "failed to generate password reset link:"
+	MsgErrRevokeAuthTokens          string = "failed to revoke auth tokens:"
+	MsgErrResetPassword             string = "failed to reset password:"
+	MsgErrResendVerificationEmail   string = "failed to resend verification email:"
+	MsgErrSwapProspectiveEmail      string = "failed to swap prospective email:"
 )
 
 var (
@@ -53,6 +74,8 @@ var (
 	ErrNoRowsFound                  = errors.New("no query row found in database")
 	ErrNoAuthTokenFound             = errors.New("no auth token were found with given uuid")
 	ErrNoMatchingAuthTokenFound     = errors.New("no matching auth token were found with given token")
+	ErrAuthTokenRevoked             = errors.New("auth token is revoked")
+	ErrAuthTokenCollision           = errors.New("failed to generate a unique auth token")
 	ErrNoMatchingEmailTokenFound    = errors.New("no matching email token were found with given token")
 	ErrNoActiveSecretKeyFound       = errors.New("no active secret key found in database")
 	ErrMismatchingToken             = errors.New("tokens do not match")
@@ -60,13 +83,89 @@ var (
 	ErrInvalidAddTime               = errors.New("add time is zero")
 	ErrEmailExists                  = errors.New("email already exists")
 	ErrEmailDoesNotExist            = errors.New("email does not exist in db")
+	ErrInvalidListUsersSortBy       = errors.New("invalid sort column for listing users")
+	ErrInvalidListUsersSortOrder    = errors.New("invalid sort order for listing users")
+	ErrInvalidListUsersPageSize     = errors.New("invalid page size for listing users")
+	ErrInvalidListUsersFilter       = errors.New("invalid filter for listing users")
+	ErrInvalidListUsersCursor       = errors.New("invalid cursor for listing users")
+	ErrInvalidDUID                  = errors.New("invalid duid")
+	ErrDocumentNotFound             = errors.New("document is not found in database")
+	ErrDocumentNotOwned             = errors.New("document is not owned by user")
+	ErrNoShareRecipients            = errors.New("no uuids or emails to share duid with")
+	ErrInvalidShareRecipient        = errors.New("share recipient is neither a valid uuid nor email")
+	ErrShareRecipientNotVerified    = errors.New("share recipient is not verified")
+	ErrNilRequestUserDocuments      = errors.New("nil or empty request User documents")
+	ErrInvalidEmailTokenPurpose     = errors.New("invalid email token purpose")
+	ErrMismatchingEmailTokenPurpose = errors.New("email token was not issued for this purpose")
+	ErrNoPendingEmailVerification   = errors.New("user has no email waiting for verification")
+	ErrEmailRateLimited             = errors.New("too many emails sent to this address, try again later")
+	ErrInvalidStoreBackend          = errors.New("invalid store backend")
+	ErrInvalidMigrateCommand        = errors.New("invalid migrate command, expected up, down, status or version")
+	ErrInvalidServiceState          = errors.New("invalid service state, expected AVAILABLE, MAINTENANCE or UNAVAILABLE")
+	ErrInvalidServiceStateReason    = errors.New("service state reason is too long")
+	ErrInvalidServiceStateExpiry    = errors.New("invalid service state expiry, expected positive seconds for MAINTENANCE or UNAVAILABLE")
+	ErrPasswordMismatch             = errors.New("password does not match")
+	ErrUnknownPasswordHash          = errors.New("unknown password hash format")
+	ErrInvalidPasswordHashAlgorithm = errors.New("invalid password hash algorithm, expected argon2id or bcrypt")
+	ErrInvalidPasswordHashParams    = errors.New("invalid password hash parameters")
+	ErrPasswordPolicy               = errors.New("password does not meet the password policy")
+	ErrPasswordTooShort             = errors.New("password is too short")
+	ErrPasswordMissingUpper         = errors.New("password needs an uppercase letter")
+	ErrPasswordMissingLower         = errors.New("password needs a lowercase letter")
+	ErrPasswordMissingDigit         = errors.New("password needs a digit")
+	ErrPasswordMissingSymbol        = errors.New("password needs a symbol")
+	ErrPasswordPersonalInfo         = errors.New("password contains the user's name or email")
+	ErrPasswordBreached             = errors.New("password appears in a breached password list")
+	ErrInvalidBreachedPasswords     = errors.New("invalid breached password list, expected SHA1[:COUNT] per line")
+	ErrInvalidCredentials           = errors.New("invalid email or password")
+	ErrLoginBlocked                 = errors.New("too many failed logins, try again later")
+	ErrLoginUserChanged             = errors.New("email moved to another user during login, try again")
+	ErrNilUnlockTarget              = errors.New("nothing to unlock, expected a user email or uuid, or a login ip")
+	ErrTOTPAlreadyEnrolled          = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled              = errors.New("two-factor authentication is not enrolled")
+	ErrInvalidTOTPSecret            = errors.New("invalid encrypted TOTP secret")
+	ErrTOTPRequired                 = errors.New("two-factor code required")
+	ErrInvalidTOTPCode              = errors.New("invalid two-factor code")
+	ErrNilRefreshToken              = errors.New("nil refresh token, expected in the refresh-token metadata")
+	ErrInvalidRefreshToken          = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired          = errors.New("refresh token is expired")
+	ErrRefreshTokenReused           = errors.New("refresh token was already used, every refresh token of its login is revoked")
+	ErrStoreUnreachable             = errors.New("store is unreachable, serving cached auth tokens only")
+	ErrSchemaBehind                 = errors.New("db schema is behind the service, run migrate up")
+	ErrInvalidSigningAlgorithm      = errors.New("invalid token signing algorithm, expected HMAC, RS256 or EdDSA")
+	ErrSigningKeyNotFound           = errors.New("signing key not found")
+	ErrInvalidPrivateKey            = errors.New("invalid sealed private key")
+	ErrMasterKeyNotConfigured       = errors.New("master key is not set, secrets can not be encrypted")
+	ErrInvalidMasterKey             = errors.New("invalid master key, expected base64 of 32 bytes")
+	ErrUnknownMasterKey             = errors.New("data key is sealed with an unknown master key, set it as a previous master key")
+	ErrInvalidCiphertext            = errors.New("invalid ciphertext")
+	ErrInvalidBatchSize             = errors.New("invalid batch size, expected a positive number")
+	ErrUnknownDataKeyTable          = errors.New("unknown table of data key")
+	ErrRoleNotFound                 = errors.New("role not found")
+	ErrInvalidRole                  = errors.New("invalid role, expected a role name in the role metadata")
+	ErrInvalidPermissionLevel       = errors.New("invalid permission level")
+	ErrLastAdmin                    = errors.New("can not remove the last admin")
+	ErrUserSuspended                = errors.New("user is suspended")
+	ErrUserNotSuspended             = errors.New("user is not suspended")
+	ErrSuspendSelf                  = errors.New("users can not suspend themselves")
+	ErrInvalidSuspensionReason      = errors.New("invalid suspension reason, expected a reason of at most 512 characters")
+	ErrInvalidSuspensionExpiry      = errors.New("invalid suspension expiry, expected positive seconds")
 	ResponseServiceUnavailable      = &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.Unavailable)},
 		Message: codes.Unavailable.String(),
 	}
-	ErrStatusServiceUnavailable = status.Error(codes.Unavailable, ErrServiceUnavailable.Error())
-	ErrStatusNilRequestUser     = status.Error(codes.InvalidArgument, ErrNilRequestUser.Error())
-	ErrStatusUUIDNotFound       = status.Error(codes.NotFound, ErrUUIDNotFound.Error())
-	ErrStatusUUIDInvalid        = status.Error(codes.InvalidArgument, authconst.ErrInvalidUUID.Error())
-	ErrStatusPermissionMismatch = status.Error(codes.Unauthenticated, MsgErrPermissionMismatch)
+	ErrStatusServiceUnavailable  = status.Error(codes.Unavailable, ErrServiceUnavailable.Error())
+	ErrStatusNilRequestUser      = status.Error(codes.InvalidArgument, ErrNilRequestUser.Error())
+	ErrStatusUUIDNotFound        = status.Error(codes.NotFound, ErrUUIDNotFound.Error())
+	ErrStatusUUIDInvalid         = status.Error(codes.InvalidArgument, authconst.ErrInvalidUUID.Error())
+	ErrStatusPermissionMismatch  = status.Error(codes.Unauthenticated, MsgErrPermissionMismatch)
+	ErrStatusUserSuspended       = status.Error(codes.PermissionDenied, ErrUserSuspended.Error())
+	ErrStatusDUIDInvalid         = status.Error(codes.InvalidArgument, ErrInvalidDUID.Error())
+	ErrStatusInvalidCredentials  = status.Error(codes.Unauthenticated, ErrInvalidCredentials.Error())
+	ErrStatusLoginBlocked        = status.Error(codes.ResourceExhausted, ErrLoginBlocked.Error())
+	ErrStatusTOTPRequired        = status.Error(codes.Unauthenticated, ErrTOTPRequired.Error())
+	ErrStatusInvalidTOTPCode     = status.Error(codes.Unauthenticated, ErrInvalidTOTPCode.Error())
+	ErrStatusInvalidRefreshToken = status.Error(codes.Unauthenticated, ErrInvalidRefreshToken.Error())
+	ErrStatusRefreshTokenExpired = status.Error(codes.Unauthenticated, ErrRefreshTokenExpired.Error())
+	ErrStatusRefreshTokenReused  = status.Error(codes.Unauthenticated, ErrRefreshTokenReused.Error())
 )
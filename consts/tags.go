@@ -1,17 +1,44 @@
 package consts
 
 const (
-	VerifyEmailToken    string = "VerifyEmailToken -"
-	UpdatingUserRowTag  string = "UpdateUserRow -"
-	AuthenticateUserTag string = "AuthenticateUser -"
-	CreateUserTag       string = "CreateUser -"
-	DeleteUserTag       string = "DeleteUser -"
-	UpdateUserTag       string = "UpdateUser -"
-	GetUserTag          string = "GetUser -"
-	UserServiceTag      string = "User Service -"
-	GetNewAuthTokenTag  string = "GetNewAuthToken -"
-	MakeNewAuthSecret   string = "MakeNewAuthSecret -"
-	GetAuthSecret       string = "GetAuthSecret -"
-	VerifyAuthToken     string = "VerifyAuthToken -"
-	PSQL                string = "PSQL -"
+	VerifyEmailToken            string = "VerifyEmailToken -"
+	UpdatingUserRowTag          string = "UpdateUserRow -"
+	AuthenticateUserTag         string = "AuthenticateUser -"
+	CreateUserTag               string = "CreateUser -"
+	DeleteUserTag               string = "DeleteUser -"
+	UpdateUserTag               string = "UpdateUser -"
+	GetUserTag                  string = "GetUser -"
+	ListUsersTag                string = "ListUsers -"
+	ShareDocumentTag            string = "ShareDocument -"
+	UnshareDocumentTag          string = "UnshareDocument -"
+	ListDocumentsTag            string = "ListDocuments -"
+	ListSharedDocumentsTag      string = "ListSharedDocuments -"
+	UpdateDocumentVisibilityTag string = "UpdateDocumentVisibility -"
+	RequestPasswordResetTag     string = "RequestPasswordReset -"
+	ConfirmPasswordResetTag     string = "ConfirmPasswordReset -"
+	ResendVerificationEmailTag  string = "ResendVerificationEmail -"
+	UserServiceTag              string = "User Service -"
+	GetStatusTag                string = "GetStatus -"
+	SetServiceStateTag          string = "SetServiceState -"
+	UnlockUserTag               string = "UnlockUser -"
+	EnrollTOTPTag               string = "EnrollTOTP -"
+	ConfirmTOTPTag              string = "ConfirmTOTP -"
+	ResetTOTPTag                string = "ResetTOTP -"
+	GetNewAuthTokenTag          string = "GetNewAuthToken -"
+	RefreshAuthTokenTag         string = "RefreshAuthToken -"
+	LogoutTag                   string = "Logout -"
+	LogoutAllTag                string = "LogoutAll -"
+	MakeNewAuthSecret           string = "MakeNewAuthSecret -"
+	GetAuthSecret               string = "GetAuthSecret -"
+	RotateAuthSecretsTag        string = "RotateAuthSecrets -"
+	WatchAuthSecretTag          string = "WatchAuthSecret -"
+	GetSigningKeysTag           string = "GetSigningKeys -"
+	ReEncryptTag                string = "ReEncrypt -"
+	GrantRoleTag                string = "GrantRole -"
+	RevokeRoleTag               string = "RevokeRole -"
+	SetPermissionLevelTag       string = "SetPermissionLevel -"
+	SuspendUserTag              string = "SuspendUser -"
+	ReactivateUserTag           string = "ReactivateUser -"
+	VerifyAuthToken             string = "VerifyAuthToken -"
+	PSQL                        string = "PSQL -"
 )
@@ -1,18 +1,51 @@
 package main
 
 import (
-	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	"github.com/hwsc-org/hwsc-lib/logger"
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	svc "github.com/hwsc-org/hwsc-user-svc/service"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 )
 
 func main() {
+	// hwsc-user-svc migrate up|down|status|version
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
+	// hwsc-user-svc reencrypt
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		reEncrypt()
+		return
+	}
+
 	logger.Info(consts.UserServiceTag, "hwsc-user-svc initiating...")
 
+	// secrets are sealed with the master key, there is nothing to sign tokens with without it
+	if err := svc.CheckMasterKey(); err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to verify master key:", err.Error())
+	}
+
+	// refuse to serve against a schema that is missing migrations db.go relies on
+	if conf.StoreBackend == svc.StoreBackendPostgres {
+		schemaStatus, err := svc.CheckSchemaVersion()
+		if err != nil {
+			if schemaStatus != nil {
+				logger.Error(consts.UserServiceTag, "Schema version:", schemaStatus.String())
+			}
+			logger.Fatal(consts.UserServiceTag, "Failed to verify db schema:", err.Error())
+		}
+		logger.Info(consts.UserServiceTag, "Schema version:", schemaStatus.String())
+	}
+
 	// make TCP listener, listen for incoming client requests
 	lis, err := net.Listen(conf.GRPCHost.Network, conf.GRPCHost.String())
 	if err != nil {
@@ -23,12 +56,109 @@ func main() {
 	// build: create an instance of gRPC server
 	grpcServer := grpc.NewServer()
 
-	// register our service implementation with gRPC server
-	pbsvc.RegisterUserServiceServer(grpcServer, &svc.Service{})
+	store, err := svc.NewStore(conf.StoreBackend)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize store:", err.Error())
+	}
+
+	// register our service implementation with gRPC server, including the RPCs the pinned proto lacks
+	userService := svc.NewService(store)
+	svc.RegisterUserServiceServer(grpcServer, userService)
+
+	// ping the store in the background to enter and leave degraded mode
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	go userService.MonitorStore(monitorCtx, conf.StoreHealthCheckInterval)
+
+	// rotate the auth secret before it expires, and pick up secrets committed by other replicas
+	go userService.RotateAuthSecrets(monitorCtx, conf.SecretRotation)
+	go userService.WatchAuthSecret(monitorCtx)
 	logger.Info(consts.UserServiceTag, "hwsc-user-svc started at:", conf.GRPCHost.String())
 
+	// handle terminate signal (Ctrl + C) by draining instead of dropping in-flight RPCs
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
 	// start gRPC server
-	if err := grpcServer.Serve(lis); err != nil {
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-served:
 		logger.Fatal(consts.UserServiceTag, "Failed to serve:", err.Error())
+	case sig := <-signals:
+		logger.Info(consts.UserServiceTag, "Received", sig.String(), "shutting down")
+	}
+
+	shutdown(grpcServer, store, stopMonitor)
+}
+
+// shutdown rejects new calls, drains in-flight RPCs and pending emails within conf.ShutdownTimeout,
+// then stops monitoring and secret rotation and closes the store once nothing uses it
+func shutdown(grpcServer *grpc.Server, store svc.UserStore, stopMonitor context.CancelFunc) {
+	svc.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		logger.Info(consts.UserServiceTag, "Drained in-flight RPCs")
+	case <-ctx.Done():
+		// cancels the context of the remaining RPCs, rolling back their transactions
+		logger.Error(consts.UserServiceTag, "Failed to drain in-flight RPCs before deadline, stopping")
+		grpcServer.Stop()
+	}
+
+	if err := svc.FlushEmails(ctx); err != nil {
+		logger.Error(consts.UserServiceTag, "Failed to flush pending emails:", err.Error())
+	}
+
+	stopMonitor()
+	logger.Info(consts.PSQL, "Disconnecting store")
+	if err := store.Close(); err != nil {
+		logger.Error(consts.UserServiceTag, "Failed to close store:", err.Error())
+	}
+
+	logger.Info(consts.UserServiceTag, "hwsc-user-svc terminated")
+}
+
+// migrate runs one migrate command against the user db and exits non-zero on failure
+func migrate(args []string) {
+	if len(args) != 1 {
+		logger.Fatal(consts.UserServiceTag, consts.ErrInvalidMigrateCommand.Error())
+	}
+
+	schemaStatus, err := svc.RunMigration(args[0])
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to migrate", args[0]+":", err.Error())
+	}
+
+	logger.Info(consts.UserServiceTag, "Schema version:", schemaStatus.String())
+}
+
+// reEncrypt re-seals the data keys sealed with a previous master key with the current master key,
+// once done the previous master keys can be removed from conf
+func reEncrypt() {
+	store, err := svc.NewStore(conf.StoreBackend)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize store:", err.Error())
+	}
+
+	count, err := svc.ReEncrypt(context.Background(), store)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to re-encrypt after", strconv.Itoa(count), "data keys:", err.Error())
+	}
+	logger.Info(consts.UserServiceTag, "Re-encrypted data keys:", strconv.Itoa(count))
+
+	if err := store.Close(); err != nil {
+		logger.Error(consts.UserServiceTag, "Failed to close store:", err.Error())
 	}
 }
@@ -1,11 +1,16 @@
 package service
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
+	"testing"
 	"time"
 )
 
@@ -13,6 +18,7 @@ var (
 	unitTestFailValue    = "shouldFail"
 	unitTestFailEmail    = "should@fail.com"
 	unitTestEmailCounter = 1
+	unitTestDUIDCounter  = 1
 	unitTestDefaultUser  = &pblib.User{
 		FirstName:    "Unit Test",
 		Organization: "Unit Testing",
@@ -49,11 +55,18 @@ func unitTestUserGenerator(lastName string) *pblib.User {
 		FirstName:    unitTestDefaultUser.GetFirstName(),
 		LastName:     lastName,
 		Email:        unitTestEmailGenerator(),
-		Password:     lastName,
+		Password:     unitTestPassword(lastName),
 		Organization: unitTestDefaultUser.Organization,
 	}
 }
 
+// unitTestPassword returns the password of the user generated for lastName,
+// it does not contain lastName so it meets the password policy
+func unitTestPassword(lastName string) string {
+	sum := sha1.Sum([]byte(lastName))
+	return "pw-" + hex.EncodeToString(sum[:])[:16]
+}
+
 func unitTestInsertUser(lastName string) (*pbsvc.UserResponse, error) {
 	insertUser := unitTestUserGenerator(lastName)
 	s := Service{}
@@ -61,15 +74,34 @@ func unitTestInsertUser(lastName string) (*pbsvc.UserResponse, error) {
 	return s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: insertUser})
 }
 
+// unitTestRequirePostgres skips t if TestMain could not start the postgres container.
+func unitTestRequirePostgres(t *testing.T) {
+	if !unitTestPostgresReady {
+		t.Skip("postgres is not available, requires docker")
+	}
+}
+
+// unitTestRequireSMTP skips t if no smtp host is configured to send the test emails with.
+func unitTestRequireSMTP(t *testing.T) {
+	if conf.EmailHost.Username == "" {
+		t.Skip("smtp is not configured")
+	}
+}
+
+// unitTestTx returns a UserTx that runs each query on its own outside of a transaction
+func unitTestTx() *postgresTx {
+	return &postgresTx{ctx: context.Background(), exec: defaultStore.db}
+}
+
 func unitTestDeleteAuthSecretTable() error {
-	_, err := postgresDB.Exec("DELETE FROM user_security.secrets")
+	_, err := defaultStore.db.Exec("DELETE FROM user_security.secrets")
 	if err != nil {
 		return err
 	}
 
 	// active_secret is set to ON CASCADE DELETE, if foregin key (secret_key)
 	// it references from secrets table is deleted, but just in case
-	_, err = postgresDB.Exec("DELETE FROM user_security.active_secret")
+	_, err = defaultStore.db.Exec("DELETE FROM user_security.active_secret")
 
 	currAuthSecret = nil
 	return err
@@ -80,16 +112,69 @@ func unitTestDeleteInsertGetAuthSecret() (*pblib.Secret, error) {
 		return nil, err
 	}
 
-	if err := insertNewAuthSecret(); err != nil {
+	if err := unitTestTx().insertNewAuthSecret(); err != nil {
 		return nil, err
 	}
 
-	return getActiveSecretRow()
+	return unitTestTx().getActiveSecretRow()
+}
+
+// unitTestMakeAuthSecret inserts a new active secret into store and signs tokens with it,
+// like MakeNewAuthSecret does once a token of the service:write permission is signed.
+func unitTestMakeAuthSecret(store UserStore) error {
+	return store.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertNewAuthSecret(); err != nil {
+			return err
+		}
+
+		var err error
+		currAuthSecret, err = tx.getActiveSecretRow()
+		return err
+	})
+}
+
+// unitTestMemoryStore returns a new memory store.
+// The cached secret belongs to the postgres store, it is reset once t is done so the postgres tests reload it.
+func unitTestMemoryStore(t *testing.T) *memoryStore {
+	currAuthSecret = nil
+	t.Cleanup(func() { currAuthSecret = nil })
+
+	return newMemoryStore()
+}
+
+// unitTestMemoryService returns a service of a new memory store, with an active secret to sign tokens with.
+func unitTestMemoryService(t *testing.T) (*Service, *memoryStore) {
+	store := unitTestMemoryStore(t)
+	assert.Nil(t, unitTestMakeAuthSecret(store))
+
+	return NewService(store), store
+}
+
+// unitTestInsertMemoryUser inserts the user generated for lastName into store with the permission level.
+func unitTestInsertMemoryUser(t *testing.T, store *memoryStore, lastName string, level auth.Permission) *pblib.User {
+	user, err := unitTestMemoryUser(store, lastName)
+	assert.Nil(t, err)
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.updatePermissionLevel(user.GetUuid(), auth.PermissionStringMap[level])
+	})
+	assert.Nil(t, err)
+
+	return user
+}
+
+// unitTestLogin authenticates user with their password, returns the identification of the new auth token.
+func unitTestLogin(t *testing.T, s *Service, user *pblib.User) *pblib.Identification {
+	response, err := s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+	})
+	assert.Nil(t, err)
+
+	return &pblib.Identification{Token: response.GetIdentification().GetToken()}
 }
 
 func unitTestInsertNewAuthToken() (*pblib.Secret, string, error) {
 	// delete tokens table
-	_, err := postgresDB.Exec("DELETE FROM user_security.auth_tokens")
+	_, err := defaultStore.db.Exec("DELETE FROM user_security.auth_tokens")
 	if err != nil {
 		return nil, "", err
 	}
@@ -114,9 +199,78 @@ func unitTestInsertNewAuthToken() (*pblib.Secret, string, error) {
 	}
 
 	// insert a token
-	if err := insertAuthToken(newToken, validAuthTokenHeader, validNoUUIDAuthTokenBody, newSecret); err != nil {
+	if err := unitTestTx().insertAuthToken(newToken, validAuthTokenHeader, validNoUUIDAuthTokenBody, newSecret); err != nil {
 		return nil, "", err
 	}
 
 	return newSecret, newToken, nil
 }
+
+func unitTestInsertAdmin(lastName string) (*pblib.User, *pblib.Identification, error) {
+	response, err := unitTestInsertUser(lastName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	admin := response.GetUser()
+	admin.PermissionLevel = auth.PermissionStringMap[auth.Admin]
+	if err := unitTestTx().updatePermissionLevel(admin.GetUuid(), admin.GetPermissionLevel()); err != nil {
+		return nil, nil, err
+	}
+
+	// make sure admin token is signed with the active secret
+	if err := unitTestTx().insertNewAuthSecret(); err != nil {
+		return nil, nil, err
+	}
+	currAuthSecret, err = unitTestTx().getActiveSecretRow()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identification, err := getAuthIdentification(unitTestTx(), admin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return admin, identification, nil
+}
+
+func unitTestDUIDGenerator() string {
+	duid := fmt.Sprintf("%027d", unitTestDUIDCounter)
+	unitTestDUIDCounter++
+
+	return duid
+}
+
+func unitTestInsertVerifiedUser(lastName string) (*pblib.User, *pblib.Identification, error) {
+	response, err := unitTestInsertUser(lastName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := response.GetUser()
+	user.PermissionLevel = auth.PermissionStringMap[auth.User]
+	if err := unitTestTx().updatePermissionLevel(user.GetUuid(), user.GetPermissionLevel()); err != nil {
+		return nil, nil, err
+	}
+
+	if err := setCurrentSecretOnce(unitTestTx()); err != nil {
+		return nil, nil, err
+	}
+
+	identification, err := getAuthIdentification(unitTestTx(), user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, identification, nil
+}
+
+// unitTestGetEmailTokenHash returns the hash of the verification token of uuid, only the hash is stored.
+func unitTestGetEmailTokenHash(uuid string) (string, error) {
+	var tokenHash string
+	err := defaultStore.db.QueryRow(`SELECT token_hash FROM user_svc.email_tokens WHERE uuid = $1 AND purpose = $2`,
+		uuid, emailTokenPurposeVerifyEmail).Scan(&tokenHash)
+
+	return tokenHash, err
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	masterKeyLength = 32
+	dataKeyLength   = 32
+
+	// masterKeyIDLength is the bytes of the SHA-256 of a master key that name it in master_key_id columns
+	masterKeyIDLength = 8
+
+	// reEncryptBatchSize is the data keys re-sealed per transaction by ReEncrypt
+	reEncryptBatchSize = 100
+
+	// dataKeyTable* name the envelopes listStaleDataKeys returns, private keys are the second envelope of secrets
+	dataKeyTableSecrets     = "user_security.secrets"
+	dataKeyTablePrivateKeys = "user_security.secrets.private_key"
+	dataKeyTableEmailTokens = "user_svc.email_tokens"
+	dataKeyTableTOTPSecrets = "user_security.totp_secrets"
+)
+
+var (
+	// masterKeys opens data keys by the id of the master key that sealed them,
+	// masterKeyID names the current master key sealing new data keys, empty if there is none
+	masterKeys  = map[string]cipher.AEAD{}
+	masterKeyID string
+)
+
+// envelope is a value sealed with its own random data key, the data key is sealed with the master key
+// named by masterKeyID. Rotating the master key only re-seals the data key, see ReEncrypt.
+type envelope struct {
+	ciphertext  []byte
+	dataKey     []byte
+	masterKeyID string
+}
+
+// dataKeyRow is the sealed data key of a row holding an envelope, key is the primary key of the row in table.
+type dataKeyRow struct {
+	table       string
+	key         string
+	dataKey     []byte
+	masterKeyID string
+}
+
+func init() {
+	current, previous, err := readMasterKeys(conf.Crypto)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize master key:", err.Error())
+	}
+
+	if current == nil {
+		logger.Info(consts.UserServiceTag, "Master key is not set, secrets can not be stored")
+		return
+	}
+
+	if err := setMasterKeys(current, previous...); err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize master key:", err.Error())
+	}
+}
+
+// readMasterKeys decodes the current and previous master keys of config,
+// the current master key is read from config.MasterKeyFile if config.MasterKey is not set.
+// Returns a nil current key if neither is set, or error if a key is not base64 or the file can not be read.
+func readMasterKeys(config conf.CryptoConfig) ([]byte, [][]byte, error) {
+	encoded := config.MasterKey
+	if encoded == "" && config.MasterKeyFile != "" {
+		contents, err := ioutil.ReadFile(config.MasterKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		encoded = strings.TrimSpace(string(contents))
+	}
+	if encoded == "" {
+		return nil, nil, nil
+	}
+
+	current, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, consts.ErrInvalidMasterKey
+	}
+
+	var previous [][]byte
+	for _, encodedPrevious := range strings.Split(config.PreviousMasterKeys, ",") {
+		encodedPrevious = strings.TrimSpace(encodedPrevious)
+		if encodedPrevious == "" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedPrevious)
+		if err != nil {
+			return nil, nil, consts.ErrInvalidMasterKey
+		}
+		previous = append(previous, key)
+	}
+
+	return current, previous, nil
+}
+
+// setMasterKeys seals new data keys with current, and opens data keys sealed with current or any of previous.
+// Returns error if a key is not 32 bytes.
+func setMasterKeys(current []byte, previous ...[]byte) error {
+	keys := make(map[string]cipher.AEAD, len(previous)+1)
+	for _, key := range append([][]byte{current}, previous...) {
+		if len(key) != masterKeyLength {
+			return consts.ErrInvalidMasterKey
+		}
+
+		aead, err := newAESGCM(key)
+		if err != nil {
+			return err
+		}
+		keys[newMasterKeyID(key)] = aead
+	}
+
+	masterKeys = keys
+	masterKeyID = newMasterKeyID(current)
+	return nil
+}
+
+// newMasterKeyID returns the hex of the first bytes of the SHA-256 of key, naming key without revealing it.
+func newMasterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:masterKeyIDLength])
+}
+
+// CheckMasterKey verifies a master key is configured, secrets can not be stored or read without it.
+// Returns consts.ErrMasterKeyNotConfigured if there is none.
+func CheckMasterKey() error {
+	if masterKeyID == "" {
+		return consts.ErrMasterKeyNotConfigured
+	}
+
+	return nil
+}
+
+// newAESGCM returns the AES-GCM cipher of key.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD seals plaintext with aead under a random nonce, bound to aad.
+// Returns the nonce followed by the ciphertext.
+func sealAEAD(aead cipher.AEAD, plaintext []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// openAEAD opens a value sealed by sealAEAD with aead for aad.
+// Returns consts.ErrInvalidCiphertext if sealed was not sealed for aad with aead.
+func openAEAD(aead cipher.AEAD, sealed []byte, aad []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, consts.ErrInvalidCiphertext
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+	if err != nil {
+		return nil, consts.ErrInvalidCiphertext
+	}
+
+	return plaintext, nil
+}
+
+// sealEnvelope seals plaintext with a new data key, and the data key with the current master key,
+// both bound to aad, the primary key of the row holding the envelope, so it can not be moved to another row.
+// Returns consts.ErrMasterKeyNotConfigured if there is no master key.
+func sealEnvelope(plaintext []byte, aad []byte) (*envelope, error) {
+	masterKey, ok := masterKeys[masterKeyID]
+	if !ok {
+		return nil, consts.ErrMasterKeyNotConfigured
+	}
+
+	key := make([]byte, dataKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	dataKey, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := sealAEAD(dataKey, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := sealAEAD(masterKey, key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envelope{
+		ciphertext:  ciphertext,
+		dataKey:     sealedKey,
+		masterKeyID: masterKeyID,
+	}, nil
+}
+
+// openEnvelope opens an envelope sealed by sealEnvelope for aad.
+// Returns consts.ErrUnknownMasterKey if its master key is not configured,
+// or consts.ErrInvalidCiphertext if it was not sealed for aad.
+func openEnvelope(e *envelope, aad []byte) ([]byte, error) {
+	key, err := openDataKey(e.dataKey, e.masterKeyID, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openAEAD(dataKey, e.ciphertext, aad)
+}
+
+// openDataKey opens dataKey sealed with the master key of id for aad.
+func openDataKey(dataKey []byte, id string, aad []byte) ([]byte, error) {
+	masterKey, ok := masterKeys[id]
+	if !ok {
+		return nil, consts.ErrUnknownMasterKey
+	}
+
+	return openAEAD(masterKey, dataKey, aad)
+}
+
+// openSecretKey opens the envelope of a secret key stored in place of its hash secretHash.
+func openSecretKey(secretHash string, e *envelope) (string, error) {
+	key, err := openEnvelope(e, []byte(secretHash))
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// rewrapDataKey re-seals the data key of row with the current master key, its ciphertext is left as is.
+// Returns consts.ErrUnknownMasterKey if the master key of row is not configured.
+func rewrapDataKey(row *dataKeyRow) error {
+	masterKey, ok := masterKeys[masterKeyID]
+	if !ok {
+		return consts.ErrMasterKeyNotConfigured
+	}
+
+	key, err := openDataKey(row.dataKey, row.masterKeyID, []byte(row.key))
+	if err != nil {
+		return err
+	}
+
+	row.dataKey, err = sealAEAD(masterKey, key, []byte(row.key))
+	if err != nil {
+		return err
+	}
+	row.masterKeyID = masterKeyID
+
+	return nil
+}
+
+// hashToken returns the SHA-256 of a token or secret key stored in its place,
+// a fast hash is enough b/c tokens and secret keys are random with at least 128 bits of entropy.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReEncrypt re-seals every data key of store sealed with a previous master key with the current master key,
+// reEncryptBatchSize data keys per transaction, so the previous master keys can be removed once done.
+// Returns the number of data keys re-sealed, or error if a data key is sealed with an unknown master key.
+func ReEncrypt(ctx context.Context, store UserStore) (int, error) {
+	if err := CheckMasterKey(); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for {
+		var count int
+		err := store.WithTx(ctx, func(tx UserTx) error {
+			rows, err := tx.listStaleDataKeys(masterKeyID, reEncryptBatchSize)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				if err := rewrapDataKey(row); err != nil {
+					return err
+				}
+				if err := tx.updateDataKey(row); err != nil {
+					return err
+				}
+			}
+
+			count = len(rows)
+			return nil
+		})
+		if err != nil {
+			logger.Error(consts.ReEncryptTag, consts.MsgErrReEncrypt, err.Error())
+			return total, err
+		}
+
+		total += count
+		if count < reEncryptBatchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// unitTestNewMasterKey returns a random master key.
+func unitTestNewMasterKey() []byte {
+	key := make([]byte, masterKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// unitTestRestoreMasterKeys restores the master keys set before a test replaced them.
+func unitTestRestoreMasterKeys() func() {
+	keys, id := masterKeys, masterKeyID
+	return func() {
+		masterKeys, masterKeyID = keys, id
+	}
+}
+
+func TestReadMasterKeys(t *testing.T) {
+	current, previous := unitTestNewMasterKey(), unitTestNewMasterKey()
+	encodedCurrent := base64.StdEncoding.EncodeToString(current)
+	encodedPrevious := base64.StdEncoding.EncodeToString(previous)
+
+	file, err := ioutil.TempFile("", "master-key")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(encodedCurrent + "\n")
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	cases := []struct {
+		desc        string
+		config      conf.CryptoConfig
+		expCurrent  []byte
+		expPrevious [][]byte
+		expErr      error
+	}{
+		{"test env var", conf.CryptoConfig{MasterKey: encodedCurrent}, current, nil, nil},
+		{"test file", conf.CryptoConfig{MasterKeyFile: file.Name()}, current, nil, nil},
+		{"test previous keys", conf.CryptoConfig{MasterKey: encodedCurrent, PreviousMasterKeys: " ," + encodedPrevious},
+			current, [][]byte{previous}, nil},
+		{"test unset", conf.CryptoConfig{}, nil, nil, nil},
+		{"test invalid base64", conf.CryptoConfig{MasterKey: "not base64!"}, nil, nil, consts.ErrInvalidMasterKey},
+		{"test invalid previous key", conf.CryptoConfig{MasterKey: encodedCurrent, PreviousMasterKeys: "!"},
+			nil, nil, consts.ErrInvalidMasterKey},
+	}
+
+	for _, c := range cases {
+		retrievedCurrent, retrievedPrevious, err := readMasterKeys(c.config)
+		assert.Equal(t, c.expErr, err, c.desc)
+		assert.Equal(t, c.expCurrent, retrievedCurrent, c.desc)
+		assert.Equal(t, c.expPrevious, retrievedPrevious, c.desc)
+	}
+
+	_, _, err = readMasterKeys(conf.CryptoConfig{MasterKeyFile: file.Name() + "-missing"})
+	assert.NotNil(t, err)
+}
+
+func TestSetMasterKeys(t *testing.T) {
+	defer unitTestRestoreMasterKeys()()
+
+	cases := []struct {
+		desc     string
+		current  []byte
+		previous [][]byte
+		expErr   error
+	}{
+		{"test current key", unitTestNewMasterKey(), nil, nil},
+		{"test previous keys", unitTestNewMasterKey(), [][]byte{unitTestNewMasterKey()}, nil},
+		{"test short current key", make([]byte, 16), nil, consts.ErrInvalidMasterKey},
+		{"test short previous key", unitTestNewMasterKey(), [][]byte{make([]byte, 16)}, consts.ErrInvalidMasterKey},
+	}
+
+	for _, c := range cases {
+		err := setMasterKeys(c.current, c.previous...)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if err == nil {
+			assert.Equal(t, newMasterKeyID(c.current), masterKeyID, c.desc)
+			assert.Len(t, masterKeys, len(c.previous)+1, c.desc)
+		}
+	}
+
+	masterKeys, masterKeyID = map[string]cipher.AEAD{}, ""
+	assert.Equal(t, consts.ErrMasterKeyNotConfigured, CheckMasterKey())
+	_, err := sealEnvelope([]byte("plaintext"), []byte("aad"))
+	assert.Equal(t, consts.ErrMasterKeyNotConfigured, err)
+}
+
+func TestEnvelope(t *testing.T) {
+	defer unitTestRestoreMasterKeys()()
+	previousKey := unitTestNewMasterKey()
+	assert.Nil(t, setMasterKeys(previousKey))
+
+	plaintext, aad := []byte("plaintext"), []byte("aad")
+	sealed, err := sealEnvelope(plaintext, aad)
+	assert.Nil(t, err)
+	assert.Equal(t, masterKeyID, sealed.masterKeyID)
+	assert.NotContains(t, string(sealed.ciphertext), string(plaintext))
+
+	tampered := *sealed
+	tampered.ciphertext = append([]byte{}, sealed.ciphertext...)
+	tampered.ciphertext[len(tampered.ciphertext)-1] ^= 1
+	unknown := *sealed
+	unknown.masterKeyID = "unknown"
+
+	cases := []struct {
+		desc     string
+		envelope *envelope
+		aad      []byte
+		expErr   error
+	}{
+		{"test valid envelope", sealed, aad, nil},
+		{"test other aad", sealed, []byte("other aad"), consts.ErrInvalidCiphertext},
+		{"test tampered ciphertext", &tampered, aad, consts.ErrInvalidCiphertext},
+		{"test unknown master key", &unknown, aad, consts.ErrUnknownMasterKey},
+	}
+
+	for _, c := range cases {
+		retrieved, err := openEnvelope(c.envelope, c.aad)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if err == nil {
+			assert.Equal(t, plaintext, retrieved, c.desc)
+		}
+	}
+
+	// rotating the master key re-seals the data key only, the previous master key still opens it until then
+	assert.Nil(t, setMasterKeys(unitTestNewMasterKey(), previousKey))
+	row := &dataKeyRow{table: dataKeyTableSecrets, key: string(aad), dataKey: sealed.dataKey,
+		masterKeyID: sealed.masterKeyID}
+	assert.Nil(t, rewrapDataKey(row))
+	assert.Equal(t, masterKeyID, row.masterKeyID)
+
+	rewrapped := &envelope{ciphertext: sealed.ciphertext, dataKey: row.dataKey, masterKeyID: row.masterKeyID}
+	assert.Nil(t, setMasterKeys(unitTestNewMasterKey(), previousKey))
+	_, err = openEnvelope(rewrapped, aad)
+	assert.Equal(t, consts.ErrUnknownMasterKey, err)
+	assert.Equal(t, consts.ErrUnknownMasterKey, rewrapDataKey(row))
+}
+
+func TestMemoryStoreReEncrypt(t *testing.T) {
+	defer unitTestRestoreMasterKeys()()
+	previousKey := unitTestNewMasterKey()
+	assert.Nil(t, setMasterKeys(previousKey))
+
+	store := newMemoryStore()
+	user, err := unitTestMemoryUser(store, "MemoryStoreReEncrypt-One")
+	assert.Nil(t, err)
+
+	var secret *pblib.Secret
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertNewAuthSecret(); err != nil {
+			return err
+		}
+		if secret, err = tx.getActiveSecretRow(); err != nil {
+			return err
+		}
+		secret.CreatedTimestamp--
+		return tx.insertEmailToken(user.GetUuid(), "MemoryStoreReEncrypt-Token", secret, emailTokenPurposeVerifyEmail)
+	})
+	assert.Nil(t, err)
+
+	// only hashes are stored in place of the secret key and email token
+	assert.NotContains(t, store.tables.secrets, secret.GetKey())
+	assert.Contains(t, store.tables.secrets, hashToken(secret.GetKey()))
+	assert.Contains(t, store.tables.emailTokens, hashToken("MemoryStoreReEncrypt-Token"))
+
+	currentKey := unitTestNewMasterKey()
+	assert.Nil(t, setMasterKeys(currentKey, previousKey))
+	count, err := ReEncrypt(context.TODO(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = ReEncrypt(context.TODO(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// the previous master key is no longer needed
+	assert.Nil(t, setMasterKeys(currentKey))
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		retrievedSecret, err := tx.getActiveSecretRow()
+		assert.Nil(t, err)
+		assert.Equal(t, secret.GetKey(), retrievedSecret.GetKey())
+
+		retrievedRow, err := tx.getEmailTokenRow("MemoryStoreReEncrypt-Token")
+		assert.Nil(t, err)
+		assert.Equal(t, secret.GetKey(), retrievedRow.secretKey)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreReEncryptTOTPAndPrivateKeys(t *testing.T) {
+	defer unitTestRestoreMasterKeys()()
+	defer func() { conf.TokenSigning.Algorithm = signingAlgorithmHMAC }()
+
+	previousKey := unitTestNewMasterKey()
+	assert.Nil(t, setMasterKeys(previousKey))
+
+	store := newMemoryStore()
+	user, err := unitTestMemoryUser(store, "MemoryStoreReEncryptTOTP-One")
+	assert.Nil(t, err)
+
+	userSecret, err := generateTOTPSecret()
+	assert.Nil(t, err)
+
+	var secret *pblib.Secret
+	conf.TokenSigning.Algorithm = signingAlgorithmEdDSA
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertNewAuthSecret(); err != nil {
+			return err
+		}
+		if secret, err = tx.getActiveSecretRow(); err != nil {
+			return err
+		}
+
+		sealed, err := encryptTOTPSecret(user.GetUuid(), userSecret)
+		if err != nil {
+			return err
+		}
+		return tx.insertTOTPSecret(user.GetUuid(), sealed)
+	})
+	assert.Nil(t, err)
+
+	// the secret key, its private key, and the TOTP secret
+	currentKey := unitTestNewMasterKey()
+	assert.Nil(t, setMasterKeys(currentKey, previousKey))
+	count, err := ReEncrypt(context.TODO(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = ReEncrypt(context.TODO(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// the previous master key is not needed anymore
+	assert.Nil(t, setMasterKeys(currentKey))
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		row, err := tx.getSigningKeyRow(secret.GetKey())
+		assert.Nil(t, err)
+		key, err := parseSigningKeyRow(row)
+		assert.Nil(t, err)
+		assert.NotNil(t, key.privateKey)
+
+		totp, err := tx.getTOTPRow(user.GetUuid())
+		assert.Nil(t, err)
+		assert.Equal(t, newMasterKeyID(currentKey), totp.secret.masterKeyID)
+
+		decrypted, err := decryptTOTPSecret(user.GetUuid(), &totp.secret)
+		assert.Nil(t, err)
+		assert.Equal(t, userSecret, decrypted)
+		return nil
+	})
+	assert.Nil(t, err)
+}
@@ -10,20 +10,20 @@ import (
 	"github.com/hwsc-org/hwsc-lib/validation"
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
-	"log"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	// database/sql uses this library indirectly
-	_ "github.com/lib/pq"
-	"os"
-	"os/signal"
-	"syscall"
+	// database/sql uses this library as driver, its listener receives notifications
+	"github.com/lib/pq"
 )
 
 type tokenAuthRow struct {
 	uuid       string
 	permission string
-	token      string
+	tokenHash  string
 	secret     *pblib.Secret
 }
 
@@ -33,15 +33,118 @@ type tokenEmailRow struct {
 	createdTimestamp    int64
 	expirationTimestamp int64
 	uuid                string
+	purpose             string
+}
+
+type refreshTokenRow struct {
+	tokenHash           string
+	familyID            string
+	uuid                string
+	createdTimestamp    int64
+	expirationTimestamp int64
+	isUsed              bool
+}
+
+// totpRow is a row of user_security.totp_secrets.
+type totpRow struct {
+	uuid             string
+	secret           envelope
+	isConfirmed      bool
+	lastUsedStep     int64
+	createdTimestamp int64
+}
+
+// suspensionRow is a row of user_security.suspensions, a zero suspendedUntil suspends until reactivated.
+type suspensionRow struct {
+	uuid               string
+	reason             string
+	suspendedBy        string
+	suspendedTimestamp time.Time
+	suspendedUntil     time.Time
+}
+
+// signingKeyRow is a row of user_security.secrets, key is the secret_key of HMAC, or the kid of a key pair.
+// publicKey is PKIX der and privateKey is PKCS #8 der sealed by encryptPrivateKey, both nil for HMAC.
+type signingKeyRow struct {
+	key                 string
+	algorithm           string
+	publicKey           []byte
+	privateKey          *envelope
+	createdTimestamp    int64
+	expirationTimestamp int64
+}
+
+type documentRow struct {
+	duid     string
+	uuid     string
+	isPublic bool
+}
+
+// listUsersQuery holds the filters, sort and page options used by listUserRows.
+// Zero values mean "no filter", isVerified is a pointer b/c false is a valid filter.
+type listUsersQuery struct {
+	permissionLevel string
+	isVerified      *bool
+	organization    string
+	createdAfter    int64
+	createdBefore   int64
+	sortBy          string
+	descending      bool
+	pageSize        int
+	cursor          *listUsersCursor
+}
+
+// listUsersCursor marks the last row of a page for keyset pagination.
+// value is the sort column of the last row, uuid breaks ties b/c uuid is the primary key.
+type listUsersCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d"`
+	Value      string `json:"v"`
+	UUID       string `json:"u"`
 }
 
 const (
 	dbDriverName = "postgres"
+
+	// activeSecretChannel is notified by the secrets table trigger whenever a new secret is committed
+	activeSecretChannel = "active_secret"
+
+	// the listener reconnects between these backoffs, and pings its connection to notice it is gone
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	listenerPingInterval = time.Minute
+
+	// uuidLockNamespace keys the advisory locks of uuids apart from other advisory locks, ie migrations
+	uuidLockNamespace = 1
+
+	// email token purposes, a user can hold one outstanding email token per purpose
+	emailTokenPurposeVerifyEmail   = "VERIFY_EMAIL"
+	emailTokenPurposeResetPassword = "RESET_PASSWORD"
 )
 
+// sqlExecutor runs queries, it is satisfied by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// postgresStore implements UserStore with a postgres connection pool.
+type postgresStore struct {
+	lock             sync.Mutex
+	connectionString string
+	db               *sql.DB
+}
+
+// postgresTx implements UserTx, every query runs in the transaction with the request context.
+type postgresTx struct {
+	ctx  context.Context
+	exec sqlExecutor
+}
+
 var (
 	connectionString string
-	postgresDB       *sql.DB
+	defaultStore     *postgresStore
 	currAuthSecret   *pblib.Secret
 )
 
@@ -49,34 +152,48 @@ func init() {
 	connectionString = fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s sslmode=%s port=%s",
 		conf.UserDB.Host, conf.UserDB.User, conf.UserDB.Password, conf.UserDB.Name, conf.UserDB.SSLMode, conf.UserDB.Port)
+	defaultStore = newPostgresStore(connectionString)
+}
 
-	// Handle Terminate Signal(Ctrl + C) gracefully
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		logger.Info(consts.PSQL, "Disconnecting postgres DB")
-		if postgresDB != nil {
-			_ = postgresDB.Close()
-		}
-		log.Fatal(consts.PSQL, "hwsc-user-svc terminated")
-	}()
+// newPostgresStore returns a postgresStore that connects lazily with connectionString.
+func newPostgresStore(connectionString string) *postgresStore {
+	return &postgresStore{connectionString: connectionString}
 }
 
-// refreshDBConnection verifies if connection is alive, ping will establish c/n if necessary.
-// Returns response object if ping failed to reconnect.
-func refreshDBConnection() error {
-	if postgresDB == nil {
-		var err error
-		postgresDB, err = sql.Open(dbDriverName, connectionString)
+// connect returns the connection pool, opening it if necessary.
+// The pool is not pinged, MonitorStore pings it in the background instead of every request.
+// Returns error if the pool failed to open.
+func (s *postgresStore) connect() (*sql.DB, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.db == nil {
+		db, err := sql.Open(dbDriverName, s.connectionString)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		s.db = db
+	}
+
+	return s.db, nil
+}
+
+// Ping verifies if connection is alive, ping will establish c/n if necessary.
+// Returns error if ping failed to reconnect.
+func (s *postgresStore) Ping(ctx context.Context) error {
+	db, err := s.connect()
+	if err != nil {
+		return err
 	}
 
-	if err := postgresDB.Ping(); err != nil {
-		_ = postgresDB.Close()
-		postgresDB = nil
+	if err := db.PingContext(ctx); err != nil {
+		s.lock.Lock()
+		// another request may have reconnected already
+		if s.db == db {
+			_ = db.Close()
+			s.db = nil
+		}
+		s.lock.Unlock()
 		logger.Error(consts.PSQL, "Failed to ping and reconnect to postgres db:", err.Error())
 		return err
 	}
@@ -84,10 +201,110 @@ func refreshDBConnection() error {
 	return nil
 }
 
+// WithTx begins a transaction with ctx and runs fn in it.
+// The transaction is committed if fn returns nil, else rolled back and fn's error is returned.
+// Cancelling ctx rolls back the transaction.
+func (s *postgresStore) WithTx(ctx context.Context, fn func(tx UserTx) error) error {
+	db, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&postgresTx{ctx: ctx, exec: tx}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the connection pool, the store reconnects on the next use.
+func (s *postgresStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// WatchActiveSecret listens on activeSecretChannel with its own connection, outside of the pool,
+// calling onChange for every notification and every time the listener (re)connects.
+// The listener reconnects on its own, blocks until ctx is done.
+func (s *postgresStore) WatchActiveSecret(ctx context.Context, onChange func()) error {
+	listener := pq.NewListener(s.connectionString, listenerMinReconnect, listenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				logger.Error(consts.PSQL, "Active secret listener:", err.Error())
+			}
+		})
+
+	// Listen waits until the listener connects, closing the listener stops waiting
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	if err := listener.Listen(activeSecretChannel); err != nil {
+		_ = listener.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	// changes before listening are missed
+	onChange()
+
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-listener.Notify:
+			if !ok {
+				return nil
+			}
+			// a nil notification means the listener reconnected, calls onChange all the same
+			onChange()
+		case <-ticker.C:
+			if err := listener.Ping(); err != nil {
+				logger.Error(consts.PSQL, "Active secret listener:", err.Error())
+			}
+		}
+	}
+}
+
+// lockUUID takes the exclusive advisory lock of uuid, serializing writes to uuid across replicas.
+// Waits until the lock is free or ctx is done, the lock is released when the transaction ends.
+func (t *postgresTx) lockUUID(uuid string) error {
+	_, err := t.exec.ExecContext(t.ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, uuidLockNamespace, uuid)
+	return err
+}
+
+// lockUUIDShared takes the shared advisory lock of uuid, held by reads while no write holds the exclusive lock.
+// Waits until the lock is free or ctx is done, the lock is released when the transaction ends.
+func (t *postgresTx) lockUUIDShared(uuid string) error {
+	_, err := t.exec.ExecContext(t.ctx, `SELECT pg_advisory_xact_lock_shared($1, hashtext($2))`,
+		uuidLockNamespace, uuid)
+	return err
+}
+
 // insertNewUser checks user field validity, hashes password and.
 // Inserts new users to user_svc.accounts table.
 // Returns error if User is nil or if error with inserting to database.
-func insertNewUser(user *pblib.User) error {
+func (t *postgresTx) insertNewUser(user *pblib.User) error {
 	if user == nil {
 		return consts.ErrNilRequestUser
 	}
@@ -102,7 +319,7 @@ func insertNewUser(user *pblib.User) error {
 		return err
 	}
 
-	// hash password using bcrypt
+	// hash password with the current hasher
 	hashedPassword, err := hashPassword(user.GetPassword())
 	if err != nil {
 		return err
@@ -115,7 +332,7 @@ func insertNewUser(user *pblib.User) error {
 				) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
 				`
 
-	_, err = postgresDB.Exec(command, user.GetUuid(), user.GetFirstName(), user.GetLastName(),
+	_, err = t.exec.ExecContext(t.ctx, command, user.GetUuid(), user.GetFirstName(), user.GetLastName(),
 		user.GetEmail(), hashedPassword, user.GetOrganization(),
 		time.Now().UTC(), false, auth.PermissionStringMap[auth.NoPermission])
 
@@ -126,9 +343,9 @@ func insertNewUser(user *pblib.User) error {
 	return nil
 }
 
-// insertEmailToken inserts received token and secret to user_svc.email_tokens.
-// Returns error if strings are empty or error with inserting to database.
-func insertEmailToken(uuid string, token string, secret *pblib.Secret) error {
+// insertEmailToken inserts the hash of received token, the sealed key of secret and purpose to user_svc.email_tokens.
+// Returns error if strings are empty, purpose is unknown, there is no master key or error with inserting to database.
+func (t *postgresTx) insertEmailToken(uuid string, token string, secret *pblib.Secret, purpose string) error {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return err
@@ -142,13 +359,26 @@ func insertEmailToken(uuid string, token string, secret *pblib.Secret) error {
 		return err
 	}
 
+	if err := validateEmailTokenPurpose(purpose); err != nil {
+		return err
+	}
+
+	tokenHash := hashToken(token)
+	sealed, err := sealEnvelope([]byte(secret.GetKey()), []byte(tokenHash))
+	if err != nil {
+		return err
+	}
+
 	createdTimestamp := time.Unix(secret.GetCreatedTimestamp(), 0).UTC()
 	expirationTimestamp := time.Unix(secret.GetExpirationTimestamp(), 0).UTC()
 
-	command := `INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid) 
-				VALUES($1, $2, $3, $4, $5)
+	command := `INSERT INTO user_svc.email_tokens(
+					token_hash, encrypted_secret_key, data_key, master_key_id,
+					created_timestamp, expiration_timestamp, uuid, purpose
+				) VALUES($1, $2, $3, $4, $5, $6, $7, $8)
 				`
-	_, err := postgresDB.Exec(command, token, secret.GetKey(), createdTimestamp, expirationTimestamp, uuid)
+	_, err = t.exec.ExecContext(t.ctx, command, tokenHash, sealed.ciphertext, sealed.dataKey, sealed.masterKeyID,
+		createdTimestamp, expirationTimestamp, uuid, purpose)
 	if err != nil {
 		return err
 	}
@@ -159,14 +389,14 @@ func insertEmailToken(uuid string, token string, secret *pblib.Secret) error {
 // deleteUser deletes user from user_svc.accounts.
 // Deleting non-existent uuid does not throw an error, db simply returns nothing which is okay.
 // Returns error if string is empty or error with deleting from database.
-func deleteUserRow(uuid string) error {
+func (t *postgresTx) deleteUserRow(uuid string) error {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return err
 	}
 
 	command := `DELETE FROM user_svc.accounts WHERE user_svc.accounts.uuid = $1`
-	_, err := postgresDB.Exec(command, uuid)
+	_, err := t.exec.ExecContext(t.ctx, command, uuid)
 
 	if err != nil {
 		return err
@@ -179,7 +409,7 @@ func deleteUserRow(uuid string) error {
 // Retrieving non-existent uuid does not throw an error, db simply returns nothing.
 // So we put in a check to see if uuid exists to return error if not found.
 // Returns pb.User struct if found, nil otherwise, error if uuid does not exist or err with db.
-func getUserRow(uuid string) (*pblib.User, error) {
+func (t *postgresTx) getUserRow(uuid string) (*pblib.User, error) {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return nil, err
@@ -189,7 +419,7 @@ func getUserRow(uuid string) (*pblib.User, error) {
        				created_timestamp, is_verified, password, permission_level, prospective_email
 				FROM user_svc.accounts WHERE user_svc.accounts.uuid = $1
 				`
-	row, err := postgresDB.Query(command, uuid)
+	row, err := t.exec.QueryContext(t.ctx, command, uuid)
 	if err != nil {
 		return nil, err
 	}
@@ -239,20 +469,23 @@ func getUserRow(uuid string) (*pblib.User, error) {
 
 // updateUser does a partial update by going through each User fields and replacing values.
 // that are different from original values. It's partial b/c some fields like created_timestamp & uuid are not touched.
+// If the email changes, the new email is kept as prospective email until verified,
+// and the identification of its verification token is returned so the caller can email the verification link.
 // Return error if params are zero values or querying problem.
-func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (*pblib.User, error) {
+func (t *postgresTx) updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
+	*pblib.User, *pblib.Identification, error) {
 	if svcDerived == nil || dbDerived == nil {
-		return nil, consts.ErrNilRequestUser
+		return nil, nil, consts.ErrNilRequestUser
 	}
 
 	if err := validation.ValidateUserUUID(uuid); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	newFirstName := dbDerived.GetFirstName()
 	if svcDerived.GetFirstName() != "" && svcDerived.GetFirstName() != newFirstName {
 		if err := validateFirstName(svcDerived.GetFirstName()); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		newFirstName = svcDerived.GetFirstName()
 	}
@@ -260,7 +493,7 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 	newLastName := dbDerived.GetLastName()
 	if svcDerived.GetLastName() != "" && svcDerived.GetLastName() != newLastName {
 		if err := validateLastName(svcDerived.GetLastName()); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		newLastName = svcDerived.GetLastName()
 	}
@@ -268,17 +501,26 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 	newOrganization := dbDerived.GetOrganization()
 	if svcDerived.GetOrganization() != "" && svcDerived.GetOrganization() != newOrganization {
 		if err := validateOrganization(svcDerived.GetOrganization()); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		newOrganization = svcDerived.GetOrganization()
 	}
 
 	newHashedPassword := dbDerived.GetPassword()
 	if svcDerived.GetPassword() != "" {
-		// hash password using bcrypt
+		if err := checkPasswordPolicy(svcDerived.GetPassword(), &pblib.User{
+			FirstName:        newFirstName,
+			LastName:         newLastName,
+			Email:            dbDerived.GetEmail(),
+			ProspectiveEmail: svcDerived.GetEmail(),
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		// hash password with the current hasher
 		hashedPassword, err := hashPassword(svcDerived.GetPassword())
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		newHashedPassword = hashedPassword
 	}
@@ -289,17 +531,17 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 	var newEmailID *pblib.Identification
 	if svcDerived.GetEmail() != "" && svcDerived.GetEmail() != dbDerived.GetEmail() {
 		if err := validateEmail(svcDerived.GetEmail()); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		newEmail = svcDerived.GetEmail()
 
-		emailTaken, err := isEmailTaken(newEmail)
+		emailTaken, err := t.isEmailTaken(newEmail)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if emailTaken {
-			return nil, consts.ErrEmailExists
+			return nil, nil, consts.ErrEmailExists
 		}
 
 		// create unique email token
@@ -313,7 +555,7 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 	}
 
 	if newFirstName == "" && newLastName == "" && newOrganization == "" && newHashedPassword == "" && newEmail == "" {
-		return nil, consts.ErrEmptyRequestUser
+		return nil, nil, consts.ErrEmptyRequestUser
 	}
 
 	command := `UPDATE user_svc.accounts SET 
@@ -326,10 +568,10 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
                     modified_timestamp = $8
 				WHERE user_svc.accounts.uuid = $1
 				`
-	_, err := postgresDB.Exec(command, uuid, newFirstName, newLastName, newOrganization,
+	_, err := t.exec.ExecContext(t.ctx, command, uuid, newFirstName, newLastName, newOrganization,
 		newHashedPassword, newEmail, newIsVerified, time.Now().UTC())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	updatedUser := &pblib.User{
@@ -342,61 +584,52 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 		ProspectiveEmail: newEmail,
 	}
 
-	// new email process
+	// new email process, replaces the verification token of any previous email change
 	if newEmailID != nil {
-		// do not return error b/c we can resend verification emails
-		if err := insertEmailToken(uuid, newEmailID.GetToken(), newEmailID.GetSecret()); err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrInsertEmailToken, err.Error())
-			return updatedUser, nil
+		if err := t.deleteEmailTokenRow(uuid, emailTokenPurposeVerifyEmail); err != nil {
+			return nil, nil, err
 		}
-		// generate a new verification link
-		verificationLink, err := generateEmailVerifyLink(newEmailID.GetToken())
-		if err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrGeneratingEmailVerifyLink, err.Error())
-			return updatedUser, nil
-		}
-		// send email
-		emailData := make(map[string]string)
-		if verificationLink != "" {
-			emailData[verificationLinkKey] = verificationLink
-			return updatedUser, nil
-		}
-		emailReq, err := newEmailRequest(emailData, []string{newEmail}, conf.EmailHost.Username, subjectUpdateEmail)
-		if err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrEmailRequest, err.Error())
-			return updatedUser, nil
-		}
-		if err := emailReq.sendEmail(templateUpdateEmail); err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrSendEmail, err.Error())
-			return updatedUser, nil
+		if err := t.insertEmailToken(uuid, newEmailID.GetToken(), newEmailID.GetSecret(),
+			emailTokenPurposeVerifyEmail); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return updatedUser, nil
+	return updatedUser, newEmailID, nil
 }
 
 // getActiveSecretRow retrieves active key information from active_secret table (constraint to one row).
 // Returns secret object if a row exists, else returns nil for all other cases (secret not found).
-func getActiveSecretRow() (*pblib.Secret, error) {
-	command := `SELECT secret_key, created_timestamp, expiration_timestamp 
+func (t *postgresTx) getActiveSecretRow() (*pblib.Secret, error) {
+	command := `SELECT user_security.active_secret.secret_key, encrypted_key, data_key, master_key_id,
+					user_security.active_secret.created_timestamp, user_security.active_secret.expiration_timestamp
 				FROM user_security.active_secret
+				INNER JOIN user_security.secrets
+				ON user_security.secrets.secret_key = user_security.active_secret.secret_key
 				`
 
-	row, err := postgresDB.Query(command)
+	row, err := t.exec.QueryContext(t.ctx, command)
 	if err != nil {
 		return nil, err
 	}
 
 	defer row.Close()
-	var secretKey string
+	var secretHash string
+	var sealed envelope
 	var createdTimestamp, expirationTimestamp time.Time
 	for row.Next() {
-		err := row.Scan(&secretKey, &createdTimestamp, &expirationTimestamp)
+		err := row.Scan(&secretHash, &sealed.ciphertext, &sealed.dataKey, &sealed.masterKeyID,
+			&createdTimestamp, &expirationTimestamp)
 		if err != nil {
 			return nil, err
 		}
 
-		if secretKey != "" {
+		if secretHash != "" {
+			secretKey, err := openSecretKey(secretHash, &sealed)
+			if err != nil {
+				return nil, err
+			}
+
 			return &pblib.Secret{
 				Key:                 secretKey,
 				CreatedTimestamp:    createdTimestamp.Unix(),
@@ -408,42 +641,138 @@ func getActiveSecretRow() (*pblib.Secret, error) {
 	return nil, consts.ErrNoActiveSecretKeyFound
 }
 
-// insertNewAuthSecret inserts a newly generated secret key to database.
-// Secret key is used to sign JWT's.
+// insertNewAuthSecret inserts a newly generated secret key to database, keyed by its hash and sealed in an envelope.
+// Secret key is used to sign JWT's, or names the key pair signing them if conf.TokenSigning is asymmetric.
 // There is a trigger set up with secrets table in that with every insert,
 // the active_secret table is updated with the newly inserted secret.
 // Returns err if secret is empty or error with database.
-func insertNewAuthSecret() error {
+func (t *postgresTx) insertNewAuthSecret() error {
 	// generate a new secret
-	secretKey, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	row, err := newSigningKeyRow(conf.TokenSigning.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	secretHash := hashToken(row.key)
+	sealed, err := sealEnvelope([]byte(row.key), []byte(secretHash))
 	if err != nil {
 		return err
 	}
 
+	// HMAC secrets have no key pair, the check constraints require NULL rather than empty keys
+	var privateKey envelope
+	if row.privateKey != nil {
+		privateKey = *row.privateKey
+	}
+
 	command := `INSERT INTO user_security.secrets(
-					secret_key, created_timestamp, expiration_timestamp
-				) VALUES($1, $2, $3)
+					secret_key, encrypted_key, data_key, master_key_id,
+					algorithm, public_key, private_key, private_key_data_key, private_key_master_key_id,
+					created_timestamp, expiration_timestamp
+				) VALUES($1, $2, $3, $4, $5, NULLIF($6, ''::BYTEA), NULLIF($7, ''::BYTEA), NULLIF($8, ''::BYTEA),
+					NULLIF($9, ''), $10, $11)
 				`
 
-	createdTimestamp := time.Now().UTC()
-	expirationTimestamp, err := auth.GenerateExpirationTimestamp(createdTimestamp, daysInOneWeek)
+	_, err = t.exec.ExecContext(t.ctx, command, secretHash, sealed.ciphertext, sealed.dataKey, sealed.masterKeyID,
+		row.algorithm, row.publicKey, privateKey.ciphertext, privateKey.dataKey, privateKey.masterKeyID,
+		time.Unix(row.createdTimestamp, 0).UTC(), time.Unix(row.expirationTimestamp, 0).UTC())
+
 	if err != nil {
 		return err
 	}
 
-	_, err = postgresDB.Exec(command, secretKey, createdTimestamp, expirationTimestamp)
+	return nil
+}
+
+// getSigningKeyRow looks up the hash of secretKey in user_security.secrets, expired secrets included.
+// Returns consts.ErrSigningKeyNotFound if there is no such secret.
+func (t *postgresTx) getSigningKeyRow(secretKey string) (*signingKeyRow, error) {
+	if secretKey == "" {
+		return nil, consts.ErrSigningKeyNotFound
+	}
+
+	command := `SELECT encrypted_key, data_key, master_key_id, algorithm, public_key,
+					private_key, private_key_data_key, COALESCE(private_key_master_key_id, ''),
+					created_timestamp, expiration_timestamp
+				FROM user_security.secrets
+				WHERE secret_key = $1
+				`
 
+	secretHash := hashToken(secretKey)
+	row := &signingKeyRow{}
+	var sealed, privateKey envelope
+	var createdTimestamp, expirationTimestamp time.Time
+	err := t.exec.QueryRowContext(t.ctx, command, secretHash).Scan(&sealed.ciphertext, &sealed.dataKey,
+		&sealed.masterKeyID, &row.algorithm, &row.publicKey, &privateKey.ciphertext, &privateKey.dataKey,
+		&privateKey.masterKeyID, &createdTimestamp, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrSigningKeyNotFound
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if privateKey.masterKeyID != "" {
+		row.privateKey = &privateKey
 	}
 
-	return nil
+	if row.key, err = openSecretKey(secretHash, &sealed); err != nil {
+		return nil, err
+	}
+
+	row.createdTimestamp = createdTimestamp.Unix()
+	row.expirationTimestamp = expirationTimestamp.Unix()
+
+	return row, nil
+}
+
+// listSigningKeys returns the unexpired key pairs in user_security.secrets, the active one first, followed by the
+// newest, without private keys.
+// Tokens are only signed with the active key, the previous keys verify the tokens signed before a rotation.
+func (t *postgresTx) listSigningKeys() ([]*signingKeyRow, error) {
+	// secrets created within the same second are only ordered by the active_secret table
+	command := `SELECT user_security.secrets.secret_key, encrypted_key, data_key, master_key_id, algorithm, public_key,
+					user_security.secrets.created_timestamp, user_security.secrets.expiration_timestamp
+				FROM user_security.secrets
+				LEFT JOIN user_security.active_secret
+				ON user_security.active_secret.secret_key = user_security.secrets.secret_key
+				WHERE algorithm <> 'HMAC' AND NOW() AT TIME ZONE 'UTC' < user_security.secrets.expiration_timestamp
+				ORDER BY user_security.active_secret.one_row IS NULL, user_security.secrets.created_timestamp DESC
+				`
+
+	rows, err := t.exec.QueryContext(t.ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	keys := []*signingKeyRow{}
+	for rows.Next() {
+		row := &signingKeyRow{}
+		var secretHash string
+		var sealed envelope
+		var createdTimestamp, expirationTimestamp time.Time
+		if err := rows.Scan(&secretHash, &sealed.ciphertext, &sealed.dataKey, &sealed.masterKeyID,
+			&row.algorithm, &row.publicKey, &createdTimestamp, &expirationTimestamp); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if row.key, err = openSecretKey(secretHash, &sealed); err != nil {
+			return nil, err
+		}
+
+		row.createdTimestamp = createdTimestamp.Unix()
+		row.expirationTimestamp = expirationTimestamp.Unix()
+		keys = append(keys, row)
+	}
+
+	return keys, rows.Err()
 }
 
 // getLatestSecret looks at the secrets table and selects row that is less than parameter seconds.
 // Used to validate that the latest secret has been inserted into database.
 // Returns the secret key string if row passes timestamp test, else empty value.
-func getLatestSecret(seconds int) (string, error) {
+func (t *postgresTx) getLatestSecret(seconds int) (string, error) {
 	if seconds == 0 {
 		return "", consts.ErrInvalidAddTime
 	}
@@ -451,27 +780,30 @@ func getLatestSecret(seconds int) (string, error) {
 	interval := time.Now().UTC().Add(time.Second * time.Duration(-seconds))
 
 	command := `
-				SELECT secret_key 
+				SELECT secret_key, encrypted_key, data_key, master_key_id
 				FROM user_security.secrets
 				WHERE created_timestamp > $1
 				`
 
-	var secretKey string
-	err := postgresDB.QueryRow(command, interval).Scan(&secretKey)
+	var secretHash string
+	var sealed envelope
+	err := t.exec.QueryRowContext(t.ctx, command, interval).Scan(&secretHash, &sealed.ciphertext, &sealed.dataKey,
+		&sealed.masterKeyID)
 	if err != nil {
 		return "", err
 	}
 
-	if secretKey == "" {
+	if secretHash == "" {
 		return "", consts.ErrNoRowsFound
 	}
 
-	return secretKey, nil
+	return openSecretKey(secretHash, &sealed)
 }
 
-// insertAuthToken inserts new token information for auditing in the database.
+// insertAuthToken inserts the hash of new token and its information for auditing in the database.
+// Tokens signed with a key pair record the algorithm of the key pair rather than the HMAC algorithm of header.
 // Returns error if parameters are zero values, expired secret, db error.
-func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error {
+func (t *postgresTx) insertAuthToken(token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error {
 	if token == "" {
 		return authconst.ErrEmptyToken
 	}
@@ -487,13 +819,16 @@ func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret
 
 	command := `
 				INSERT INTO user_security.auth_tokens(
-					token, secret_key, token_type, algorithm,
+					token_hash, secret_key, token_type, algorithm,
 					permission, expiration_timestamp, uuid
-				) VALUES($1, $2, $3, $4, $5, $6, $7)
+				) VALUES($1, $2, $3,
+					(SELECT CASE WHEN algorithm = 'HMAC' THEN $4 ELSE algorithm END
+					FROM user_security.secrets WHERE secret_key = $2),
+					$5, $6, $7)
 				`
 
-	_, err := postgresDB.Exec(command, token, secret.Key, auth.TokenTypeStringMap[header.TokenTyp],
-		auth.AlgorithmStringMap[header.Alg], auth.PermissionStringMap[body.Permission],
+	_, err := t.exec.ExecContext(t.ctx, command, hashToken(token), hashToken(secret.Key),
+		auth.TokenTypeStringMap[header.TokenTyp], auth.AlgorithmStringMap[header.Alg], auth.PermissionStringMap[body.Permission],
 		time.Unix(body.ExpirationTimestamp, 0), body.UUID)
 
 	if err != nil {
@@ -503,35 +838,39 @@ func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret
 	return nil
 }
 
-// getAuthTokenRow looks up existing user and grabs row where token is not expired from the auth_tokens table.
+// getAuthTokenRow looks up existing user and grabs row where token is not expired nor revoked from the auth_tokens table.
 // Once matched, inner join will join a row from secrets table that matches its secrets_key with
 // the matched token's row secret_key.
 // Returns tokenAuthRow object if existing token is found and unexpired, nil if not found, else errors.
-func getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
+func (t *postgresTx) getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return nil, authconst.ErrInvalidUUID
 	}
 
-	command := `SELECT DISTINCT ON (uuid) uuid, permission, token, user_security.auth_tokens.secret_key, 
-       				user_security.secrets.created_timestamp, user_security.secrets.expiration_timestamp
+	command := `SELECT DISTINCT ON (uuid) uuid, permission, token_hash, user_security.auth_tokens.secret_key,
+					encrypted_key, data_key, master_key_id,
+					user_security.secrets.created_timestamp, user_security.secrets.expiration_timestamp
 				FROM user_security.auth_tokens
 				INNER JOIN user_security.secrets
 				ON user_security.secrets.secret_key = user_security.auth_tokens.secret_key
 				WHERE uuid = $1 AND NOW() AT TIME ZONE 'UTC' < user_security.auth_tokens.expiration_timestamp
+					AND user_security.auth_tokens.revoked_timestamp IS NULL
 				ORDER BY uuid, user_security.auth_tokens.expiration_timestamp DESC
 				`
 
-	row, err := postgresDB.Query(command, uuid)
+	row, err := t.exec.QueryContext(t.ctx, command, uuid)
 	if err != nil {
 		return nil, err
 	}
 
 	defer row.Close()
 	for row.Next() {
-		var retrievedUUID, permission, token, secret string
+		var retrievedUUID, permission, tokenHash, secretHash string
+		var sealed envelope
 		var secretCreatedTimestamp, secretExpirationTimestamp time.Time
 
-		err := row.Scan(&retrievedUUID, &permission, &token, &secret,
+		err := row.Scan(&retrievedUUID, &permission, &tokenHash, &secretHash,
+			&sealed.ciphertext, &sealed.dataKey, &sealed.masterKeyID,
 			&secretCreatedTimestamp, &secretExpirationTimestamp)
 		if err != nil {
 			return nil, err
@@ -541,12 +880,17 @@ func getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
 			return nil, authconst.ErrInvalidUUID
 		}
 
+		secretKey, err := openSecretKey(secretHash, &sealed)
+		if err != nil {
+			return nil, err
+		}
+
 		return &tokenAuthRow{
 			uuid:       retrievedUUID,
 			permission: permission,
-			token:      token,
+			tokenHash:  tokenHash,
 			secret: &pblib.Secret{
-				Key:                 secret,
+				Key:                 secretKey,
 				CreatedTimestamp:    secretCreatedTimestamp.Unix(),
 				ExpirationTimestamp: secretExpirationTimestamp.Unix(),
 			},
@@ -556,42 +900,56 @@ func getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
 	return nil, consts.ErrNoAuthTokenFound
 }
 
-// pairTokenWithSecret will look up matching token in the tokens table.
+// pairTokenWithSecret will look up the hash of token in the tokens table.
 // Once matched, inner join will join the matching secret_key row in secrets table with matched tokens row secret_key.
-// Returns secret object for the found token.
-func pairTokenWithSecret(token string) (*pblib.Identification, error) {
+// Returns secret object for the found token, or revoked error if the token was revoked.
+func (t *postgresTx) pairTokenWithSecret(token string) (*pblib.Identification, error) {
 	if token == "" {
 		return nil, authconst.ErrEmptyToken
 	}
 
-	command := `SELECT token, user_security.auth_tokens.secret_key, 
-					user_security.secrets.created_timestamp, user_security.secrets.expiration_timestamp
+	command := `SELECT token_hash, user_security.auth_tokens.secret_key, encrypted_key, data_key, master_key_id,
+					user_security.secrets.created_timestamp, user_security.secrets.expiration_timestamp,
+					user_security.auth_tokens.revoked_timestamp IS NOT NULL
 				FROM user_security.auth_tokens
 				INNER JOIN user_security.secrets
 				ON user_security.auth_tokens.secret_key = user_security.secrets.secret_key
-				WHERE token = $1
+				WHERE token_hash = $1
 				`
-	row, err := postgresDB.Query(command, token)
+	tokenHash := hashToken(token)
+	row, err := t.exec.QueryContext(t.ctx, command, tokenHash)
 	if err != nil {
 		return nil, err
 	}
 
 	defer row.Close()
 	for row.Next() {
-		var retrievedToken, secretKey string
+		var retrievedTokenHash, secretHash string
+		var sealed envelope
 		var secretCreatedTimeStamp, secretExpirationTimestamp time.Time
+		var isRevoked bool
 
-		err := row.Scan(&retrievedToken, &secretKey, &secretCreatedTimeStamp, &secretExpirationTimestamp)
+		err := row.Scan(&retrievedTokenHash, &secretHash, &sealed.ciphertext, &sealed.dataKey, &sealed.masterKeyID,
+			&secretCreatedTimeStamp, &secretExpirationTimestamp, &isRevoked)
 		if err != nil {
 			return nil, err
 		}
 
-		if token != retrievedToken {
+		if tokenHash != retrievedTokenHash {
 			return nil, consts.ErrMismatchingToken
 		}
 
+		if isRevoked {
+			return nil, consts.ErrAuthTokenRevoked
+		}
+
+		secretKey, err := openSecretKey(secretHash, &sealed)
+		if err != nil {
+			return nil, err
+		}
+
 		return &pblib.Identification{
-			Token: retrievedToken,
+			Token: token,
 			Secret: &pblib.Secret{
 				Key:                 secretKey,
 				CreatedTimestamp:    secretCreatedTimeStamp.Unix(),
@@ -603,17 +961,66 @@ func pairTokenWithSecret(token string) (*pblib.Identification, error) {
 	return nil, consts.ErrNoMatchingAuthTokenFound
 }
 
+// revokeAuthToken marks token as revoked in user_security.auth_tokens, the row is kept for auditing.
+// Returns no matching token error if token does not exist or is already revoked, else any db error.
+func (t *postgresTx) revokeAuthToken(token string) error {
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	command := `UPDATE user_security.auth_tokens SET revoked_timestamp = $2
+				WHERE token_hash = $1 AND revoked_timestamp IS NULL
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, hashToken(token), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrNoMatchingAuthTokenFound
+	}
+
+	return nil
+}
+
+// revokeAuthTokens marks every auth token of uuid as revoked in user_security.auth_tokens,
+// and deletes every refresh token of uuid from user_security.refresh_tokens.
+// Returns error if uuid is invalid, or any db error.
+func (t *postgresTx) revokeAuthTokens(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `UPDATE user_security.auth_tokens SET revoked_timestamp = $2
+				WHERE uuid = $1 AND revoked_timestamp IS NULL
+				`
+	if _, err := t.exec.ExecContext(t.ctx, command, uuid, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	command = `DELETE FROM user_security.refresh_tokens WHERE uuid = $1`
+	if _, err := t.exec.ExecContext(t.ctx, command, uuid); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // hasActiveAuthSecret checks active_secret table for a row.
 // active_secret table has a constraint to only one row.
 // Returns true if a row was found, false otherwise, or any error encountered with the db itself.
-func hasActiveAuthSecret() (bool, error) {
+func (t *postgresTx) hasActiveAuthSecret() (bool, error) {
 	command := `SELECT EXISTS( 
   					SELECT *
   					FROM user_security.active_secret
   				)`
 
 	var exists bool
-	err := postgresDB.QueryRow(command).Scan(&exists)
+	err := t.exec.QueryRowContext(t.ctx, command).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
@@ -625,10 +1032,80 @@ func hasActiveAuthSecret() (bool, error) {
 	return false, nil
 }
 
+// listStaleDataKeys returns up to limit data keys in user_security.secrets, user_svc.email_tokens
+// and user_security.totp_secrets that are not sealed with the master key of masterKeyID.
+// Returns error if limit is not positive, or any db error.
+func (t *postgresTx) listStaleDataKeys(masterKeyID string, limit int) ([]*dataKeyRow, error) {
+	if limit <= 0 {
+		return nil, consts.ErrInvalidBatchSize
+	}
+
+	command := `SELECT 'user_security.secrets', secret_key, data_key, master_key_id
+				FROM user_security.secrets
+				WHERE master_key_id <> $1
+				UNION ALL
+				SELECT 'user_security.secrets.private_key', secret_key, private_key_data_key, private_key_master_key_id
+				FROM user_security.secrets
+				WHERE private_key_master_key_id IS NOT NULL AND private_key_master_key_id <> $1
+				UNION ALL
+				SELECT 'user_svc.email_tokens', token_hash, data_key, master_key_id
+				FROM user_svc.email_tokens
+				WHERE master_key_id IS NOT NULL AND master_key_id <> $1
+				UNION ALL
+				SELECT 'user_security.totp_secrets', uuid, data_key, master_key_id
+				FROM user_security.totp_secrets
+				WHERE master_key_id <> $1
+				LIMIT $2
+				`
+
+	rows, err := t.exec.QueryContext(t.ctx, command, masterKeyID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	dataKeys := []*dataKeyRow{}
+	for rows.Next() {
+		row := &dataKeyRow{}
+		if err := rows.Scan(&row.table, &row.key, &row.dataKey, &row.masterKeyID); err != nil {
+			return nil, err
+		}
+		dataKeys = append(dataKeys, row)
+	}
+
+	return dataKeys, rows.Err()
+}
+
+// updateDataKey replaces the data key of row in its table with row.dataKey sealed with row.masterKeyID.
+// Returns error if the table of row is unknown, or any db error.
+func (t *postgresTx) updateDataKey(row *dataKeyRow) error {
+	var command string
+	switch row.table {
+	case dataKeyTableSecrets:
+		command = `UPDATE user_security.secrets SET data_key = $2, master_key_id = $3 WHERE secret_key = $1`
+	case dataKeyTablePrivateKeys:
+		command = `UPDATE user_security.secrets SET private_key_data_key = $2, private_key_master_key_id = $3
+					WHERE secret_key = $1`
+	case dataKeyTableEmailTokens:
+		command = `UPDATE user_svc.email_tokens SET data_key = $2, master_key_id = $3 WHERE token_hash = $1`
+	case dataKeyTableTOTPSecrets:
+		command = `UPDATE user_security.totp_secrets SET data_key = $2, master_key_id = $3 WHERE uuid = $1`
+	default:
+		return consts.ErrUnknownDataKeyTable
+	}
+
+	_, err := t.exec.ExecContext(t.ctx, command, row.key, row.dataKey, row.masterKeyID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // isEmailTaken takes received email and checks it against user_svc.accounts table for
 // existing email in both email and prospective_email columns.
 // On success querying, returns true if exists, false otherwise.
-func isEmailTaken(prospectiveEmail string) (bool, error) {
+func (t *postgresTx) isEmailTaken(prospectiveEmail string) (bool, error) {
 	if err := validateEmail(prospectiveEmail); err != nil {
 		return false, err
 	}
@@ -641,7 +1118,7 @@ func isEmailTaken(prospectiveEmail string) (bool, error) {
 				)`
 
 	var emailExists bool
-	err := postgresDB.QueryRow(command, prospectiveEmail).Scan(&emailExists)
+	err := t.exec.QueryRowContext(t.ctx, command, prospectiveEmail).Scan(&emailExists)
 	if err != nil {
 		return false, err
 	}
@@ -653,58 +1130,78 @@ func isEmailTaken(prospectiveEmail string) (bool, error) {
 	return false, nil
 }
 
-// getEmailTokenRow looks up existing token from user_svc.email_tokens table.
+// getEmailTokenRow looks up the hash of existing token from user_svc.email_tokens table.
+// Tokens inserted before their secret was sealed have an empty secretKey.
 // If token exists, the rows information are returned in a tokenEmailRow struct.
 // If token does not exist, return error.
-func getEmailTokenRow(token string) (*tokenEmailRow, error) {
+func (t *postgresTx) getEmailTokenRow(token string) (*tokenEmailRow, error) {
 	if token == "" {
 		return nil, authconst.ErrEmptyToken
 	}
 
-	command := `SELECT * FROM user_svc.email_tokens
-				WHERE token = $1`
+	command := `SELECT token_hash, encrypted_secret_key, data_key, master_key_id,
+					created_timestamp, expiration_timestamp, uuid, purpose
+				FROM user_svc.email_tokens
+				WHERE token_hash = $1`
 
-	row, err := postgresDB.Query(command, token)
+	tokenHash := hashToken(token)
+	row, err := t.exec.QueryContext(t.ctx, command, tokenHash)
 	if err != nil {
 		return nil, err
 	}
 
 	defer row.Close()
 	for row.Next() {
-		var emailToken, secretKey, uuid string
+		var emailTokenHash, uuid, purpose string
+		var sealed envelope
+		var masterKeyID sql.NullString
 		var createdTimestamp, expirationTimestamp time.Time
 
-		err := row.Scan(&emailToken, &secretKey, &createdTimestamp, &expirationTimestamp, &uuid)
+		err := row.Scan(&emailTokenHash, &sealed.ciphertext, &sealed.dataKey, &masterKeyID,
+			&createdTimestamp, &expirationTimestamp, &uuid, &purpose)
 		if err != nil {
 			return nil, err
 		}
 
-		if token != emailToken {
+		if tokenHash != emailTokenHash {
 			return nil, consts.ErrMismatchingEmailToken
 		}
 
+		var secretKey string
+		if masterKeyID.Valid {
+			sealed.masterKeyID = masterKeyID.String
+			if secretKey, err = openSecretKey(tokenHash, &sealed); err != nil {
+				return nil, err
+			}
+		}
+
 		return &tokenEmailRow{
-			token:               emailToken,
+			token:               token,
 			secretKey:           secretKey,
 			createdTimestamp:    createdTimestamp.Unix(),
 			expirationTimestamp: expirationTimestamp.Unix(),
 			uuid:                uuid,
+			purpose:             purpose,
 		}, nil
 	}
 
 	return nil, consts.ErrNoMatchingEmailTokenFound
 }
 
-// deleteEmailTokenRow looks up the given uuid in user_svc.email_tokens table and deletes the matching row.
-// Returns error if given uuid is invalid or any db error.
-func deleteEmailTokenRow(uuid string) error {
+// deleteEmailTokenRow looks up the given uuid and purpose in user_svc.email_tokens table and deletes the matching row.
+// Returns error if given uuid is invalid, purpose is unknown or any db error.
+func (t *postgresTx) deleteEmailTokenRow(uuid string, purpose string) error {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return authconst.ErrInvalidUUID
 	}
 
-	command := `DELETE FROM user_svc.email_tokens WHERE uuid = $1`
+	if err := validateEmailTokenPurpose(purpose); err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_svc.email_tokens WHERE uuid = $1 AND purpose = $2`
 
-	_, err := postgresDB.Exec(command, uuid)
+	_, err := t.exec.ExecContext(t.ctx, command, uuid, purpose)
 
 	if err != nil {
 		return err
@@ -718,8 +1215,9 @@ func deleteEmailTokenRow(uuid string) error {
 // If both email and password matches, returns the matched users row.
 // If the query by email returns nothing, returns email does not exist error.
 // If email is found, but password does not match, returns password does not match error.
+// Hashes of older hashers are rewritten, so the caller holds the lock of the user matching email.
 // All other errors are returned.
-func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
+func (t *postgresTx) matchEmailAndPassword(email string, password string) (*pblib.User, error) {
 	if err := validateEmail(email); err != nil {
 		return nil, err
 	}
@@ -734,7 +1232,7 @@ func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
 				WHERE email = $1
 				`
 
-	row, err := postgresDB.Query(command, email)
+	row, err := t.exec.QueryContext(t.ctx, command, email)
 	if err != nil {
 		return nil, err
 	}
@@ -783,12 +1281,27 @@ func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
 		return nil, err
 	}
 
+	// hashes of older hashers or parameters are replaced while the password is at hand
+	if needsPasswordRehash(foundUser.GetPassword()) {
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+
+		command := `UPDATE user_svc.accounts SET password = $3 WHERE uuid = $1 AND password = $2`
+		if _, err := t.exec.ExecContext(t.ctx, command, foundUser.GetUuid(), foundUser.GetPassword(),
+			hashedPassword); err != nil {
+			return nil, err
+		}
+		foundUser.Password = hashedPassword
+	}
+
 	return foundUser, nil
 }
 
 // updatePermissionLevel changes the permission level for given UUID.
 // returns nil on success, nil if user doesnt exist, else err
-func updatePermissionLevel(uuid string, permissionLevel string) error {
+func (t *postgresTx) updatePermissionLevel(uuid string, permissionLevel string) error {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return err
 	}
@@ -801,10 +1314,1040 @@ func updatePermissionLevel(uuid string, permissionLevel string) error {
 				WHERE uuid = $1
 				`
 
-	_, err := postgresDB.Exec(command, uuid, permissionLevel)
+	_, err := t.exec.ExecContext(t.ctx, command, uuid, permissionLevel)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// countAdmins returns the number of ADMIN users in user_svc.accounts that are not suspended.
+// Locks the rows of every admin until the transaction ends, so concurrent demotions can not remove the last admin.
+// Returns any db error.
+func (t *postgresTx) countAdmins() (int, error) {
+	command := `SELECT COUNT(*) FROM (
+					SELECT uuid FROM user_svc.accounts
+					WHERE permission_level = $1
+					AND NOT EXISTS (
+						SELECT 1 FROM user_security.suspensions
+						WHERE suspensions.uuid = accounts.uuid
+						AND (suspended_until IS NULL OR suspended_until > NOW())
+					)
+					FOR UPDATE
+				) AS admins
+				`
+
+	var count int
+	if err := t.exec.QueryRowContext(t.ctx, command, auth.PermissionStringMap[auth.Admin]).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// swapProspectiveEmailRow promotes prospective_email of uuid to email in user_svc.accounts, clears prospective_email,
+// marks the user verified and raises the permission level to at least USER.
+// Returns the replaced email, or error if uuid is invalid, uuid has no prospective email, or any db error.
+func (t *postgresTx) swapProspectiveEmailRow(uuid string) (string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return "", err
+	}
+
+	// lock the row so the prospective email can not change between reading and swapping
+	var oldEmail string
+	var prospectiveEmailNullable sql.NullString
+	err := t.exec.QueryRowContext(t.ctx,
+		`SELECT email, prospective_email FROM user_svc.accounts WHERE uuid = $1 FOR UPDATE`,
+		uuid).Scan(&oldEmail, &prospectiveEmailNullable)
+	if err == sql.ErrNoRows {
+		return "", consts.ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !prospectiveEmailNullable.Valid || prospectiveEmailNullable.String == "" {
+		return "", consts.ErrNoPendingEmailVerification
+	}
+
+	// GREATEST keeps the permission level of users above USER, enum values are ordered
+	command := `UPDATE user_svc.accounts SET
+					email = prospective_email,
+					prospective_email = NULL,
+					is_verified = TRUE,
+					permission_level = GREATEST(permission_level, $2::permission_level),
+					modified_timestamp = $3
+				WHERE uuid = $1
+				`
+	_, err = t.exec.ExecContext(t.ctx, command, uuid, auth.PermissionStringMap[auth.User], time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+
+	return oldEmail, nil
+}
+
+// listUserRows retrieves a page of users from user_svc.accounts matching the filters in query.
+// Rows are ordered by query.sortBy and uuid, so the cursor of the last row continues the next page.
+// Returns the users (passwords included, callers must strip them), the next cursor or nil if this is
+// the last page, else any error with the query or db.
+func (t *postgresTx) listUserRows(query *listUsersQuery) ([]*pblib.User, *listUsersCursor, error) {
+	if query == nil {
+		return nil, nil, consts.ErrInvalidListUsersFilter
+	}
+
+	sortExpression, ok := listUsersSortColumns[query.sortBy]
+	if !ok {
+		return nil, nil, consts.ErrInvalidListUsersSortBy
+	}
+
+	if query.pageSize <= 0 || query.pageSize > maxListUsersPageSize {
+		return nil, nil, consts.ErrInvalidListUsersPageSize
+	}
+
+	var conditions []string
+	var args []interface{}
+	addArg := func(arg interface{}) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.permissionLevel != "" {
+		if _, ok := auth.PermissionEnumMap[query.permissionLevel]; !ok {
+			return nil, nil, authconst.ErrInvalidPermission
+		}
+		conditions = append(conditions, "permission_level = "+addArg(query.permissionLevel)+"::permission_level")
+	}
+	if query.isVerified != nil {
+		conditions = append(conditions, "is_verified = "+addArg(*query.isVerified))
+	}
+	if query.organization != "" {
+		conditions = append(conditions, "organization = "+addArg(query.organization))
+	}
+	if query.createdAfter > 0 {
+		conditions = append(conditions, "created_timestamp >= "+addArg(time.Unix(query.createdAfter, 0).UTC()))
+	}
+	if query.createdBefore > 0 {
+		conditions = append(conditions, "created_timestamp < "+addArg(time.Unix(query.createdBefore, 0).UTC()))
+	}
+
+	order := "ASC"
+	comparator := ">"
+	if query.descending {
+		order = "DESC"
+		comparator = "<"
+	}
+
+	if query.cursor != nil {
+		if query.cursor.SortBy != query.sortBy || query.cursor.Descending != query.descending {
+			return nil, nil, consts.ErrInvalidListUsersCursor
+		}
+		if err := validation.ValidateUserUUID(query.cursor.UUID); err != nil {
+			return nil, nil, consts.ErrInvalidListUsersCursor
+		}
+
+		if query.sortBy == listUsersSortByUUID {
+			conditions = append(conditions, fmt.Sprintf("uuid %s %s", comparator, addArg(query.cursor.UUID)))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s, uuid) %s (%s::%s, %s)",
+				sortExpression, comparator, addArg(query.cursor.Value),
+				listUsersSortTypes[query.sortBy], addArg(query.cursor.UUID)))
+		}
+	}
+
+	command := `SELECT uuid, first_name, last_name, email, organization,
+       				created_timestamp, is_verified, password, permission_level, prospective_email
+				FROM user_svc.accounts
+				`
+	if len(conditions) > 0 {
+		command += "WHERE " + strings.Join(conditions, " AND ") + "\n"
+	}
+	if query.sortBy == listUsersSortByUUID {
+		command += fmt.Sprintf("ORDER BY uuid %s\n", order)
+	} else {
+		command += fmt.Sprintf("ORDER BY %s %s, uuid %s\n", sortExpression, order, order)
+	}
+	// fetch one extra row to know if there is a next page
+	command += "LIMIT " + addArg(query.pageSize+1)
+
+	row, err := t.exec.QueryContext(t.ctx, command, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer row.Close()
+
+	var users []*pblib.User
+	var lastCreatedTimestamp time.Time
+	for row.Next() {
+		var organizationNullable, prospectiveEmailNullable sql.NullString
+		var uuid, firstName, lastName, email, password, permissionLevel string
+		var isVerified bool
+		var createdTimestamp time.Time
+
+		err := row.Scan(&uuid, &firstName, &lastName, &email, &organizationNullable,
+			&createdTimestamp, &isVerified, &password, &permissionLevel, &prospectiveEmailNullable)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(users) == query.pageSize {
+			// extra row exists, build the cursor from the last row of this page
+			lastUser := users[len(users)-1]
+			nextCursor := &listUsersCursor{
+				SortBy:     query.sortBy,
+				Descending: query.descending,
+				UUID:       lastUser.GetUuid(),
+			}
+			switch query.sortBy {
+			case listUsersSortByPermissionLevel:
+				nextCursor.Value = lastUser.GetPermissionLevel()
+			case listUsersSortByIsVerified:
+				nextCursor.Value = strconv.FormatBool(lastUser.GetIsVerified())
+			case listUsersSortByOrganization:
+				nextCursor.Value = lastUser.GetOrganization()
+			case listUsersSortByCreatedTimestamp:
+				nextCursor.Value = lastCreatedTimestamp.Format(time.RFC3339Nano)
+			}
+
+			return users, nextCursor, nil
+		}
+
+		lastCreatedTimestamp = createdTimestamp
+		users = append(users, &pblib.User{
+			Uuid:             uuid,
+			FirstName:        firstName,
+			LastName:         lastName,
+			Email:            email,
+			Organization:     organizationNullable.String,
+			CreatedTimestamp: createdTimestamp.Unix(),
+			IsVerified:       isVerified,
+			Password:         password,
+			PermissionLevel:  permissionLevel,
+			ProspectiveEmail: prospectiveEmailNullable.String,
+		})
+	}
+	if err := row.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return users, nil, nil
+}
+
+// insertRefreshToken inserts the hash of a refresh token of uuid into user_security.refresh_tokens,
+// tokens of a login share its familyID so they can be revoked together.
+// Expired refresh tokens of uuid are deleted along the way.
+// Returns error if params are invalid, or any db error.
+func (t *postgresTx) insertRefreshToken(tokenHash string, familyID string, uuid string,
+	expirationTimestamp time.Time) error {
+	if tokenHash == "" || familyID == "" {
+		return consts.ErrInvalidRefreshToken
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	command := `DELETE FROM user_security.refresh_tokens WHERE uuid = $1 AND expiration_timestamp < $2`
+	if _, err := t.exec.ExecContext(t.ctx, command, uuid, now); err != nil {
+		return err
+	}
+
+	command = `INSERT INTO user_security.refresh_tokens(
+					token_hash, family_id, uuid, created_timestamp, expiration_timestamp)
+				VALUES($1, $2, $3, $4, $5)
+				`
+	_, err := t.exec.ExecContext(t.ctx, command, tokenHash, familyID, uuid, now, expirationTimestamp.UTC())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getRefreshTokenRow looks up the refresh token hashed to tokenHash in user_security.refresh_tokens.
+// Returns nil if there is no such token, else any db error.
+func (t *postgresTx) getRefreshTokenRow(tokenHash string) (*refreshTokenRow, error) {
+	if tokenHash == "" {
+		return nil, consts.ErrInvalidRefreshToken
+	}
+
+	command := `SELECT token_hash, family_id, uuid, created_timestamp, expiration_timestamp,
+					used_timestamp IS NOT NULL
+				FROM user_security.refresh_tokens
+				WHERE token_hash = $1`
+
+	var row refreshTokenRow
+	var createdTimestamp, expirationTimestamp time.Time
+	err := t.exec.QueryRowContext(t.ctx, command, tokenHash).Scan(&row.tokenHash, &row.familyID, &row.uuid,
+		&createdTimestamp, &expirationTimestamp, &row.isUsed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	row.createdTimestamp = createdTimestamp.Unix()
+	row.expirationTimestamp = expirationTimestamp.Unix()
+
+	return &row, nil
+}
+
+// useRefreshToken marks the refresh token hashed to tokenHash as used in user_security.refresh_tokens.
+// Returns false if the token does not exist or was already used, so only one of concurrent uses wins,
+// else any db error.
+func (t *postgresTx) useRefreshToken(tokenHash string) (bool, error) {
+	if tokenHash == "" {
+		return false, consts.ErrInvalidRefreshToken
+	}
+
+	command := `UPDATE user_security.refresh_tokens SET used_timestamp = $2
+				WHERE token_hash = $1 AND used_timestamp IS NULL
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, tokenHash, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// deleteRefreshTokenFamily revokes every refresh token of familyID in user_security.refresh_tokens.
+// Returns any db error.
+func (t *postgresTx) deleteRefreshTokenFamily(familyID string) error {
+	if familyID == "" {
+		return consts.ErrInvalidRefreshToken
+	}
+
+	command := `DELETE FROM user_security.refresh_tokens WHERE family_id = $1`
+	if _, err := t.exec.ExecContext(t.ctx, command, familyID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// insertTOTPSecret stores the sealed TOTP secret of uuid in user_security.totp_secrets,
+// replacing a secret that was enrolled but never confirmed.
+// Returns already enrolled error if uuid has a confirmed secret, error if uuid is invalid, or any db error.
+func (t *postgresTx) insertTOTPSecret(uuid string, sealedSecret *envelope) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if sealedSecret == nil || len(sealedSecret.ciphertext) == 0 || sealedSecret.masterKeyID == "" {
+		return consts.ErrInvalidTOTPSecret
+	}
+
+	command := `INSERT INTO user_security.totp_secrets(
+					uuid, secret, data_key, master_key_id, is_confirmed, last_used_step, created_timestamp
+				) VALUES($1, $2, $3, $4, FALSE, 0, $5)
+				ON CONFLICT (uuid) DO UPDATE
+				SET secret = EXCLUDED.secret, data_key = EXCLUDED.data_key, master_key_id = EXCLUDED.master_key_id,
+					created_timestamp = EXCLUDED.created_timestamp
+				WHERE user_security.totp_secrets.is_confirmed = FALSE
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid, sealedSecret.ciphertext, sealedSecret.dataKey,
+		sealedSecret.masterKeyID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrTOTPAlreadyEnrolled
+	}
+
+	return nil
+}
+
+// getTOTPRow looks up the TOTP secret of uuid in user_security.totp_secrets.
+// Returns nil if uuid is not enrolled, error if uuid is invalid, or any db error.
+func (t *postgresTx) getTOTPRow(uuid string) (*totpRow, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid, secret, data_key, master_key_id, is_confirmed, last_used_step,
+					created_timestamp
+				FROM user_security.totp_secrets
+				WHERE uuid = $1`
+
+	var row totpRow
+	var createdTimestamp time.Time
+	err := t.exec.QueryRowContext(t.ctx, command, uuid).Scan(&row.uuid, &row.secret.ciphertext,
+		&row.secret.dataKey, &row.secret.masterKeyID, &row.isConfirmed, &row.lastUsedStep, &createdTimestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	row.createdTimestamp = createdTimestamp.Unix()
+
+	return &row, nil
+}
+
+// confirmTOTP confirms the TOTP secret of uuid with the step of its first code,
+// and replaces the recovery codes of uuid in user_security.totp_recovery_codes.
+// Returns not enrolled error if uuid has no unconfirmed secret, error if uuid is invalid, or any db error.
+func (t *postgresTx) confirmTOTP(uuid string, step int64, recoveryCodeHashes []string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `UPDATE user_security.totp_secrets SET is_confirmed = TRUE, last_used_step = $2
+				WHERE uuid = $1 AND is_confirmed = FALSE
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid, step)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrTOTPNotEnrolled
+	}
+
+	command = `DELETE FROM user_security.totp_recovery_codes WHERE uuid = $1`
+	if _, err := t.exec.ExecContext(t.ctx, command, uuid); err != nil {
+		return err
+	}
+
+	if len(recoveryCodeHashes) == 0 {
+		return nil
+	}
+
+	args := []interface{}{uuid}
+	values := make([]string, 0, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		args = append(args, hash)
+		values = append(values, fmt.Sprintf("($1, $%d)", len(args)))
+	}
+
+	command = `INSERT INTO user_security.totp_recovery_codes(uuid, code_hash)
+				VALUES ` + strings.Join(values, ", ") + `
+				ON CONFLICT DO NOTHING
+				`
+	if _, err := t.exec.ExecContext(t.ctx, command, args...); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// useTOTPStep records step as the last TOTP step used by uuid, if it is later than the last one used.
+// Returns false if the step, or a later one, was already used, error if uuid is invalid, or any db error.
+func (t *postgresTx) useTOTPStep(uuid string, step int64) (bool, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, err
+	}
+
+	command := `UPDATE user_security.totp_secrets SET last_used_step = $2
+				WHERE uuid = $1 AND is_confirmed = TRUE AND last_used_step < $2
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid, step)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// useTOTPRecoveryCode deletes the recovery code of uuid matching codeHash from user_security.totp_recovery_codes.
+// Returns false if uuid has no such recovery code, error if uuid is invalid, or any db error.
+func (t *postgresTx) useTOTPRecoveryCode(uuid string, codeHash string) (bool, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, err
+	}
+
+	command := `DELETE FROM user_security.totp_recovery_codes WHERE uuid = $1 AND code_hash = $2`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// deleteTOTP deletes the TOTP secret of uuid from user_security.totp_secrets, cascading to its recovery codes.
+// Returns not enrolled error if uuid has no secret, error if uuid is invalid, or any db error.
+func (t *postgresTx) deleteTOTP(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_security.totp_secrets WHERE uuid = $1`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrTOTPNotEnrolled
+	}
+
+	return nil
+}
+
+// getSuspensionRow returns the suspension of uuid from user_security.suspensions,
+// nil if uuid is not suspended or its suspension passed suspended_until.
+// Returns error if uuid is invalid, or any db error.
+func (t *postgresTx) getSuspensionRow(uuid string) (*suspensionRow, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid, reason, suspended_by, suspended_timestamp, suspended_until
+				FROM user_security.suspensions
+				WHERE uuid = $1 AND (suspended_until IS NULL OR suspended_until > NOW())
+				`
+
+	var row suspensionRow
+	var suspendedUntil pq.NullTime
+	err := t.exec.QueryRowContext(t.ctx, command, uuid).Scan(&row.uuid, &row.reason, &row.suspendedBy,
+		&row.suspendedTimestamp, &suspendedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if suspendedUntil.Valid {
+		row.suspendedUntil = suspendedUntil.Time
+	}
+
+	return &row, nil
+}
+
+// insertSuspension suspends row.uuid in user_security.suspensions, replacing a previous suspension.
+// Returns error if uuid is invalid, the reason is empty, or any db error.
+func (t *postgresTx) insertSuspension(row *suspensionRow) error {
+	if err := validation.ValidateUserUUID(row.uuid); err != nil {
+		return err
+	}
+	if row.reason == "" {
+		return consts.ErrInvalidSuspensionReason
+	}
+
+	var suspendedUntil pq.NullTime
+	if !row.suspendedUntil.IsZero() {
+		suspendedUntil = pq.NullTime{Time: row.suspendedUntil, Valid: true}
+	}
+
+	command := `INSERT INTO user_security.suspensions(uuid, reason, suspended_by, suspended_timestamp, suspended_until)
+				VALUES($1, $2, $3, $4, $5)
+				ON CONFLICT (uuid) DO UPDATE
+				SET reason = $2, suspended_by = $3, suspended_timestamp = $4, suspended_until = $5
+				`
+	_, err := t.exec.ExecContext(t.ctx, command, row.uuid, row.reason, row.suspendedBy, row.suspendedTimestamp,
+		suspendedUntil)
+
+	return err
+}
+
+// deleteSuspension reactivates uuid, deleting its suspension from user_security.suspensions.
+// Returns not suspended error if uuid has no suspension, error if uuid is invalid, or any db error.
+func (t *postgresTx) deleteSuspension(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_security.suspensions WHERE uuid = $1`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrUserNotSuspended
+	}
+
+	return nil
+}
+
+// getRolePermissions returns the permissions of role in user_security.role_permissions.
+// Returns consts.ErrRoleNotFound if role does not exist, or any db error.
+func (t *postgresTx) getRolePermissions(role string) ([]string, error) {
+	if role == "" {
+		return nil, consts.ErrInvalidRole
+	}
+
+	command := `SELECT user_security.role_permissions.permission
+				FROM user_security.roles
+				LEFT JOIN user_security.role_permissions
+				ON user_security.role_permissions.role = user_security.roles.name
+				WHERE user_security.roles.name = $1
+				ORDER BY user_security.role_permissions.permission
+				`
+	rows, err := t.exec.QueryContext(t.ctx, command, role)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var exists bool
+	permissions := []string{}
+	for rows.Next() {
+		var permission sql.NullString
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+
+		exists = true
+		if permission.Valid {
+			permissions = append(permissions, permission.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, consts.ErrRoleNotFound
+	}
+
+	return permissions, nil
+}
+
+// listRoleGrants returns the roles granted to uuid in user_security.user_roles, oldest first.
+// Returns error if uuid is invalid, or any db error.
+func (t *postgresTx) listRoleGrants(uuid string) ([]*roleGrant, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT role, organization, granted_by, granted_timestamp
+				FROM user_security.user_roles
+				WHERE uuid = $1
+				ORDER BY granted_timestamp, role, organization
+				`
+	rows, err := t.exec.QueryContext(t.ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	grants := []*roleGrant{}
+	for rows.Next() {
+		grant := &roleGrant{uuid: uuid}
+		if err := rows.Scan(&grant.role, &grant.organization, &grant.grantedBy, &grant.grantedTimestamp); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+// insertRoleGrant grants grant.role to grant.uuid in user_security.user_roles,
+// granting a role that is already granted in the same organization is ignored.
+// Returns consts.ErrRoleNotFound if the role does not exist, error if uuid is invalid, or any db error.
+func (t *postgresTx) insertRoleGrant(grant *roleGrant) error {
+	if err := validation.ValidateUserUUID(grant.uuid); err != nil {
+		return err
+	}
+
+	if _, err := t.getRolePermissions(grant.role); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_security.user_roles(uuid, role, organization, granted_by, granted_timestamp)
+				VALUES($1, $2, $3, $4, $5)
+				ON CONFLICT (uuid, role, organization) DO NOTHING
+				`
+	_, err := t.exec.ExecContext(t.ctx, command, grant.uuid, grant.role, grant.organization, grant.grantedBy,
+		grant.grantedTimestamp.UTC())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteRoleGrant revokes role granted to uuid in organization from user_security.user_roles,
+// revoking a role that is not granted is ignored.
+// Returns error if uuid or role are invalid, or any db error.
+func (t *postgresTx) deleteRoleGrant(uuid string, role string, organization string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if role == "" {
+		return consts.ErrInvalidRole
+	}
+
+	command := `DELETE FROM user_security.user_roles WHERE uuid = $1 AND role = $2 AND organization = $3`
+	_, err := t.exec.ExecContext(t.ctx, command, uuid, role, organization)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// insertDocumentRow inserts a document owned by uuid into user_svc.documents.
+// Returns error if duid or uuid are invalid, or error with inserting to database.
+func (t *postgresTx) insertDocumentRow(duid string, uuid string, isPublic bool) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.documents(duid, uuid, is_public) VALUES($1, $2, $3)`
+
+	_, err := t.exec.ExecContext(t.ctx, command, duid, uuid, isPublic)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getDocumentRow looks up a document by its duid in user_svc.documents.
+// Returns documentRow if found, document not found error if not, else any db error.
+func (t *postgresTx) getDocumentRow(duid string) (*documentRow, error) {
+	if err := validateDUID(duid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT duid, uuid, is_public FROM user_svc.documents WHERE duid = $1`
+
+	var document documentRow
+	err := t.exec.QueryRowContext(t.ctx, command, duid).Scan(&document.duid, &document.uuid, &document.isPublic)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrDocumentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+// insertSharedDocumentRows shares duid with every uuid by inserting rows into user_svc.shared_documents.
+// Method is idempotent, uuids that already have the duid shared are ignored.
+// Rows are inserted in one statement, so either all uuids are shared or none.
+// Returns error if duid or any uuid is invalid, or error with inserting to database.
+func (t *postgresTx) insertSharedDocumentRows(duid string, uuids []string) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if len(uuids) == 0 {
+		return consts.ErrNoShareRecipients
+	}
+
+	args := []interface{}{duid}
+	values := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			return err
+		}
+		args = append(args, uuid)
+		values = append(values, fmt.Sprintf("($1, $%d)", len(args)))
+	}
+
+	command := `INSERT INTO user_svc.shared_documents(duid, uuid)
+				VALUES ` + strings.Join(values, ", ") + `
+				ON CONFLICT DO NOTHING
+				`
+
+	_, err := t.exec.ExecContext(t.ctx, command, args...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getSharedDocumentUUIDs retrieves every uuid the duid is shared with from user_svc.shared_documents.
+// Returns the uuids ordered by uuid, empty if the duid is not shared, else any db error.
+func (t *postgresTx) getSharedDocumentUUIDs(duid string) ([]string, error) {
+	if err := validateDUID(duid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid FROM user_svc.shared_documents WHERE duid = $1 ORDER BY uuid`
+
+	row, err := t.exec.QueryContext(t.ctx, command, duid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	var uuids []string
+	for row.Next() {
+		var uuid string
+		if err := row.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+// getUserRowByEmail looks up a user by its email in user_svc.accounts.
+// Returns pb.User struct if found, email does not exist error if not, else any db error.
+func (t *postgresTx) getUserRowByEmail(email string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid FROM user_svc.accounts WHERE email = $1`
+
+	var uuid string
+	err := t.exec.QueryRowContext(t.ctx, command, email).Scan(&uuid)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t.getUserRow(uuid)
+}
+
+// getUserRowByProspectiveEmail looks up the user waiting to verify prospective_email in user_svc.accounts.
+// Returns email does not exist error if no user is updating to the email, else any db error.
+func (t *postgresTx) getUserRowByProspectiveEmail(email string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid FROM user_svc.accounts WHERE prospective_email = $1`
+
+	var uuid string
+	err := t.exec.QueryRowContext(t.ctx, command, email).Scan(&uuid)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t.getUserRow(uuid)
+}
+
+// deleteSharedDocumentRows revokes the duid shared with every uuid from user_svc.shared_documents.
+// Method is idempotent, uuids that do not have the duid shared are ignored.
+// Returns error if duid or any uuid is invalid, or error with deleting from database.
+func (t *postgresTx) deleteSharedDocumentRows(duid string, uuids []string) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if len(uuids) == 0 {
+		return consts.ErrNoShareRecipients
+	}
+
+	args := []interface{}{duid}
+	placeholders := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			return err
+		}
+		args = append(args, uuid)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+
+	command := `DELETE FROM user_svc.shared_documents
+				WHERE duid = $1 AND uuid IN (` + strings.Join(placeholders, ", ") + `)
+				`
+
+	_, err := t.exec.ExecContext(t.ctx, command, args...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getOwnedDocuments retrieves every document owned by uuid from user_svc.documents,
+// along with every uuid each document is shared with.
+// Returns a map keyed by duid, empty if uuid owns no documents, else any db error.
+func (t *postgresTx) getOwnedDocuments(uuid string) (map[string]*pblib.UserDocumentMetadata, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT user_svc.documents.duid, user_svc.documents.is_public, user_svc.shared_documents.uuid
+				FROM user_svc.documents
+				LEFT JOIN user_svc.shared_documents
+				ON user_svc.documents.duid = user_svc.shared_documents.duid
+				WHERE user_svc.documents.uuid = $1
+				`
+
+	row, err := t.exec.QueryContext(t.ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	documents := make(map[string]*pblib.UserDocumentMetadata)
+	for row.Next() {
+		var duid string
+		var isPublic bool
+		var sharedUUIDNullable sql.NullString
+
+		if err := row.Scan(&duid, &isPublic, &sharedUUIDNullable); err != nil {
+			return nil, err
+		}
+
+		document, ok := documents[duid]
+		if !ok {
+			document = &pblib.UserDocumentMetadata{
+				IsPublic:   isPublic,
+				SharedWith: make(map[string]bool),
+			}
+			documents[duid] = document
+		}
+
+		// documents that are not shared have a NULL uuid from the left join
+		if sharedUUIDNullable.Valid {
+			document.SharedWith[sharedUUIDNullable.String] = true
+		}
+	}
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	return documents, nil
+}
+
+// getDocumentsSharedToUUID retrieves every document shared to uuid from user_svc.shared_documents.
+// Returns a map keyed by the owner's uuid, empty if nothing is shared to uuid, else any db error.
+func (t *postgresTx) getDocumentsSharedToUUID(uuid string) (map[string]*pblib.UserFriendMetadata, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT user_svc.documents.uuid, user_svc.documents.duid
+				FROM user_svc.shared_documents
+				INNER JOIN user_svc.documents
+				ON user_svc.shared_documents.duid = user_svc.documents.duid
+				WHERE user_svc.shared_documents.uuid = $1
+				`
+
+	row, err := t.exec.QueryContext(t.ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+
+	sharedToMe := make(map[string]*pblib.UserFriendMetadata)
+	for row.Next() {
+		var ownerUUID, duid string
+		if err := row.Scan(&ownerUUID, &duid); err != nil {
+			return nil, err
+		}
+
+		friend, ok := sharedToMe[ownerUUID]
+		if !ok {
+			friend = &pblib.UserFriendMetadata{SharedDuidToMe: make(map[string]bool)}
+			sharedToMe[ownerUUID] = friend
+		}
+		friend.SharedDuidToMe[duid] = true
+	}
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	return sharedToMe, nil
+}
+
+// updateDocumentIsPublic sets is_public of duid in user_svc.documents.
+// Returns document not found error if duid does not exist, else any db error.
+func (t *postgresTx) updateDocumentIsPublic(duid string, isPublic bool) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	command := `UPDATE user_svc.documents SET is_public = $2 WHERE duid = $1`
+
+	result, err := t.exec.ExecContext(t.ctx, command, duid, isPublic)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrDocumentNotFound
+	}
+
+	return nil
+}
+
+// resetPasswordRow replaces the hashed password of uuid in user_svc.accounts and revokes every
+// auth token and refresh token of uuid.
+// Returns error if uuid is invalid, uuid does not exist, or any db error.
+func (t *postgresTx) resetPasswordRow(uuid string, hashedPassword string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if hashedPassword == "" {
+		return consts.ErrInvalidPassword
+	}
+
+	command := `UPDATE user_svc.accounts SET password = $2, modified_timestamp = $3
+				WHERE user_svc.accounts.uuid = $1
+				`
+	result, err := t.exec.ExecContext(t.ctx, command, uuid, hashedPassword, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return consts.ErrUUIDNotFound
+	}
+
+	return t.revokeAuthTokens(uuid)
+}
@@ -1,39 +1,91 @@
 package service
 
 import (
+	"errors"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"testing"
 	"time"
 )
 
-func TestRefreshDBConnection(t *testing.T) {
-	assert.NotNil(t, postgresDB)
+func TestPostgresStorePing(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	assert.NotNil(t, defaultStore.db)
 
 	//verify connection on supposedly opened connection
-	err := refreshDBConnection()
+	err := defaultStore.Ping(context.TODO())
 	assert.Nil(t, err)
-	assert.NotNil(t, postgresDB)
+	assert.NotNil(t, defaultStore.db)
 
 	// close connection
-	err = postgresDB.Close()
+	err = defaultStore.db.Close()
 	assert.Nil(t, err)
 
 	// test on closed connection
-	err = refreshDBConnection()
+	err = defaultStore.Ping(context.TODO())
 	assert.NotNil(t, err)
-	assert.Nil(t, postgresDB)
+	assert.Nil(t, defaultStore.db)
 
 	//verify initializing
-	err = refreshDBConnection()
+	err = defaultStore.Ping(context.TODO())
+	assert.Nil(t, err)
+}
+
+func TestPostgresStoreWithTx(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user := unitTestUserGenerator("PostgresStoreWithTx-One")
+	user.Uuid, _ = generateUUID()
+	errRollback := errors.New("rollback")
+
+	// rolled back insert is not visible
+	err := defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertNewUser(user); err != nil {
+			return err
+		}
+		_, err := tx.getUserRow(user.GetUuid())
+		assert.Nil(t, err)
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+
+	_, err = unitTestTx().getUserRow(user.GetUuid())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error())
+
+	// committed insert is visible
+	err = defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewUser(user)
+	})
+	assert.Nil(t, err)
+
+	retrievedUser, err := unitTestTx().getUserRow(user.GetUuid())
+	assert.Nil(t, err)
+	assert.Equal(t, user.GetUuid(), retrievedUser.GetUuid())
+
+	// cancelled context does not begin a transaction
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err = defaultStore.WithTx(ctx, func(tx UserTx) error {
+		return tx.deleteUserRow(user.GetUuid())
+	})
+	assert.NotNil(t, err)
+
+	_, err = unitTestTx().getUserRow(user.GetUuid())
 	assert.Nil(t, err)
 }
 
 func TestInsertNewUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// valid user
 	uuid1, _ := generateUUID()
 	uuid2, _ := generateUUID()
@@ -113,7 +165,7 @@ func TestInsertNewUser(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := insertNewUser(c.user)
+		err := unitTestTx().insertNewUser(c.user)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 		} else {
@@ -123,13 +175,15 @@ func TestInsertNewUser(t *testing.T) {
 }
 
 func TestInsertEmailToken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	user1, err := unitTestInsertUser("InsertEmailToken-One")
 	assert.Nil(t, err)
 	user2, err := unitTestInsertUser("InsertEmailToken-Two")
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(user1.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user2.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(user2.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	validID1, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -137,62 +191,77 @@ func TestInsertEmailToken(t *testing.T) {
 	assert.NotNil(t, validID1)
 
 	desc := "empty uuid"
-	err = insertEmailToken("", validID1.GetToken(), validID1.GetSecret())
+	err = unitTestTx().insertEmailToken("", validID1.GetToken(), validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
 
 	desc = "invalid uuid format"
-	err = insertEmailToken("1234", validID1.GetToken(), validID1.GetSecret())
+	err = unitTestTx().insertEmailToken("1234", validID1.GetToken(), validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
 
 	desc = "empty token"
-	err = insertEmailToken(user1.GetUser().GetUuid(), "", validID1.GetSecret())
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), "", validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
 
 	desc = "valid uuid and valid token"
-	err = insertEmailToken(user1.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err, desc)
 
 	desc = "test duplicate uuid in user_svc.email_tokens table"
-	err = insertEmailToken(user1.GetUser().GetUuid(), "some token", validID1.GetSecret())
-	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"email_tokens_uuid_key\"", desc)
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), "some token", validID1.GetSecret(), emailTokenPurposeVerifyEmail)
+	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"email_tokens_uuid_purpose_key\"", desc)
 
 	desc = "test non-existent uuid"
 	nonExistentUUID, _ := generateUUID()
-	err = insertEmailToken(nonExistentUUID, "some token", validID1.GetSecret())
+	err = unitTestTx().insertEmailToken(nonExistentUUID, "some token", validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, "pq: insert or update on table \"email_tokens\" violates foreign key constraint \"email_tokens_uuid_fkey\"", desc)
 
 	desc = "test duplicate token"
-	err = insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
+	err = unitTestTx().insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"email_tokens_pkey\"", desc)
 
 	desc = "test nil secret"
-	err = insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), nil)
+	err = unitTestTx().insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), nil, emailTokenPurposeVerifyEmail)
 	assert.EqualError(t, err, authconst.ErrNilSecret.Error(), desc)
 
+	desc = "test invalid purpose"
+	err = unitTestTx().insertEmailToken(user2.GetUser().GetUuid(), "some token", validID1.GetSecret(), "")
+	assert.EqualError(t, err, consts.ErrInvalidEmailTokenPurpose.Error(), desc)
+
+	desc = "test same uuid with a different purpose"
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), "some token", validID1.GetSecret(), emailTokenPurposeResetPassword)
+	assert.Nil(t, err, desc)
+	retrievedRow, err := unitTestTx().getEmailTokenRow("some token")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, emailTokenPurposeResetPassword, retrievedRow.purpose, desc)
+
 }
 
 func TestDeleteUserRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	response, err := unitTestInsertUser("DeleteUserRow-One")
 	assert.Nil(t, err)
 
-	err = deleteUserRow("")
+	err = unitTestTx().deleteUserRow("")
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error())
 
-	err = deleteUserRow("1234")
+	err = unitTestTx().deleteUserRow("1234")
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error())
 
-	err = deleteUserRow(response.GetUser().GetUuid())
+	err = unitTestTx().deleteUserRow(response.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	// non existent (db does not throw an error)
-	err = deleteUserRow(response.GetUser().GetUuid())
+	err = unitTestTx().deleteUserRow(response.GetUser().GetUuid())
 	assert.Nil(t, err)
 }
 
 func TestGetUserRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// non existent uuid
 	nonExistentUUID, _ := generateUUID()
-	retrievedUser, err := getUserRow(nonExistentUUID)
+	retrievedUser, err := unitTestTx().getUserRow(nonExistentUUID)
 	assert.EqualError(t, err, consts.ErrUserNotFound.Error())
 	assert.Nil(t, retrievedUser)
 
@@ -200,7 +269,7 @@ func TestGetUserRow(t *testing.T) {
 	response, err := unitTestInsertUser("GetUserRow-One")
 	assert.Nil(t, err)
 
-	retrievedUser, err = getUserRow(response.GetUser().GetUuid())
+	retrievedUser, err = unitTestTx().getUserRow(response.GetUser().GetUuid())
 	assert.Nil(t, err)
 	assert.Equal(t, response.GetUser().GetUuid(), retrievedUser.GetUuid())
 	assert.Equal(t, response.GetUser().GetFirstName(), retrievedUser.GetFirstName())
@@ -210,6 +279,8 @@ func TestGetUserRow(t *testing.T) {
 }
 
 func TestUpdateUserRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// insert some new users
 	response1, err := unitTestInsertUser("UpdateUserRow-One")
 	assert.Nil(t, err)
@@ -219,7 +290,7 @@ func TestUpdateUserRow(t *testing.T) {
 	response2, err := unitTestInsertUser("UpdateUserRow-Two")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response2.GetMessage())
-	err = deleteEmailTokenRow(response2.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(response2.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 	response2.GetUser().IsVerified = true
 
@@ -276,7 +347,7 @@ func TestUpdateUserRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		updatedUser, err := updateUserRow(c.uuid, c.svcDerived, c.dbDerived)
+		updatedUser, _, err := unitTestTx().updateUserRow(c.uuid, c.svcDerived, c.dbDerived)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
 			assert.Nil(t, updatedUser)
@@ -290,19 +361,21 @@ func TestUpdateUserRow(t *testing.T) {
 }
 
 func TestGetActiveSecretRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	// test empty row
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error())
 	assert.Nil(t, retrievedSecret)
 
 	// insert a key to test for active key retrieval
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 
-	retrievedSecret, err = getActiveSecretRow()
+	retrievedSecret, err = unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 	assert.NotEmpty(t, retrievedSecret.Key)
@@ -311,43 +384,161 @@ func TestGetActiveSecretRow(t *testing.T) {
 }
 
 func TestInsertNewSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 
 	// test that key was inserted
-	secretKey, err := getLatestSecret(2)
+	secretKey, err := unitTestTx().getLatestSecret(2)
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 }
 
+func TestSigningKeyRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	err := unitTestDeleteAuthSecretTable()
+	assert.Nil(t, err)
+	defer func() { conf.TokenSigning.Algorithm = signingAlgorithmHMAC }()
+
+	// HMAC secrets have no key pair to list
+	err = unitTestTx().insertNewAuthSecret()
+	assert.Nil(t, err)
+	hmacSecret, err := unitTestTx().getActiveSecretRow()
+	assert.Nil(t, err)
+
+	row, err := unitTestTx().getSigningKeyRow(hmacSecret.GetKey())
+	assert.Nil(t, err)
+	assert.Equal(t, signingAlgorithmHMAC, row.algorithm)
+	assert.Nil(t, row.publicKey)
+	assert.Nil(t, row.privateKey)
+
+	keys, err := unitTestTx().listSigningKeys()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	var kids []string
+	for _, algorithm := range []string{signingAlgorithmRS256, signingAlgorithmEdDSA} {
+		conf.TokenSigning.Algorithm = algorithm
+		err = unitTestTx().insertNewAuthSecret()
+		assert.Nil(t, err, algorithm)
+
+		secret, err := unitTestTx().getActiveSecretRow()
+		assert.Nil(t, err, algorithm)
+		kids = append([]string{secret.GetKey()}, kids...)
+
+		row, err := unitTestTx().getSigningKeyRow(secret.GetKey())
+		assert.Nil(t, err, algorithm)
+		assert.Equal(t, algorithm, row.algorithm)
+
+		key, err := parseSigningKeyRow(row)
+		assert.Nil(t, err, algorithm)
+		assert.NotNil(t, key.privateKey, algorithm)
+	}
+
+	// the active key first, without private keys
+	keys, err = unitTestTx().listSigningKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, kids[i], key.key)
+		assert.Nil(t, key.privateKey)
+	}
+
+	_, err = unitTestTx().getSigningKeyRow("unknown")
+	assert.Equal(t, consts.ErrSigningKeyNotFound, err)
+}
+
+func TestStaleDataKeys(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	err := unitTestDeleteAuthSecretTable()
+	assert.Nil(t, err)
+	defer unitTestRestoreMasterKeys()()
+	defer func() { assert.Nil(t, unitTestDeleteAuthSecretTable()) }()
+
+	err = unitTestTx().insertNewAuthSecret()
+	assert.Nil(t, err)
+	secret, err := unitTestTx().getActiveSecretRow()
+	assert.Nil(t, err)
+	secretHash := hashToken(secret.GetKey())
+
+	_, err = unitTestTx().listStaleDataKeys(masterKeyID, 0)
+	assert.Equal(t, consts.ErrInvalidBatchSize, err)
+
+	// rotate the master key, the secret stays readable with the previous master key
+	previousKeys := masterKeys
+	assert.Nil(t, setMasterKeys(unitTestNewMasterKey()))
+	for id, aead := range previousKeys {
+		masterKeys[id] = aead
+	}
+
+	rows, err := unitTestTx().listStaleDataKeys(masterKeyID, reEncryptBatchSize)
+	assert.Nil(t, err)
+	var row *dataKeyRow
+	for _, stale := range rows {
+		assert.NotEqual(t, masterKeyID, stale.masterKeyID)
+		if stale.table == dataKeyTableSecrets && stale.key == secretHash {
+			row = stale
+		}
+	}
+	assert.NotNil(t, row)
+	if row == nil {
+		return
+	}
+
+	assert.Nil(t, rewrapDataKey(row))
+	assert.Nil(t, unitTestTx().updateDataKey(row))
+	assert.Equal(t, consts.ErrUnknownDataKeyTable, unitTestTx().updateDataKey(&dataKeyRow{table: "unknown"}))
+
+	rows, err = unitTestTx().listStaleDataKeys(masterKeyID, reEncryptBatchSize)
+	assert.Nil(t, err)
+	for _, stale := range rows {
+		assert.NotEqual(t, secretHash, stale.key)
+	}
+
+	// the re-sealed secret no longer needs the previous master key
+	for id := range previousKeys {
+		delete(masterKeys, id)
+	}
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
+	assert.Nil(t, err)
+	assert.Equal(t, secret.GetKey(), retrievedSecret.GetKey())
+}
+
 func TestGetLatestSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 
-	secretKey, err := getLatestSecret(2)
+	secretKey, err := unitTestTx().getLatestSecret(2)
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 
-	secretKey, err = getLatestSecret(0)
+	secretKey, err = unitTestTx().getLatestSecret(0)
 	assert.EqualError(t, err, consts.ErrInvalidAddTime.Error())
 	assert.Empty(t, secretKey)
 
 }
 
 func TestInsertAuthToken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	token := "someToken"
 
 	// retrieve freshly active secret
@@ -427,7 +618,7 @@ func TestInsertAuthToken(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := insertAuthToken(c.token, c.header, c.body, c.secret)
+		err := unitTestTx().insertAuthToken(c.token, c.header, c.body, c.secret)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
@@ -438,6 +629,8 @@ func TestInsertAuthToken(t *testing.T) {
 }
 
 func TestGetAuthTokenRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	retrievedSecret, err := unitTestDeleteInsertGetAuthSecret()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
@@ -458,7 +651,7 @@ func TestGetAuthTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		retrievedToken, err := getAuthTokenRow(c.uuid)
+		retrievedToken, err := unitTestTx().getAuthTokenRow(c.uuid)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -473,13 +666,13 @@ func TestGetAuthTokenRow(t *testing.T) {
 	validNoUUIDAuthTokenBody.UUID = validUUID
 	// the above happens so fast that validating secret creation time fails b/c time == now()
 	time.Sleep(2 * time.Second)
-	err = insertAuthToken("TestRetrieveExistingToken", validAuthTokenHeader, validNoUUIDAuthTokenBody, retrievedSecret)
+	err = unitTestTx().insertAuthToken("TestRetrieveExistingToken", validAuthTokenHeader, validNoUUIDAuthTokenBody, retrievedSecret)
 	assert.Nil(t, err)
 
-	retrievedToken, err := getAuthTokenRow(validUUID)
+	retrievedToken, err := unitTestTx().getAuthTokenRow(validUUID)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, retrievedToken.uuid)
-	assert.NotEmpty(t, retrievedToken.token)
+	assert.Equal(t, hashToken("TestRetrieveExistingToken"), retrievedToken.tokenHash)
 	assert.NotEmpty(t, retrievedToken.permission)
 	assert.NotEmpty(t, retrievedToken.secret.Key)
 	assert.NotEmpty(t, retrievedToken.secret.ExpirationTimestamp)
@@ -487,13 +680,15 @@ func TestGetAuthTokenRow(t *testing.T) {
 }
 
 func TestPairTokenWithSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	desc := "test empty token"
-	retrievedSecret, err := pairTokenWithSecret("")
+	retrievedSecret, err := unitTestTx().pairTokenWithSecret("")
 	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
 	assert.Nil(t, retrievedSecret, desc)
 
 	desc = "test non-existing token"
-	retrievedSecret, err = pairTokenWithSecret("non-existing-token")
+	retrievedSecret, err = unitTestTx().pairTokenWithSecret("non-existing-token")
 	assert.EqualError(t, err, consts.ErrNoMatchingAuthTokenFound.Error(), desc)
 	assert.Nil(t, retrievedSecret, desc)
 
@@ -503,7 +698,7 @@ func TestPairTokenWithSecret(t *testing.T) {
 	assert.NotEmpty(t, newToken)
 
 	desc = "test against existing token"
-	retrievedSecret, err = pairTokenWithSecret(newToken)
+	retrievedSecret, err = unitTestTx().pairTokenWithSecret(newToken)
 	assert.Nil(t, err, desc)
 	assert.NotEmpty(t, retrievedSecret, desc)
 	assert.Equal(t, newSecret.Key, retrievedSecret.GetSecret().GetKey(), desc)
@@ -512,50 +707,56 @@ func TestPairTokenWithSecret(t *testing.T) {
 }
 
 func TestHasActiveSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	desc := "test with no active secret in table"
-	exists, err := hasActiveAuthSecret()
+	exists, err := unitTestTx().hasActiveAuthSecret()
 	assert.Nil(t, err, desc)
 	assert.Equal(t, false, exists, desc)
 
 	desc = "test with an active secret in table"
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
-	exists, err = hasActiveAuthSecret()
+	exists, err = unitTestTx().hasActiveAuthSecret()
 	assert.Nil(t, err, desc)
 	assert.Equal(t, true, exists, desc)
 }
 
 func TestActiveSecretTrigger(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
 
-	exists, err := hasActiveAuthSecret()
+	exists, err := unitTestTx().hasActiveAuthSecret()
 	assert.Nil(t, err)
 	assert.Equal(t, true, exists)
 
-	secretKey, err := getLatestSecret(5)
+	secretKey, err := unitTestTx().getLatestSecret(5)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, secretKey)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 }
 
 func TestIsEmailTaken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create a user to test with
 	user1, err := unitTestInsertUser("IsEmailTaken-One")
 	assert.Nil(t, err)
@@ -568,7 +769,7 @@ func TestIsEmailTaken(t *testing.T) {
 		Uuid:  user1.GetUser().GetUuid(),
 	}
 	// update user1's email
-	updatedUser, err := updateUserRow(user1.GetUser().GetUuid(), svcDerived, user1.GetUser())
+	updatedUser, _, err := unitTestTx().updateUserRow(user1.GetUser().GetUuid(), svcDerived, user1.GetUser())
 	assert.Nil(t, err)
 	assert.NotNil(t, updatedUser)
 
@@ -587,7 +788,7 @@ func TestIsEmailTaken(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		emailTaken, err := isEmailTaken(c.email)
+		emailTaken, err := unitTestTx().isEmailTaken(c.email)
 		if c.isExpErr {
 			assert.EqualError(t, err, consts.ErrInvalidUserEmail.Error(), c.desc)
 			assert.Equal(t, false, emailTaken, c.desc)
@@ -603,12 +804,14 @@ func TestIsEmailTaken(t *testing.T) {
 }
 
 func TestGetEmailTokenRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create a user to insert a token to its uuid
 	user1, err := unitTestInsertUser("GetExistingEmailToken-One")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), user1.GetMessage())
 
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(user1.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	emailID, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -616,7 +819,7 @@ func TestGetEmailTokenRow(t *testing.T) {
 	assert.NotNil(t, emailID)
 
 	// insert token
-	err = insertEmailToken(user1.GetUser().GetUuid(), emailID.GetToken(), emailID.GetSecret())
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), emailID.GetToken(), emailID.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	cases := []struct {
@@ -631,7 +834,7 @@ func TestGetEmailTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		retrievedRow, err := getEmailTokenRow(c.token)
+		retrievedRow, err := unitTestTx().getEmailTokenRow(c.token)
 
 		if c.isExpErr {
 			assert.Nil(t, retrievedRow, c.desc)
@@ -644,6 +847,8 @@ func TestGetEmailTokenRow(t *testing.T) {
 }
 
 func TestDeleteEmailTokenRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create a user to insert a token
 	user1, err := unitTestInsertUser("DeleteEmailTokenRow-One")
 	assert.Nil(t, err)
@@ -665,7 +870,7 @@ func TestDeleteEmailTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := deleteEmailTokenRow(c.uuid)
+		err := unitTestTx().deleteEmailTokenRow(c.uuid, emailTokenPurposeVerifyEmail)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -675,10 +880,52 @@ func TestDeleteEmailTokenRow(t *testing.T) {
 	}
 }
 
+func TestResetPasswordRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, identification, err := unitTestInsertVerifiedUser("ResetPasswordRow-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+	nonExistentUUID, _ := generateUUID()
+
+	hashedPassword, err := hashPassword("ResetPasswordRow-NewPassword")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc           string
+		uuid           string
+		hashedPassword string
+		isExpErr       bool
+		expMsg         string
+	}{
+		{"test invalid uuid", "1234", hashedPassword, true, authconst.ErrInvalidUUID.Error()},
+		{"test empty password", uuid, "", true, consts.ErrInvalidPassword.Error()},
+		{"test non-existent uuid", nonExistentUUID, hashedPassword, true, consts.ErrUUIDNotFound.Error()},
+		{"test valid reset", uuid, hashedPassword, false, ""},
+	}
+
+	for _, c := range cases {
+		err := unitTestTx().resetPasswordRow(c.uuid, c.hashedPassword)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			retrievedUser, err := unitTestTx().getUserRow(c.uuid)
+			assert.Nil(t, err, c.desc)
+			assert.Nil(t, comparePassword(retrievedUser.GetPassword(), "ResetPasswordRow-NewPassword"), c.desc)
+
+			_, err = unitTestTx().pairTokenWithSecret(identification.GetToken())
+			assert.NotNil(t, err, c.desc)
+		}
+	}
+}
+
 func TestMatchEmailAndPassword(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create a user
-	user1Password := "TestMatchEmailAndPassword-One"
-	user1, err := unitTestInsertUser(user1Password)
+	user1Password := unitTestPassword("TestMatchEmailAndPassword-One")
+	user1, err := unitTestInsertUser("TestMatchEmailAndPassword-One")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), user1.GetMessage())
 	u1 := user1.GetUser()
@@ -708,7 +955,7 @@ func TestMatchEmailAndPassword(t *testing.T) {
 		},
 		{
 			"test existing email but non-existent password", u1.GetEmail(), unitTestFailValue,
-			true, "crypto/bcrypt: hashedPassword is not the hash of the given password",
+			true, consts.ErrPasswordMismatch.Error(),
 		},
 		{
 			"valid, test existing email and matching password", u1.GetEmail(), user1Password,
@@ -717,7 +964,7 @@ func TestMatchEmailAndPassword(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		retrievedUser, err := matchEmailAndPassword(c.email, c.password)
+		retrievedUser, err := unitTestTx().matchEmailAndPassword(c.email, c.password)
 		if c.isExpErr {
 			assert.Nil(t, retrievedUser, c.desc)
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -728,9 +975,28 @@ func TestMatchEmailAndPassword(t *testing.T) {
 		}
 	}
 
+	// test legacy bcrypt hash is replaced on login
+	legacyHash, err := (&bcryptHasher{cost: bcrypt.MinCost}).hash(user1Password)
+	assert.Nil(t, err)
+	_, err = defaultStore.db.Exec("UPDATE user_svc.accounts SET password = $2 WHERE uuid = $1", u1.GetUuid(), legacyHash)
+	assert.Nil(t, err)
+
+	retrievedUser, err := unitTestTx().matchEmailAndPassword(u1.GetEmail(), user1Password)
+	assert.Nil(t, err)
+	assert.NotEqual(t, legacyHash, retrievedUser.GetPassword())
+	assert.False(t, needsPasswordRehash(retrievedUser.GetPassword()))
+
+	var storedHash string
+	err = defaultStore.db.QueryRow("SELECT password FROM user_svc.accounts WHERE uuid = $1", u1.GetUuid()).
+		Scan(&storedHash)
+	assert.Nil(t, err)
+	assert.Equal(t, retrievedUser.GetPassword(), storedHash)
+	assert.Nil(t, comparePassword(storedHash, user1Password))
 }
 
 func TestUpdatePermissionLevel(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create a test user
 	user1, err := unitTestInsertUser("TestUpdatePermissionLevel")
 	assert.Nil(t, err)
@@ -775,16 +1041,819 @@ func TestUpdatePermissionLevel(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := updatePermissionLevel(c.uuid, c.permLevel)
+		err := unitTestTx().updatePermissionLevel(c.uuid, c.permLevel)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 		} else {
 			assert.Nil(t, err, c.desc)
 
-			retrievedUser, err := getUserRow(c.uuid)
+			retrievedUser, err := unitTestTx().getUserRow(c.uuid)
 			if err == nil {
 				assert.Equal(t, c.permLevel, retrievedUser.GetPermissionLevel())
 			}
 		}
 	}
 }
+
+func TestListUserRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	organization := "ListUserRows Org"
+	var insertedUUIDs []string
+	for _, lastName := range []string{"ListUserRows-One", "ListUserRows-Two", "ListUserRows-Three"} {
+		user := unitTestUserGenerator(lastName)
+		user.Organization = organization
+		s := Service{}
+		response, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+		assert.Nil(t, err)
+		insertedUUIDs = append(insertedUUIDs, response.GetUser().GetUuid())
+	}
+	err := unitTestTx().updatePermissionLevel(insertedUUIDs[1], auth.PermissionStringMap[auth.User])
+	assert.Nil(t, err)
+
+	notVerified := false
+
+	cases := []struct {
+		desc     string
+		query    *listUsersQuery
+		isExpErr bool
+		expMsg   string
+		expUUIDs []string
+	}{
+		{"test nil query", nil, true, consts.ErrInvalidListUsersFilter.Error(), nil},
+		{"test invalid sort column",
+			&listUsersQuery{organization: organization, sortBy: "password", pageSize: 10},
+			true, consts.ErrInvalidListUsersSortBy.Error(), nil,
+		},
+		{"test invalid page size",
+			&listUsersQuery{organization: organization, sortBy: listUsersSortByUUID, pageSize: 0},
+			true, consts.ErrInvalidListUsersPageSize.Error(), nil,
+		},
+		{"test invalid permission level",
+			&listUsersQuery{permissionLevel: "GUEST", sortBy: listUsersSortByUUID, pageSize: 10},
+			true, authconst.ErrInvalidPermission.Error(), nil,
+		},
+		{"test mismatching cursor",
+			&listUsersQuery{organization: organization, sortBy: listUsersSortByUUID, pageSize: 10,
+				cursor: &listUsersCursor{SortBy: listUsersSortByOrganization, UUID: insertedUUIDs[0]}},
+			true, consts.ErrInvalidListUsersCursor.Error(), nil,
+		},
+		{"test filter by organization",
+			&listUsersQuery{organization: organization, sortBy: listUsersSortByUUID, pageSize: 10},
+			false, "", insertedUUIDs,
+		},
+		{"test filter by organization descending",
+			&listUsersQuery{organization: organization, sortBy: listUsersSortByUUID, descending: true, pageSize: 10},
+			false, "", []string{insertedUUIDs[2], insertedUUIDs[1], insertedUUIDs[0]},
+		},
+		{"test filter by permission level",
+			&listUsersQuery{organization: organization, permissionLevel: auth.PermissionStringMap[auth.User],
+				sortBy: listUsersSortByCreatedTimestamp, pageSize: 10},
+			false, "", []string{insertedUUIDs[1]},
+		},
+		{"test filter by is verified",
+			&listUsersQuery{organization: organization, isVerified: &notVerified,
+				sortBy: listUsersSortByPermissionLevel, pageSize: 10},
+			false, "", []string{insertedUUIDs[0], insertedUUIDs[2], insertedUUIDs[1]},
+		},
+		{"test filter by created timestamp in the future",
+			&listUsersQuery{organization: organization, createdAfter: time.Now().Add(time.Hour).Unix(),
+				sortBy: listUsersSortByUUID, pageSize: 10},
+			false, "", nil,
+		},
+	}
+
+	for _, c := range cases {
+		users, nextCursor, err := unitTestTx().listUserRows(c.query)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, users, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Nil(t, nextCursor, c.desc)
+			var retrievedUUIDs []string
+			for _, user := range users {
+				retrievedUUIDs = append(retrievedUUIDs, user.GetUuid())
+			}
+			assert.Equal(t, c.expUUIDs, retrievedUUIDs, c.desc)
+		}
+	}
+
+	// page through every sortable column one row at a time
+	for sortBy := range listUsersSortColumns {
+		desc := "test paging sorted by " + sortBy
+		query := &listUsersQuery{organization: organization, sortBy: sortBy, pageSize: 1}
+		var pagedUUIDs []string
+		for {
+			users, nextCursor, err := unitTestTx().listUserRows(query)
+			assert.Nil(t, err, desc)
+			assert.Len(t, users, 1, desc)
+			pagedUUIDs = append(pagedUUIDs, users[0].GetUuid())
+			if nextCursor == nil {
+				break
+			}
+			query.cursor = nextCursor
+		}
+		assert.ElementsMatch(t, insertedUUIDs, pagedUUIDs, desc)
+	}
+}
+
+func TestGetDocumentRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, err := unitTestInsertUser("GetDocumentRow-One")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, user.GetUser().GetUuid(), true)
+	assert.Nil(t, err)
+
+	desc := "test invalid duid"
+	document, err := unitTestTx().getDocumentRow("1234")
+	assert.EqualError(t, err, consts.ErrInvalidDUID.Error(), desc)
+	assert.Nil(t, document, desc)
+
+	desc = "test non-existent duid"
+	document, err = unitTestTx().getDocumentRow(unitTestDUIDGenerator())
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+	assert.Nil(t, document, desc)
+
+	desc = "test existing duid"
+	document, err = unitTestTx().getDocumentRow(duid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, duid, document.duid, desc)
+	assert.Equal(t, user.GetUser().GetUuid(), document.uuid, desc)
+	assert.Equal(t, true, document.isPublic, desc)
+
+	desc = "test duplicate duid"
+	err = unitTestTx().insertDocumentRow(duid, user.GetUser().GetUuid(), false)
+	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"documents_pkey\"", desc)
+}
+
+func TestInsertSharedDocumentRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, err := unitTestInsertUser("InsertSharedDocumentRows-Owner")
+	assert.Nil(t, err)
+	friend1, err := unitTestInsertUser("InsertSharedDocumentRows-One")
+	assert.Nil(t, err)
+	friend2, err := unitTestInsertUser("InsertSharedDocumentRows-Two")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUser().GetUuid(), false)
+	assert.Nil(t, err)
+
+	nonExistentUUID, _ := generateUUID()
+	friendUUIDs := []string{friend1.GetUser().GetUuid(), friend2.GetUser().GetUuid()}
+
+	cases := []struct {
+		desc     string
+		duid     string
+		uuids    []string
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test invalid duid", "1234", friendUUIDs, true, consts.ErrInvalidDUID.Error()},
+		{"test no uuids", duid, nil, true, consts.ErrNoShareRecipients.Error()},
+		{"test invalid uuid", duid, []string{"1234"}, true, authconst.ErrInvalidUUID.Error()},
+		{"test non-existent uuid", duid, []string{nonExistentUUID}, true,
+			"pq: insert or update on table \"shared_documents\" violates foreign key constraint \"shared_documents_uuid_fkey\""},
+		{"test non-existent duid", unitTestDUIDGenerator(), friendUUIDs, true,
+			"pq: insert or update on table \"shared_documents\" violates foreign key constraint \"shared_documents_duid_fkey\""},
+		{"test valid uuids", duid, friendUUIDs, false, ""},
+		{"test idempotent", duid, friendUUIDs[:1], false, ""},
+	}
+
+	for _, c := range cases {
+		err := unitTestTx().insertSharedDocumentRows(c.duid, c.uuids)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			sharedUUIDs, err := unitTestTx().getSharedDocumentUUIDs(c.duid)
+			assert.Nil(t, err, c.desc)
+			assert.ElementsMatch(t, friendUUIDs, sharedUUIDs, c.desc)
+		}
+	}
+
+	desc := "test shares are removed with the user"
+	err = unitTestTx().deleteUserRow(friend1.GetUser().GetUuid())
+	assert.Nil(t, err, desc)
+	sharedUUIDs, err := unitTestTx().getSharedDocumentUUIDs(duid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{friend2.GetUser().GetUuid()}, sharedUUIDs, desc)
+}
+
+func TestDeleteSharedDocumentRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, err := unitTestInsertUser("DeleteSharedDocumentRows-Owner")
+	assert.Nil(t, err)
+	friend1, err := unitTestInsertUser("DeleteSharedDocumentRows-One")
+	assert.Nil(t, err)
+	friend2, err := unitTestInsertUser("DeleteSharedDocumentRows-Two")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUser().GetUuid(), false)
+	assert.Nil(t, err)
+	err = unitTestTx().insertSharedDocumentRows(duid, []string{friend1.GetUser().GetUuid(), friend2.GetUser().GetUuid()})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		duid     string
+		uuids    []string
+		isExpErr bool
+		expMsg   string
+		expUUIDs []string
+	}{
+		{"test invalid duid", "1234", []string{friend1.GetUser().GetUuid()}, true, consts.ErrInvalidDUID.Error(), nil},
+		{"test no uuids", duid, nil, true, consts.ErrNoShareRecipients.Error(), nil},
+		{"test invalid uuid", duid, []string{"1234"}, true, authconst.ErrInvalidUUID.Error(), nil},
+		{"test valid uuid", duid, []string{friend1.GetUser().GetUuid()}, false, "",
+			[]string{friend2.GetUser().GetUuid()},
+		},
+		{"test idempotent", duid, []string{friend1.GetUser().GetUuid()}, false, "",
+			[]string{friend2.GetUser().GetUuid()},
+		},
+	}
+
+	for _, c := range cases {
+		err := unitTestTx().deleteSharedDocumentRows(c.duid, c.uuids)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			sharedUUIDs, err := unitTestTx().getSharedDocumentUUIDs(c.duid)
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expUUIDs, sharedUUIDs, c.desc)
+		}
+	}
+}
+
+func TestGetOwnedAndSharedDocuments(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, err := unitTestInsertUser("GetOwnedAndSharedDocuments-Owner")
+	assert.Nil(t, err)
+	friend, err := unitTestInsertUser("GetOwnedAndSharedDocuments-One")
+	assert.Nil(t, err)
+	ownerUUID := owner.GetUser().GetUuid()
+	friendUUID := friend.GetUser().GetUuid()
+
+	sharedDUID := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(sharedDUID, ownerUUID, false)
+	assert.Nil(t, err)
+	privateDUID := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(privateDUID, ownerUUID, true)
+	assert.Nil(t, err)
+	err = unitTestTx().insertSharedDocumentRows(sharedDUID, []string{friendUUID})
+	assert.Nil(t, err)
+
+	desc := "test invalid uuid"
+	documents, err := unitTestTx().getOwnedDocuments("1234")
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
+	assert.Nil(t, documents, desc)
+	sharedToMe, err := unitTestTx().getDocumentsSharedToUUID("1234")
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
+	assert.Nil(t, sharedToMe, desc)
+
+	desc = "test owned documents"
+	documents, err = unitTestTx().getOwnedDocuments(ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, map[string]*pblib.UserDocumentMetadata{
+		sharedDUID:  {IsPublic: false, SharedWith: map[string]bool{friendUUID: true}},
+		privateDUID: {IsPublic: true, SharedWith: map[string]bool{}},
+	}, documents, desc)
+
+	desc = "test no owned documents"
+	documents, err = unitTestTx().getOwnedDocuments(friendUUID)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, documents, desc)
+
+	desc = "test documents shared to uuid"
+	sharedToMe, err = unitTestTx().getDocumentsSharedToUUID(friendUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, map[string]*pblib.UserFriendMetadata{
+		ownerUUID: {SharedDuidToMe: map[string]bool{sharedDUID: true}},
+	}, sharedToMe, desc)
+
+	desc = "test no documents shared to uuid"
+	sharedToMe, err = unitTestTx().getDocumentsSharedToUUID(ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, sharedToMe, desc)
+}
+
+func TestUpdateDocumentIsPublic(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, err := unitTestInsertUser("UpdateDocumentIsPublic-Owner")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUser().GetUuid(), false)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		duid     string
+		isPublic bool
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test invalid duid", "1234", true, true, consts.ErrInvalidDUID.Error()},
+		{"test non-existent duid", unitTestDUIDGenerator(), true, true, consts.ErrDocumentNotFound.Error()},
+		{"test set public", duid, true, false, ""},
+		{"test set private", duid, false, false, ""},
+	}
+
+	for _, c := range cases {
+		err := unitTestTx().updateDocumentIsPublic(c.duid, c.isPublic)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			document, err := unitTestTx().getDocumentRow(c.duid)
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.isPublic, document.isPublic, c.desc)
+		}
+	}
+}
+
+func TestGetUserRowByEmail(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, err := unitTestInsertUser("GetUserRowByEmail-One")
+	assert.Nil(t, err)
+
+	desc := "test invalid email"
+	retrievedUser, err := unitTestTx().getUserRowByEmail("@")
+	assert.EqualError(t, err, consts.ErrInvalidUserEmail.Error(), desc)
+	assert.Nil(t, retrievedUser, desc)
+
+	desc = "test non-existent email"
+	retrievedUser, err = unitTestTx().getUserRowByEmail(unitTestFailEmail)
+	assert.EqualError(t, err, consts.ErrEmailDoesNotExist.Error(), desc)
+	assert.Nil(t, retrievedUser, desc)
+
+	desc = "test existing email"
+	retrievedUser, err = unitTestTx().getUserRowByEmail(user.GetUser().GetEmail())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, user.GetUser().GetUuid(), retrievedUser.GetUuid(), desc)
+}
+
+func TestGetUserRowByProspectiveEmail(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, err := unitTestInsertUser("GetUserRowByProspectiveEmail-One")
+	assert.Nil(t, err)
+
+	prospectiveEmail := unitTestEmailGenerator()
+	_, _, err = unitTestTx().updateUserRow(user.GetUser().GetUuid(), &pblib.User{Email: prospectiveEmail}, user.GetUser())
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		email    string
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test invalid email", "@", true, consts.ErrInvalidUserEmail.Error()},
+		{"test current email", user.GetUser().GetEmail(), true, consts.ErrEmailDoesNotExist.Error()},
+		{"test prospective email", prospectiveEmail, false, ""},
+	}
+
+	for _, c := range cases {
+		retrievedUser, err := unitTestTx().getUserRowByProspectiveEmail(c.email)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, retrievedUser, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, user.GetUser().GetUuid(), retrievedUser.GetUuid(), c.desc)
+		}
+	}
+}
+
+func TestSwapProspectiveEmailRow(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, err := unitTestInsertUser("SwapProspectiveEmailRow-One")
+	assert.Nil(t, err)
+	admin, _, err := unitTestInsertAdmin("SwapProspectiveEmailRow-Admin")
+	assert.Nil(t, err)
+
+	userProspectiveEmail := unitTestEmailGenerator()
+	_, _, err = unitTestTx().updateUserRow(user.GetUser().GetUuid(), &pblib.User{Email: userProspectiveEmail}, user.GetUser())
+	assert.Nil(t, err)
+	adminProspectiveEmail := unitTestEmailGenerator()
+	_, _, err = unitTestTx().updateUserRow(admin.GetUuid(), &pblib.User{Email: adminProspectiveEmail}, admin)
+	assert.Nil(t, err)
+
+	nonExistentUUID, _ := generateUUID()
+
+	cases := []struct {
+		desc          string
+		uuid          string
+		isExpErr      bool
+		expMsg        string
+		expOldEmail   string
+		expEmail      string
+		expPermission string
+	}{
+		{"test invalid uuid", "1234", true, authconst.ErrInvalidUUID.Error(), "", "", ""},
+		{"test non-existent uuid", nonExistentUUID, true, consts.ErrUserNotFound.Error(), "", "", ""},
+		{"test new user", user.GetUser().GetUuid(), false, "", user.GetUser().GetEmail(), userProspectiveEmail,
+			auth.PermissionStringMap[auth.User],
+		},
+		{"test no prospective email", user.GetUser().GetUuid(), true, consts.ErrNoPendingEmailVerification.Error(),
+			"", "", "",
+		},
+		{"test admin keeps permission", admin.GetUuid(), false, "", admin.GetEmail(), adminProspectiveEmail,
+			auth.PermissionStringMap[auth.Admin],
+		},
+	}
+
+	for _, c := range cases {
+		oldEmail, err := unitTestTx().swapProspectiveEmailRow(c.uuid)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Empty(t, oldEmail, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expOldEmail, oldEmail, c.desc)
+
+			retrievedUser, err := unitTestTx().getUserRow(c.uuid)
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expEmail, retrievedUser.GetEmail(), c.desc)
+			assert.Empty(t, retrievedUser.GetProspectiveEmail(), c.desc)
+			assert.True(t, retrievedUser.GetIsVerified(), c.desc)
+			assert.Equal(t, c.expPermission, retrievedUser.GetPermissionLevel(), c.desc)
+		}
+	}
+}
+
+func TestTOTPRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, _, err := unitTestInsertVerifiedUser("TOTPRows-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+
+	row, err := unitTestTx().getTOTPRow(uuid)
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+
+	first, err := encryptTOTPSecret(uuid, []byte("first"))
+	assert.Nil(t, err)
+	second, err := encryptTOTPSecret(uuid, []byte("second"))
+	assert.Nil(t, err)
+
+	err = unitTestTx().insertTOTPSecret("1234", first)
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error())
+	err = unitTestTx().insertTOTPSecret(uuid, nil)
+	assert.Equal(t, consts.ErrInvalidTOTPSecret, err)
+	err = unitTestTx().insertTOTPSecret(uuid, &envelope{ciphertext: []byte("unsealed")})
+	assert.Equal(t, consts.ErrInvalidTOTPSecret, err)
+
+	// an unconfirmed secret is replaced by enrolling again
+	assert.Nil(t, unitTestTx().insertTOTPSecret(uuid, first))
+	assert.Nil(t, unitTestTx().insertTOTPSecret(uuid, second))
+	row, err = unitTestTx().getTOTPRow(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, *second, row.secret)
+	assert.False(t, row.isConfirmed)
+
+	used, err := unitTestTx().useTOTPStep(uuid, 10)
+	assert.Nil(t, err)
+	assert.False(t, used)
+
+	hashes := []string{hashRecoveryCode("aaaaa-aaaaa"), hashRecoveryCode("bbbbb-bbbbb")}
+	assert.Nil(t, unitTestTx().confirmTOTP(uuid, 10, hashes))
+	assert.Equal(t, consts.ErrTOTPNotEnrolled, unitTestTx().confirmTOTP(uuid, 10, hashes))
+	assert.Equal(t, consts.ErrTOTPAlreadyEnrolled, unitTestTx().insertTOTPSecret(uuid, first))
+
+	// steps are used once and in order
+	cases := []struct {
+		desc    string
+		step    int64
+		expUsed bool
+	}{
+		{"test confirmed step", 10, false},
+		{"test next step", 11, true},
+		{"test replayed step", 11, false},
+		{"test older step", 9, false},
+	}
+
+	for _, c := range cases {
+		used, err := unitTestTx().useTOTPStep(uuid, c.step)
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expUsed, used, c.desc)
+	}
+
+	used, err = unitTestTx().useTOTPRecoveryCode(uuid, hashes[0])
+	assert.Nil(t, err)
+	assert.True(t, used)
+	used, err = unitTestTx().useTOTPRecoveryCode(uuid, hashes[0])
+	assert.Nil(t, err)
+	assert.False(t, used)
+
+	assert.Nil(t, unitTestTx().deleteTOTP(uuid))
+	assert.Equal(t, consts.ErrTOTPNotEnrolled, unitTestTx().deleteTOTP(uuid))
+	used, err = unitTestTx().useTOTPRecoveryCode(uuid, hashes[1])
+	assert.Nil(t, err)
+	assert.False(t, used)
+}
+
+func TestRefreshTokenRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, _, err := unitTestInsertVerifiedUser("RefreshTokenRows-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+	expiration := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		desc      string
+		tokenHash string
+		familyID  string
+		uuid      string
+		expMsg    string
+	}{
+		{"test empty hash", "", "family", uuid, consts.ErrInvalidRefreshToken.Error()},
+		{"test empty family", hashToken("RefreshTokenRows-Two"), "", uuid,
+			consts.ErrInvalidRefreshToken.Error()},
+		{"test invalid uuid", hashToken("RefreshTokenRows-Two"), "family", "1234",
+			authconst.ErrInvalidUUID.Error()},
+		{"test valid", hashToken("RefreshTokenRows-One"), "RefreshTokenRows-Family", uuid, ""},
+		{"test same family", hashToken("RefreshTokenRows-Two"), "RefreshTokenRows-Family", uuid, ""},
+	}
+
+	for _, c := range cases {
+		err := unitTestTx().insertRefreshToken(c.tokenHash, c.familyID, c.uuid, expiration)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+
+	row, err := unitTestTx().getRefreshTokenRow(hashToken("RefreshTokenRows-One"))
+	assert.Nil(t, err)
+	assert.Equal(t, uuid, row.uuid)
+	assert.Equal(t, "RefreshTokenRows-Family", row.familyID)
+	assert.Equal(t, expiration.Unix(), row.expirationTimestamp)
+	assert.False(t, row.isUsed)
+
+	row, err = unitTestTx().getRefreshTokenRow(hashToken(unitTestFailValue))
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+
+	// a token is used once
+	used, err := unitTestTx().useRefreshToken(hashToken("RefreshTokenRows-One"))
+	assert.Nil(t, err)
+	assert.True(t, used)
+	used, err = unitTestTx().useRefreshToken(hashToken("RefreshTokenRows-One"))
+	assert.Nil(t, err)
+	assert.False(t, used)
+
+	row, err = unitTestTx().getRefreshTokenRow(hashToken("RefreshTokenRows-One"))
+	assert.Nil(t, err)
+	assert.True(t, row.isUsed)
+
+	assert.Nil(t, unitTestTx().deleteRefreshTokenFamily("RefreshTokenRows-Family"))
+	row, err = unitTestTx().getRefreshTokenRow(hashToken("RefreshTokenRows-Two"))
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+}
+
+func TestRevokeAuthTokens(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, identification, err := unitTestInsertVerifiedUser("RevokeAuthTokens-One")
+	assert.Nil(t, err)
+
+	err = unitTestTx().revokeAuthToken("")
+	assert.Equal(t, authconst.ErrEmptyToken, err)
+	err = unitTestTx().revokeAuthToken(unitTestFailValue)
+	assert.Equal(t, consts.ErrNoMatchingAuthTokenFound, err)
+
+	assert.Nil(t, unitTestTx().revokeAuthToken(identification.GetToken()))
+	assert.Equal(t, consts.ErrNoMatchingAuthTokenFound, unitTestTx().revokeAuthToken(identification.GetToken()))
+	_, err = unitTestTx().pairTokenWithSecret(identification.GetToken())
+	assert.Equal(t, consts.ErrAuthTokenRevoked, err)
+	_, err = unitTestTx().getAuthTokenRow(user.GetUuid())
+	assert.Equal(t, consts.ErrNoAuthTokenFound, err)
+
+	// revoking every token also revokes the refresh tokens
+	identification, err = getAuthIdentification(unitTestTx(), user)
+	assert.Nil(t, err)
+	refreshToken, err := newRefreshToken(unitTestTx(), user.GetUuid(), "")
+	assert.Nil(t, err)
+
+	assert.EqualError(t, unitTestTx().revokeAuthTokens("1234"), authconst.ErrInvalidUUID.Error())
+	assert.Nil(t, unitTestTx().revokeAuthTokens(user.GetUuid()))
+	_, err = unitTestTx().pairTokenWithSecret(identification.GetToken())
+	assert.Equal(t, consts.ErrAuthTokenRevoked, err)
+	row, err := unitTestTx().getRefreshTokenRow(hashToken(refreshToken))
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+}
+
+func TestLockUUID(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+			if err := tx.lockUUID(uuid); err != nil {
+				return err
+			}
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	cases := []struct {
+		desc    string
+		lock    func(tx UserTx) error
+		expWait bool
+	}{
+		{"test exclusive waits", func(tx UserTx) error { return tx.lockUUID(uuid) }, true},
+		{"test shared waits", func(tx UserTx) error { return tx.lockUUIDShared(uuid) }, true},
+		{"test other uuid", func(tx UserTx) error { return tx.lockUUID(uuid + "0") }, false},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		err := defaultStore.WithTx(ctx, c.lock)
+		cancel()
+		assert.Equal(t, c.expWait, err != nil, c.desc)
+	}
+
+	// the lock is released once the transaction ends
+	close(release)
+	assert.Nil(t, <-done)
+	err = defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.lockUUID(uuid)
+	})
+	assert.Nil(t, err)
+}
+
+func TestWatchActiveSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	changes := make(chan struct{}, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- defaultStore.WatchActiveSecret(ctx, func() { changes <- struct{}{} })
+	}()
+
+	// once when watching starts, then once per committed secret
+	select {
+	case <-changes:
+	case <-time.After(10 * time.Second):
+		t.Fatal("test watching starts")
+	}
+
+	err := defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewAuthSecret()
+	})
+	assert.Nil(t, err)
+
+	select {
+	case <-changes:
+	case <-time.After(10 * time.Second):
+		t.Fatal("test new secret")
+	}
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestRoleRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	// the seeded roles match the roles the memory store is seeded with
+	for role, expPermissions := range defaultRolePermissions {
+		permissions, err := unitTestTx().getRolePermissions(role)
+		assert.Nil(t, err, role)
+		assert.ElementsMatch(t, expPermissions, permissions, role)
+	}
+
+	_, err := unitTestTx().getRolePermissions("")
+	assert.Equal(t, consts.ErrInvalidRole, err)
+	_, err = unitTestTx().getRolePermissions("RoleRows-DoesNotExist")
+	assert.Equal(t, consts.ErrRoleNotFound, err)
+
+	user, _, err := unitTestInsertVerifiedUser("RoleRows-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+
+	grants, err := unitTestTx().listRoleGrants(uuid)
+	assert.Nil(t, err)
+	assert.Empty(t, grants)
+
+	now := time.Now().UTC()
+	viewer := &roleGrant{uuid: uuid, role: "viewer", organization: "hwsc", grantedBy: uuid, grantedTimestamp: now}
+	admin := &roleGrant{uuid: uuid, role: roleAdmin, grantedBy: uuid, grantedTimestamp: now.Add(time.Second)}
+	assert.Nil(t, unitTestTx().insertRoleGrant(viewer))
+	assert.Nil(t, unitTestTx().insertRoleGrant(viewer))
+	assert.Nil(t, unitTestTx().insertRoleGrant(admin))
+	assert.Equal(t, consts.ErrRoleNotFound, unitTestTx().insertRoleGrant(&roleGrant{uuid: uuid,
+		role: "RoleRows-DoesNotExist", grantedBy: uuid, grantedTimestamp: now}))
+
+	grants, err = unitTestTx().listRoleGrants(uuid)
+	assert.Nil(t, err)
+	if assert.Len(t, grants, 2) {
+		assert.Equal(t, "viewer", grants[0].role)
+		assert.Equal(t, "hwsc", grants[0].organization)
+		assert.Equal(t, roleAdmin, grants[1].role)
+		assert.Equal(t, "", grants[1].organization)
+	}
+
+	assert.Nil(t, unitTestTx().deleteRoleGrant(uuid, "viewer", "hwsc"))
+	assert.Nil(t, unitTestTx().deleteRoleGrant(uuid, "viewer", "hwsc"))
+	grants, err = unitTestTx().listRoleGrants(uuid)
+	assert.Nil(t, err)
+	assert.Len(t, grants, 1)
+
+	// deleting the user deletes their roles
+	assert.Nil(t, unitTestTx().deleteUserRow(uuid))
+	grants, err = unitTestTx().listRoleGrants(uuid)
+	assert.Nil(t, err)
+	assert.Empty(t, grants)
+}
+
+func TestCountAdmins(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	count, err := unitTestTx().countAdmins()
+	assert.Nil(t, err)
+
+	admin, _, err := unitTestInsertAdmin("CountAdmins-One")
+	assert.Nil(t, err)
+	newCount, err := unitTestTx().countAdmins()
+	assert.Nil(t, err)
+	assert.Equal(t, count+1, newCount)
+
+	// suspended admins are not counted, until their suspension passes
+	suspension := &suspensionRow{uuid: admin.GetUuid(), reason: "CountAdmins", suspendedBy: admin.GetUuid(),
+		suspendedTimestamp: time.Now(), suspendedUntil: time.Now().Add(time.Hour)}
+	assert.Nil(t, unitTestTx().insertSuspension(suspension))
+	newCount, err = unitTestTx().countAdmins()
+	assert.Nil(t, err)
+	assert.Equal(t, count, newCount)
+
+	suspension.suspendedUntil = time.Now().Add(-time.Second)
+	assert.Nil(t, unitTestTx().insertSuspension(suspension))
+	newCount, err = unitTestTx().countAdmins()
+	assert.Nil(t, err)
+	assert.Equal(t, count+1, newCount)
+}
+
+func TestSuspensionRows(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, _, err := unitTestInsertVerifiedUser("SuspensionRows-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+
+	row, err := unitTestTx().getSuspensionRow(uuid)
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+	assert.Equal(t, consts.ErrUserNotSuspended, unitTestTx().deleteSuspension(uuid))
+	assert.Equal(t, consts.ErrInvalidSuspensionReason, unitTestTx().insertSuspension(&suspensionRow{uuid: uuid}))
+
+	// suspending again replaces the suspension, a suspension without suspended until lasts
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	assert.Nil(t, unitTestTx().insertSuspension(&suspensionRow{uuid: uuid, reason: "first", suspendedBy: uuid,
+		suspendedTimestamp: now, suspendedUntil: now.Add(time.Hour)}))
+	assert.Nil(t, unitTestTx().insertSuspension(&suspensionRow{uuid: uuid, reason: "second", suspendedBy: uuid,
+		suspendedTimestamp: now}))
+	row, err = unitTestTx().getSuspensionRow(uuid)
+	assert.Nil(t, err)
+	if assert.NotNil(t, row) {
+		assert.Equal(t, "second", row.reason)
+		assert.True(t, now.Equal(row.suspendedTimestamp))
+		assert.True(t, row.suspendedUntil.IsZero())
+	}
+
+	// an expired suspension is ignored, but still deleted on reactivation
+	assert.Nil(t, unitTestTx().insertSuspension(&suspensionRow{uuid: uuid, reason: "expired", suspendedBy: uuid,
+		suspendedTimestamp: now.Add(-time.Hour), suspendedUntil: now.Add(-time.Second)}))
+	row, err = unitTestTx().getSuspensionRow(uuid)
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+	assert.Nil(t, unitTestTx().deleteSuspension(uuid))
+}
@@ -3,16 +3,28 @@ package service
 import (
 	"bytes"
 	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"html"
 	"io/ioutil"
 	"net/smtp"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
+// emailTracker counts the emails being sent, so shutdown can wait for them
+type emailTracker struct {
+	lock  sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
 // Request holds transaction email data
 type emailRequest struct {
 	from         string
@@ -24,18 +36,34 @@ type emailRequest struct {
 
 const (
 	// MIME (Multipurpose Internet Mail Extension), extends the format of email
-	mime                = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-	subjectVerifyEmail  = "Verify email for Humpback Whale Social Call"
-	subjectUpdateEmail  = "Verify Request to Update Email"
-	templateVerifyEmail = "verify_new_user_email.html"
-	templateUpdateEmail = "verify_email_update.html"
-	maxEmailLength      = 320
-
-	verificationLinkKey = "VERIFICATION_LINK"
+	mime                  = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
+	subjectVerifyEmail    = "Verify email for Humpback Whale Social Call"
+	subjectUpdateEmail    = "Verify Request to Update Email"
+	subjectResetPassword  = "Reset Password for Humpback Whale Social Call"
+	subjectEmailChanged   = "Your Humpback Whale Social Call Email Was Changed"
+	subjectAccountLocked  = "Your Humpback Whale Social Call Account Was Locked"
+	subjectSuspended      = "Your Humpback Whale Social Call Account Was Suspended"
+	subjectReactivated    = "Your Humpback Whale Social Call Account Was Reactivated"
+	templateVerifyEmail   = "verify_new_user_email.html"
+	templateUpdateEmail   = "verify_email_update.html"
+	templateResetPassword = "reset_password.html"
+	templateEmailChanged  = "email_changed.html"
+	templateAccountLocked = "account_locked.html"
+	templateSuspended     = "account_suspended.html"
+	templateReactivated   = "account_reactivated.html"
+	maxEmailLength        = 320
+
+	verificationLinkKey  = "VERIFICATION_LINK"
+	resetPasswordLinkKey = "RESET_PASSWORD_LINK"
+	newEmailKey          = "NEW_EMAIL"
+	lockedUntilKey       = "LOCKED_UNTIL"
+	reasonKey            = "REASON"
+	suspendedUntilKey    = "SUSPENDED_UNTIL"
 )
 
 var (
 	templateDirectory string
+	pendingEmails     emailTracker
 
 	// tests empty string, @ symbol in between, at least 3 chars
 	emailRegex = regexp.MustCompile(`.+@.+`)
@@ -157,6 +185,9 @@ func (r *emailRequest) processEmail() error {
 // Then, with all these information, email is processed and sent
 // Returns error if there are any errors returned from the sub functions or if htmlTemplate is empty
 func (r *emailRequest) sendEmail(htmlTemplate string) error {
+	pendingEmails.add()
+	defer pendingEmails.done()
+
 	if htmlTemplate == "" {
 		return consts.ErrEmailMainTemplateNotProvided
 	}
@@ -177,6 +208,53 @@ func (r *emailRequest) sendEmail(htmlTemplate string) error {
 	return nil
 }
 
+// add marks one more email as being sent
+func (t *emailTracker) add() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+}
+
+// done marks one email as sent or failed
+func (t *emailTracker) done() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+	}
+}
+
+// wait blocks until no email is being sent.
+// Returns ctx's error if ctx is done first.
+func (t *emailTracker) wait(ctx context.Context) error {
+	t.lock.Lock()
+	if t.count == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.lock.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FlushEmails waits for the emails already being sent by RPCs to finish.
+// Returns ctx's error if ctx is done first.
+func FlushEmails(ctx context.Context) error {
+	return pendingEmails.wait(ctx)
+}
+
 // validateEmail checks for very basic valid email format and string length
 // Returns error if checks fail
 func validateEmail(email string) error {
@@ -186,3 +264,67 @@ func validateEmail(email string) error {
 
 	return nil
 }
+
+// sendVerificationEmail emails a verification link for the email token to a single recipient.
+// param "subject" and "htmlTemplate" select between the new user and the update email verification emails
+// Returns error if failed to generate the link or send the email
+func sendVerificationEmail(token string, to string, subject string, htmlTemplate string) error {
+	verificationLink, err := generateEmailVerifyLink(token)
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]string{verificationLinkKey: verificationLink}
+	emailReq, err := newEmailRequest(emailData, []string{to}, conf.EmailHost.Username, subject)
+	if err != nil {
+		return err
+	}
+
+	return emailReq.sendEmail(htmlTemplate)
+}
+
+// sendLockoutEmail notifies to that its account is locked out of logins until lockedUntil.
+// The email is sent in the background, so the response time of the locking login
+// does not reveal that the email exists. Failures are only logged.
+func sendLockoutEmail(to string, lockedUntil time.Time) {
+	emailData := map[string]string{lockedUntilKey: lockedUntil.UTC().Format(time.RFC1123)}
+	sendNotificationEmail(consts.AuthenticateUserTag, emailData, to, subjectAccountLocked, templateAccountLocked)
+}
+
+// sendSuspensionEmail notifies to that its account is suspended for reason, until suspendedUntil if it is set.
+// Sent in the background, failures are only logged b/c the user is already suspended.
+func sendSuspensionEmail(to string, reason string, suspendedUntil time.Time) {
+	until := "it is reactivated"
+	if !suspendedUntil.IsZero() {
+		until = suspendedUntil.UTC().Format(time.RFC1123)
+	}
+
+	// text templates do not escape, the reason is written by whoever suspended the user
+	emailData := map[string]string{reasonKey: html.EscapeString(reason), suspendedUntilKey: until}
+	sendNotificationEmail(consts.SuspendUserTag, emailData, to, subjectSuspended, templateSuspended)
+}
+
+// sendReactivationEmail notifies to that its account is reactivated.
+// Sent in the background, failures are only logged b/c the user is already reactivated.
+func sendReactivationEmail(to string) {
+	sendNotificationEmail(consts.ReactivateUserTag, map[string]string{}, to, subjectReactivated, templateReactivated)
+}
+
+// sendNotificationEmail sends htmlTemplate interpolated with emailData to a single recipient in the background.
+// Failures are logged with tag.
+func sendNotificationEmail(tag string, emailData map[string]string, to string, subject string, htmlTemplate string) {
+	emailReq, err := newEmailRequest(emailData, []string{to}, conf.EmailHost.Username, subject)
+	if err != nil {
+		logger.Error(tag, consts.MsgErrEmailRequest, err.Error())
+		return
+	}
+
+	// counted before the goroutine starts, so shutdown waits for it
+	pendingEmails.add()
+	go func() {
+		defer pendingEmails.done()
+		if err := emailReq.sendEmail(htmlTemplate); err != nil {
+			logger.Error(tag, consts.MsgErrSendEmail, err.Error())
+		}
+	}()
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"testing"
+	"time"
 )
 
 func TestNewEmailRequest(t *testing.T) {
@@ -72,9 +74,20 @@ func TestParseTemplates(t *testing.T) {
 
 	err = r.parseTemplates(files)
 	assert.Nil(t, err)
+
+	// interpolated template data
+	r.templateData = map[string]string{reasonKey: "spam &amp; abuse", suspendedUntilKey: "it is reactivated"}
+	files, err = r.getAllTemplatePaths(templateSuspended)
+	assert.Nil(t, err)
+	err = r.parseTemplates(files)
+	assert.Nil(t, err)
+	assert.Contains(t, r.body, "Your account was suspended: spam &amp; abuse")
+	assert.Contains(t, r.body, "Logins are disabled until it is reactivated.")
 }
 
 func TestProcessEmail(t *testing.T) {
+	unitTestRequireSMTP(t)
+
 	validEmails := []string{
 		"hwsc.test+user1@gmail.com",
 		"hwsc.test+user2@gmail.com",
@@ -118,6 +131,8 @@ func TestProcessEmail(t *testing.T) {
 }
 
 func TestSendEmail(t *testing.T) {
+	unitTestRequireSMTP(t)
+
 	testData := map[string]string{verificationLinkKey: "Unit Testing sendEmail"}
 	email := []string{"hwsc.test+user0@gmail.com"}
 	r, err := newEmailRequest(testData, email, conf.EmailHost.Username, "HWSC Testing")
@@ -183,3 +198,25 @@ func TestValidateEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestFlushEmails(t *testing.T) {
+	// nothing pending
+	err := FlushEmails(context.TODO())
+	assert.Nil(t, err)
+
+	// pending email outlives the deadline
+	pendingEmails.add()
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	err = FlushEmails(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// pending email finishes before the deadline
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pendingEmails.done()
+	}()
+	err = FlushEmails(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pendingEmails.count)
+}
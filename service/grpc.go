@@ -0,0 +1,116 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// userServiceName is the proto service name of pbsvc, the RPCs below are served under it
+// so clients generated from a proto declaring them call the same methods
+const userServiceName = "user.UserService"
+
+// UserServiceServer is pbsvc.UserServiceServer with the RPCs the pinned hwsc-api-blocks does not declare yet.
+type UserServiceServer interface {
+	pbsvc.UserServiceServer
+	SetServiceState(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	UnlockUser(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	EnrollTOTP(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ConfirmTOTP(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ResetTOTP(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	UnshareDocument(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ListDocuments(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ListSharedDocuments(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	UpdateDocumentVisibility(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	GetSigningKeys(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	RefreshAuthToken(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	Logout(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	LogoutAll(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	GrantRole(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	RevokeRole(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	SetPermissionLevel(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	SuspendUser(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ReactivateUser(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ResendVerificationEmail(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	RequestPasswordReset(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+	ConfirmPasswordReset(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+}
+
+// userServiceDesc declares every RPC of UserServiceServer, the ones of pbsvc included,
+// b/c grpc serves one ServiceDesc per service name
+var userServiceDesc = grpc.ServiceDesc{
+	ServiceName: userServiceName,
+	HandlerType: (*UserServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		userServiceMethod("GetStatus", UserServiceServer.GetStatus),
+		userServiceMethod("CreateUser", UserServiceServer.CreateUser),
+		userServiceMethod("DeleteUser", UserServiceServer.DeleteUser),
+		userServiceMethod("UpdateUser", UserServiceServer.UpdateUser),
+		userServiceMethod("AuthenticateUser", UserServiceServer.AuthenticateUser),
+		userServiceMethod("ListUsers", UserServiceServer.ListUsers),
+		userServiceMethod("GetUser", UserServiceServer.GetUser),
+		userServiceMethod("ShareDocument", UserServiceServer.ShareDocument),
+		userServiceMethod("GetNewAuthToken", UserServiceServer.GetNewAuthToken),
+		userServiceMethod("VerifyAuthToken", UserServiceServer.VerifyAuthToken),
+		userServiceMethod("VerifyEmailToken", UserServiceServer.VerifyEmailToken),
+		userServiceMethod("GetAuthSecret", UserServiceServer.GetAuthSecret),
+		userServiceMethod("MakeNewAuthSecret", UserServiceServer.MakeNewAuthSecret),
+		userServiceMethod("SetServiceState", UserServiceServer.SetServiceState),
+		userServiceMethod("UnlockUser", UserServiceServer.UnlockUser),
+		userServiceMethod("EnrollTOTP", UserServiceServer.EnrollTOTP),
+		userServiceMethod("ConfirmTOTP", UserServiceServer.ConfirmTOTP),
+		userServiceMethod("ResetTOTP", UserServiceServer.ResetTOTP),
+		userServiceMethod("UnshareDocument", UserServiceServer.UnshareDocument),
+		userServiceMethod("ListDocuments", UserServiceServer.ListDocuments),
+		userServiceMethod("ListSharedDocuments", UserServiceServer.ListSharedDocuments),
+		userServiceMethod("UpdateDocumentVisibility", UserServiceServer.UpdateDocumentVisibility),
+		userServiceMethod("GetSigningKeys", UserServiceServer.GetSigningKeys),
+		userServiceMethod("RefreshAuthToken", UserServiceServer.RefreshAuthToken),
+		userServiceMethod("Logout", UserServiceServer.Logout),
+		userServiceMethod("LogoutAll", UserServiceServer.LogoutAll),
+		userServiceMethod("GrantRole", UserServiceServer.GrantRole),
+		userServiceMethod("RevokeRole", UserServiceServer.RevokeRole),
+		userServiceMethod("SetPermissionLevel", UserServiceServer.SetPermissionLevel),
+		userServiceMethod("SuspendUser", UserServiceServer.SuspendUser),
+		userServiceMethod("ReactivateUser", UserServiceServer.ReactivateUser),
+		userServiceMethod("ResendVerificationEmail", UserServiceServer.ResendVerificationEmail),
+		userServiceMethod("RequestPasswordReset", UserServiceServer.RequestPasswordReset),
+		userServiceMethod("ConfirmPasswordReset", UserServiceServer.ConfirmPasswordReset),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "hwsc-user-svc.proto",
+}
+
+// RegisterUserServiceServer registers every RPC of srv with s,
+// use it instead of pbsvc.RegisterUserServiceServer, which only registers the RPCs of the pinned proto.
+// Clients generated from the pinned proto call the RPCs it declares as before,
+// the others are called by their full method name, ie "/user.UserService/<RPC>".
+func RegisterUserServiceServer(s *grpc.Server, srv UserServiceServer) {
+	s.RegisterService(&userServiceDesc, srv)
+}
+
+// userServiceMethod makes the unary handler of one RPC the way protoc-gen-go does
+func userServiceMethod(name string,
+	call func(UserServiceServer, context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(pbsvc.UserRequest)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(UserServiceServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + userServiceName + "/" + name,
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(UserServiceServer), ctx, req.(*pbsvc.UserRequest))
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
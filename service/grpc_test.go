@@ -0,0 +1,57 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+)
+
+func TestRegisterUserServiceServer(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "RegisterUserServiceServer-One", auth.User)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterUserServiceServer(server, s)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(context.TODO(), "bufconn", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// the RPCs of the pinned proto are called with its generated client
+	var header metadata.MD
+	response, err := pbsvc.NewUserServiceClient(conn).AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+	}, grpc.Header(&header))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, response.GetIdentification().GetToken())
+	assert.Len(t, header.Get(refreshTokenKey), 1)
+
+	// the others are called by their full method name
+	refreshed := &pbsvc.UserResponse{}
+	ctx := metadata.AppendToOutgoingContext(context.TODO(), refreshTokenKey, header.Get(refreshTokenKey)[0])
+	err = conn.Invoke(ctx, "/user.UserService/RefreshAuthToken", &pbsvc.UserRequest{}, refreshed)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, refreshed.GetIdentification().GetToken())
+
+	documents := &pbsvc.UserResponse{}
+	err = conn.Invoke(context.TODO(), "/user.UserService/ListDocuments",
+		&pbsvc.UserRequest{Identification: refreshed.GetIdentification()}, documents)
+	assert.Nil(t, err)
+	assert.Equal(t, user.GetUuid(), documents.GetUser().GetUuid())
+
+	err = conn.Invoke(context.TODO(), "/user.UserService/ListDocuments", &pbsvc.UserRequest{}, documents)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loginLimiter sweeps every key once it tracks more than this many
+	maxLoginLimitedKeys = 10000
+
+	loginEmailKeyPrefix = "email:"
+	loginIPKeyPrefix    = "ip:"
+
+	// AuthenticateUser sets the seconds until a blocked login can be retried in the header metadata
+	loginRetryAfterKey = "retry-after"
+
+	// hwsc-app-gateway-svc forwards the IP of its client in the incoming gRPC metadata b/c UserRequest has no field
+	// for it, AuthenticateUser counts failures of the IP and UnlockUser reads the IP to unlock
+	clientIPKey = "login-ip"
+)
+
+// loginLimiter counts failed logins per email and per client IP.
+// Every failure of an email blocks it for a backoff doubled by each further failure,
+// once a key reaches its limit it is locked out. Client IPs are only locked out b/c users behind a shared IP
+// would be blocked by each other's failures. Counters are kept per replica, like emailRateLimiter.
+type loginLimiter struct {
+	lock     sync.Mutex
+	config   conf.LoginLimitConfig
+	failures map[string]*loginFailures
+}
+
+// loginFailures are the failed logins of a key
+type loginFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+var loginAttempts = newLoginLimiter(conf.LoginLimit)
+
+// newLoginLimiter returns a loginLimiter configured by config.
+func newLoginLimiter(config conf.LoginLimitConfig) *loginLimiter {
+	return &loginLimiter{
+		config:   config,
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// loginEmailKey returns the loginLimiter key of email, emails are case insensitive
+func loginEmailKey(email string) string {
+	return loginEmailKeyPrefix + strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginIPKey returns the loginLimiter key of ip, or "" if ip is empty
+func loginIPKey(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	return loginIPKeyPrefix + ip
+}
+
+// clientIP returns the client IP forwarded by the gateway in md, or "" if it is missing or invalid.
+// The peer IP is not used b/c every request comes through the gateway, it is the same for every client.
+func clientIP(md metadata.MD) string {
+	ip := net.ParseIP(strings.TrimSpace(getMetadataValue(md, clientIPKey)))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// blocked returns how long until every key can log in again, 0 if none of keys are blocked.
+// Empty keys are skipped.
+func (l *loginLimiter) blocked(now time.Time, keys ...string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		failures, ok := l.failures[key]
+		if !ok {
+			continue
+		}
+		if remaining := failures.blockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait
+}
+
+// fail records a failed login of key, blocking an email key for the backoff of its failures,
+// or any key for conf.LoginLimitConfig.Lockout once it reaches the limit of its kind, email or IP.
+// Returns true if this failure locked key out. Empty keys are skipped.
+func (l *loginLimiter) fail(now time.Time, key string) bool {
+	if key == "" {
+		return false
+	}
+
+	isEmail := strings.HasPrefix(key, loginEmailKeyPrefix)
+	limit := l.config.MaxIPFailures
+	if isEmail {
+		limit = l.config.MaxEmailFailures
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.failures) > maxLoginLimitedKeys {
+		for k := range l.failures {
+			l.prune(k, now)
+		}
+	}
+	l.prune(key, now)
+
+	failures, ok := l.failures[key]
+	if !ok {
+		failures = &loginFailures{}
+		l.failures[key] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+
+	if failures.count >= limit {
+		failures.blockedUntil = now.Add(l.config.Lockout)
+		return failures.count == limit
+	}
+	if !isEmail {
+		return false
+	}
+
+	backoff := l.config.Backoff
+	for i := 1; i < failures.count && backoff < l.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > l.config.MaxBackoff {
+		backoff = l.config.MaxBackoff
+	}
+	failures.blockedUntil = now.Add(backoff)
+
+	return false
+}
+
+// reset forgets the failed logins of key.
+// Returns true if key had failed logins.
+func (l *loginLimiter) reset(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.failures[key]
+	delete(l.failures, key)
+	return ok
+}
+
+// prune forgets the failures of key once it is no longer blocked and its last failure is outside of the window,
+// the caller must hold the lock.
+func (l *loginLimiter) prune(key string, now time.Time) {
+	failures, ok := l.failures[key]
+	if !ok {
+		return
+	}
+
+	if now.Before(failures.blockedUntil) || now.Sub(failures.lastFailure) < l.config.Window {
+		return
+	}
+	delete(l.failures, key)
+}
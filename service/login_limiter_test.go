@@ -0,0 +1,144 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	limiter := newLoginLimiter(conf.LoginLimitConfig{
+		MaxEmailFailures: 5,
+		Backoff:          time.Second,
+		MaxBackoff:       5 * time.Second,
+		Lockout:          time.Hour,
+		Window:           time.Hour,
+	})
+	now := time.Now()
+	key := loginEmailKey("Backoff@Test.com")
+
+	cases := []struct {
+		desc      string
+		expWait   time.Duration
+		expLocked bool
+	}{
+		{"test first failure", time.Second, false},
+		{"test second failure doubles", 2 * time.Second, false},
+		{"test third failure doubles", 4 * time.Second, false},
+		{"test backoff is capped", 5 * time.Second, false},
+		{"test lockout", time.Hour, true},
+		{"test locked out once", time.Hour, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expLocked, limiter.fail(now, key), c.desc)
+		assert.Equal(t, c.expWait, limiter.blocked(now, key), c.desc)
+	}
+
+	// emails are case insensitive, other keys and empty keys are not blocked
+	assert.Equal(t, time.Hour, limiter.blocked(now, loginEmailKey(" backoff@test.com")))
+	assert.Equal(t, time.Duration(0), limiter.blocked(now, loginEmailKey("other@test.com"), ""))
+	assert.Equal(t, time.Duration(0), limiter.blocked(now.Add(time.Hour), key))
+	assert.False(t, limiter.fail(now, ""))
+
+	assert.True(t, limiter.reset(key))
+	assert.False(t, limiter.reset(key))
+	assert.Equal(t, time.Duration(0), limiter.blocked(now, key))
+}
+
+func TestLoginLimiterWindow(t *testing.T) {
+	limiter := newLoginLimiter(conf.LoginLimitConfig{
+		MaxIPFailures: 2,
+		Backoff:       time.Second,
+		MaxBackoff:    time.Minute,
+		Lockout:       time.Hour,
+		Window:        time.Minute,
+	})
+	now := time.Now()
+	key := loginIPKey("10.0.0.1")
+
+	assert.False(t, limiter.fail(now, key))
+
+	// the first failure is forgotten once outside of the window, IPs are not backed off
+	now = now.Add(2 * time.Minute)
+	assert.False(t, limiter.fail(now, key))
+	assert.Equal(t, time.Duration(0), limiter.blocked(now, key))
+
+	assert.True(t, limiter.fail(now, key))
+	assert.Equal(t, time.Hour, limiter.blocked(now, key))
+
+	// still locked out after the window
+	now = now.Add(2 * time.Minute)
+	limiter.prune(key, now)
+	assert.Equal(t, time.Hour-2*time.Minute, limiter.blocked(now, key))
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		desc  string
+		md    metadata.MD
+		expIP string
+	}{
+		{"test no metadata", nil, ""},
+		{"test ipv4", metadata.Pairs(clientIPKey, "10.0.0.1"), "10.0.0.1"},
+		{"test ipv6", metadata.Pairs(clientIPKey, " 0:0:0:0:0:0:0:1 "), "::1"},
+		{"test invalid ip", metadata.Pairs(clientIPKey, "10.0.0.1:4242"), ""},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expIP, clientIP(c.md), c.desc)
+	}
+
+	assert.Equal(t, "", loginIPKey(""))
+	assert.Equal(t, loginIPKeyPrefix+"::1", loginIPKey("::1"))
+}
+
+func TestMemoryStoreLoginLockout(t *testing.T) {
+	// with the backoff of the default config, a failure blocks its email for a minute
+	defaultLoginAttempts := loginAttempts
+	loginAttempts = newLoginLimiter(conf.LoginLimitConfig{MaxEmailFailures: 2, MaxIPFailures: 3,
+		Backoff: time.Minute, MaxBackoff: time.Minute, Lockout: time.Hour, Window: time.Hour})
+	defer func() { loginAttempts = defaultLoginAttempts }()
+
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreLockout-One", auth.User)
+	other := unitTestInsertMemoryUser(t, store, "MemoryStoreLockout-Two", auth.User)
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(clientIPKey, "10.0.0.2"))
+
+	// unknown emails and wrong passwords fail alike
+	_, err := s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Email: unitTestFailEmail,
+		Password: user.GetPassword()}})
+	assert.Equal(t, consts.ErrStatusInvalidCredentials, err)
+
+	// the client IP is not backed off, other users behind it still log in
+	_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: other})
+	assert.Nil(t, err)
+
+	// the email is backed off for every client
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(),
+		Password: unitTestFailValue}})
+	assert.Equal(t, consts.ErrStatusInvalidCredentials, err)
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.Equal(t, consts.ErrStatusLoginBlocked, err)
+
+	// the client IP is locked out for every email once it reaches its own limit
+	assert.True(t, loginAttempts.reset(loginEmailKey(user.GetEmail())))
+	for i := 0; i < 2; i++ {
+		_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Email: unitTestEmailGenerator(),
+			Password: unitTestFailValue}})
+		assert.Equal(t, consts.ErrStatusInvalidCredentials, err)
+	}
+	_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.Equal(t, consts.ErrStatusLoginBlocked, err)
+
+	// other clients are not
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err)
+}
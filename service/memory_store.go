@@ -0,0 +1,1712 @@
+package service
+
+import (
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryStore implements UserStore in memory, for tests and local development without postgres.
+// Transactions are serialized, each runs on a copy of the tables that replaces them on commit,
+// so a rolled back transaction leaves no trace.
+type memoryStore struct {
+	lock   sync.Mutex
+	tables *memoryTables
+}
+
+// memoryTx implements UserTx on the tables of one memoryStore transaction.
+type memoryTx struct {
+	tables *memoryTables
+}
+
+// memoryTables mirrors the postgres schema in migrations, rows are keyed by their primary key.
+type memoryTables struct {
+	accounts        map[string]memoryAccountRow
+	emailTokens     map[string]memoryEmailTokenRow
+	documents       map[string]documentRow
+	sharedDocuments map[string]map[string]bool // duid to uuids
+	secrets         map[string]memorySecretRow
+	authTokens      map[string]memoryAuthTokenRow
+	refreshTokens   map[string]refreshTokenRow
+	totpSecrets     map[string]totpRow
+	recoveryCodes   map[string]map[string]bool // uuid to recovery code hashes
+	rolePermissions map[string]map[string]bool // role to permissions
+	userRoles       map[string]roleGrant       // keyed by roleGrantKey
+	suspensions     map[string]suspensionRow
+
+	// activeSecretHash mirrors the one row active_secret table, empty if there is no active secret
+	activeSecretHash string
+}
+
+type memoryAccountRow struct {
+	uuid             string
+	firstName        string
+	lastName         string
+	email            string
+	prospectiveEmail string
+	password         string
+	organization     string
+	createdTimestamp time.Time
+	isVerified       bool
+	permissionLevel  string
+}
+
+// memorySecretRow is keyed by keyHash, the hash of its key, the key itself is sealed in sealedKey.
+type memorySecretRow struct {
+	keyHash             string
+	sealedKey           envelope
+	algorithm           string
+	publicKey           []byte
+	privateKey          *envelope
+	createdTimestamp    time.Time
+	expirationTimestamp time.Time
+}
+
+type memoryAuthTokenRow struct {
+	tokenHash           string
+	secretHash          string
+	permission          string
+	expirationTimestamp time.Time
+	uuid                string
+	revokedTimestamp    time.Time // zero unless revoked
+}
+
+// memoryEmailTokenRow is keyed by tokenHash, the secret key of the token is sealed in sealedSecretKey.
+type memoryEmailTokenRow struct {
+	tokenHash           string
+	sealedSecretKey     envelope // no masterKeyID if the secret key was not sealed
+	createdTimestamp    int64
+	expirationTimestamp int64
+	uuid                string
+	purpose             string
+}
+
+// newMemoryStore returns an empty memoryStore, data is lost once the store is released.
+func newMemoryStore() *memoryStore {
+	// the roles seeded by the 12_roles migration
+	rolePermissions := make(map[string]map[string]bool, len(defaultRolePermissions))
+	for role, permissions := range defaultRolePermissions {
+		rolePermissions[role] = make(map[string]bool, len(permissions))
+		for _, permission := range permissions {
+			rolePermissions[role][permission] = true
+		}
+	}
+
+	return &memoryStore{
+		tables: &memoryTables{
+			accounts:        make(map[string]memoryAccountRow),
+			emailTokens:     make(map[string]memoryEmailTokenRow),
+			documents:       make(map[string]documentRow),
+			sharedDocuments: make(map[string]map[string]bool),
+			secrets:         make(map[string]memorySecretRow),
+			authTokens:      make(map[string]memoryAuthTokenRow),
+			refreshTokens:   make(map[string]refreshTokenRow),
+			totpSecrets:     make(map[string]totpRow),
+			recoveryCodes:   make(map[string]map[string]bool),
+			rolePermissions: rolePermissions,
+			userRoles:       make(map[string]roleGrant),
+			suspensions:     make(map[string]suspensionRow),
+		},
+	}
+}
+
+// Ping returns ctx's error if ctx is done, the store is always reachable otherwise.
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close keeps the tables, there is nothing to release.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// WatchActiveSecret blocks until ctx is done, the tables are not shared with other replicas to change the secret.
+func (s *memoryStore) WatchActiveSecret(ctx context.Context, onChange func()) error {
+	<-ctx.Done()
+	return nil
+}
+
+// WithTx runs fn on a copy of the tables, the copy replaces the tables if fn returns nil.
+// Returns fn's error, or ctx's error if ctx is done before the transaction begins or commits.
+func (s *memoryStore) WithTx(ctx context.Context, fn func(tx UserTx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tables := s.tables.clone()
+	if err := fn(&memoryTx{tables: tables}); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.tables = tables
+	return nil
+}
+
+// clone copies every table, rows are values so the copy shares nothing with t.
+func (t *memoryTables) clone() *memoryTables {
+	c := &memoryTables{
+		accounts:         make(map[string]memoryAccountRow, len(t.accounts)),
+		emailTokens:      make(map[string]memoryEmailTokenRow, len(t.emailTokens)),
+		documents:        make(map[string]documentRow, len(t.documents)),
+		sharedDocuments:  make(map[string]map[string]bool, len(t.sharedDocuments)),
+		secrets:          make(map[string]memorySecretRow, len(t.secrets)),
+		authTokens:       make(map[string]memoryAuthTokenRow, len(t.authTokens)),
+		refreshTokens:    make(map[string]refreshTokenRow, len(t.refreshTokens)),
+		totpSecrets:      make(map[string]totpRow, len(t.totpSecrets)),
+		recoveryCodes:    make(map[string]map[string]bool, len(t.recoveryCodes)),
+		rolePermissions:  make(map[string]map[string]bool, len(t.rolePermissions)),
+		userRoles:        make(map[string]roleGrant, len(t.userRoles)),
+		suspensions:      make(map[string]suspensionRow, len(t.suspensions)),
+		activeSecretHash: t.activeSecretHash,
+	}
+
+	for k, v := range t.accounts {
+		c.accounts[k] = v
+	}
+	for k, v := range t.emailTokens {
+		c.emailTokens[k] = v
+	}
+	for k, v := range t.documents {
+		c.documents[k] = v
+	}
+	for duid, uuids := range t.sharedDocuments {
+		c.sharedDocuments[duid] = make(map[string]bool, len(uuids))
+		for uuid := range uuids {
+			c.sharedDocuments[duid][uuid] = true
+		}
+	}
+	for k, v := range t.secrets {
+		c.secrets[k] = v
+	}
+	for k, v := range t.authTokens {
+		c.authTokens[k] = v
+	}
+	for k, v := range t.refreshTokens {
+		c.refreshTokens[k] = v
+	}
+	for k, v := range t.totpSecrets {
+		c.totpSecrets[k] = v
+	}
+	for uuid, hashes := range t.recoveryCodes {
+		c.recoveryCodes[uuid] = make(map[string]bool, len(hashes))
+		for hash := range hashes {
+			c.recoveryCodes[uuid][hash] = true
+		}
+	}
+	for role, permissions := range t.rolePermissions {
+		c.rolePermissions[role] = make(map[string]bool, len(permissions))
+		for permission := range permissions {
+			c.rolePermissions[role][permission] = true
+		}
+	}
+	for k, v := range t.userRoles {
+		c.userRoles[k] = v
+	}
+	for k, v := range t.suspensions {
+		c.suspensions[k] = v
+	}
+
+	return c
+}
+
+// errUniqueViolation and errForeignKeyViolation mirror the constraint errors of the postgres schema.
+func errUniqueViolation(constraint string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint %q", constraint)
+}
+
+func errForeignKeyViolation(table string, constraint string) error {
+	return fmt.Errorf("insert or update on table %q violates foreign key constraint %q", table, constraint)
+}
+
+// toUser converts the row to a pb.User, password included.
+func (r memoryAccountRow) toUser() *pblib.User {
+	return &pblib.User{
+		Uuid:             r.uuid,
+		FirstName:        r.firstName,
+		LastName:         r.lastName,
+		Email:            r.email,
+		Organization:     r.organization,
+		CreatedTimestamp: r.createdTimestamp.Unix(),
+		IsVerified:       r.isVerified,
+		Password:         r.password,
+		PermissionLevel:  r.permissionLevel,
+		ProspectiveEmail: r.prospectiveEmail,
+	}
+}
+
+// lockUUID is a no-op, WithTx already runs one transaction at a time.
+func (t *memoryTx) lockUUID(uuid string) error {
+	return nil
+}
+
+// lockUUIDShared is a no-op, WithTx already runs one transaction at a time.
+func (t *memoryTx) lockUUIDShared(uuid string) error {
+	return nil
+}
+
+// accountByEmail returns the account whose email, or prospective email if isProspective, matches email.
+func (t *memoryTx) accountByEmail(email string, isProspective bool) (memoryAccountRow, bool) {
+	for _, account := range t.tables.accounts {
+		if (!isProspective && account.email == email) || (isProspective && account.prospectiveEmail == email) {
+			return account, true
+		}
+	}
+	return memoryAccountRow{}, false
+}
+
+// putAccount writes the account, enforcing the unique email and prospective_email constraints.
+func (t *memoryTx) putAccount(account memoryAccountRow) error {
+	if other, ok := t.accountByEmail(account.email, false); ok && other.uuid != account.uuid {
+		return errUniqueViolation("accounts_email_key")
+	}
+	if account.prospectiveEmail != "" {
+		if other, ok := t.accountByEmail(account.prospectiveEmail, true); ok && other.uuid != account.uuid {
+			return errUniqueViolation("accounts_prospective_email_key")
+		}
+	}
+
+	t.tables.accounts[account.uuid] = account
+	return nil
+}
+
+func (t *memoryTx) insertNewUser(user *pblib.User) error {
+	if user == nil {
+		return consts.ErrNilRequestUser
+	}
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		return err
+	}
+
+	if err := validateUser(user); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(user.GetPassword())
+	if err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.accounts[user.GetUuid()]; ok {
+		return errUniqueViolation("accounts_pkey")
+	}
+
+	return t.putAccount(memoryAccountRow{
+		uuid:             user.GetUuid(),
+		firstName:        user.GetFirstName(),
+		lastName:         user.GetLastName(),
+		email:            user.GetEmail(),
+		password:         hashedPassword,
+		organization:     user.GetOrganization(),
+		createdTimestamp: time.Now().UTC(),
+		isVerified:       false,
+		permissionLevel:  auth.PermissionStringMap[auth.NoPermission],
+	})
+}
+
+func (t *memoryTx) insertEmailToken(uuid string, token string, secret *pblib.Secret, purpose string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	if err := validateEmailTokenPurpose(purpose); err != nil {
+		return err
+	}
+
+	tokenHash := hashToken(token)
+	if _, ok := t.tables.emailTokens[tokenHash]; ok {
+		return errUniqueViolation("email_tokens_pkey")
+	}
+	for _, row := range t.tables.emailTokens {
+		if row.uuid == uuid && row.purpose == purpose {
+			return errUniqueViolation("email_tokens_uuid_purpose_key")
+		}
+	}
+	if _, ok := t.tables.accounts[uuid]; !ok {
+		return errForeignKeyViolation("email_tokens", "email_tokens_uuid_fkey")
+	}
+
+	sealed, err := sealEnvelope([]byte(secret.GetKey()), []byte(tokenHash))
+	if err != nil {
+		return err
+	}
+
+	t.tables.emailTokens[tokenHash] = memoryEmailTokenRow{
+		tokenHash:           tokenHash,
+		sealedSecretKey:     *sealed,
+		createdTimestamp:    secret.GetCreatedTimestamp(),
+		expirationTimestamp: secret.GetExpirationTimestamp(),
+		uuid:                uuid,
+		purpose:             purpose,
+	}
+
+	return nil
+}
+
+// deleteUserRow deletes the account and cascades to its email tokens, documents, shares, refresh tokens,
+// TOTP secret and roles.
+func (t *memoryTx) deleteUserRow(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	delete(t.tables.accounts, uuid)
+
+	for token, row := range t.tables.emailTokens {
+		if row.uuid == uuid {
+			delete(t.tables.emailTokens, token)
+		}
+	}
+	for duid, document := range t.tables.documents {
+		if document.uuid == uuid {
+			delete(t.tables.documents, duid)
+			delete(t.tables.sharedDocuments, duid)
+		}
+	}
+	for _, uuids := range t.tables.sharedDocuments {
+		delete(uuids, uuid)
+	}
+	for hash, row := range t.tables.refreshTokens {
+		if row.uuid == uuid {
+			delete(t.tables.refreshTokens, hash)
+		}
+	}
+	delete(t.tables.totpSecrets, uuid)
+	delete(t.tables.recoveryCodes, uuid)
+	for key, grant := range t.tables.userRoles {
+		if grant.uuid == uuid {
+			delete(t.tables.userRoles, key)
+		}
+	}
+	delete(t.tables.suspensions, uuid)
+
+	return nil
+}
+
+func (t *memoryTx) getUserRow(uuid string) (*pblib.User, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	account, ok := t.tables.accounts[uuid]
+	if !ok {
+		return nil, consts.ErrUserNotFound
+	}
+
+	return account.toUser(), nil
+}
+
+func (t *memoryTx) getUserRowByEmail(email string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	account, ok := t.accountByEmail(email, false)
+	if !ok {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+
+	return account.toUser(), nil
+}
+
+func (t *memoryTx) getUserRowByProspectiveEmail(email string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	account, ok := t.accountByEmail(email, true)
+	if !ok {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+
+	return account.toUser(), nil
+}
+
+func (t *memoryTx) updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
+	*pblib.User, *pblib.Identification, error) {
+	if svcDerived == nil || dbDerived == nil {
+		return nil, nil, consts.ErrNilRequestUser
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, nil, err
+	}
+
+	account, ok := t.tables.accounts[uuid]
+	if !ok {
+		// postgres updates no rows, the user is gone so there is nothing to return
+		return nil, nil, consts.ErrUserNotFound
+	}
+
+	if svcDerived.GetFirstName() != "" && svcDerived.GetFirstName() != dbDerived.GetFirstName() {
+		if err := validateFirstName(svcDerived.GetFirstName()); err != nil {
+			return nil, nil, err
+		}
+		account.firstName = svcDerived.GetFirstName()
+	} else {
+		account.firstName = dbDerived.GetFirstName()
+	}
+
+	if svcDerived.GetLastName() != "" && svcDerived.GetLastName() != dbDerived.GetLastName() {
+		if err := validateLastName(svcDerived.GetLastName()); err != nil {
+			return nil, nil, err
+		}
+		account.lastName = svcDerived.GetLastName()
+	} else {
+		account.lastName = dbDerived.GetLastName()
+	}
+
+	if svcDerived.GetOrganization() != "" && svcDerived.GetOrganization() != dbDerived.GetOrganization() {
+		if err := validateOrganization(svcDerived.GetOrganization()); err != nil {
+			return nil, nil, err
+		}
+		account.organization = svcDerived.GetOrganization()
+	} else {
+		account.organization = dbDerived.GetOrganization()
+	}
+
+	account.password = dbDerived.GetPassword()
+	if svcDerived.GetPassword() != "" {
+		if err := checkPasswordPolicy(svcDerived.GetPassword(), &pblib.User{
+			FirstName:        account.firstName,
+			LastName:         account.lastName,
+			Email:            dbDerived.GetEmail(),
+			ProspectiveEmail: svcDerived.GetEmail(),
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		hashedPassword, err := hashPassword(svcDerived.GetPassword())
+		if err != nil {
+			return nil, nil, err
+		}
+		account.password = hashedPassword
+	}
+
+	account.isVerified = dbDerived.GetIsVerified()
+	account.prospectiveEmail = ""
+
+	var newEmailID *pblib.Identification
+	if svcDerived.GetEmail() != "" && svcDerived.GetEmail() != dbDerived.GetEmail() {
+		if err := validateEmail(svcDerived.GetEmail()); err != nil {
+			return nil, nil, err
+		}
+
+		emailTaken, err := t.isEmailTaken(svcDerived.GetEmail())
+		if err != nil {
+			return nil, nil, err
+		}
+		if emailTaken {
+			return nil, nil, consts.ErrEmailExists
+		}
+
+		// does not return error because we can regen a token and thus resend email
+		newEmailID, _ = auth.GenerateEmailIdentification(dbDerived.GetUuid(), dbDerived.GetPermissionLevel())
+		account.prospectiveEmail = svcDerived.GetEmail()
+		account.isVerified = false
+	}
+
+	if account.firstName == "" && account.lastName == "" && account.organization == "" &&
+		account.password == "" && account.prospectiveEmail == "" {
+		return nil, nil, consts.ErrEmptyRequestUser
+	}
+
+	if err := t.putAccount(account); err != nil {
+		return nil, nil, err
+	}
+
+	updatedUser := &pblib.User{
+		Uuid:             uuid,
+		FirstName:        account.firstName,
+		LastName:         account.lastName,
+		Organization:     account.organization,
+		Email:            account.prospectiveEmail,
+		IsVerified:       account.isVerified,
+		ProspectiveEmail: account.prospectiveEmail,
+	}
+
+	if newEmailID != nil {
+		if err := t.deleteEmailTokenRow(uuid, emailTokenPurposeVerifyEmail); err != nil {
+			return nil, nil, err
+		}
+		if err := t.insertEmailToken(uuid, newEmailID.GetToken(), newEmailID.GetSecret(),
+			emailTokenPurposeVerifyEmail); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return updatedUser, newEmailID, nil
+}
+
+func (t *memoryTx) updatePermissionLevel(uuid string, permissionLevel string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+	if _, ok := auth.PermissionEnumMap[permissionLevel]; !ok {
+		return authconst.ErrInvalidPermission
+	}
+
+	if account, ok := t.tables.accounts[uuid]; ok {
+		account.permissionLevel = permissionLevel
+		t.tables.accounts[uuid] = account
+	}
+
+	return nil
+}
+
+func (t *memoryTx) countAdmins() (int, error) {
+	var count int
+	for uuid, account := range t.tables.accounts {
+		if account.permissionLevel != auth.PermissionStringMap[auth.Admin] {
+			continue
+		}
+		suspension, err := t.getSuspensionRow(uuid)
+		if err != nil {
+			return 0, err
+		}
+		if suspension == nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (t *memoryTx) matchEmailAndPassword(email string, password string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+
+	account, ok := t.accountByEmail(email, false)
+	if !ok {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+
+	if err := comparePassword(account.password, password); err != nil {
+		return nil, err
+	}
+
+	if needsPasswordRehash(account.password) {
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		account.password = hashedPassword
+		if err := t.putAccount(account); err != nil {
+			return nil, err
+		}
+	}
+
+	return account.toUser(), nil
+}
+
+func (t *memoryTx) isEmailTaken(prospectiveEmail string) (bool, error) {
+	if err := validateEmail(prospectiveEmail); err != nil {
+		return false, err
+	}
+
+	if _, ok := t.accountByEmail(prospectiveEmail, false); ok {
+		return true, nil
+	}
+	_, ok := t.accountByEmail(prospectiveEmail, true)
+
+	return ok, nil
+}
+
+func (t *memoryTx) swapProspectiveEmailRow(uuid string) (string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return "", err
+	}
+
+	account, ok := t.tables.accounts[uuid]
+	if !ok {
+		return "", consts.ErrUserNotFound
+	}
+
+	if account.prospectiveEmail == "" {
+		return "", consts.ErrNoPendingEmailVerification
+	}
+
+	oldEmail := account.email
+	account.email = account.prospectiveEmail
+	account.prospectiveEmail = ""
+	account.isVerified = true
+	if auth.PermissionEnumMap[account.permissionLevel] < auth.User {
+		account.permissionLevel = auth.PermissionStringMap[auth.User]
+	}
+
+	if err := t.putAccount(account); err != nil {
+		return "", err
+	}
+
+	return oldEmail, nil
+}
+
+func (t *memoryTx) resetPasswordRow(uuid string, hashedPassword string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if hashedPassword == "" {
+		return consts.ErrInvalidPassword
+	}
+
+	account, ok := t.tables.accounts[uuid]
+	if !ok {
+		return consts.ErrUUIDNotFound
+	}
+	account.password = hashedPassword
+	t.tables.accounts[uuid] = account
+
+	return t.revokeAuthTokens(uuid)
+}
+
+func (t *memoryTx) listUserRows(query *listUsersQuery) ([]*pblib.User, *listUsersCursor, error) {
+	if query == nil {
+		return nil, nil, consts.ErrInvalidListUsersFilter
+	}
+
+	if _, ok := listUsersSortColumns[query.sortBy]; !ok {
+		return nil, nil, consts.ErrInvalidListUsersSortBy
+	}
+
+	if query.pageSize <= 0 || query.pageSize > maxListUsersPageSize {
+		return nil, nil, consts.ErrInvalidListUsersPageSize
+	}
+
+	if query.permissionLevel != "" {
+		if _, ok := auth.PermissionEnumMap[query.permissionLevel]; !ok {
+			return nil, nil, authconst.ErrInvalidPermission
+		}
+	}
+
+	var cursor *memoryAccountRow
+	if query.cursor != nil {
+		if query.cursor.SortBy != query.sortBy || query.cursor.Descending != query.descending {
+			return nil, nil, consts.ErrInvalidListUsersCursor
+		}
+		if err := validation.ValidateUserUUID(query.cursor.UUID); err != nil {
+			return nil, nil, consts.ErrInvalidListUsersCursor
+		}
+
+		var err error
+		if cursor, err = newMemoryListUsersCursorRow(query.cursor); err != nil {
+			return nil, nil, consts.ErrInvalidListUsersCursor
+		}
+	}
+
+	// compare orders rows by the sort column, then uuid
+	compare := func(a memoryAccountRow, b memoryAccountRow) int {
+		result := 0
+		switch query.sortBy {
+		case listUsersSortByPermissionLevel:
+			result = int(auth.PermissionEnumMap[a.permissionLevel]) - int(auth.PermissionEnumMap[b.permissionLevel])
+		case listUsersSortByIsVerified:
+			if a.isVerified != b.isVerified {
+				result = 1
+				if b.isVerified {
+					result = -1
+				}
+			}
+		case listUsersSortByOrganization:
+			result = compareStrings(a.organization, b.organization)
+		case listUsersSortByCreatedTimestamp:
+			if a.createdTimestamp.Before(b.createdTimestamp) {
+				result = -1
+			} else if a.createdTimestamp.After(b.createdTimestamp) {
+				result = 1
+			}
+		}
+		if result == 0 {
+			result = compareStrings(a.uuid, b.uuid)
+		}
+		if query.descending {
+			return -result
+		}
+		return result
+	}
+
+	var rows []memoryAccountRow
+	for _, account := range t.tables.accounts {
+		if query.permissionLevel != "" && account.permissionLevel != query.permissionLevel {
+			continue
+		}
+		if query.isVerified != nil && account.isVerified != *query.isVerified {
+			continue
+		}
+		if query.organization != "" && account.organization != query.organization {
+			continue
+		}
+		if query.createdAfter > 0 && account.createdTimestamp.Before(time.Unix(query.createdAfter, 0)) {
+			continue
+		}
+		if query.createdBefore > 0 && !account.createdTimestamp.Before(time.Unix(query.createdBefore, 0)) {
+			continue
+		}
+		if cursor != nil && compare(account, *cursor) <= 0 {
+			continue
+		}
+		rows = append(rows, account)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return compare(rows[i], rows[j]) < 0
+	})
+
+	var users []*pblib.User
+	for i, row := range rows {
+		if i == query.pageSize {
+			// extra row exists, build the cursor from the last row of this page
+			lastRow := rows[i-1]
+			nextCursor := &listUsersCursor{
+				SortBy:     query.sortBy,
+				Descending: query.descending,
+				UUID:       lastRow.uuid,
+			}
+			switch query.sortBy {
+			case listUsersSortByPermissionLevel:
+				nextCursor.Value = lastRow.permissionLevel
+			case listUsersSortByIsVerified:
+				nextCursor.Value = strconv.FormatBool(lastRow.isVerified)
+			case listUsersSortByOrganization:
+				nextCursor.Value = lastRow.organization
+			case listUsersSortByCreatedTimestamp:
+				nextCursor.Value = lastRow.createdTimestamp.Format(time.RFC3339Nano)
+			}
+
+			return users, nextCursor, nil
+		}
+		users = append(users, row.toUser())
+	}
+
+	return users, nil, nil
+}
+
+// newMemoryListUsersCursorRow converts the cursor to a row holding only the cursor's sort column and uuid.
+// Returns error if the cursor value can not be cast to the sort column's type.
+func newMemoryListUsersCursorRow(cursor *listUsersCursor) (*memoryAccountRow, error) {
+	row := &memoryAccountRow{uuid: cursor.UUID}
+
+	switch cursor.SortBy {
+	case listUsersSortByPermissionLevel:
+		if _, ok := auth.PermissionEnumMap[cursor.Value]; !ok {
+			return nil, authconst.ErrInvalidPermission
+		}
+		row.permissionLevel = cursor.Value
+	case listUsersSortByIsVerified:
+		isVerified, err := strconv.ParseBool(cursor.Value)
+		if err != nil {
+			return nil, err
+		}
+		row.isVerified = isVerified
+	case listUsersSortByOrganization:
+		row.organization = cursor.Value
+	case listUsersSortByCreatedTimestamp:
+		createdTimestamp, err := time.Parse(time.RFC3339Nano, cursor.Value)
+		if err != nil {
+			return nil, err
+		}
+		row.createdTimestamp = createdTimestamp
+	}
+
+	return row, nil
+}
+
+func compareStrings(a string, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (t *memoryTx) getEmailTokenRow(token string) (*tokenEmailRow, error) {
+	if token == "" {
+		return nil, authconst.ErrEmptyToken
+	}
+
+	row, ok := t.tables.emailTokens[hashToken(token)]
+	if !ok {
+		return nil, consts.ErrNoMatchingEmailTokenFound
+	}
+
+	var secretKey string
+	if row.sealedSecretKey.masterKeyID != "" {
+		var err error
+		if secretKey, err = openSecretKey(row.tokenHash, &row.sealedSecretKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tokenEmailRow{
+		token:               token,
+		secretKey:           secretKey,
+		createdTimestamp:    row.createdTimestamp,
+		expirationTimestamp: row.expirationTimestamp,
+		uuid:                row.uuid,
+		purpose:             row.purpose,
+	}, nil
+}
+
+func (t *memoryTx) deleteEmailTokenRow(uuid string, purpose string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return authconst.ErrInvalidUUID
+	}
+
+	if err := validateEmailTokenPurpose(purpose); err != nil {
+		return err
+	}
+
+	for token, row := range t.tables.emailTokens {
+		if row.uuid == uuid && row.purpose == purpose {
+			delete(t.tables.emailTokens, token)
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) getActiveSecretRow() (*pblib.Secret, error) {
+	if _, ok := t.tables.secrets[t.tables.activeSecretHash]; !ok {
+		return nil, consts.ErrNoActiveSecretKeyFound
+	}
+
+	return t.openSecret(t.tables.activeSecretHash)
+}
+
+// openSecret returns the secret keyed by secretHash with its key opened.
+func (t *memoryTx) openSecret(secretHash string) (*pblib.Secret, error) {
+	secret := t.tables.secrets[secretHash]
+	key, err := openSecretKey(secretHash, &secret.sealedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pblib.Secret{
+		Key:                 key,
+		CreatedTimestamp:    secret.createdTimestamp.Unix(),
+		ExpirationTimestamp: secret.expirationTimestamp.Unix(),
+	}, nil
+}
+
+// insertNewAuthSecret inserts a new secret and makes it the active secret, like the secrets table trigger.
+func (t *memoryTx) insertNewAuthSecret() error {
+	row, err := newSigningKeyRow(conf.TokenSigning.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	secretHash := hashToken(row.key)
+	if _, ok := t.tables.secrets[secretHash]; ok {
+		return errUniqueViolation("secrets_pkey")
+	}
+
+	sealed, err := sealEnvelope([]byte(row.key), []byte(secretHash))
+	if err != nil {
+		return err
+	}
+
+	t.tables.secrets[secretHash] = memorySecretRow{
+		keyHash:             secretHash,
+		sealedKey:           *sealed,
+		algorithm:           row.algorithm,
+		publicKey:           row.publicKey,
+		privateKey:          row.privateKey,
+		createdTimestamp:    time.Unix(row.createdTimestamp, 0).UTC(),
+		expirationTimestamp: time.Unix(row.expirationTimestamp, 0).UTC(),
+	}
+	t.tables.activeSecretHash = secretHash
+
+	return nil
+}
+
+func (t *memoryTx) getSigningKeyRow(secretKey string) (*signingKeyRow, error) {
+	secret, ok := t.tables.secrets[hashToken(secretKey)]
+	if !ok {
+		return nil, consts.ErrSigningKeyNotFound
+	}
+
+	key, err := openSecretKey(secret.keyHash, &secret.sealedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKeyRow{
+		key:                 key,
+		algorithm:           secret.algorithm,
+		publicKey:           secret.publicKey,
+		privateKey:          secret.privateKey,
+		createdTimestamp:    secret.createdTimestamp.Unix(),
+		expirationTimestamp: secret.expirationTimestamp.Unix(),
+	}, nil
+}
+
+func (t *memoryTx) listSigningKeys() ([]*signingKeyRow, error) {
+	now := time.Now()
+	keys := []*signingKeyRow{}
+	for _, secret := range t.tables.secrets {
+		if secret.algorithm == signingAlgorithmHMAC || !now.Before(secret.expirationTimestamp) {
+			continue
+		}
+
+		key, err := openSecretKey(secret.keyHash, &secret.sealedKey)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &signingKeyRow{
+			key:                 key,
+			algorithm:           secret.algorithm,
+			publicKey:           secret.publicKey,
+			createdTimestamp:    secret.createdTimestamp.Unix(),
+			expirationTimestamp: secret.expirationTimestamp.Unix(),
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		isActive := hashToken(keys[i].key) == t.tables.activeSecretHash
+		if isActive || hashToken(keys[j].key) == t.tables.activeSecretHash {
+			return isActive
+		}
+		return keys[i].createdTimestamp > keys[j].createdTimestamp
+	})
+
+	return keys, nil
+}
+
+func (t *memoryTx) getLatestSecret(seconds int) (string, error) {
+	if seconds == 0 {
+		return "", consts.ErrInvalidAddTime
+	}
+
+	interval := time.Now().UTC().Add(time.Second * time.Duration(-seconds))
+	for _, secret := range t.tables.secrets {
+		if secret.createdTimestamp.After(interval) {
+			return openSecretKey(secret.keyHash, &secret.sealedKey)
+		}
+	}
+
+	return "", consts.ErrNoRowsFound
+}
+
+func (t *memoryTx) hasActiveAuthSecret() (bool, error) {
+	_, ok := t.tables.secrets[t.tables.activeSecretHash]
+	return ok, nil
+}
+
+func (t *memoryTx) insertAuthToken(token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error {
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+	if err := auth.ValidateHeader(header); err != nil {
+		return err
+	}
+	if err := auth.ValidateBody(body); err != nil {
+		return err
+	}
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	tokenHash, secretHash := hashToken(token), hashToken(secret.GetKey())
+	if _, ok := t.tables.authTokens[tokenHash]; ok {
+		return errUniqueViolation("auth_tokens_pkey")
+	}
+	if _, ok := t.tables.secrets[secretHash]; !ok {
+		return errForeignKeyViolation("auth_tokens", "auth_tokens_secret_key_fkey")
+	}
+
+	t.tables.authTokens[tokenHash] = memoryAuthTokenRow{
+		tokenHash:           tokenHash,
+		secretHash:          secretHash,
+		permission:          auth.PermissionStringMap[body.Permission],
+		expirationTimestamp: time.Unix(body.ExpirationTimestamp, 0),
+		uuid:                body.UUID,
+	}
+
+	return nil
+}
+
+// getAuthTokenRow returns the unexpired, unrevoked auth token of uuid that expires last.
+func (t *memoryTx) getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, authconst.ErrInvalidUUID
+	}
+
+	now := time.Now()
+	var latest *memoryAuthTokenRow
+	for _, row := range t.tables.authTokens {
+		if row.uuid != uuid || !now.Before(row.expirationTimestamp) || !row.revokedTimestamp.IsZero() {
+			continue
+		}
+		if latest == nil || row.expirationTimestamp.After(latest.expirationTimestamp) {
+			row := row
+			latest = &row
+		}
+	}
+	if latest == nil {
+		return nil, consts.ErrNoAuthTokenFound
+	}
+
+	secret, err := t.openSecret(latest.secretHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenAuthRow{
+		uuid:       latest.uuid,
+		permission: latest.permission,
+		tokenHash:  latest.tokenHash,
+		secret:     secret,
+	}, nil
+}
+
+func (t *memoryTx) pairTokenWithSecret(token string) (*pblib.Identification, error) {
+	if token == "" {
+		return nil, authconst.ErrEmptyToken
+	}
+
+	row, ok := t.tables.authTokens[hashToken(token)]
+	if !ok {
+		return nil, consts.ErrNoMatchingAuthTokenFound
+	}
+	if !row.revokedTimestamp.IsZero() {
+		return nil, consts.ErrAuthTokenRevoked
+	}
+
+	secret, err := t.openSecret(row.secretHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pblib.Identification{
+		Token:  token,
+		Secret: secret,
+	}, nil
+}
+
+func (t *memoryTx) revokeAuthToken(token string) error {
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	tokenHash := hashToken(token)
+	row, ok := t.tables.authTokens[tokenHash]
+	if !ok || !row.revokedTimestamp.IsZero() {
+		return consts.ErrNoMatchingAuthTokenFound
+	}
+
+	row.revokedTimestamp = time.Now().UTC()
+	t.tables.authTokens[tokenHash] = row
+	return nil
+}
+
+func (t *memoryTx) revokeAuthTokens(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for token, row := range t.tables.authTokens {
+		if row.uuid == uuid && row.revokedTimestamp.IsZero() {
+			row.revokedTimestamp = now
+			t.tables.authTokens[token] = row
+		}
+	}
+	for hash, row := range t.tables.refreshTokens {
+		if row.uuid == uuid {
+			delete(t.tables.refreshTokens, hash)
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) listStaleDataKeys(masterKeyID string, limit int) ([]*dataKeyRow, error) {
+	if limit <= 0 {
+		return nil, consts.ErrInvalidBatchSize
+	}
+
+	dataKeys := []*dataKeyRow{}
+	for hash, secret := range t.tables.secrets {
+		if len(dataKeys) == limit {
+			return dataKeys, nil
+		}
+		if secret.sealedKey.masterKeyID != masterKeyID {
+			dataKeys = append(dataKeys, &dataKeyRow{table: dataKeyTableSecrets, key: hash,
+				dataKey: secret.sealedKey.dataKey, masterKeyID: secret.sealedKey.masterKeyID})
+		}
+	}
+	for hash, secret := range t.tables.secrets {
+		if len(dataKeys) == limit {
+			return dataKeys, nil
+		}
+		if secret.privateKey != nil && secret.privateKey.masterKeyID != masterKeyID {
+			dataKeys = append(dataKeys, &dataKeyRow{table: dataKeyTablePrivateKeys, key: hash,
+				dataKey: secret.privateKey.dataKey, masterKeyID: secret.privateKey.masterKeyID})
+		}
+	}
+	for hash, row := range t.tables.emailTokens {
+		if len(dataKeys) == limit {
+			return dataKeys, nil
+		}
+		if row.sealedSecretKey.masterKeyID != "" && row.sealedSecretKey.masterKeyID != masterKeyID {
+			dataKeys = append(dataKeys, &dataKeyRow{table: dataKeyTableEmailTokens, key: hash,
+				dataKey: row.sealedSecretKey.dataKey, masterKeyID: row.sealedSecretKey.masterKeyID})
+		}
+	}
+	for uuid, row := range t.tables.totpSecrets {
+		if len(dataKeys) == limit {
+			return dataKeys, nil
+		}
+		if row.secret.masterKeyID != masterKeyID {
+			dataKeys = append(dataKeys, &dataKeyRow{table: dataKeyTableTOTPSecrets, key: uuid,
+				dataKey: row.secret.dataKey, masterKeyID: row.secret.masterKeyID})
+		}
+	}
+
+	return dataKeys, nil
+}
+
+func (t *memoryTx) updateDataKey(row *dataKeyRow) error {
+	switch row.table {
+	case dataKeyTableSecrets:
+		if secret, ok := t.tables.secrets[row.key]; ok {
+			secret.sealedKey.dataKey, secret.sealedKey.masterKeyID = row.dataKey, row.masterKeyID
+			t.tables.secrets[row.key] = secret
+		}
+	case dataKeyTablePrivateKeys:
+		if secret, ok := t.tables.secrets[row.key]; ok && secret.privateKey != nil {
+			privateKey := *secret.privateKey
+			privateKey.dataKey, privateKey.masterKeyID = row.dataKey, row.masterKeyID
+			secret.privateKey = &privateKey
+			t.tables.secrets[row.key] = secret
+		}
+	case dataKeyTableEmailTokens:
+		if token, ok := t.tables.emailTokens[row.key]; ok {
+			token.sealedSecretKey.dataKey, token.sealedSecretKey.masterKeyID = row.dataKey, row.masterKeyID
+			t.tables.emailTokens[row.key] = token
+		}
+	case dataKeyTableTOTPSecrets:
+		if totp, ok := t.tables.totpSecrets[row.key]; ok {
+			totp.secret.dataKey, totp.secret.masterKeyID = row.dataKey, row.masterKeyID
+			t.tables.totpSecrets[row.key] = totp
+		}
+	default:
+		return consts.ErrUnknownDataKeyTable
+	}
+
+	return nil
+}
+
+func (t *memoryTx) insertRefreshToken(tokenHash string, familyID string, uuid string,
+	expirationTimestamp time.Time) error {
+	if tokenHash == "" || familyID == "" {
+		return consts.ErrInvalidRefreshToken
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.accounts[uuid]; !ok {
+		return errForeignKeyViolation("refresh_tokens", "refresh_tokens_uuid_fkey")
+	}
+	if _, ok := t.tables.refreshTokens[tokenHash]; ok {
+		return errUniqueViolation("refresh_tokens_pkey")
+	}
+
+	now := time.Now().UTC()
+	for hash, row := range t.tables.refreshTokens {
+		if row.uuid == uuid && row.expirationTimestamp < now.Unix() {
+			delete(t.tables.refreshTokens, hash)
+		}
+	}
+
+	t.tables.refreshTokens[tokenHash] = refreshTokenRow{
+		tokenHash:           tokenHash,
+		familyID:            familyID,
+		uuid:                uuid,
+		createdTimestamp:    now.Unix(),
+		expirationTimestamp: expirationTimestamp.Unix(),
+	}
+	return nil
+}
+
+func (t *memoryTx) getRefreshTokenRow(tokenHash string) (*refreshTokenRow, error) {
+	if tokenHash == "" {
+		return nil, consts.ErrInvalidRefreshToken
+	}
+
+	row, ok := t.tables.refreshTokens[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+
+	return &row, nil
+}
+
+func (t *memoryTx) useRefreshToken(tokenHash string) (bool, error) {
+	if tokenHash == "" {
+		return false, consts.ErrInvalidRefreshToken
+	}
+
+	row, ok := t.tables.refreshTokens[tokenHash]
+	if !ok || row.isUsed {
+		return false, nil
+	}
+
+	row.isUsed = true
+	t.tables.refreshTokens[tokenHash] = row
+	return true, nil
+}
+
+func (t *memoryTx) deleteRefreshTokenFamily(familyID string) error {
+	if familyID == "" {
+		return consts.ErrInvalidRefreshToken
+	}
+
+	for hash, row := range t.tables.refreshTokens {
+		if row.familyID == familyID {
+			delete(t.tables.refreshTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (t *memoryTx) insertTOTPSecret(uuid string, sealedSecret *envelope) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if sealedSecret == nil || len(sealedSecret.ciphertext) == 0 || sealedSecret.masterKeyID == "" {
+		return consts.ErrInvalidTOTPSecret
+	}
+
+	if _, ok := t.tables.accounts[uuid]; !ok {
+		return errForeignKeyViolation("totp_secrets", "totp_secrets_uuid_fkey")
+	}
+	if row, ok := t.tables.totpSecrets[uuid]; ok && row.isConfirmed {
+		return consts.ErrTOTPAlreadyEnrolled
+	}
+
+	t.tables.totpSecrets[uuid] = totpRow{
+		uuid:             uuid,
+		secret:           *sealedSecret,
+		createdTimestamp: time.Now().UTC().Unix(),
+	}
+	return nil
+}
+
+func (t *memoryTx) getTOTPRow(uuid string) (*totpRow, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	row, ok := t.tables.totpSecrets[uuid]
+	if !ok {
+		return nil, nil
+	}
+
+	return &row, nil
+}
+
+func (t *memoryTx) confirmTOTP(uuid string, step int64, recoveryCodeHashes []string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	row, ok := t.tables.totpSecrets[uuid]
+	if !ok || row.isConfirmed {
+		return consts.ErrTOTPNotEnrolled
+	}
+
+	row.isConfirmed = true
+	row.lastUsedStep = step
+	t.tables.totpSecrets[uuid] = row
+
+	hashes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		hashes[hash] = true
+	}
+	t.tables.recoveryCodes[uuid] = hashes
+
+	return nil
+}
+
+func (t *memoryTx) useTOTPStep(uuid string, step int64) (bool, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, err
+	}
+
+	row, ok := t.tables.totpSecrets[uuid]
+	if !ok || !row.isConfirmed || row.lastUsedStep >= step {
+		return false, nil
+	}
+
+	row.lastUsedStep = step
+	t.tables.totpSecrets[uuid] = row
+	return true, nil
+}
+
+func (t *memoryTx) useTOTPRecoveryCode(uuid string, codeHash string) (bool, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, err
+	}
+
+	if !t.tables.recoveryCodes[uuid][codeHash] {
+		return false, nil
+	}
+
+	delete(t.tables.recoveryCodes[uuid], codeHash)
+	return true, nil
+}
+
+func (t *memoryTx) deleteTOTP(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.totpSecrets[uuid]; !ok {
+		return consts.ErrTOTPNotEnrolled
+	}
+
+	delete(t.tables.totpSecrets, uuid)
+	delete(t.tables.recoveryCodes, uuid)
+	return nil
+}
+
+// roleGrantKey mirrors the primary key of user_security.user_roles.
+func roleGrantKey(uuid string, role string, organization string) string {
+	return uuid + "/" + role + "/" + organization
+}
+
+func (t *memoryTx) getRolePermissions(role string) ([]string, error) {
+	if role == "" {
+		return nil, consts.ErrInvalidRole
+	}
+
+	permissions, ok := t.tables.rolePermissions[role]
+	if !ok {
+		return nil, consts.ErrRoleNotFound
+	}
+
+	list := make([]string, 0, len(permissions))
+	for permission := range permissions {
+		list = append(list, permission)
+	}
+	sort.Strings(list)
+
+	return list, nil
+}
+
+func (t *memoryTx) listRoleGrants(uuid string) ([]*roleGrant, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	grants := []*roleGrant{}
+	for _, grant := range t.tables.userRoles {
+		if grant.uuid == uuid {
+			grant := grant
+			grants = append(grants, &grant)
+		}
+	}
+
+	sort.Slice(grants, func(i, j int) bool {
+		if !grants[i].grantedTimestamp.Equal(grants[j].grantedTimestamp) {
+			return grants[i].grantedTimestamp.Before(grants[j].grantedTimestamp)
+		}
+		if grants[i].role != grants[j].role {
+			return grants[i].role < grants[j].role
+		}
+		return grants[i].organization < grants[j].organization
+	})
+
+	return grants, nil
+}
+
+func (t *memoryTx) insertRoleGrant(grant *roleGrant) error {
+	if err := validation.ValidateUserUUID(grant.uuid); err != nil {
+		return err
+	}
+
+	if _, err := t.getRolePermissions(grant.role); err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.accounts[grant.uuid]; !ok {
+		return errForeignKeyViolation("user_roles", "user_roles_uuid_fkey")
+	}
+
+	key := roleGrantKey(grant.uuid, grant.role, grant.organization)
+	if _, ok := t.tables.userRoles[key]; ok {
+		return nil
+	}
+
+	t.tables.userRoles[key] = roleGrant{
+		uuid:             grant.uuid,
+		role:             grant.role,
+		organization:     grant.organization,
+		grantedBy:        grant.grantedBy,
+		grantedTimestamp: grant.grantedTimestamp.UTC(),
+	}
+
+	return nil
+}
+
+func (t *memoryTx) deleteRoleGrant(uuid string, role string, organization string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if role == "" {
+		return consts.ErrInvalidRole
+	}
+
+	delete(t.tables.userRoles, roleGrantKey(uuid, role, organization))
+	return nil
+}
+
+func (t *memoryTx) getSuspensionRow(uuid string) (*suspensionRow, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	row, ok := t.tables.suspensions[uuid]
+	if !ok || (!row.suspendedUntil.IsZero() && !row.suspendedUntil.After(time.Now())) {
+		return nil, nil
+	}
+
+	return &row, nil
+}
+
+func (t *memoryTx) insertSuspension(row *suspensionRow) error {
+	if err := validation.ValidateUserUUID(row.uuid); err != nil {
+		return err
+	}
+	if row.reason == "" {
+		return consts.ErrInvalidSuspensionReason
+	}
+
+	if _, ok := t.tables.accounts[row.uuid]; !ok {
+		return errForeignKeyViolation("suspensions", "suspensions_uuid_fkey")
+	}
+
+	t.tables.suspensions[row.uuid] = suspensionRow{
+		uuid:               row.uuid,
+		reason:             row.reason,
+		suspendedBy:        row.suspendedBy,
+		suspendedTimestamp: row.suspendedTimestamp.UTC(),
+		suspendedUntil:     row.suspendedUntil.UTC(),
+	}
+
+	return nil
+}
+
+func (t *memoryTx) deleteSuspension(uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.suspensions[uuid]; !ok {
+		return consts.ErrUserNotSuspended
+	}
+
+	delete(t.tables.suspensions, uuid)
+	return nil
+}
+
+func (t *memoryTx) insertDocumentRow(duid string, uuid string, isPublic bool) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if _, ok := t.tables.documents[duid]; ok {
+		return errUniqueViolation("documents_pkey")
+	}
+	if _, ok := t.tables.accounts[uuid]; !ok {
+		return errForeignKeyViolation("documents", "documents_uuid_fkey")
+	}
+
+	t.tables.documents[duid] = documentRow{duid: duid, uuid: uuid, isPublic: isPublic}
+	return nil
+}
+
+func (t *memoryTx) getDocumentRow(duid string) (*documentRow, error) {
+	if err := validateDUID(duid); err != nil {
+		return nil, err
+	}
+
+	document, ok := t.tables.documents[duid]
+	if !ok {
+		return nil, consts.ErrDocumentNotFound
+	}
+
+	return &document, nil
+}
+
+func (t *memoryTx) updateDocumentIsPublic(duid string, isPublic bool) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	document, ok := t.tables.documents[duid]
+	if !ok {
+		return consts.ErrDocumentNotFound
+	}
+	document.isPublic = isPublic
+	t.tables.documents[duid] = document
+
+	return nil
+}
+
+func (t *memoryTx) getOwnedDocuments(uuid string) (map[string]*pblib.UserDocumentMetadata, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	documents := make(map[string]*pblib.UserDocumentMetadata)
+	for duid, document := range t.tables.documents {
+		if document.uuid != uuid {
+			continue
+		}
+
+		sharedWith := make(map[string]bool)
+		for sharedUUID := range t.tables.sharedDocuments[duid] {
+			sharedWith[sharedUUID] = true
+		}
+		documents[duid] = &pblib.UserDocumentMetadata{
+			IsPublic:   document.isPublic,
+			SharedWith: sharedWith,
+		}
+	}
+
+	return documents, nil
+}
+
+// insertSharedDocumentRows shares duid with every uuid, either all uuids are shared or none.
+func (t *memoryTx) insertSharedDocumentRows(duid string, uuids []string) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if len(uuids) == 0 {
+		return consts.ErrNoShareRecipients
+	}
+
+	for _, uuid := range uuids {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			return err
+		}
+		if _, ok := t.tables.accounts[uuid]; !ok {
+			return errForeignKeyViolation("shared_documents", "shared_documents_uuid_fkey")
+		}
+	}
+	if _, ok := t.tables.documents[duid]; !ok {
+		return errForeignKeyViolation("shared_documents", "shared_documents_duid_fkey")
+	}
+
+	if t.tables.sharedDocuments[duid] == nil {
+		t.tables.sharedDocuments[duid] = make(map[string]bool)
+	}
+	for _, uuid := range uuids {
+		t.tables.sharedDocuments[duid][uuid] = true
+	}
+
+	return nil
+}
+
+func (t *memoryTx) deleteSharedDocumentRows(duid string, uuids []string) error {
+	if err := validateDUID(duid); err != nil {
+		return err
+	}
+
+	if len(uuids) == 0 {
+		return consts.ErrNoShareRecipients
+	}
+
+	for _, uuid := range uuids {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			return err
+		}
+	}
+	for _, uuid := range uuids {
+		delete(t.tables.sharedDocuments[duid], uuid)
+	}
+
+	return nil
+}
+
+// getSharedDocumentUUIDs returns the uuids ordered by uuid, like the postgres query.
+func (t *memoryTx) getSharedDocumentUUIDs(duid string) ([]string, error) {
+	if err := validateDUID(duid); err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for uuid := range t.tables.sharedDocuments[duid] {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	return uuids, nil
+}
+
+func (t *memoryTx) getDocumentsSharedToUUID(uuid string) (map[string]*pblib.UserFriendMetadata, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	sharedToMe := make(map[string]*pblib.UserFriendMetadata)
+	for duid, uuids := range t.tables.sharedDocuments {
+		if !uuids[uuid] {
+			continue
+		}
+
+		ownerUUID := t.tables.documents[duid].uuid
+		friend, ok := sharedToMe[ownerUUID]
+		if !ok {
+			friend = &pblib.UserFriendMetadata{SharedDuidToMe: make(map[string]bool)}
+			sharedToMe[ownerUUID] = friend
+		}
+		friend.SharedDuidToMe[duid] = true
+	}
+
+	return sharedToMe, nil
+}
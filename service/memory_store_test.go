@@ -0,0 +1,625 @@
+package service
+
+import (
+	"errors"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func unitTestMemoryUser(store *memoryStore, lastName string) (*pblib.User, error) {
+	user := unitTestUserGenerator(lastName)
+	user.Uuid, _ = generateUUID()
+
+	err := store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewUser(user)
+	})
+
+	return user, err
+}
+
+func TestNewStore(t *testing.T) {
+	cases := []struct {
+		desc     string
+		backend  string
+		isExpErr bool
+	}{
+		{"test postgres backend", StoreBackendPostgres, false},
+		{"test memory backend", StoreBackendMemory, false},
+		{"test unknown backend", "mongo", true},
+	}
+
+	for _, c := range cases {
+		store, err := NewStore(c.backend)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidStoreBackend.Error(), c.desc)
+			assert.Nil(t, store, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.NotNil(t, store, c.desc)
+		}
+	}
+}
+
+func TestMemoryStoreWithTx(t *testing.T) {
+	store := newMemoryStore()
+	user := unitTestUserGenerator("MemoryStoreWithTx-One")
+	user.Uuid, _ = generateUUID()
+	errRollback := errors.New("rollback")
+
+	// rolled back insert is not visible
+	err := store.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertNewUser(user); err != nil {
+			return err
+		}
+		_, err := tx.getUserRow(user.GetUuid())
+		assert.Nil(t, err)
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	assert.Empty(t, store.tables.accounts)
+
+	// committed insert is visible
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewUser(user)
+	})
+	assert.Nil(t, err)
+	assert.Len(t, store.tables.accounts, 1)
+
+	// cancelled context does not begin a transaction
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err = store.WithTx(ctx, func(tx UserTx) error {
+		return tx.deleteUserRow(user.GetUuid())
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, store.tables.accounts, 1)
+	assert.Equal(t, context.Canceled, store.Ping(ctx))
+}
+
+func TestMemoryStoreUniqueEmails(t *testing.T) {
+	store := newMemoryStore()
+	user1, err := unitTestMemoryUser(store, "MemoryStoreUniqueEmails-One")
+	assert.Nil(t, err)
+	user2, err := unitTestMemoryUser(store, "MemoryStoreUniqueEmails-Two")
+	assert.Nil(t, err)
+
+	// duplicate uuid and email
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewUser(user1)
+	})
+	assert.EqualError(t, err, errUniqueViolation("accounts_pkey").Error())
+
+	duplicateEmail := unitTestUserGenerator("MemoryStoreUniqueEmails-Three")
+	duplicateEmail.Uuid, _ = generateUUID()
+	duplicateEmail.Email = user1.GetEmail()
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewUser(duplicateEmail)
+	})
+	assert.EqualError(t, err, errUniqueViolation("accounts_email_key").Error())
+
+	// prospective email can not be another user's email or prospective email
+	prospectiveEmail := unitTestEmailGenerator()
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		dbDerived, err := tx.getUserRow(user1.GetUuid())
+		if err != nil {
+			return err
+		}
+		_, emailID, err := tx.updateUserRow(user1.GetUuid(), &pblib.User{Email: prospectiveEmail}, dbDerived)
+		assert.NotNil(t, emailID)
+		return err
+	})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc  string
+		email string
+	}{
+		{"test another user's email", user1.GetEmail()},
+		{"test another user's prospective email", prospectiveEmail},
+	}
+
+	for _, c := range cases {
+		err = store.WithTx(context.TODO(), func(tx UserTx) error {
+			dbDerived, err := tx.getUserRow(user2.GetUuid())
+			if err != nil {
+				return err
+			}
+			_, _, err = tx.updateUserRow(user2.GetUuid(), &pblib.User{Email: c.email}, dbDerived)
+			return err
+		})
+		assert.EqualError(t, err, consts.ErrEmailExists.Error(), c.desc)
+	}
+
+	// promoted prospective email frees the old email
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		oldEmail, err := tx.swapProspectiveEmailRow(user1.GetUuid())
+		assert.Equal(t, user1.GetEmail(), oldEmail)
+		return err
+	})
+	assert.Nil(t, err)
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		taken, err := tx.isEmailTaken(user1.GetEmail())
+		assert.False(t, taken)
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreActiveSecret(t *testing.T) {
+	store := newMemoryStore()
+	var prevKey string
+
+	err := store.WithTx(context.TODO(), func(tx UserTx) error {
+		exists, err := tx.hasActiveAuthSecret()
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		_, err = tx.getActiveSecretRow()
+		assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error())
+
+		// every new secret replaces the one active secret
+		for i := 0; i < 2; i++ {
+			if err := tx.insertNewAuthSecret(); err != nil {
+				return err
+			}
+
+			latestKey, err := tx.getLatestSecret(2)
+			assert.Nil(t, err)
+			assert.NotEmpty(t, latestKey)
+
+			activeSecret, err := tx.getActiveSecretRow()
+			assert.Nil(t, err)
+			assert.NotEqual(t, prevKey, activeSecret.GetKey())
+			prevKey = activeSecret.GetKey()
+		}
+
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, store.tables.secrets, 2)
+	assert.Contains(t, store.tables.secrets, store.tables.activeSecretHash)
+	assert.Equal(t, hashToken(prevKey), store.tables.activeSecretHash)
+}
+
+func TestMemoryStoreDeleteUserCascades(t *testing.T) {
+	store := newMemoryStore()
+	owner, err := unitTestMemoryUser(store, "MemoryStoreCascade-One")
+	assert.Nil(t, err)
+	friend, err := unitTestMemoryUser(store, "MemoryStoreCascade-Two")
+	assert.Nil(t, err)
+
+	ownerDUID := unitTestDUIDGenerator()
+	friendDUID := unitTestDUIDGenerator()
+	emailID, err := auth.GenerateEmailIdentification(owner.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err)
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		if err := tx.insertEmailToken(owner.GetUuid(), emailID.GetToken(), emailID.GetSecret(),
+			emailTokenPurposeVerifyEmail); err != nil {
+			return err
+		}
+		if err := tx.insertDocumentRow(ownerDUID, owner.GetUuid(), false); err != nil {
+			return err
+		}
+		if err := tx.insertDocumentRow(friendDUID, friend.GetUuid(), false); err != nil {
+			return err
+		}
+		if err := tx.insertSharedDocumentRows(ownerDUID, []string{friend.GetUuid()}); err != nil {
+			return err
+		}
+		return tx.insertSharedDocumentRows(friendDUID, []string{owner.GetUuid()})
+	})
+	assert.Nil(t, err)
+
+	// foreign keys reject rows of unknown users and documents
+	unknownUUID, _ := generateUUID()
+	unknownDUID := unitTestDUIDGenerator()
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertSharedDocumentRows(ownerDUID, []string{unknownUUID})
+	})
+	assert.EqualError(t, err, errForeignKeyViolation("shared_documents", "shared_documents_uuid_fkey").Error())
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertSharedDocumentRows(unknownDUID, []string{friend.GetUuid()})
+	})
+	assert.EqualError(t, err, errForeignKeyViolation("shared_documents", "shared_documents_duid_fkey").Error())
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.deleteUserRow(owner.GetUuid())
+	})
+	assert.Nil(t, err)
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		_, err := tx.getEmailTokenRow(emailID.GetToken())
+		assert.EqualError(t, err, consts.ErrNoMatchingEmailTokenFound.Error())
+
+		_, err = tx.getDocumentRow(ownerDUID)
+		assert.EqualError(t, err, consts.ErrDocumentNotFound.Error())
+
+		sharedUUIDs, err := tx.getSharedDocumentUUIDs(friendDUID)
+		assert.Nil(t, err)
+		assert.Empty(t, sharedUUIDs)
+
+		sharedToFriend, err := tx.getDocumentsSharedToUUID(friend.GetUuid())
+		assert.Nil(t, err)
+		assert.Empty(t, sharedToFriend)
+
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreService(t *testing.T) {
+	s, _ := unitTestMemoryService(t)
+
+	response, err := s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+
+	user := unitTestUserGenerator("MemoryStoreService-One")
+	password := user.GetPassword()
+	response, err = s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+	uuid := response.GetUser().GetUuid()
+
+	response, err = s.VerifyEmailToken(context.TODO(), &pbsvc.UserRequest{
+		Identification: response.GetIdentification(),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+
+	response, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: password},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uuid, response.GetUser().GetUuid())
+	assert.Equal(t, auth.PermissionStringMap[auth.User], response.GetUser().GetPermissionLevel())
+
+	identification := response.GetIdentification()
+
+	response, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{
+		Identification: identification,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+
+	// a user reads and deletes themself
+	response, err = s.GetUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid},
+		Identification: identification})
+	assert.Nil(t, err)
+	assert.Equal(t, uuid, response.GetUser().GetUuid())
+
+	response, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid},
+		Identification: identification})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+
+	_, err = s.GetUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid},
+		Identification: identification})
+	assert.NotNil(t, err)
+}
+
+func TestMemoryStoreRevokeAuthTokens(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreRevokeAuthTokens-One", auth.User)
+
+	isRevoked := func(identification *pblib.Identification) bool {
+		_, verifyErr := s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+		_, renewErr := s.GetNewAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+		return verifyErr != nil && renewErr != nil
+	}
+
+	// logout revokes the token, the next login gets a new one
+	identification := unitTestLogin(t, s, user)
+	assert.False(t, isRevoked(identification))
+	_, err := s.Logout(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err)
+	assert.True(t, isRevoked(identification))
+	_, err = s.Logout(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+	assert.NotNil(t, err)
+
+	// logout all revokes every token, a user can not log out another user
+	identification = unitTestLogin(t, s, user)
+	other, err := unitTestMemoryUser(store, "MemoryStoreRevokeAuthTokens-Two")
+	assert.Nil(t, err)
+	_, err = s.LogoutAll(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: other.GetUuid()},
+		Identification: identification})
+	assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = unauthorized permission")
+	response, err := s.LogoutAll(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err)
+	assert.Equal(t, user.GetUuid(), response.GetUser().GetUuid())
+	assert.True(t, isRevoked(identification))
+
+	// a new password revokes every token
+	identification = unitTestLogin(t, s, user)
+	user.Password = unitTestPassword("MemoryStoreRevokeAuthTokens-New")
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid(),
+		Password: user.GetPassword()}, Identification: identification})
+	assert.Nil(t, err)
+	assert.True(t, isRevoked(identification))
+
+	// other updates do not
+	identification = unitTestLogin(t, s, user)
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid(),
+		LastName: "Revoked"}, Identification: identification})
+	assert.Nil(t, err)
+	assert.False(t, isRevoked(identification))
+
+	// deleting the user revokes every token
+	_, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+		Identification: identification})
+	assert.Nil(t, err)
+	assert.True(t, isRevoked(identification))
+}
+
+func TestMemoryStoreSetPermissionLevel(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+
+	isRevoked := func(identification *pblib.Identification) bool {
+		_, err := s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+		return err != nil
+	}
+
+	admin := unitTestInsertMemoryUser(t, store, "SetPermissionLevel-Admin", auth.Admin)
+	user := unitTestInsertMemoryUser(t, store, "SetPermissionLevel-User", auth.User)
+	adminIdentification := unitTestLogin(t, s, admin)
+	userIdentification := unitTestLogin(t, s, user)
+	unknownUUID, err := generateUUID()
+	assert.Nil(t, err)
+
+	setLevel := func(identification *pblib.Identification, uuid string, level string) error {
+		_, err := s.SetPermissionLevel(context.TODO(), &pbsvc.UserRequest{
+			User:           &pblib.User{Uuid: uuid, PermissionLevel: level},
+			Identification: identification,
+		})
+		return err
+	}
+	adminLevel, userLevel := auth.PermissionStringMap[auth.Admin], auth.PermissionStringMap[auth.User]
+
+	_, err = s.SetPermissionLevel(context.TODO(), nil)
+	assert.Equal(t, consts.ErrStatusNilRequestUser, err)
+
+	cases := []struct {
+		desc           string
+		identification *pblib.Identification
+		uuid           string
+		level          string
+		expMsg         string
+	}{
+		{"test invalid uuid", adminIdentification, unitTestFailValue, userLevel, consts.ErrStatusUUIDInvalid.Error()},
+		{"test invalid level", adminIdentification, user.GetUuid(), "ROOT",
+			"rpc error: code = InvalidArgument desc = " + consts.ErrInvalidPermissionLevel.Error(),
+		},
+		{"test user promotes themself", userIdentification, user.GetUuid(), adminLevel,
+			"rpc error: code = PermissionDenied desc = unauthorized permission",
+		},
+		{"test unknown uuid", adminIdentification, unknownUUID, userLevel, consts.ErrStatusUUIDNotFound.Error()},
+		{"test demote last admin", adminIdentification, admin.GetUuid(), userLevel,
+			"rpc error: code = FailedPrecondition desc = " + consts.ErrLastAdmin.Error(),
+		},
+		{"test unchanged level", adminIdentification, user.GetUuid(), userLevel, ""},
+	}
+
+	for _, c := range cases {
+		err := setLevel(c.identification, c.uuid, c.level)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+	assert.False(t, isRevoked(userIdentification))
+
+	// promoting revokes the tokens of the previous level, the new admin can demote the first one
+	assert.Nil(t, setLevel(adminIdentification, user.GetUuid(), adminLevel))
+	assert.True(t, isRevoked(userIdentification))
+	userIdentification = unitTestLogin(t, s, user)
+
+	assert.Nil(t, setLevel(userIdentification, admin.GetUuid(), userLevel))
+	assert.True(t, isRevoked(adminIdentification))
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		retrievedUser, err := tx.getUserRow(admin.GetUuid())
+		assert.Nil(t, err)
+		assert.Equal(t, userLevel, retrievedUser.GetPermissionLevel())
+
+		admins, err := tx.countAdmins()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, admins)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// the last admin can not delete themself either
+	lastAdmin := "rpc error: code = FailedPrecondition desc = " + consts.ErrLastAdmin.Error()
+	_, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+		Identification: userIdentification})
+	assert.EqualError(t, err, lastAdmin)
+
+	// suspended admins do not count, suspending the other admin does not let the last one step down
+	second := unitTestInsertMemoryUser(t, store, "SetPermissionLevel-Second", auth.Admin)
+	_, err = s.SuspendUser(metadata.NewIncomingContext(context.TODO(), metadata.Pairs(suspensionReasonKey, "spam")),
+		&pbsvc.UserRequest{User: &pblib.User{Uuid: second.GetUuid()}, Identification: userIdentification})
+	assert.Nil(t, err)
+	assert.EqualError(t, setLevel(userIdentification, user.GetUuid(), userLevel), lastAdmin)
+	_, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+		Identification: userIdentification})
+	assert.EqualError(t, err, lastAdmin)
+
+	// but the suspended admin can be demoted
+	assert.Nil(t, setLevel(userIdentification, second.GetUuid(), userLevel))
+}
+
+func TestMemoryStoreSuspendUser(t *testing.T) {
+	// without a backoff, so the wrong password below does not block the next logins
+	defaultLoginAttempts := loginAttempts
+	loginAttempts = newLoginLimiter(conf.LoginLimitConfig{MaxEmailFailures: 5, MaxIPFailures: 5,
+		Lockout: time.Hour, Window: time.Hour})
+	defer func() { loginAttempts = defaultLoginAttempts }()
+
+	s, store := unitTestMemoryService(t)
+	admin := unitTestInsertMemoryUser(t, store, "SuspendUser-Admin", auth.Admin)
+	user := unitTestInsertMemoryUser(t, store, "SuspendUser-User", auth.User)
+
+	login := func(user *pblib.User) error {
+		_, err := s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+			User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+		})
+		return err
+	}
+	suspend := func(identification *pblib.Identification, uuid string, md metadata.MD) error {
+		_, err := s.SuspendUser(metadata.NewIncomingContext(context.TODO(), md), &pbsvc.UserRequest{
+			User:           &pblib.User{Uuid: uuid},
+			Identification: identification,
+		})
+		return err
+	}
+	reactivate := func(identification *pblib.Identification, uuid string) error {
+		_, err := s.ReactivateUser(context.TODO(), &pbsvc.UserRequest{
+			User:           &pblib.User{Uuid: uuid},
+			Identification: identification,
+		})
+		return err
+	}
+	adminIdentification := unitTestLogin(t, s, admin)
+	userIdentification := unitTestLogin(t, s, user)
+	unknownUUID, err := generateUUID()
+	assert.Nil(t, err)
+	reason := metadata.Pairs(suspensionReasonKey, "spam")
+
+	cases := []struct {
+		desc           string
+		identification *pblib.Identification
+		uuid           string
+		md             metadata.MD
+		expMsg         string
+	}{
+		{"test invalid uuid", adminIdentification, unitTestFailValue, reason, consts.ErrStatusUUIDInvalid.Error()},
+		{"test missing reason", adminIdentification, user.GetUuid(), nil,
+			"rpc error: code = InvalidArgument desc = " + consts.ErrInvalidSuspensionReason.Error(),
+		},
+		{"test user suspends admin", userIdentification, admin.GetUuid(), reason,
+			"rpc error: code = PermissionDenied desc = unauthorized permission",
+		},
+		{"test unknown uuid", adminIdentification, unknownUUID, reason, consts.ErrStatusUUIDNotFound.Error()},
+		{"test suspend self", adminIdentification, admin.GetUuid(), reason,
+			"rpc error: code = FailedPrecondition desc = " + consts.ErrSuspendSelf.Error(),
+		},
+	}
+
+	for _, c := range cases {
+		assert.EqualError(t, suspend(c.identification, c.uuid, c.md), c.expMsg, c.desc)
+	}
+
+	// suspending revokes the tokens of the user and blocks their logins
+	assert.Nil(t, suspend(adminIdentification, user.GetUuid(), reason))
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: userIdentification})
+	assert.NotNil(t, err)
+	assert.Equal(t, consts.ErrStatusUserSuspended, login(user))
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: unitTestPassword("SuspendUser-Wrong")},
+	})
+	assert.Equal(t, consts.ErrStatusInvalidCredentials, err)
+
+	// reactivating lets the user log in again, only once
+	assert.Nil(t, reactivate(adminIdentification, user.GetUuid()))
+	assert.EqualError(t, reactivate(adminIdentification, user.GetUuid()),
+		"rpc error: code = FailedPrecondition desc = "+consts.ErrUserNotSuspended.Error())
+	userIdentification = unitTestLogin(t, s, user)
+
+	// a suspension without revoked tokens is still enforced on the tokens
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertSuspension(&suspensionRow{uuid: user.GetUuid(), reason: "spam", suspendedBy: admin.GetUuid(),
+			suspendedTimestamp: time.Now(), suspendedUntil: time.Now().Add(time.Hour)})
+	})
+	assert.Nil(t, err)
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: userIdentification})
+	assert.Equal(t, consts.ErrStatusUserSuspended, err)
+	_, err = s.GetNewAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: userIdentification})
+	assert.Equal(t, consts.ErrStatusUserSuspended, err)
+
+	// the user is reactivated once the suspension expires
+	row := store.tables.suspensions[user.GetUuid()]
+	row.suspendedUntil = time.Now().Add(-time.Second)
+	store.tables.suspensions[user.GetUuid()] = row
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: userIdentification})
+	assert.Nil(t, err)
+	assert.Nil(t, login(user))
+	assert.EqualError(t, reactivate(adminIdentification, user.GetUuid()),
+		"rpc error: code = FailedPrecondition desc = "+consts.ErrUserNotSuspended.Error())
+}
+
+func TestMemoryStoreConfirmPasswordReset(t *testing.T) {
+	store := newMemoryStore()
+	s := NewService(store)
+	user, err := unitTestMemoryUser(store, "PasswordReset-Memory")
+	assert.Nil(t, err)
+	newPassword := unitTestPassword("PasswordReset-New")
+
+	insertResetToken := func() *pblib.Identification {
+		resetID, err := newResetPasswordIdentification(user.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+		assert.Nil(t, err)
+		err = store.WithTx(context.TODO(), func(tx UserTx) error {
+			return tx.insertEmailToken(user.GetUuid(), resetID.GetToken(), resetID.GetSecret(),
+				emailTokenPurposeResetPassword)
+		})
+		assert.Nil(t, err)
+		return &pblib.Identification{Token: resetID.GetToken()}
+	}
+	confirm := func(identification *pblib.Identification, password string) error {
+		_, err := s.ConfirmPasswordReset(context.TODO(), &pbsvc.UserRequest{Identification: identification,
+			User: &pblib.User{Password: password}})
+		return err
+	}
+	notFound := "rpc error: code = NotFound desc = " + consts.ErrNoMatchingEmailTokenFound.Error()
+
+	// a rejected password rolls back the deletion, the token is retried with a valid password
+	resetToken := insertResetToken()
+	err = confirm(resetToken, "x-PasswordReset-Memory")
+	assert.EqualError(t, err,
+		status.Convert(&passwordPolicyError{violations: []error{consts.ErrPasswordPersonalInfo}}).Err().Error())
+	assert.Len(t, store.tables.emailTokens, 1)
+	assert.Nil(t, confirm(resetToken, newPassword))
+	assert.Empty(t, store.tables.emailTokens)
+	assert.EqualError(t, confirm(resetToken, newPassword), notFound)
+
+	// an expired token is deleted even though the password is not reset
+	resetToken = insertResetToken()
+	for tokenHash, row := range store.tables.emailTokens {
+		row.expirationTimestamp = time.Now().Add(-time.Second).Unix()
+		store.tables.emailTokens[tokenHash] = row
+	}
+	assert.EqualError(t, confirm(resetToken, unitTestPassword("PasswordReset-Expired")),
+		"rpc error: code = DeadlineExceeded desc = "+consts.ErrExpiredEmailToken.Error())
+	assert.Empty(t, store.tables.emailTokens)
+	assert.EqualError(t, confirm(resetToken, unitTestPassword("PasswordReset-Expired")), notFound)
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		_, err := tx.matchEmailAndPassword(user.GetEmail(), newPassword)
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreResendVerificationEmail(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+	verified := unitTestInsertMemoryUser(t, store, "ResendVerificationEmail-Memory", auth.User)
+
+	// verified and unknown emails get the same response, no token is issued for either
+	for _, email := range []string{verified.GetEmail(), unitTestEmailGenerator()} {
+		response, err := s.ResendVerificationEmail(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Email: email}})
+		assert.Nil(t, err, email)
+		assert.Equal(t, codes.OK.String(), response.GetMessage(), email)
+	}
+	assert.Empty(t, store.tables.emailTokens)
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	bindata "github.com/golang-migrate/migrate/v4/source/go_bindata"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"os"
+	"path"
+)
+
+const (
+	// migrationsDirectory holds the embedded schema migrations, applied in version order.
+	// Test data lives in test_fixtures/psql, it is not embedded
+	migrationsDirectory = "migrations"
+
+	// MigrateUp applies every pending migration
+	MigrateUp = "up"
+
+	// MigrateDown rolls back the most recently applied migration
+	MigrateDown = "down"
+
+	// MigrateStatus reports the applied and expected schema versions
+	MigrateStatus = "status"
+
+	// MigrateVersion reports the applied schema version
+	MigrateVersion = "version"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// SchemaStatus describes the schema_migrations table against the embedded migrations
+type SchemaStatus struct {
+	// Version is the last applied migration, 0 if none were applied
+	Version uint
+
+	// Expected is the newest embedded migration, the version db.go queries against
+	Expected uint
+
+	// Dirty is set when a migration failed part way and needs manual repair
+	Dirty bool
+}
+
+// IsBehind reports if the db is missing embedded migrations or is dirty
+func (s *SchemaStatus) IsBehind() bool {
+	return s.Dirty || s.Version < s.Expected
+}
+
+// String formats the status for logs, ie "3 (expected 4, dirty false)"
+func (s *SchemaStatus) String() string {
+	return fmt.Sprintf("%d (expected %d, dirty %t)", s.Version, s.Expected, s.Dirty)
+}
+
+// newMigrationSource reads the embedded migrations.
+// Returns error if the embedded directory can not be read.
+func newMigrationSource() (source.Driver, error) {
+	entries, err := migrationFiles.ReadDir(migrationsDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return bindata.WithInstance(bindata.Resource(names, func(name string) ([]byte, error) {
+		return migrationFiles.ReadFile(path.Join(migrationsDirectory, name))
+	}))
+}
+
+// newMigration creates a migration of the embedded migrations against db.
+// Closing the migration closes db.
+// Returns error if db is unreachable or the embedded migrations can not be read.
+func newMigration(db *sql.DB) (*migrate.Migrate, error) {
+	src, err := newMigrationSource()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("go-bindata", src, dbDriverName, driver)
+}
+
+// expectedSchemaVersion returns the newest embedded migration version.
+// Returns error if no migrations are embedded.
+func expectedSchemaVersion() (uint, error) {
+	src, err := newMigrationSource()
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		next, err := src.Next(version)
+		if os.IsNotExist(err) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// withMigration runs fn with a migration on its own connection to the user db,
+// so the advisory lock and connection held by the migration are released once done.
+func withMigration(fn func(m *migrate.Migrate) error) error {
+	db, err := sql.Open(dbDriverName, connectionString)
+	if err != nil {
+		return err
+	}
+
+	m, err := newMigration(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	defer m.Close()
+
+	return fn(m)
+}
+
+// getSchemaStatus reads the applied version of m against the embedded migrations.
+// Returns error if the schema_migrations table can not be read.
+func getSchemaStatus(m *migrate.Migrate) (*SchemaStatus, error) {
+	expected, err := expectedSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	version, dirty, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return nil, err
+	}
+
+	return &SchemaStatus{
+		Version:  version,
+		Expected: expected,
+		Dirty:    dirty,
+	}, nil
+}
+
+// RunMigration runs a migrate command, one of MigrateUp, MigrateDown, MigrateStatus or MigrateVersion,
+// against the user db.
+// Returns the schema status after the command, or error if the command is unknown or failed.
+func RunMigration(command string) (*SchemaStatus, error) {
+	switch command {
+	case MigrateUp, MigrateDown, MigrateStatus, MigrateVersion:
+	default:
+		return nil, consts.ErrInvalidMigrateCommand
+	}
+
+	var schemaStatus *SchemaStatus
+	err := withMigration(func(m *migrate.Migrate) error {
+		var err error
+		switch command {
+		case MigrateUp:
+			err = m.Up()
+		case MigrateDown:
+			err = m.Steps(-1)
+		}
+		if err != nil && err != migrate.ErrNoChange {
+			return err
+		}
+
+		schemaStatus, err = getSchemaStatus(m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schemaStatus, nil
+}
+
+// CheckSchemaVersion verifies the user db has every embedded migration applied.
+// Returns the schema status, and consts.ErrSchemaBehind if the db is behind or dirty.
+func CheckSchemaVersion() (*SchemaStatus, error) {
+	schemaStatus, err := RunMigration(MigrateStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	if schemaStatus.IsBehind() {
+		return schemaStatus, consts.ErrSchemaBehind
+	}
+
+	return schemaStatus, nil
+}
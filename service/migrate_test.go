@@ -0,0 +1,97 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExpectedSchemaVersion(t *testing.T) {
+	entries, err := migrationFiles.ReadDir(migrationsDirectory)
+	assert.Nil(t, err)
+
+	var newest uint64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".up.sql") {
+			continue
+		}
+		version, err := strconv.ParseUint(strings.SplitN(entry.Name(), "_", 2)[0], 10, 64)
+		assert.Nil(t, err, entry.Name())
+		if version > newest {
+			newest = version
+		}
+	}
+
+	expected, err := expectedSchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(newest), expected)
+}
+
+func TestMigrationFilesExcludeTestData(t *testing.T) {
+	entries, err := migrationFiles.ReadDir(migrationsDirectory)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, entries)
+
+	for _, entry := range entries {
+		assert.True(t, strings.HasSuffix(entry.Name(), ".up.sql") || strings.HasSuffix(entry.Name(), ".down.sql"),
+			entry.Name())
+	}
+
+	_, err = migrationFiles.ReadFile(unitTestSeedFile)
+	assert.NotNil(t, err)
+}
+
+func TestSchemaStatusIsBehind(t *testing.T) {
+	cases := []struct {
+		desc         string
+		schemaStatus *SchemaStatus
+		isBehind     bool
+	}{
+		{"test up to date", &SchemaStatus{Version: 4, Expected: 4}, false},
+		{"test ahead", &SchemaStatus{Version: 5, Expected: 4}, false},
+		{"test behind", &SchemaStatus{Version: 3, Expected: 4}, true},
+		{"test no migrations", &SchemaStatus{Version: 0, Expected: 4}, true},
+		{"test dirty", &SchemaStatus{Version: 4, Expected: 4, Dirty: true}, true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.isBehind, c.schemaStatus.IsBehind(), c.desc)
+	}
+}
+
+func TestRunMigration(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	expected, err := expectedSchemaVersion()
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		command  string
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test status", MigrateStatus, false, ""},
+		{"test version", MigrateVersion, false, ""},
+		{"test up without pending migrations", MigrateUp, false, ""},
+		{"test empty command", "", true, consts.ErrInvalidMigrateCommand.Error()},
+		{"test unknown command", "drop", true, consts.ErrInvalidMigrateCommand.Error()},
+	}
+
+	for _, c := range cases {
+		schemaStatus, err := RunMigration(c.command)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, schemaStatus, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, &SchemaStatus{Version: expected, Expected: expected}, schemaStatus, c.desc)
+		}
+	}
+
+	schemaStatus, err := CheckSchemaVersion()
+	assert.Nil(t, err)
+	assert.False(t, schemaStatus.IsBehind())
+}
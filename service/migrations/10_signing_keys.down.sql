@@ -0,0 +1,15 @@
+-- tokens signed with key pairs are deleted with their secrets, the enum only has HMAC algorithms
+DELETE FROM user_security.secrets WHERE algorithm <> 'HMAC';
+
+ALTER TABLE user_security.auth_tokens
+    DROP CONSTRAINT auth_tokens_algorithm_check,
+    ALTER COLUMN algorithm TYPE user_security.algorithm_type USING algorithm::user_security.algorithm_type;
+
+ALTER TABLE user_security.secrets
+    DROP CONSTRAINT secrets_private_key_envelope_check,
+    DROP CONSTRAINT secrets_key_pair_check,
+    DROP COLUMN private_key_master_key_id,
+    DROP COLUMN private_key_data_key,
+    DROP COLUMN private_key,
+    DROP COLUMN public_key,
+    DROP COLUMN algorithm;
@@ -0,0 +1,19 @@
+-- RS256 and EdDSA secrets are key pairs keyed by their kid, the private key is sealed in its own envelope,
+-- ie with a data key sealed with the master key. HMAC secrets keep signing with secret_key alone
+ALTER TABLE user_security.secrets
+    ADD COLUMN algorithm                 TEXT NOT NULL DEFAULT 'HMAC'
+        CONSTRAINT secrets_algorithm_check CHECK (algorithm IN ('HMAC', 'RS256', 'EdDSA')),
+    ADD COLUMN public_key                BYTEA,
+    ADD COLUMN private_key               BYTEA,
+    ADD COLUMN private_key_data_key      BYTEA,
+    ADD COLUMN private_key_master_key_id TEXT,
+    ADD CONSTRAINT secrets_key_pair_check
+        CHECK ((algorithm = 'HMAC') = (public_key IS NULL AND private_key IS NULL)),
+    ADD CONSTRAINT secrets_private_key_envelope_check
+        CHECK ((private_key IS NULL) = (private_key_data_key IS NULL AND private_key_master_key_id IS NULL));
+
+-- the enum has no asymmetric algorithms, and enum values can not be dropped by the down migration
+ALTER TABLE user_security.auth_tokens
+    ALTER COLUMN algorithm TYPE TEXT USING algorithm::TEXT,
+    ADD CONSTRAINT auth_tokens_algorithm_check
+        CHECK (algorithm IN ('NO_ALG', 'HS256', 'HS512', 'RS256', 'EdDSA'));
@@ -0,0 +1,24 @@
+-- hashed tokens and sealed secrets can not be restored to plaintext, they are deleted
+DROP INDEX user_security.secrets_private_key_master_key_id_idx;
+DROP INDEX user_security.totp_secrets_master_key_id_idx;
+DROP INDEX user_svc.email_tokens_master_key_id_idx;
+DROP INDEX user_security.secrets_master_key_id_idx;
+
+DELETE FROM user_svc.email_tokens;
+
+ALTER TABLE user_svc.email_tokens
+    DROP COLUMN master_key_id,
+    DROP COLUMN data_key,
+    DROP COLUMN encrypted_secret_key,
+    ADD COLUMN secret_key TEXT NOT NULL;
+
+ALTER TABLE user_svc.email_tokens RENAME COLUMN token_hash TO token;
+
+DELETE FROM user_security.secrets;
+
+ALTER TABLE user_security.auth_tokens RENAME COLUMN token_hash TO token;
+
+ALTER TABLE user_security.secrets
+    DROP COLUMN master_key_id,
+    DROP COLUMN data_key,
+    DROP COLUMN encrypted_key;
@@ -0,0 +1,29 @@
+-- secrets are keyed by the SHA-256 of their key, the key is sealed with a data key sealed with the master key.
+-- Existing keys can not be sealed in SQL, so existing secrets are deleted along with their auth tokens,
+-- a new secret is created on the next request, and users log in or refresh again
+DELETE FROM user_security.secrets;
+
+ALTER TABLE user_security.secrets
+    ADD COLUMN encrypted_key BYTEA NOT NULL,
+    ADD COLUMN data_key      BYTEA NOT NULL,
+    ADD COLUMN master_key_id TEXT  NOT NULL;
+
+-- only the SHA-256 of auth tokens is stored, tokens are looked up by it
+ALTER TABLE user_security.auth_tokens RENAME COLUMN token TO token_hash;
+
+-- pending email tokens are kept by hashing them in place, their plaintext secret is dropped,
+-- new email tokens seal their secret like secrets do
+ALTER TABLE user_svc.email_tokens RENAME COLUMN token TO token_hash;
+UPDATE user_svc.email_tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+
+ALTER TABLE user_svc.email_tokens
+    DROP COLUMN secret_key,
+    ADD COLUMN encrypted_secret_key BYTEA,
+    ADD COLUMN data_key             BYTEA,
+    ADD COLUMN master_key_id        TEXT;
+
+-- the reencrypt command looks up data keys sealed with a previous master key
+CREATE INDEX secrets_master_key_id_idx ON user_security.secrets (master_key_id);
+CREATE INDEX email_tokens_master_key_id_idx ON user_svc.email_tokens (master_key_id);
+CREATE INDEX totp_secrets_master_key_id_idx ON user_security.totp_secrets (master_key_id);
+CREATE INDEX secrets_private_key_master_key_id_idx ON user_security.secrets (private_key_master_key_id);
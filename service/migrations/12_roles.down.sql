@@ -0,0 +1,3 @@
+DROP TABLE user_security.user_roles;
+DROP TABLE user_security.role_permissions;
+DROP TABLE user_security.roles;
@@ -0,0 +1,51 @@
+-- roles name a set of permissions, see service/policy.go for the permissions handlers evaluate
+CREATE TABLE user_security.roles
+(
+    name        TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE user_security.role_permissions
+(
+    PRIMARY KEY (role, permission),
+    role       TEXT REFERENCES user_security.roles (name) ON DELETE CASCADE,
+    permission TEXT NOT NULL
+);
+
+-- a role is granted over the users of organization, or over every user if organization is empty
+CREATE TABLE user_security.user_roles
+(
+    PRIMARY KEY (uuid, role, organization),
+    uuid              ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    role              TEXT REFERENCES user_security.roles (name) ON DELETE CASCADE,
+    organization      TEXT        NOT NULL DEFAULT '',
+    granted_by        TEXT        NOT NULL,
+    granted_timestamp TIMESTAMPTZ NOT NULL
+);
+
+-- admin and user are implied by the ADMIN and USER permission levels, user only over the user themself
+INSERT INTO user_security.roles(name, description)
+VALUES ('admin', 'every permission over every user, implied by the ADMIN permission level'),
+       ('user', 'permissions of a user over themself, implied by the USER permission level'),
+       ('org-admin', 'manages the users and roles of an organization'),
+       ('viewer', 'reads the users and documents of an organization');
+
+INSERT INTO user_security.role_permissions(role, permission)
+VALUES ('admin', 'users:read'),
+       ('admin', 'users:write'),
+       ('admin', 'users:admin'),
+       ('admin', 'documents:read'),
+       ('admin', 'documents:share'),
+       ('admin', 'roles:write'),
+       ('admin', 'service:write'),
+       ('user', 'users:read'),
+       ('user', 'users:write'),
+       ('user', 'documents:read'),
+       ('user', 'documents:share'),
+       ('org-admin', 'users:read'),
+       ('org-admin', 'users:write'),
+       ('org-admin', 'users:admin'),
+       ('org-admin', 'documents:read'),
+       ('org-admin', 'roles:write'),
+       ('viewer', 'users:read'),
+       ('viewer', 'documents:read');
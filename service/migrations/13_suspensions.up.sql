@@ -0,0 +1,9 @@
+-- a suspended user can not log in until reactivated, or until suspended_until passes if it is set
+CREATE TABLE user_security.suspensions
+(
+    uuid                ulid PRIMARY KEY REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    reason              TEXT        NOT NULL,
+    suspended_by        TEXT        NOT NULL,
+    suspended_timestamp TIMESTAMPTZ NOT NULL,
+    suspended_until     TIMESTAMPTZ
+);
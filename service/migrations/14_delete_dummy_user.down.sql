@@ -0,0 +1,2 @@
+-- the dummy user is test data, it is not restored
+SELECT 1;
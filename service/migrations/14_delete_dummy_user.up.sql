@@ -0,0 +1,5 @@
+-- the dummy user was seeded by migration 3 when the test fixtures were the migrations,
+-- it is a known login so it is deleted from every deployment that applied it
+DELETE
+FROM user_svc.accounts
+WHERE uuid = '01d793kwwv8ncaamd1b3yr5w48';
@@ -0,0 +1,10 @@
+DELETE
+FROM user_svc.email_tokens
+WHERE purpose <> 'VERIFY_EMAIL';
+
+ALTER TABLE user_svc.email_tokens
+    DROP CONSTRAINT IF EXISTS email_tokens_uuid_purpose_key,
+    DROP COLUMN IF EXISTS purpose,
+    ADD CONSTRAINT email_tokens_uuid_key UNIQUE (uuid);
+
+DROP TYPE IF EXISTS user_svc.email_token_purpose;
@@ -0,0 +1,11 @@
+CREATE TYPE user_svc.email_token_purpose AS ENUM
+    (
+        'VERIFY_EMAIL',
+        'RESET_PASSWORD'
+        );
+
+-- a user can hold one outstanding email token per purpose
+ALTER TABLE user_svc.email_tokens
+    ADD COLUMN purpose user_svc.email_token_purpose NOT NULL DEFAULT 'VERIFY_EMAIL',
+    DROP CONSTRAINT email_tokens_uuid_key,
+    ADD CONSTRAINT email_tokens_uuid_purpose_key UNIQUE (uuid, purpose);
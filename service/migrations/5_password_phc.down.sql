@@ -0,0 +1,3 @@
+-- fails while any password is longer than a bcrypt hash
+ALTER TABLE user_svc.accounts
+    ALTER COLUMN password TYPE VARCHAR(60);
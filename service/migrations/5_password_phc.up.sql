@@ -0,0 +1,3 @@
+-- argon2id PHC strings do not fit the 60 characters of a bcrypt hash
+ALTER TABLE user_svc.accounts
+    ALTER COLUMN password TYPE VARCHAR(255);
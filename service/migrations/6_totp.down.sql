@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_security.totp_recovery_codes;
+DROP TABLE IF EXISTS user_security.totp_secrets;
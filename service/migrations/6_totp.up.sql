@@ -0,0 +1,20 @@
+-- one TOTP secret per user, unusable for login until confirmed with a first code.
+-- The secret is sealed with a data key sealed with the master key, like secrets and email tokens
+CREATE TABLE user_security.totp_secrets
+(
+    uuid              ulid PRIMARY KEY REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    secret            BYTEA       NOT NULL,
+    data_key          BYTEA       NOT NULL,
+    master_key_id     TEXT        NOT NULL,
+    is_confirmed      BOOLEAN     NOT NULL DEFAULT FALSE,
+    last_used_step    BIGINT      NOT NULL DEFAULT 0,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+-- recovery codes are stored as SHA-256 hashes and deleted once used
+CREATE TABLE user_security.totp_recovery_codes
+(
+    PRIMARY KEY (uuid, code_hash),
+    uuid      ulid REFERENCES user_security.totp_secrets (uuid) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL
+);
@@ -0,0 +1,13 @@
+-- refresh tokens are stored as SHA-256 hashes, a used token is kept until it expires to detect its reuse
+CREATE TABLE user_security.refresh_tokens
+(
+    token_hash           TEXT PRIMARY KEY,
+    family_id            TEXT        NOT NULL,
+    uuid                 ulid        NOT NULL REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    created_timestamp    TIMESTAMPTZ NOT NULL,
+    expiration_timestamp TIMESTAMPTZ NOT NULL,
+    used_timestamp       TIMESTAMPTZ
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON user_security.refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_uuid_idx ON user_security.refresh_tokens (uuid);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_security.auth_tokens_uuid_idx;
+
+ALTER TABLE user_security.auth_tokens DROP COLUMN IF EXISTS revoked_timestamp;
@@ -0,0 +1,4 @@
+-- revoked auth tokens are kept for auditing, pairTokenWithSecret rejects them
+ALTER TABLE user_security.auth_tokens ADD COLUMN revoked_timestamp TIMESTAMPTZ;
+
+CREATE INDEX auth_tokens_uuid_idx ON user_security.auth_tokens (uuid);
@@ -0,0 +1,10 @@
+CREATE OR REPLACE FUNCTION insert_new_active_secret() RETURNS trigger AS
+$BODY$
+BEGIN
+    EXECUTE 'DELETE FROM user_security.active_secret';
+    INSERT INTO user_security.active_secret(secret_key, created_timestamp, expiration_timestamp, one_row)
+    VALUES (NEW.secret_key, NEW.created_timestamp, NEW.expiration_timestamp, TRUE);
+    RETURN NEW;
+END;
+$BODY$
+    LANGUAGE plpgsql;
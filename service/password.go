@@ -0,0 +1,230 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+// passwordHasher hashes passwords into PHC strings, $<id>$<params>$<salt>$<hash>,
+// so the hasher and parameters of a stored password can be told apart from the current ones.
+type passwordHasher interface {
+	// hash returns the PHC string of password with a new salt
+	hash(password string) (string, error)
+
+	// verify returns consts.ErrPasswordMismatch if password is not the password of encoded
+	verify(encoded string, password string) error
+
+	// isCurrent reports if encoded was hashed by this hasher with its current parameters
+	isCurrent(encoded string) bool
+}
+
+// argon2idParams are the argon2id cost parameters, memory is in KiB
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+}
+
+// argon2idHasher hashes passwords with argon2id, the default hasher
+type argon2idHasher struct {
+	params argon2idParams
+}
+
+// bcryptHasher hashes passwords with bcrypt, it verifies the hashes stored before argon2id
+type bcryptHasher struct {
+	cost int
+}
+
+const (
+	passwordHashArgon2id = "argon2id"
+	passwordHashBcrypt   = "bcrypt"
+
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+var (
+	// currentPasswordHasher hashes every new password, set from conf.PasswordHash
+	currentPasswordHasher passwordHasher
+
+	// phcEncoding is the base64 encoding of salts and hashes in PHC strings
+	phcEncoding = base64.RawStdEncoding
+
+	// dummyPasswordHash is compared against when a login email does not exist,
+	// so the response time does not reveal if the email exists
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+func init() {
+	var err error
+	currentPasswordHasher, err = newPasswordHasher(conf.PasswordHash)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize password hasher:", err.Error())
+	}
+}
+
+// newPasswordHasher returns the hasher configured by config.
+// Returns error if the algorithm is unknown or the parameters are out of range.
+func newPasswordHasher(config conf.PasswordHashConfig) (passwordHasher, error) {
+	switch config.Algorithm {
+	case passwordHashArgon2id:
+		if config.Memory < 8*uint32(config.Parallelism) || config.Iterations < 1 || config.Parallelism < 1 {
+			return nil, consts.ErrInvalidPasswordHashParams
+		}
+		return &argon2idHasher{
+			params: argon2idParams{
+				memory:      config.Memory,
+				iterations:  config.Iterations,
+				parallelism: config.Parallelism,
+				saltLength:  argon2idSaltLength,
+				keyLength:   argon2idKeyLength,
+			},
+		}, nil
+	case passwordHashBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, consts.ErrInvalidPasswordHashParams
+		}
+		return &bcryptHasher{cost: config.BcryptCost}, nil
+	default:
+		return nil, consts.ErrInvalidPasswordHashAlgorithm
+	}
+}
+
+// passwordHasherOf returns a hasher able to verify encoded, picked by the PHC id of encoded.
+// Returns error if encoded was not made by a known hasher.
+func passwordHasherOf(encoded string) (passwordHasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$"+passwordHashArgon2id+"$"):
+		return &argon2idHasher{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return &bcryptHasher{}, nil
+	default:
+		return nil, consts.ErrUnknownPasswordHash
+	}
+}
+
+func (h *argon2idHasher) hash(password string) (string, error) {
+	salt := make([]byte, h.params.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt,
+		h.params.iterations, h.params.memory, h.params.parallelism, h.params.keyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", passwordHashArgon2id, argon2.Version,
+		h.params.memory, h.params.iterations, h.params.parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) verify(encoded string, password string) error {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+
+	derivedKey := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism,
+		params.keyLength)
+	if subtle.ConstantTimeCompare(key, derivedKey) != 1 {
+		return consts.ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+func (h *argon2idHasher) isCurrent(encoded string) bool {
+	params, _, _, err := decodeArgon2id(encoded)
+	return err == nil && params == h.params
+}
+
+// decodeArgon2id parses an argon2id PHC string, $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>.
+// Returns error if encoded is malformed or of another argon2 version.
+func decodeArgon2id(encoded string) (argon2idParams, []byte, []byte, error) {
+	var params argon2idParams
+
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[1] != passwordHashArgon2id {
+		return params, nil, nil, consts.ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, consts.ErrUnknownPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d",
+		&params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, consts.ErrUnknownPasswordHash
+	}
+
+	salt, err := phcEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, consts.ErrUnknownPasswordHash
+	}
+	key, err := phcEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, consts.ErrUnknownPasswordHash
+	}
+
+	params.saltLength = uint32(len(salt))
+	params.keyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (h *bcryptHasher) hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashedPassword), nil
+}
+
+func (h *bcryptHasher) verify(encoded string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return consts.ErrPasswordMismatch
+	}
+
+	return err
+}
+
+func (h *bcryptHasher) isCurrent(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == h.cost
+}
+
+// needsPasswordRehash reports if hashedPassword was not hashed by currentPasswordHasher with its current parameters,
+// matchEmailAndPassword then replaces it while the password is at hand.
+func needsPasswordRehash(hashedPassword string) bool {
+	return !currentPasswordHasher.isCurrent(hashedPassword)
+}
+
+// compareDummyPassword spends the time of comparing password against a hash of currentPasswordHasher,
+// for logins of emails that do not exist
+func compareDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		hashed, err := currentPasswordHasher.hash("dummy password")
+		if err != nil {
+			logger.Error(consts.UserServiceTag, "Failed to hash dummy password:", err.Error())
+			return
+		}
+		dummyPasswordHash = hashed
+	})
+
+	if dummyPasswordHash != "" {
+		_ = comparePassword(dummyPasswordHash, password)
+	}
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed" // bundles the breached password list
+	"encoding/hex"
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	// breachedPrefixLength is the length of the SHA1 prefix ranges are looked up by, as in the Pwned Passwords range API
+	breachedPrefixLength = 5
+
+	// minPersonalInfoLength skips names and emails too short to matter, ie a first name "Al"
+	minPersonalInfoLength = 3
+
+	passwordField = "password"
+)
+
+// bundledBreachedPasswords is the breached password list used unless conf.PasswordPolicy.BreachedFile is set
+//
+//go:embed breached_passwords.txt
+var bundledBreachedPasswords string
+
+// breachedPasswords holds the SHA1 suffixes of breached passwords by their SHA1 prefix,
+// so a password is only compared against the range of its prefix, k-anonymity style, without a network call
+type breachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+// passwordPolicy checks passwords against conf.PasswordPolicyConfig
+type passwordPolicy struct {
+	config   conf.PasswordPolicyConfig
+	breached *breachedPasswords
+}
+
+// passwordPolicyError lists the rules a password failed,
+// it converts to an InvalidArgument status with a BadRequest field violation per rule
+type passwordPolicyError struct {
+	violations []error
+}
+
+// currentPasswordPolicy checks every created, updated or reset password, set from conf.PasswordPolicy
+var currentPasswordPolicy *passwordPolicy
+
+func init() {
+	var err error
+	currentPasswordPolicy, err = newPasswordPolicy(conf.PasswordPolicy)
+	if err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize password policy:", err.Error())
+	}
+}
+
+// newPasswordPolicy returns the policy configured by config, loading its breached password list if enabled.
+// Returns error if the breached password list can not be read or is malformed.
+func newPasswordPolicy(config conf.PasswordPolicyConfig) (*passwordPolicy, error) {
+	policy := &passwordPolicy{config: config}
+	if !config.BlockBreached {
+		return policy, nil
+	}
+
+	var r io.Reader = strings.NewReader(bundledBreachedPasswords)
+	if config.BreachedFile != "" {
+		file, err := os.Open(config.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	breached, err := readBreachedPasswords(r)
+	if err != nil {
+		return nil, err
+	}
+	policy.breached = breached
+
+	return policy, nil
+}
+
+// readBreachedPasswords reads one uppercase or lowercase hex SHA1 per line, optionally followed by ":COUNT"
+// as in the Pwned Passwords downloads, blank lines and lines starting with "#" are skipped.
+// Returns error if a line is not a SHA1.
+func readBreachedPasswords(r io.Reader) (*breachedPasswords, error) {
+	breached := &breachedPasswords{ranges: make(map[string]map[string]struct{})}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash := strings.ToUpper(strings.SplitN(line, ":", 2)[0])
+		if len(hash) != sha1.Size*2 {
+			return nil, consts.ErrInvalidBreachedPasswords
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, consts.ErrInvalidBreachedPasswords
+		}
+
+		prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+		if breached.ranges[prefix] == nil {
+			breached.ranges[prefix] = make(map[string]struct{})
+		}
+		breached.ranges[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return breached, nil
+}
+
+// contains reports if password is in the list, by the range of its SHA1 prefix
+func (b *breachedPasswords) contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, ok := b.ranges[hash[:breachedPrefixLength]][hash[breachedPrefixLength:]]
+	return ok
+}
+
+// check returns every rule password fails, user holds the names and emails password may not contain.
+// Returns nil if password meets the policy.
+func (p *passwordPolicy) check(password string, user *pblib.User) error {
+	var violations []error
+
+	if len([]rune(password)) < p.config.MinLength {
+		violations = append(violations, fmt.Errorf("%w, expected at least %d characters",
+			consts.ErrPasswordTooShort, p.config.MinLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if p.config.RequireUpper && !hasUpper {
+		violations = append(violations, consts.ErrPasswordMissingUpper)
+	}
+	if p.config.RequireLower && !hasLower {
+		violations = append(violations, consts.ErrPasswordMissingLower)
+	}
+	if p.config.RequireDigit && !hasDigit {
+		violations = append(violations, consts.ErrPasswordMissingDigit)
+	}
+	if p.config.RequireSymbol && !hasSymbol {
+		violations = append(violations, consts.ErrPasswordMissingSymbol)
+	}
+
+	if p.config.BlockPersonalInfo && containsPersonalInfo(password, user) {
+		violations = append(violations, consts.ErrPasswordPersonalInfo)
+	}
+
+	if p.config.BlockBreached && p.breached.contains(password) {
+		violations = append(violations, consts.ErrPasswordBreached)
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return &passwordPolicyError{violations: violations}
+}
+
+// containsPersonalInfo reports if password contains, ignoring case, the first or last name of user,
+// or the part before "@" of its email or prospective email
+func containsPersonalInfo(password string, user *pblib.User) bool {
+	if user == nil {
+		return false
+	}
+
+	password = strings.ToLower(password)
+	for _, info := range []string{
+		user.GetFirstName(),
+		user.GetLastName(),
+		strings.SplitN(user.GetEmail(), "@", 2)[0],
+		strings.SplitN(user.GetProspectiveEmail(), "@", 2)[0],
+	} {
+		info = strings.ToLower(strings.TrimSpace(info))
+		if len([]rune(info)) >= minPersonalInfoLength && strings.Contains(password, info) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPasswordPolicy checks password against currentPasswordPolicy.
+// Returns a *passwordPolicyError listing the failed rules, or nil if password meets the policy.
+func checkPasswordPolicy(password string, user *pblib.User) error {
+	return currentPasswordPolicy.check(password, user)
+}
+
+func (e *passwordPolicyError) Error() string {
+	reasons := make([]string, 0, len(e.violations))
+	for _, violation := range e.violations {
+		reasons = append(reasons, violation.Error())
+	}
+
+	return consts.ErrPasswordPolicy.Error() + ": " + strings.Join(reasons, ", ")
+}
+
+// GRPCStatus lets status.FromError and grpc convert e into InvalidArgument with its field violations
+func (e *passwordPolicyError) GRPCStatus() *status.Status {
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range e.violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       passwordField,
+			Description: violation.Error(),
+		})
+	}
+
+	s := status.New(codes.InvalidArgument, e.Error())
+	detailed, err := s.WithDetails(badRequest)
+	if err != nil {
+		return s
+	}
+
+	return detailed
+}
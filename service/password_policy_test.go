@@ -0,0 +1,183 @@
+package service
+
+import (
+	"errors"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+)
+
+func TestReadBreachedPasswords(t *testing.T) {
+	cases := []struct {
+		desc     string
+		list     string
+		password string
+		contains bool
+		expErr   error
+	}{
+		// SHA1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+		{"test uppercase with count", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n", "password", true, nil},
+		{"test lowercase", "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8", "password", true, nil},
+		{"test comments and blank lines", "# breached\n\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n",
+			"password", true, nil},
+		{"test same prefix other suffix", "5BAA6000000000000000000000000000000000FF", "password", false, nil},
+		{"test short hash", "5BAA61E4C9B93F3F", "", false, consts.ErrInvalidBreachedPasswords},
+		{"test not hex", strings.Repeat("Z", 40), "", false, consts.ErrInvalidBreachedPasswords},
+	}
+
+	for _, c := range cases {
+		breached, err := readBreachedPasswords(strings.NewReader(c.list))
+		assert.Equal(t, c.expErr, err, c.desc)
+		if c.expErr == nil {
+			assert.Equal(t, c.contains, breached.contains(c.password), c.desc)
+		}
+	}
+
+	// bundled list loads and holds the usual suspects
+	breached, err := readBreachedPasswords(strings.NewReader(bundledBreachedPasswords))
+	assert.Nil(t, err)
+	assert.True(t, breached.contains("password1"))
+	assert.False(t, breached.contains(unitTestPassword("ReadBreachedPasswords-One")))
+}
+
+func TestNewPasswordPolicy(t *testing.T) {
+	policy, err := newPasswordPolicy(conf.PasswordPolicyConfig{BlockBreached: false})
+	assert.Nil(t, err)
+	assert.Nil(t, policy.breached)
+
+	policy, err = newPasswordPolicy(conf.PasswordPolicyConfig{BlockBreached: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, policy.breached)
+
+	_, err = newPasswordPolicy(conf.PasswordPolicyConfig{BlockBreached: true,
+		BreachedFile: "test_fixtures/does-not-exist.txt"})
+	assert.NotNil(t, err)
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy, err := newPasswordPolicy(conf.PasswordPolicyConfig{
+		MinLength:         10,
+		RequireUpper:      true,
+		RequireLower:      true,
+		RequireDigit:      true,
+		RequireSymbol:     true,
+		BlockPersonalInfo: true,
+		BlockBreached:     true,
+	})
+	assert.Nil(t, err)
+
+	user := &pblib.User{
+		FirstName:        "Unit",
+		LastName:         "Policy",
+		Email:            "hwsc.policy@gmail.com",
+		ProspectiveEmail: "hwsc.other@gmail.com",
+	}
+
+	cases := []struct {
+		desc       string
+		password   string
+		violations []error
+	}{
+		{"test valid", "Correct-Horse-42", nil},
+		{"test short", "Ab1-", []error{consts.ErrPasswordTooShort}},
+		{"test missing upper", "correct-horse-42", []error{consts.ErrPasswordMissingUpper}},
+		{"test missing lower", "CORRECT-HORSE-42", []error{consts.ErrPasswordMissingLower}},
+		{"test missing digit", "Correct-Horse-xx", []error{consts.ErrPasswordMissingDigit}},
+		{"test missing symbol", "CorrectHorse42x", []error{consts.ErrPasswordMissingSymbol}},
+		{"test last name", "My-POLICY-pass-42", []error{consts.ErrPasswordPersonalInfo}},
+		{"test email", "x-Hwsc.Policy-42", []error{consts.ErrPasswordPersonalInfo}},
+		{"test prospective email", "x-HWSC.other-42", []error{consts.ErrPasswordPersonalInfo}},
+		{"test breached", "P@ssw0rd", []error{consts.ErrPasswordTooShort, consts.ErrPasswordBreached}},
+		{"test every rule", "policy", []error{consts.ErrPasswordTooShort, consts.ErrPasswordMissingUpper,
+			consts.ErrPasswordMissingDigit, consts.ErrPasswordMissingSymbol, consts.ErrPasswordPersonalInfo}},
+	}
+
+	for _, c := range cases {
+		err := policy.check(c.password, user)
+		if c.violations == nil {
+			assert.Nil(t, err, c.desc)
+			continue
+		}
+
+		policyErr, ok := err.(*passwordPolicyError)
+		assert.True(t, ok, c.desc)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, len(c.violations), len(policyErr.violations), c.desc)
+		for i := range c.violations {
+			if i < len(policyErr.violations) {
+				assert.True(t, errors.Is(policyErr.violations[i], c.violations[i]), c.desc)
+			}
+		}
+	}
+
+	// short names are not personal info
+	assert.Nil(t, policy.check("Al-Correct-42", &pblib.User{FirstName: "Al"}))
+	assert.Nil(t, policy.check("Correct-Horse-42", nil))
+}
+
+func TestPasswordPolicyErrorStatus(t *testing.T) {
+	err := &passwordPolicyError{violations: []error{consts.ErrPasswordMissingDigit, consts.ErrPasswordBreached}}
+
+	s, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, s.Code())
+	assert.Equal(t, consts.ErrPasswordPolicy.Error()+": "+consts.ErrPasswordMissingDigit.Error()+", "+
+		consts.ErrPasswordBreached.Error(), s.Message())
+
+	details := s.Details()
+	assert.Equal(t, 1, len(details))
+	badRequest, ok := details[0].(*errdetails.BadRequest)
+	assert.True(t, ok)
+	assert.Equal(t, []*errdetails.BadRequest_FieldViolation{
+		{Field: passwordField, Description: consts.ErrPasswordMissingDigit.Error()},
+		{Field: passwordField, Description: consts.ErrPasswordBreached.Error()},
+	}, badRequest.GetFieldViolations())
+
+	// the details survive converting to a status error, as the handlers return it
+	converted, ok := status.FromError(status.Convert(err).Err())
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(converted.Details()))
+}
+
+func TestMemoryStoreUpdatePasswordPolicy(t *testing.T) {
+	store := newMemoryStore()
+	user, err := unitTestMemoryUser(store, "UpdatePasswordPolicy-One")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		password string
+		isExpErr bool
+	}{
+		{"test breached", "password123", true},
+		{"test last name", "new-UpdatePasswordPolicy-One", true},
+		{"test valid", unitTestPassword("UpdatePasswordPolicy-Two"), false},
+	}
+
+	for _, c := range cases {
+		err := store.WithTx(context.TODO(), func(tx UserTx) error {
+			dbDerived, err := tx.getUserRow(user.GetUuid())
+			if err != nil {
+				return err
+			}
+			_, _, err = tx.updateUserRow(user.GetUuid(), &pblib.User{Uuid: user.GetUuid(), Password: c.password},
+				dbDerived)
+			return err
+		})
+		if c.isExpErr {
+			_, ok := err.(*passwordPolicyError)
+			assert.True(t, ok, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+}
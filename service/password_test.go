@@ -0,0 +1,124 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+)
+
+func TestNewPasswordHasher(t *testing.T) {
+	cases := []struct {
+		desc   string
+		config conf.PasswordHashConfig
+		expErr error
+	}{
+		{"test argon2id", conf.PasswordHashConfig{Algorithm: passwordHashArgon2id, Memory: 1024, Iterations: 1,
+			Parallelism: 1}, nil},
+		{"test bcrypt", conf.PasswordHashConfig{Algorithm: passwordHashBcrypt, BcryptCost: bcrypt.MinCost}, nil},
+		{"test unknown algorithm", conf.PasswordHashConfig{Algorithm: "md5"}, consts.ErrInvalidPasswordHashAlgorithm},
+		{"test argon2id zero iterations", conf.PasswordHashConfig{Algorithm: passwordHashArgon2id, Memory: 1024,
+			Parallelism: 1}, consts.ErrInvalidPasswordHashParams},
+		{"test argon2id too little memory", conf.PasswordHashConfig{Algorithm: passwordHashArgon2id, Memory: 8,
+			Iterations: 1, Parallelism: 2}, consts.ErrInvalidPasswordHashParams},
+		{"test bcrypt cost too high", conf.PasswordHashConfig{Algorithm: passwordHashBcrypt,
+			BcryptCost: bcrypt.MaxCost + 1}, consts.ErrInvalidPasswordHashParams},
+	}
+
+	for _, c := range cases {
+		hasher, err := newPasswordHasher(c.config)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if c.expErr == nil {
+			assert.NotNil(t, hasher, c.desc)
+		}
+	}
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	password := "TestArgon2idHasher-Password"
+	hasher := &argon2idHasher{params: argon2idParams{memory: 1024, iterations: 1, parallelism: 1,
+		saltLength: argon2idSaltLength, keyLength: argon2idKeyLength}}
+
+	encoded, err := hasher.hash(password)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	// same password hashes differently b/c of the salt
+	other, err := hasher.hash(password)
+	assert.Nil(t, err)
+	assert.NotEqual(t, encoded, other)
+
+	assert.Nil(t, hasher.verify(encoded, password))
+	assert.Equal(t, consts.ErrPasswordMismatch, hasher.verify(encoded, password+"x"))
+	assert.True(t, hasher.isCurrent(encoded))
+
+	// other parameters verify, but are not current
+	stronger := &argon2idHasher{params: hasher.params}
+	stronger.params.iterations = 2
+	assert.Nil(t, stronger.verify(encoded, password))
+	assert.False(t, stronger.isCurrent(encoded))
+
+	malformed := []string{
+		"",
+		"$argon2id$v=19$m=1024,t=1,p=1$salt",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$",
+	}
+	for _, m := range malformed {
+		assert.Equal(t, consts.ErrUnknownPasswordHash, hasher.verify(m, password), m)
+		assert.False(t, hasher.isCurrent(m), m)
+	}
+}
+
+func TestComparePasswordHashers(t *testing.T) {
+	password := "TestComparePasswordHashers-Password"
+	bcryptHash, err := (&bcryptHasher{cost: bcrypt.MinCost}).hash(password)
+	assert.Nil(t, err)
+	argon2idHash, err := currentPasswordHasher.hash(password)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc        string
+		hash        string
+		expErr      error
+		needsRehash bool
+	}{
+		{"test legacy bcrypt", bcryptHash, nil, true},
+		{"test current argon2id", argon2idHash, nil, false},
+		{"test unknown hash", "plaintext", consts.ErrUnknownPasswordHash, true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expErr, comparePassword(c.hash, password), c.desc)
+		assert.Equal(t, c.needsRehash, needsPasswordRehash(c.hash), c.desc)
+	}
+}
+
+func TestMemoryStoreRehashOnLogin(t *testing.T) {
+	store := newMemoryStore()
+	user, err := unitTestMemoryUser(store, "RehashOnLogin-One")
+	assert.Nil(t, err)
+
+	// store a legacy bcrypt hash
+	legacyHash, err := (&bcryptHasher{cost: bcrypt.MinCost}).hash(user.GetPassword())
+	assert.Nil(t, err)
+	account := store.tables.accounts[user.GetUuid()]
+	account.password = legacyHash
+	store.tables.accounts[user.GetUuid()] = account
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		_, err := tx.matchEmailAndPassword(user.GetEmail(), user.GetPassword())
+		return err
+	})
+	assert.Nil(t, err)
+
+	rehashed := store.tables.accounts[user.GetUuid()].password
+	assert.NotEqual(t, legacyHash, rehashed)
+	assert.False(t, needsPasswordRehash(rehashed))
+	assert.Nil(t, comparePassword(rehashed, user.GetPassword()))
+}
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const (
+	// permissions evaluated by the handlers, granted by the roles in user_security.role_permissions.
+	// users:admin unlocks users and resets their TOTP, the user role lacks it so users can not undo their own lockout
+	permUsersRead      = "users:read"
+	permUsersWrite     = "users:write"
+	permUsersAdmin     = "users:admin"
+	permDocumentsRead  = "documents:read"
+	permDocumentsShare = "documents:share"
+	permRolesWrite     = "roles:write"
+	permServiceWrite   = "service:write"
+
+	// roleAdmin and roleUser are implied by the ADMIN and USER permission levels, see levelRoleGrant
+	roleAdmin = "admin"
+	roleUser  = "user"
+
+	// GrantRole and RevokeRole read the role and the organization it is granted in from the incoming metadata,
+	// and return the roles of the user in the roles header metadata
+	roleKey             = "role"
+	roleOrganizationKey = "role-organization"
+	rolesKey            = "roles"
+
+	// GetAuthSecret reads the key of the calling service from the incoming metadata, see authorizeServiceKey
+	serviceKeyKey = "service-key"
+)
+
+// defaultRolePermissions are the roles and permissions seeded by the 12_roles migration
+var defaultRolePermissions = map[string][]string{
+	roleAdmin: {permUsersRead, permUsersWrite, permUsersAdmin, permDocumentsRead, permDocumentsShare, permRolesWrite,
+		permServiceWrite},
+	roleUser:    {permUsersRead, permUsersWrite, permDocumentsRead, permDocumentsShare},
+	"org-admin": {permUsersRead, permUsersWrite, permUsersAdmin, permDocumentsRead, permRolesWrite},
+	"viewer":    {permUsersRead, permDocumentsRead},
+}
+
+// roleGrant is a role held by uuid over the users of organization, or over every user if organization is empty.
+// isSelf grants are implied by a permission level, and only held over the user themself.
+type roleGrant struct {
+	uuid             string
+	role             string
+	organization     string
+	grantedBy        string
+	grantedTimestamp time.Time
+	isSelf           bool
+}
+
+// policyTarget is the user a handler acts on, organization is empty if the user belongs to none.
+// isAdmin targets are only covered by the admin role held over every user, see evaluatePolicy.
+type policyTarget struct {
+	uuid         string
+	organization string
+	isAdmin      bool
+}
+
+// jsonRoleGrant is a roleGrant returned in the roles header metadata.
+type jsonRoleGrant struct {
+	Role         string `json:"role"`
+	Organization string `json:"organization,omitempty"`
+	GrantedBy    string `json:"granted_by"`
+}
+
+// levelRoleGrant returns the role implied by the permission level of body,
+// ADMIN holds roleAdmin over every user, USER holds roleUser over themself, lower levels hold none.
+func levelRoleGrant(body *auth.Body) *roleGrant {
+	switch body.Permission {
+	case auth.Admin:
+		return &roleGrant{uuid: body.UUID, role: roleAdmin}
+	case auth.User:
+		return &roleGrant{uuid: body.UUID, role: roleUser, isSelf: true}
+	default:
+		return nil
+	}
+}
+
+// covers returns true if grant is held over target, a nil target is the service itself.
+func (grant *roleGrant) covers(target *policyTarget) bool {
+	if grant.isSelf {
+		return target != nil && target.uuid == grant.uuid
+	}
+	if grant.organization == "" {
+		return true
+	}
+
+	return target != nil && target.organization == grant.organization
+}
+
+// evaluatePolicy checks that the user of body holds permission over target, or over the service if target is nil.
+// Permissions are granted by the role implied by the permission level of body, and the roles granted to the user.
+// Acting on an ADMIN also takes every permission of the admin role over every user,
+// so roles held over the organization of an ADMIN do not let their holder take over the ADMIN.
+// Returns status error PermissionDenied if no role held over target grants permission.
+func evaluatePolicy(tx UserTx, body *auth.Body, permission string, target *policyTarget) error {
+	if target != nil && target.isAdmin {
+		if err := authorizeRoleGrant(tx, body, roleAdmin, "", true); err != nil {
+			return err
+		}
+	}
+
+	grants, err := tx.listRoleGrants(body.UUID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if grant := levelRoleGrant(body); grant != nil {
+		grants = append(grants, grant)
+	}
+
+	for _, grant := range grants {
+		if !grant.covers(target) {
+			continue
+		}
+
+		permissions, err := tx.getRolePermissions(grant.role)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		for _, granted := range permissions {
+			if granted == permission {
+				return nil
+			}
+		}
+	}
+
+	return status.Error(codes.PermissionDenied, authconst.ErrInvalidPermission.Error())
+}
+
+// authorizePolicy authorizes identity like authorizeIdentification with at least level,
+// then checks the user of the token holds permission over target, see evaluatePolicy.
+// Returns a copy of the token body on success, else status error.
+func authorizePolicy(tx UserTx, identity *pblib.Identification, level auth.Permission, permission string,
+	target *policyTarget) (*auth.Body, error) {
+	body, err := authorizeIdentification(tx, identity, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := evaluatePolicy(tx, body, permission, target); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// getPolicyTarget looks up the organization and permission level of uuid.
+// A user that does not exist is only covered by roles held over every user.
+func getPolicyTarget(tx UserTx, uuid string) (*policyTarget, error) {
+	user, err := tx.getUserRow(uuid)
+	if err != nil && err != consts.ErrUserNotFound {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return newPolicyTarget(uuid, user), nil
+}
+
+// newPolicyTarget returns the policy target of user, user is nil if uuid does not exist.
+func newPolicyTarget(uuid string, user *pblib.User) *policyTarget {
+	return &policyTarget{
+		uuid:         uuid,
+		organization: user.GetOrganization(),
+		isAdmin:      user.GetPermissionLevel() == auth.PermissionStringMap[auth.Admin],
+	}
+}
+
+// newRolesMetadataValue returns grants as the JSON of the roles header metadata,
+// ie [{"role":"viewer","organization":"hwsc","granted_by":"..."}].
+func newRolesMetadataValue(grants []*roleGrant) (string, error) {
+	roles := make([]*jsonRoleGrant, 0, len(grants))
+	for _, grant := range grants {
+		roles = append(roles, &jsonRoleGrant{
+			Role:         grant.role,
+			Organization: grant.organization,
+			GrantedBy:    grant.grantedBy,
+		})
+	}
+
+	value, err := json.Marshal(roles)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// getRoleGrantMetadata reads the role and the organization it is granted in from md.
+// An empty organization grants the role over every user.
+// Returns error if the role is missing, or the organization is invalid.
+func getRoleGrantMetadata(md metadata.MD) (string, string, error) {
+	role := getMetadataValue(md, roleKey)
+	if role == "" {
+		return "", "", consts.ErrInvalidRole
+	}
+
+	organization := getMetadataValue(md, roleOrganizationKey)
+	if organization != "" {
+		if err := validateOrganization(organization); err != nil {
+			return "", "", err
+		}
+	}
+
+	return role, organization, nil
+}
+
+// authorizeRoleGrant checks the user of body holds roles:write over organization, or over every user if it is empty.
+// Granting a role also requires holding every permission of the role over organization,
+// so users cannot grant more than they hold.
+// Returns status error NotFound if the role does not exist, PermissionDenied if not allowed.
+func authorizeRoleGrant(tx UserTx, body *auth.Body, role string, organization string, isGrant bool) error {
+	var target *policyTarget
+	if organization != "" {
+		target = &policyTarget{organization: organization}
+	}
+
+	if err := evaluatePolicy(tx, body, permRolesWrite, target); err != nil {
+		return err
+	}
+	if !isGrant {
+		return nil
+	}
+
+	permissions, err := tx.getRolePermissions(role)
+	if err == consts.ErrRoleNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, permission := range permissions {
+		if err := evaluatePolicy(tx, body, permission, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkLastAdmin returns status error FailedPrecondition if target is the last ADMIN that is not suspended,
+// demoting or deleting them would leave no one to administer the service.
+// Returns status error Internal for any store error.
+func checkLastAdmin(tx UserTx, target *policyTarget) error {
+	if !target.isAdmin {
+		return nil
+	}
+
+	suspension, err := tx.getSuspensionRow(target.uuid)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if suspension != nil {
+		return nil
+	}
+
+	admins, err := tx.countAdmins()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if admins <= 1 {
+		return status.Error(codes.FailedPrecondition, consts.ErrLastAdmin.Error())
+	}
+
+	return nil
+}
+
+// authorizeServiceKey returns true if md carries one of conf.ServiceKeys in the service-key metadata.
+// Downstream services hold a service key rather than an auth token, they have no user to log in as.
+func authorizeServiceKey(md metadata.MD) bool {
+	key := getMetadataValue(md, serviceKeyKey)
+	if key == "" {
+		return false
+	}
+
+	for _, serviceKey := range strings.Split(conf.ServiceKeys, ",") {
+		serviceKey = strings.TrimSpace(serviceKey)
+		if serviceKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(serviceKey)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setRolesHeader returns grants in the roles header metadata,
+// errors are only logged b/c the role was already granted or revoked.
+func setRolesHeader(ctx context.Context, tag string, grants []*roleGrant) {
+	value, err := newRolesMetadataValue(grants)
+	if err != nil {
+		logger.Error(tag, err.Error())
+		return
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(rolesKey, value)); err != nil {
+		logger.Error(tag, err.Error())
+	}
+}
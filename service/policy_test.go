@@ -0,0 +1,277 @@
+package service
+
+import (
+	"encoding/json"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestRoleGrantCovers(t *testing.T) {
+	self := &roleGrant{uuid: "self", role: roleUser, isSelf: true}
+	global := &roleGrant{uuid: "self", role: roleAdmin}
+	scoped := &roleGrant{uuid: "self", role: "viewer", organization: "hwsc"}
+
+	cases := []struct {
+		desc     string
+		grant    *roleGrant
+		target   *policyTarget
+		expCover bool
+	}{
+		{"test self over self", self, &policyTarget{uuid: "self", organization: "hwsc"}, true},
+		{"test self over other", self, &policyTarget{uuid: "other", organization: "hwsc"}, false},
+		{"test self over service", self, nil, false},
+		{"test global over other", global, &policyTarget{uuid: "other", organization: "other"}, true},
+		{"test global over service", global, nil, true},
+		{"test scoped over organization", scoped, &policyTarget{uuid: "other", organization: "hwsc"}, true},
+		{"test scoped over other organization", scoped, &policyTarget{uuid: "other", organization: "other"}, false},
+		{"test scoped over no organization", scoped, &policyTarget{uuid: "other"}, false},
+		{"test scoped over service", scoped, nil, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expCover, c.grant.covers(c.target), c.desc)
+	}
+}
+
+func TestLevelRoleGrant(t *testing.T) {
+	cases := []struct {
+		desc     string
+		level    auth.Permission
+		expRole  string
+		expIsNil bool
+		expSelf  bool
+	}{
+		{"test admin", auth.Admin, roleAdmin, false, false},
+		{"test user", auth.User, roleUser, false, true},
+		{"test user registration", auth.UserRegistration, "", true, false},
+		{"test no permission", auth.NoPermission, "", true, false},
+	}
+
+	for _, c := range cases {
+		grant := levelRoleGrant(&auth.Body{UUID: "self", Permission: c.level})
+		if c.expIsNil {
+			assert.Nil(t, grant, c.desc)
+			continue
+		}
+		assert.Equal(t, c.expRole, grant.role, c.desc)
+		assert.Equal(t, c.expSelf, grant.isSelf, c.desc)
+		assert.Equal(t, "", grant.organization, c.desc)
+	}
+}
+
+func TestMemoryStoreEvaluatePolicy(t *testing.T) {
+	store := newMemoryStore()
+	user, err := unitTestMemoryUser(store, "MemoryStoreEvaluatePolicy-One")
+	assert.Nil(t, err)
+	uuid := user.GetUuid()
+
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertRoleGrant(&roleGrant{uuid: uuid, role: "viewer", organization: "hwsc", grantedBy: uuid})
+	})
+	assert.Nil(t, err)
+
+	denied := status.Error(codes.PermissionDenied, "unauthorized permission")
+	cases := []struct {
+		desc       string
+		level      auth.Permission
+		permission string
+		target     *policyTarget
+		expErr     error
+	}{
+		{"test role over organization", auth.UserRegistration, permUsersRead, &policyTarget{organization: "hwsc"}, nil},
+		{"test role over other organization", auth.UserRegistration, permUsersRead,
+			&policyTarget{organization: "other"}, denied,
+		},
+		{"test permission not in role", auth.UserRegistration, permUsersWrite,
+			&policyTarget{organization: "hwsc"}, denied,
+		},
+		{"test user over self", auth.User, permUsersWrite, &policyTarget{uuid: uuid}, nil},
+		{"test role over admin of organization", auth.UserRegistration, permUsersRead,
+			&policyTarget{organization: "hwsc", isAdmin: true}, denied,
+		},
+		{"test admin over admin", auth.Admin, permUsersWrite, &policyTarget{uuid: "other", isAdmin: true}, nil},
+		{"test user over service", auth.User, permServiceWrite, nil, denied},
+		{"test admin over service", auth.Admin, permServiceWrite, nil, nil},
+	}
+
+	for _, c := range cases {
+		err := store.WithTx(context.TODO(), func(tx UserTx) error {
+			return evaluatePolicy(tx, &auth.Body{UUID: uuid, Permission: c.level}, c.permission, c.target)
+		})
+		assert.Equal(t, c.expErr, err, c.desc)
+	}
+}
+
+func TestMemoryStoreRoles(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+
+	login := func(lastName string, organization string, level auth.Permission) (*pblib.User, *pblib.Identification) {
+		user := unitTestUserGenerator(lastName)
+		user.Uuid, _ = generateUUID()
+		user.Organization = organization
+		err := store.WithTx(context.TODO(), func(tx UserTx) error {
+			if err := tx.insertNewUser(user); err != nil {
+				return err
+			}
+			return tx.updatePermissionLevel(user.GetUuid(), auth.PermissionStringMap[level])
+		})
+		assert.Nil(t, err)
+		return user, unitTestLogin(t, s, user)
+	}
+	adminUser, admin := login("MemoryStoreRoles-Admin", "hwsc", auth.Admin)
+	manager, managerIdentification := login("MemoryStoreRoles-Manager", "hwsc", auth.User)
+	member, _ := login("MemoryStoreRoles-Member", "hwsc", auth.User)
+	outsider, _ := login("MemoryStoreRoles-Outsider", "other", auth.User)
+
+	changeRole := func(isGrant bool, identification *pblib.Identification, uuid string, md metadata.MD) (
+		[]*jsonRoleGrant, error) {
+		stream := &unitTestHeaderStream{}
+		ctx := grpc.NewContextWithServerTransportStream(metadata.NewIncomingContext(context.TODO(), md), stream)
+		req := &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid}, Identification: identification}
+
+		var err error
+		if isGrant {
+			_, err = s.GrantRole(ctx, req)
+		} else {
+			_, err = s.RevokeRole(ctx, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var roles []*jsonRoleGrant
+		assert.Nil(t, json.Unmarshal([]byte(stream.header.Get(rolesKey)[0]), &roles))
+		return roles, nil
+	}
+	listUsers := func(organization string) error {
+		md := metadata.MD{}
+		if organization != "" {
+			md = metadata.Pairs(listUsersOrganizationKey, organization)
+		}
+		_, err := s.ListUsers(metadata.NewIncomingContext(context.TODO(), md),
+			&pbsvc.UserRequest{Identification: managerIdentification})
+		return err
+	}
+	denied := "rpc error: code = PermissionDenied desc = unauthorized permission"
+	unknownUUID, err := generateUUID()
+	assert.Nil(t, err)
+	orgAdmin := metadata.Pairs(roleKey, "org-admin", roleOrganizationKey, "hwsc")
+
+	// users can not list users, nor grant themselves roles
+	assert.EqualError(t, listUsers("hwsc"), denied)
+	_, err = changeRole(true, managerIdentification, manager.GetUuid(), orgAdmin)
+	assert.EqualError(t, err, denied)
+
+	cases := []struct {
+		desc     string
+		uuid     string
+		md       metadata.MD
+		expMsg   string
+		expRoles []*jsonRoleGrant
+	}{
+		{"test missing role", manager.GetUuid(), metadata.Pairs(roleOrganizationKey, "hwsc"),
+			status.Error(codes.InvalidArgument, consts.ErrInvalidRole.Error()).Error(), nil,
+		},
+		{"test unknown role", manager.GetUuid(), metadata.Pairs(roleKey, "MemoryStoreRoles-DoesNotExist"),
+			status.Error(codes.NotFound, consts.ErrRoleNotFound.Error()).Error(), nil,
+		},
+		{"test invalid uuid", unitTestFailValue, orgAdmin, consts.ErrStatusUUIDInvalid.Error(), nil},
+		{"test unknown uuid", unknownUUID, orgAdmin, consts.ErrStatusUUIDNotFound.Error(), nil},
+		{"test grant org admin", manager.GetUuid(), orgAdmin, "",
+			[]*jsonRoleGrant{{Role: "org-admin", Organization: "hwsc", GrantedBy: adminUser.GetUuid()}},
+		},
+	}
+
+	for _, c := range cases {
+		roles, err := changeRole(true, admin, c.uuid, c.md)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expRoles, roles, c.desc)
+	}
+
+	// the org admin lists the users of its organization only
+	assert.Nil(t, listUsers("hwsc"))
+	assert.EqualError(t, listUsers("other"), denied)
+	assert.EqualError(t, listUsers(""), denied)
+
+	// and grants the roles it holds in its organization
+	roles, err := changeRole(true, managerIdentification, member.GetUuid(),
+		metadata.Pairs(roleKey, "viewer", roleOrganizationKey, "hwsc"))
+	assert.Nil(t, err)
+	assert.Equal(t, []*jsonRoleGrant{{Role: "viewer", Organization: "hwsc", GrantedBy: manager.GetUuid()}}, roles)
+	_, err = changeRole(true, managerIdentification, member.GetUuid(),
+		metadata.Pairs(roleKey, roleAdmin, roleOrganizationKey, "hwsc"))
+	assert.EqualError(t, err, denied)
+	_, err = changeRole(true, managerIdentification, outsider.GetUuid(),
+		metadata.Pairs(roleKey, "viewer", roleOrganizationKey, "other"))
+	assert.EqualError(t, err, denied)
+
+	// but can not take over an ADMIN of its organization
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{
+		User:           &pblib.User{Uuid: adminUser.GetUuid(), Password: unitTestPassword("MemoryStoreRoles-TakeOver")},
+		Identification: managerIdentification,
+	})
+	assert.EqualError(t, err, denied)
+	_, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: adminUser.GetUuid()},
+		Identification: managerIdentification})
+	assert.EqualError(t, err, denied)
+	_, err = s.ResetTOTP(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: adminUser.GetUuid()},
+		Identification: managerIdentification})
+	assert.EqualError(t, err, denied)
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: adminUser.GetEmail(), Password: unitTestPassword("MemoryStoreRoles-Admin")},
+	})
+	assert.Nil(t, err)
+
+	// revoking is idempotent, the org admin loses its permissions
+	for i := 0; i < 2; i++ {
+		roles, err = changeRole(false, admin, manager.GetUuid(), orgAdmin)
+		assert.Nil(t, err)
+		assert.Empty(t, roles)
+	}
+	assert.EqualError(t, listUsers("hwsc"), denied)
+
+	// unknown users are only covered by roles held over every user
+	_, err = s.LogoutAll(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: unknownUUID},
+		Identification: managerIdentification})
+	assert.EqualError(t, err, denied)
+	_, err = s.LogoutAll(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: unknownUUID},
+		Identification: admin})
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeServiceKey(t *testing.T) {
+	defer func(serviceKeys string) { conf.ServiceKeys = serviceKeys }(conf.ServiceKeys)
+
+	cases := []struct {
+		desc         string
+		serviceKeys  string
+		md           metadata.MD
+		isAuthorized bool
+	}{
+		{"test no service keys", "", metadata.Pairs(serviceKeyKey, ""), false},
+		{"test missing key", "one", nil, false},
+		{"test matching key", "one", metadata.Pairs(serviceKeyKey, "one"), true},
+		{"test matching second key", "one, two", metadata.Pairs(serviceKeyKey, "two"), true},
+		{"test wrong key", "one,two", metadata.Pairs(serviceKeyKey, "three"), false},
+		{"test empty key", "one,,two", metadata.Pairs(serviceKeyKey, ""), false},
+	}
+
+	for _, c := range cases {
+		conf.ServiceKeys = c.serviceKeys
+		assert.Equal(t, c.isAuthorized, authorizeServiceKey(c.md), c.desc)
+	}
+}
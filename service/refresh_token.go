@@ -0,0 +1,54 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"time"
+)
+
+const (
+	// refreshTokenLength and refreshFamilyIDLength are in random bytes
+	refreshTokenLength    = 32
+	refreshFamilyIDLength = 16
+
+	// AuthenticateUser and RefreshAuthToken return the refresh token in the header metadata,
+	// RefreshAuthToken reads it from the incoming metadata b/c Identification has no field for it
+	refreshTokenKey = "refresh-token"
+)
+
+// generateRefreshToken returns a new random refresh token, url safe.
+func generateRefreshToken() (string, error) {
+	random := make([]byte, refreshTokenLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// newRefreshToken issues a refresh token of uuid expiring after conf.RefreshTokenLifetime.
+// The token starts a new family, or joins familyID if it rotates a token of that family.
+// Returns the token, only its hash is stored.
+func newRefreshToken(tx UserTx, uuid string, familyID string) (string, error) {
+	if familyID == "" {
+		random := make([]byte, refreshFamilyIDLength)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		familyID = hex.EncodeToString(random)
+	}
+
+	token, err := generateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	expiration := time.Now().UTC().Add(conf.RefreshTokenLifetime)
+	if err := tx.insertRefreshToken(hashToken(token), familyID, uuid, expiration); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
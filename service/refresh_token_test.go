@@ -0,0 +1,124 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestGenerateRefreshToken(t *testing.T) {
+	first, err := generateRefreshToken()
+	assert.Nil(t, err)
+	second, err := generateRefreshToken()
+	assert.Nil(t, err)
+
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, 43, len(first))
+	assert.Equal(t, hashToken(first), hashToken(first))
+	assert.NotEqual(t, hashToken(first), hashToken(second))
+	assert.NotContains(t, hashToken(first), first)
+}
+
+func TestMemoryStoreRefreshAuthToken(t *testing.T) {
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreRefreshAuthToken-One", auth.User)
+
+	stream := &unitTestHeaderStream{}
+	response, err := s.AuthenticateUser(grpc.NewContextWithServerTransportStream(context.TODO(), stream),
+		&pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()}})
+	assert.Nil(t, err)
+	assert.NotNil(t, response.GetIdentification())
+	first := stream.header.Get(refreshTokenKey)[0]
+
+	refresh := func(token string) (*pbsvc.UserResponse, string, error) {
+		stream := &unitTestHeaderStream{}
+		ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(refreshTokenKey, token))
+		response, err := s.RefreshAuthToken(grpc.NewContextWithServerTransportStream(ctx, stream),
+			&pbsvc.UserRequest{})
+		if err != nil {
+			return nil, "", err
+		}
+		return response, stream.header.Get(refreshTokenKey)[0], nil
+	}
+
+	_, _, err = refresh("")
+	assert.Equal(t, status.Error(codes.InvalidArgument, consts.ErrNilRefreshToken.Error()), err)
+	_, _, err = refresh(unitTestFailValue)
+	assert.Equal(t, consts.ErrStatusInvalidRefreshToken, err)
+
+	// each refresh rotates the refresh token
+	response, second, err := refresh(first)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: response.GetIdentification()})
+	assert.Nil(t, err)
+
+	_, third, err := refresh(second)
+	assert.Nil(t, err)
+
+	// reusing a rotated token revokes the whole family, the latest token included
+	_, _, err = refresh(first)
+	assert.Equal(t, consts.ErrStatusRefreshTokenReused, err)
+	_, _, err = refresh(third)
+	assert.Equal(t, consts.ErrStatusInvalidRefreshToken, err)
+
+	// suspended users can not refresh, even with a token issued before the suspension revoked them
+	var suspended string
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		var err error
+		if suspended, err = newRefreshToken(tx, user.GetUuid(), ""); err != nil {
+			return err
+		}
+		return tx.insertSuspension(&suspensionRow{uuid: user.GetUuid(), reason: "RefreshAuthToken",
+			suspendedTimestamp: time.Now().UTC()})
+	})
+	assert.Nil(t, err)
+	_, _, err = refresh(suspended)
+	assert.Equal(t, consts.ErrStatusUserSuspended, err)
+
+	// the token is not used up by the rejected refresh
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.deleteSuspension(user.GetUuid())
+	})
+	assert.Nil(t, err)
+	_, _, err = refresh(suspended)
+	assert.Nil(t, err)
+
+	// expired tokens are rejected
+	defaultRefreshTokenLifetime := conf.RefreshTokenLifetime
+	conf.RefreshTokenLifetime = -time.Minute
+	defer func() { conf.RefreshTokenLifetime = defaultRefreshTokenLifetime }()
+
+	var expired string
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		var err error
+		expired, err = newRefreshToken(tx, user.GetUuid(), "")
+		return err
+	})
+	assert.Nil(t, err)
+	_, _, err = refresh(expired)
+	assert.Equal(t, consts.ErrStatusRefreshTokenExpired, err)
+
+	// tokens of a user that no longer exists are rejected
+	conf.RefreshTokenLifetime = defaultRefreshTokenLifetime
+	var orphan string
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		var err error
+		orphan, err = newRefreshToken(tx, user.GetUuid(), "")
+		return err
+	})
+	assert.Nil(t, err)
+	delete(store.tables.accounts, user.GetUuid())
+	_, _, err = refresh(orphan)
+	assert.Equal(t, consts.ErrStatusInvalidRefreshToken, err)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// RotateAuthSecrets reloads the active secret into currAuthSecret every config.Interval until ctx is done,
+// so every replica signs with the secret another replica rotated to,
+// and rotates the secret once it expires within the rotation lead of config.
+// The store is not written while the service is not available, the secret is only reloaded.
+func (s *Service) RotateAuthSecrets(ctx context.Context, config conf.SecretRotationConfig) {
+	lead := secretRotationLead(config)
+
+	// rotate right away in case the secret expired while no replica was running
+	s.rotateAuthSecret(ctx, config.Interval, lead)
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rotateAuthSecret(ctx, config.Interval, lead)
+		}
+	}
+}
+
+// WatchAuthSecret reloads the active secret into currAuthSecret as soon as any replica commits a new secret,
+// rather than on the next tick of RotateAuthSecrets, until ctx is done.
+func (s *Service) WatchAuthSecret(ctx context.Context) {
+	err := s.userStore().WatchActiveSecret(ctx, func() {
+		s.reloadAuthSecret(ctx)
+	})
+	if err != nil {
+		logger.Error(consts.WatchAuthSecretTag, consts.MsgErrWatchSecret, err.Error())
+	}
+}
+
+// reloadAuthSecret sets currAuthSecret to the active secret, logging instead of returning errors.
+func (s *Service) reloadAuthSecret(ctx context.Context) {
+	authSecretLocker.Lock()
+	defer authSecretLocker.Unlock()
+
+	var retrievedSecret *pblib.Secret
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		var err error
+		retrievedSecret, err = tx.getActiveSecretRow()
+		return err
+	})
+	if err != nil {
+		logger.Error(consts.WatchAuthSecretTag, consts.MsgErrGetActiveSecret, err.Error())
+		return
+	}
+
+	currAuthSecret = retrievedSecret
+}
+
+// secretRotationLead returns the rotation lead of config, raised to the longest an auth token signed
+// with a rotated secret can outlive the rotation: the token lifetime, plus the interval a replica
+// keeps signing with the secret it loaded before the rotation.
+// Tokens therefore expire before the secret they are signed with, and keep verifying until then.
+// The lead is capped below the shortest secret lifetime, secrets expire at 3 AM, else every tick would rotate.
+func secretRotationLead(config conf.SecretRotationConfig) time.Duration {
+	minLead := time.Hour*time.Duration(authTokenExpirationTime) + config.Interval
+	maxLead := time.Hour * 24 * time.Duration(authSecretExpirationTime-1)
+
+	switch {
+	case config.Lead < minLead:
+		return minLead
+	case config.Lead > maxLead:
+		return maxLead
+	}
+
+	return config.Lead
+}
+
+// rotateAuthSecret runs one tick of RotateAuthSecrets within timeout, logging instead of returning errors.
+func (s *Service) rotateAuthSecret(ctx context.Context, timeout time.Duration, lead time.Duration) {
+	rotateCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	authSecretLocker.Lock()
+	defer authSecretLocker.Unlock()
+
+	canRotate := serviceStateLocker.isStateAvailable()
+	var retrievedSecret *pblib.Secret
+	var isRotated bool
+	err := s.userStore().WithTx(rotateCtx, func(tx UserTx) error {
+		if !canRotate {
+			var err error
+			retrievedSecret, err = tx.getActiveSecretRow()
+			return err
+		}
+
+		var err error
+		retrievedSecret, isRotated, err = rotateAuthSecretIfDue(tx, time.Now().UTC().Add(lead))
+		return err
+	})
+	if err != nil {
+		logger.Error(consts.RotateAuthSecretsTag, consts.MsgErrRotateSecret, err.Error())
+		return
+	}
+
+	// set the currAuthSecret only once the new secret is committed
+	currAuthSecret = retrievedSecret
+	if isRotated {
+		logger.Info(consts.RotateAuthSecretsTag, "Rotated auth secret, expires at:",
+			time.Unix(retrievedSecret.GetExpirationTimestamp(), 0).UTC().String())
+	}
+}
+
+// rotateAuthSecretIfDue inserts a new secret if there is no active secret, or the active secret expires by deadline.
+// The previous secret is kept, so tokens signed with it keep verifying until they or it expire.
+// Returns the active secret and whether it is new.
+func rotateAuthSecretIfDue(tx UserTx, deadline time.Time) (*pblib.Secret, bool, error) {
+	activeSecret, err := tx.getActiveSecretRow()
+	if err != nil && err != consts.ErrNoActiveSecretKeyFound {
+		return nil, false, err
+	}
+
+	// another replica may have rotated the secret already
+	if activeSecret != nil && activeSecret.GetExpirationTimestamp() > deadline.Unix() {
+		return activeSecret, false, nil
+	}
+
+	if err := tx.insertNewAuthSecret(); err != nil {
+		return nil, false, err
+	}
+
+	activeSecret, err = tx.getActiveSecretRow()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return activeSecret, true, nil
+}
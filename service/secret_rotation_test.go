@@ -0,0 +1,126 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestSecretRotationLead(t *testing.T) {
+	tokenLifetime := time.Hour * time.Duration(authTokenExpirationTime)
+
+	cases := []struct {
+		desc    string
+		config  conf.SecretRotationConfig
+		expLead time.Duration
+	}{
+		{"test default", conf.SecretRotationConfig{Interval: time.Minute, Lead: 24 * time.Hour}, 24 * time.Hour},
+		{"test zero lead", conf.SecretRotationConfig{Interval: time.Minute}, tokenLifetime + time.Minute},
+		{"test lead shorter than a token", conf.SecretRotationConfig{Interval: time.Hour, Lead: time.Hour},
+			tokenLifetime + time.Hour},
+		{"test lead longer than a secret", conf.SecretRotationConfig{Interval: time.Minute, Lead: 30 * 24 * time.Hour},
+			time.Hour * 24 * time.Duration(authSecretExpirationTime-1)},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expLead, secretRotationLead(c.config), c.desc)
+	}
+}
+
+func TestMemoryStoreRotateAuthSecret(t *testing.T) {
+	store := unitTestMemoryStore(t)
+	s := NewService(store)
+
+	// the first tick creates the secret
+	s.rotateAuthSecret(context.TODO(), time.Minute, time.Hour)
+	assert.NotNil(t, currAuthSecret)
+	first := currAuthSecret
+
+	// an admin holds the service:write permission GetAuthSecret requires
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreRotateAuthSecret-One", auth.Admin)
+
+	response, err := s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+	})
+	assert.Nil(t, err)
+	oldIdentification := response.GetIdentification()
+	assert.Equal(t, first.GetKey(), oldIdentification.GetSecret().GetKey())
+
+	// not rotated until the secret expires within the lead
+	s.rotateAuthSecret(context.TODO(), time.Minute, time.Hour)
+	assert.Equal(t, first.GetKey(), currAuthSecret.GetKey())
+
+	// secrets expire at 3 AM, up to a day before their expiration time
+	s.rotateAuthSecret(context.TODO(), time.Minute, time.Hour*24*(authSecretExpirationTime+1))
+	assert.NotEqual(t, first.GetKey(), currAuthSecret.GetKey())
+	second := currAuthSecret
+
+	// tokens signed with the previous secret keep verifying
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: oldIdentification})
+	assert.Nil(t, err)
+
+	// a secret rotated by another replica is picked up by the next tick
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewAuthSecret()
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, second.GetKey(), currAuthSecret.GetKey())
+
+	s.rotateAuthSecret(context.TODO(), time.Minute, time.Hour)
+	assert.NotEqual(t, second.GetKey(), currAuthSecret.GetKey())
+
+	response, err = s.GetAuthSecret(context.TODO(), &pbsvc.UserRequest{Identification: oldIdentification})
+	assert.Nil(t, err)
+	assert.Equal(t, currAuthSecret.GetKey(), response.GetIdentification().GetSecret().GetKey())
+
+	// services get the secret with a service key instead of an auth token
+	defer func(serviceKeys string) { conf.ServiceKeys = serviceKeys }(conf.ServiceKeys)
+	conf.ServiceKeys = "MemoryStoreRotateAuthSecret-Key"
+	serviceResponse, err := s.GetAuthSecret(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceKeyKey, "MemoryStoreRotateAuthSecret-Key")), &pbsvc.UserRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, currAuthSecret.GetKey(), serviceResponse.GetIdentification().GetSecret().GetKey())
+	_, err = s.GetAuthSecret(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceKeyKey, unitTestFailValue)), &pbsvc.UserRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// an expired cached secret is reloaded before signing
+	currAuthSecret = &pblib.Secret{Key: first.GetKey(), CreatedTimestamp: first.GetCreatedTimestamp(),
+		ExpirationTimestamp: time.Now().Add(-time.Minute).Unix()}
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return setCurrentSecretOnce(tx)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, response.GetIdentification().GetSecret().GetKey(), currAuthSecret.GetKey())
+}
+
+func TestMemoryStoreWatchAuthSecret(t *testing.T) {
+	store := unitTestMemoryStore(t)
+	s := NewService(store)
+
+	err := store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.insertNewAuthSecret()
+	})
+	assert.Nil(t, err)
+
+	s.reloadAuthSecret(context.TODO())
+	assert.NotNil(t, currAuthSecret)
+
+	// there are no other replicas to watch, returns once ctx is done
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		s.WatchAuthSecret(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+}
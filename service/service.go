@@ -1,6 +1,7 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
@@ -11,22 +12,32 @@ import (
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // Service struct type, implements the generated (pb file) UserServiceServer interface
-type Service struct{}
+type Service struct {
+	store UserStore
+}
 
 // state of the service
 type state uint32
 
 // stateLocker synchronizes the state of the service
+// reason explains a state other than available, and a non zero expiresAt returns the service to available.
+// degraded is set while the store is unreachable, only VerifyAuthToken is served then, from cachedAuthTokens.
 type stateLocker struct {
 	lock                sync.RWMutex
 	currentServiceState state
+	reason              string
+	expiresAt           time.Time
+	degraded            bool
 }
 
 const (
@@ -36,16 +47,18 @@ const (
 	// unavailable - service is locked
 	unavailable state = 1
 
+	// maintenance - service is available for reads, writes are rejected
+	maintenance state = 2
+
 	// authTokenExpirationTime in hours
 	authTokenExpirationTime = 2
 
-	// authTokenExpirationTime in days
+	// authSecretExpirationTime in days, RotateAuthSecrets rotates the secret before it expires
 	authSecretExpirationTime = 7
 )
 
 var (
 	serviceStateLocker stateLocker
-	uuidMapLocker      sync.Map
 	authSecretLocker   sync.RWMutex
 )
 
@@ -55,23 +68,119 @@ func init() {
 	}
 }
 
+// Drain marks the service unavailable, new calls get ResponseServiceUnavailable
+// while calls already past the state check run to completion.
+func Drain() {
+	serviceStateLocker.setState(unavailable, "shutting down", time.Time{})
+}
+
+// NewService returns a Service that keeps its data in store, see NewStore.
+// A nil store, like the zero Service, uses the postgres store.
+func NewService(store UserStore) *Service {
+	return &Service{store: store}
+}
+
+// userStore returns the store of the service, defaulting to the postgres store.
+func (s *Service) userStore() UserStore {
+	if s.store == nil {
+		return defaultStore
+	}
+	return s.store
+}
+
 // GetStatus checks the current status of the service.
-// On success, returns OK status and message.
+// Returns OK status for available and maintenance, Unavailable status for unavailable or if the store is unreachable.
+// The message names the state and its reason, the state, reason and expiry are also sent as header metadata.
 func (s *Service) GetStatus(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("GetStatus")
 
-	if ok := serviceStateLocker.isStateAvailable(); !ok {
-		return consts.ResponseServiceUnavailable, nil
+	currState, reason, expiresAt := serviceStateLocker.current()
+	if err := grpc.SetHeader(ctx, newServiceStateMetadata(currState, reason, expiresAt)); err != nil {
+		logger.Error(consts.GetStatusTag, err.Error())
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return consts.ResponseServiceUnavailable, nil
+	if currState == unavailable {
+		return newServiceStateResponse(codes.Unavailable, currState, reason), nil
 	}
 
-	return &pbsvc.UserResponse{
-		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
-		Message: codes.OK.String(),
-	}, nil
+	if err := s.checkStore(ctx); err != nil {
+		return newServiceStateResponse(codes.Unavailable, unavailable, consts.ErrStoreUnreachable.Error()), nil
+	}
+
+	return newServiceStateResponse(codes.OK, currState, reason), nil
+}
+
+// MonitorStore pings the store every interval until ctx is done,
+// entering degraded mode while the store is unreachable and leaving it once the store reconnects.
+func (s *Service) MonitorStore(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			_ = s.checkStore(pingCtx)
+			cancel()
+		}
+	}
+}
+
+// checkStore pings the store and updates degraded mode.
+// Returns error if the store is unreachable.
+func (s *Service) checkStore(ctx context.Context) error {
+	err := s.userStore().Ping(ctx)
+	if serviceStateLocker.setDegraded(err != nil) {
+		if err != nil {
+			logger.Error(consts.PSQL, consts.ErrStoreUnreachable.Error(), err.Error())
+		} else {
+			logger.Info(consts.PSQL, "Store is reachable, leaving degraded mode")
+		}
+	}
+
+	return err
+}
+
+// SetServiceState puts the service into maintenance, where only reads are served, unavailable, or back to available.
+// Requires the service:write permission, the state, reason and optional expiry are read from the request metadata.
+// Is served in every state b/c it is how the service leaves maintenance or unavailable.
+// On success, returns OK status with the new state and reason as message.
+func (s *Service) SetServiceState(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetServiceState")
+
+	if req == nil {
+		logger.Error(consts.SetServiceStateTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	newState, reason, expiresAt, err := newServiceStateOptions(md, time.Now().UTC())
+	if err != nil {
+		logger.Error(consts.SetServiceStateTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permServiceWrite, nil); err != nil {
+			logger.Error(consts.SetServiceStateTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	serviceStateLocker.setState(newState, reason, expiresAt)
+	logger.Info("Service state set to:", serviceStateNames[newState], reason)
+
+	if err := grpc.SetHeader(ctx, newServiceStateMetadata(newState, reason, expiresAt)); err != nil {
+		logger.Error(consts.SetServiceStateTag, err.Error())
+	}
+
+	return newServiceStateResponse(codes.OK, newState, reason), nil
 }
 
 // CreateUser creates a new User row and inserts it to accounts table.
@@ -89,10 +198,6 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	// get User Object
 	user := req.GetUser()
 	if user == nil {
@@ -100,6 +205,14 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
+	// blank passwords are rejected by insertNewUser along with the other blank fields
+	if validatePassword(user.GetPassword()) == nil {
+		if err := checkPasswordPolicy(user.GetPassword(), user); err != nil {
+			logger.Error(consts.CreateUserTag, err.Error())
+			return nil, status.Convert(err).Err()
+		}
+	}
+
 	// generate uuid synchronously to prevent users getting the same uuid
 	var err error
 	user.Uuid, err = generateUUID()
@@ -108,20 +221,36 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// sync.Map equivalent to map[string](&sync.RWMutex{}) = each uuid string gets its own lock
-	// LoadOrStore = LOAD: get the lock for uuid or if not exist,
-	// 				 STORE: make uuid key and store lock type &sync.RWMutex{}
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	// insert user and its email token in one transaction, so a user can not exist without a verification token
+	var emailID *pblib.Identification
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(user.GetUuid()); err != nil {
+			return err
+		}
 
-	// insert user into DB
-	if err := insertNewUser(user); err != nil {
-		// remove unstored/invaid uuid from cache uuidMapLocker b/c
-		// Mutex was allocated (saves resources/memory and prevent security issues)
-		uuidMapLocker.Delete(user.GetUuid())
-		logger.Error(consts.CreateUserTag, consts.MsgErrInsertUser, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		if err := tx.insertNewUser(user); err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrInsertUser, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// create identification for email token
+		var err error
+		emailID, err = auth.GenerateEmailIdentification(user.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+		if err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.insertEmailToken(user.GetUuid(), emailID.GetToken(), emailID.GetSecret(),
+			emailTokenPurposeVerifyEmail); err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrInsertEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
 	}
 
 	logger.Info("Inserted new user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
@@ -131,61 +260,24 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 	user.PermissionLevel = auth.PermissionStringMap[auth.NoPermission]
 
 	userCreatedResponse := &pbsvc.UserResponse{
-		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
-		Message: codes.OK.String(),
-		User:    user,
-	}
-
-	// from here on: do not return an error because we can always regenerate tokens and resend verification emails
-
-	// create identification for email token
-	emailID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.PermissionLevel)
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailToken, err.Error())
-		return userCreatedResponse, nil
-	}
-
-	// insert token into db, if nondb error returns, token will simply expire, so no need to remove
-	if err := insertEmailToken(user.GetUuid(), emailID.GetToken(), emailID.GetSecret()); err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrInsertEmailToken, err.Error())
-		return userCreatedResponse, nil
-	}
-
-	// generate verification link for emails
-	verificationLink, err := generateEmailVerifyLink(emailID.GetToken())
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailVerifyLink, err.Error())
-		return userCreatedResponse, nil
-	}
-
-	// send email
-	emailData := make(map[string]string)
-	if verificationLink == "" {
-		return userCreatedResponse, nil
-	}
-	emailData[verificationLinkKey] = verificationLink
-
-	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username, subjectVerifyEmail)
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrEmailRequest, err.Error())
-		return userCreatedResponse, nil
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		Identification: &pblib.Identification{Token: emailID.GetToken()},
+		User:           user,
 	}
 
-	if err := emailReq.sendEmail(templateVerifyEmail); err != nil {
+	// from here on: do not return an error because we can always resend verification emails
+	if err := sendVerificationEmail(emailID.GetToken(), user.GetEmail(), subjectVerifyEmail,
+		templateVerifyEmail); err != nil {
 		logger.Error(consts.CreateUserTag, consts.MsgErrSendEmail, err.Error())
 	}
 
-	return &pbsvc.UserResponse{
-		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
-		Message:        codes.OK.String(),
-		Identification: &pblib.Identification{Token: emailID.GetToken()},
-		User:           user,
-	}, nil
+	return userCreatedResponse, nil
 }
 
-// DeleteUser deletes a user row in accounts table.
-// Releases mutex resource stored in uuidMapLocker by deleting the uuid.
-// Method is idempotent, returns OK regardless of user not existing in accounts table and uuidMapLocker.
+// DeleteUser deletes a user row in accounts table, requires the users:admin permission over the user,
+// or users:write to delete themself. The last ADMIN that is not suspended can not be deleted.
+// Method is idempotent, returns OK regardless of user not existing in accounts table.
 func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("DeleteUser")
 
@@ -198,10 +290,6 @@ func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	// get User Object
 	user := req.GetUser()
 	if user == nil {
@@ -214,18 +302,46 @@ func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	// delete from db, auth tokens are not tied to the account row so they are revoked on their own
+	if err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(user.GetUuid()); err != nil {
+			return err
+		}
+
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.DeleteUserTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		target, err := getPolicyTarget(tx, user.GetUuid())
+		if err != nil {
+			logger.Error(consts.DeleteUserTag, consts.MsgErrGetUserRow, err.Error())
+			return err
+		}
+		permission := permUsersAdmin
+		if body.UUID == user.GetUuid() {
+			permission = permUsersWrite
+		}
+		if err := evaluatePolicy(tx, body, permission, target); err != nil {
+			logger.Error(consts.DeleteUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+		if err := checkLastAdmin(tx, target); err != nil {
+			logger.Error(consts.DeleteUserTag, consts.MsgErrDeleteUser, err.Error())
+			return err
+		}
 
-	// delete from db
-	if err := deleteUserRow(user.GetUuid()); err != nil {
+		if err := tx.deleteUserRow(user.GetUuid()); err != nil {
+			return err
+		}
+		return tx.revokeAuthTokens(user.GetUuid())
+	}); err != nil {
 		logger.Error(consts.DeleteUserTag, consts.MsgErrDeleteUser, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
 	}
 
-	// release mutex resource
-	uuidMapLocker.Delete(user.GetUuid())
+	cachedAuthTokens.evictUUID(user.GetUuid())
 
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -234,7 +350,8 @@ func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 	}, nil
 }
 
-// UpdateUser performs a partial update to a user row in accounts table.
+// UpdateUser performs a partial update to a user row in accounts table, requires the users:write permission
+// over the user, and users:admin over the user in both organizations to change their organization.
 // Method is idempotent, will perform a partial update regardless of any changes or not.
 // If no changes are present, it will rewrite the selected columns with existing values.
 // On success, returns user object regardless of change or not.
@@ -250,10 +367,6 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	// get User Object
 	svcDerivedUser := req.GetUser()
 	if svcDerivedUser == nil {
@@ -266,28 +379,76 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(svcDerivedUser.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	var updatedUser *pblib.User
+	var emailID *pblib.Identification
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(svcDerivedUser.GetUuid()); err != nil {
+			return err
+		}
 
-	// retrieve users row from database
-	dbDerivedUser, err := getUserRow(svcDerivedUser.GetUuid())
+		target, err := getPolicyTarget(tx, svcDerivedUser.GetUuid())
+		if err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrGetUserRow, err.Error())
+			return err
+		}
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersWrite, target)
+		if err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		// moving a user takes users:admin over them in the organization they leave, and in the one they join
+		if organization := svcDerivedUser.GetOrganization(); organization != "" && organization != target.organization {
+			joined := *target
+			joined.organization = organization
+			for _, organizationTarget := range []*policyTarget{target, &joined} {
+				if err := evaluatePolicy(tx, body, permUsersAdmin, organizationTarget); err != nil {
+					logger.Error(consts.UpdateUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+					return err
+				}
+			}
+		}
+
+		// retrieve users row from database
+		dbDerivedUser, err := tx.getUserRow(svcDerivedUser.GetUuid())
+		if err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// update user
+		updatedUser, emailID, err = tx.updateUserRow(svcDerivedUser.GetUuid(), svcDerivedUser, dbDerivedUser)
+		if err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrUpdateUserRow, err.Error())
+			if _, ok := err.(*passwordPolicyError); ok {
+				return status.Convert(err).Err()
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// a new password logs out every session
+		if svcDerivedUser.GetPassword() != "" {
+			if err := tx.revokeAuthTokens(svcDerivedUser.GetUuid()); err != nil {
+				logger.Error(consts.UpdateUserTag, consts.MsgErrRevokeAuthTokens, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.UpdateUserTag, consts.MsgErrGetUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
 	}
-
-	if dbDerivedUser == nil {
-		logger.Error(consts.UpdateUserTag, consts.ErrUUIDNotFound.Error())
-		return nil, consts.ErrStatusUUIDNotFound
+	if svcDerivedUser.GetPassword() != "" {
+		cachedAuthTokens.evictUUID(svcDerivedUser.GetUuid())
 	}
 
-	// update user
-	var updatedUser *pblib.User
-	updatedUser, err = updateUserRow(svcDerivedUser.GetUuid(), svcDerivedUser, dbDerivedUser)
-	if err != nil {
-		logger.Error(consts.UpdateUserTag, consts.MsgErrUpdateUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	// do not return an error b/c the user is already updated, verification emails can be resent
+	if emailID != nil {
+		if err := sendVerificationEmail(emailID.GetToken(), updatedUser.GetProspectiveEmail(), subjectUpdateEmail,
+			templateUpdateEmail); err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrSendEmail, err.Error())
+		}
 	}
 
 	logger.Info("Updated user:", updatedUser.GetUuid(),
@@ -302,6 +463,9 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 }
 
 // AuthenticateUser goes through accounts table and find matching email and password.
+// Failed logins are backed off and locked out per email, and locked out per client IP (see loginLimiter),
+// blocked logins return ResourceExhausted with the seconds to wait in the retry-after header.
+// Unknown emails and wrong passwords fail alike, so the response does not reveal if the email exists.
 // On success, returns the identification, and matched row as user object with password set to empty string.
 func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("AuthenticateUser")
@@ -322,11 +486,6 @@ func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest)
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.AuthenticateUserTag, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	// email, password
 	if err := validateEmail(user.GetEmail()); err != nil {
 		logger.Error(consts.AuthenticateUserTag, consts.ErrInvalidUserEmail.Error())
@@ -337,30 +496,108 @@ func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest)
 		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidPassword.Error())
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).RLock()
-	defer lock.(*sync.RWMutex).RUnlock()
-
-	// match email and password
-	matchedUser, err := matchEmailAndPassword(user.GetEmail(), user.GetPassword())
-	if err != nil {
-		logger.Error(consts.AuthenticateUserTag, consts.MsgErrMatchEmailPassword, err.Error())
-		return nil, status.Error(codes.Unauthenticated, err.Error())
+	md, _ := metadata.FromIncomingContext(ctx)
+	emailKey, ipKey := loginEmailKey(user.GetEmail()), loginIPKey(clientIP(md))
+	if wait := loginAttempts.blocked(time.Now(), emailKey, ipKey); wait > 0 {
+		logger.Error(consts.AuthenticateUserTag, consts.ErrLoginBlocked.Error())
+		retryAfter := strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10)
+		if err := grpc.SetHeader(ctx, metadata.Pairs(loginRetryAfterKey, retryAfter)); err != nil {
+			logger.Error(consts.AuthenticateUserTag, err.Error())
+		}
+		return nil, consts.ErrStatusLoginBlocked
 	}
 
-	if auth.PermissionEnumMap[matchedUser.GetPermissionLevel()] < auth.UserRegistration {
-		logger.Error(consts.AuthenticateUserTag, consts.MsgErrGeneratingAuthToken)
-		return nil, status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
+	code, recoveryCode := getMetadataValue(md, totpCodeKey), getMetadataValue(md, totpRecoveryCodeKey)
+
+	var matchedUser *pblib.User
+	var identification *pblib.Identification
+	var refreshToken string
+	var emailExists bool
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// the user is only known once looked up by email, it is locked before a password rehash or
+		// a TOTP step is written, so the writes do not race other writes to the user
+		lookedUpUser, err := tx.getUserRowByEmail(user.GetEmail())
+		if err == nil {
+			err = tx.lockUUID(lookedUpUser.GetUuid())
+		}
+
+		// match email and password
+		if err == nil {
+			matchedUser, err = tx.matchEmailAndPassword(user.GetEmail(), user.GetPassword())
+		}
+		switch err {
+		case nil:
+		case consts.ErrEmailDoesNotExist:
+			compareDummyPassword(user.GetPassword())
+			logger.Error(consts.AuthenticateUserTag, consts.MsgErrMatchEmailPassword, err.Error())
+			return consts.ErrStatusInvalidCredentials
+		case consts.ErrPasswordMismatch:
+			emailExists = true
+			logger.Error(consts.AuthenticateUserTag, consts.MsgErrMatchEmailPassword, err.Error())
+			return consts.ErrStatusInvalidCredentials
+		default:
+			logger.Error(consts.AuthenticateUserTag, consts.MsgErrMatchEmailPassword, err.Error())
+			return err
+		}
+		if matchedUser.GetUuid() != lookedUpUser.GetUuid() {
+			logger.Error(consts.AuthenticateUserTag, consts.ErrLoginUserChanged.Error())
+			return status.Error(codes.Aborted, consts.ErrLoginUserChanged.Error())
+		}
+
+		if auth.PermissionEnumMap[matchedUser.GetPermissionLevel()] < auth.UserRegistration {
+			logger.Error(consts.AuthenticateUserTag, consts.MsgErrGeneratingAuthToken)
+			return status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
+		}
+
+		// users enrolled in two-factor authentication also need a code, or a recovery code
+		if err := verifySecondFactor(tx, matchedUser.GetUuid(), code, recoveryCode, time.Now()); err != nil {
+			logger.Error(consts.AuthenticateUserTag, err.Error())
+			emailExists = true
+			return err
+		}
+
+		// checked once the credentials match, so only the user learns they are suspended
+		if err := checkSuspension(tx, matchedUser.GetUuid()); err != nil {
+			logger.Error(consts.AuthenticateUserTag, err.Error())
+			return err
+		}
+
+		identification, err = getAuthIdentification(tx, matchedUser)
+		if err != nil {
+			logger.Error(consts.AuthenticateUserTag, err.Error())
+			return err
+		}
+
+		refreshToken, err = newRefreshToken(tx, matchedUser.GetUuid(), "")
+		if err != nil {
+			logger.Error(consts.AuthenticateUserTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	// a wrong code counts as a failed login, a missing one does not b/c clients first try without
+	if err == consts.ErrStatusInvalidCredentials || err == consts.ErrStatusInvalidTOTPCode {
+		now := time.Now()
+		loginAttempts.fail(now, ipKey)
+		if loginAttempts.fail(now, emailKey) && emailExists {
+			sendLockoutEmail(user.GetEmail(), now.Add(conf.LoginLimit.Lockout))
+		}
+		return nil, err
 	}
-	identification, err := getAuthIdentification(matchedUser)
 	if err != nil {
-		logger.Error(consts.AuthenticateUserTag, err.Error())
-		return nil, err
+		return nil, txErrorToStatus(err)
 	}
 
+	// the email proved its password, an IP can not reset its own failures by logging into an account it owns
+	loginAttempts.reset(emailKey)
 	logger.Info("Authenticated user:", matchedUser.GetUuid(),
 		matchedUser.GetFirstName(), matchedUser.GetLastName())
 
+	if err := grpc.SetHeader(ctx, metadata.Pairs(refreshTokenKey, refreshToken)); err != nil {
+		logger.Error(consts.AuthenticateUserTag, err.Error())
+	}
+
 	matchedUser.Password = ""
 	return &pbsvc.UserResponse{
 		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -370,203 +607,1782 @@ func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest)
 	}, nil
 }
 
-// ListUsers returns the user DB collection
-// TODO write return values after implementing
-func (s *Service) ListUsers(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	//TODO
-	logger.RequestService("ListUsers")
-	return &pbsvc.UserResponse{}, nil
-}
-
-// GetUser looks up a user by their uuid in accounts table.
-// On success, returns the matched row as user object, setting password to empty.
-func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	logger.RequestService("GetUser")
+// UnlockUser clears the failed logins of a user, or of a client IP.
+// Unlocking a user requires the users:admin permission over the user, unlocking an IP over every user.
+// The user is picked by user.email, or by user.uuid if email is empty,
+// the client IP is read from the login-ip incoming metadata.
+// On success, returns OK whether or not the user or IP was locked.
+func (s *Service) UnlockUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnlockUser")
 
 	if ok := serviceStateLocker.isStateAvailable(); !ok {
-		logger.Error(consts.GetUserTag, consts.ErrServiceUnavailable.Error())
+		logger.Error(consts.UnlockUserTag, consts.ErrServiceUnavailable.Error())
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
 	if req == nil {
+		logger.Error(consts.UnlockUserTag, consts.ErrNilRequest.Error())
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	md, _ := metadata.FromIncomingContext(ctx)
+	ip := clientIP(md)
+	email, uuid := req.GetUser().GetEmail(), req.GetUser().GetUuid()
+	if email == "" && uuid == "" && ip == "" {
+		logger.Error(consts.UnlockUserTag, consts.ErrNilUnlockTarget.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilUnlockTarget.Error())
 	}
-
-	// get User Object
-	user := req.GetUser()
-	if user == nil {
-		logger.Error(consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			logger.Error(consts.UnlockUserTag, err.Error())
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	} else if uuid != "" {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			logger.Error(consts.UnlockUserTag, err.Error())
+			return nil, consts.ErrStatusUUIDInvalid
+		}
 	}
 
-	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
-		logger.Error(consts.GetUserTag, authconst.ErrInvalidUUID.Error())
-		return nil, consts.ErrStatusUUIDInvalid
-	}
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.UnlockUserTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		if ip != "" {
+			if err := evaluatePolicy(tx, body, permUsersAdmin, nil); err != nil {
+				logger.Error(consts.UnlockUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+				return err
+			}
+		}
 
-	// read lock, b/c we are only retrieving/reading from the DB
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).RLock()
-	defer lock.(*sync.RWMutex).RUnlock()
+		if email == "" && uuid == "" {
+			return nil
+		}
 
-	// retrieve users row from database
-	retrievedUser, err := getUserRow(user.GetUuid())
+		// an unknown email is still unlocked b/c failed logins are counted for unknown emails too
+		var retrievedUser *pblib.User
+		if email != "" {
+			retrievedUser, err = tx.getUserRowByEmail(email)
+			if err == consts.ErrEmailDoesNotExist {
+				err = nil
+			}
+		} else {
+			retrievedUser, err = tx.getUserRow(uuid)
+			if err == consts.ErrUserNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			logger.Error(consts.UnlockUserTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		target := newPolicyTarget(retrievedUser.GetUuid(), retrievedUser)
+		if err := evaluatePolicy(tx, body, permUsersAdmin, target); err != nil {
+			logger.Error(consts.UnlockUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		if retrievedUser == nil && email == "" {
+			logger.Error(consts.UnlockUserTag, consts.ErrUUIDNotFound.Error())
+			return consts.ErrStatusUUIDNotFound
+		}
+		if email == "" {
+			email = retrievedUser.GetEmail()
+		}
+
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.GetUserTag, consts.MsgErrGetUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
 	}
 
-	if retrievedUser == nil {
-		logger.Error(consts.GetUserTag, consts.ErrUUIDNotFound.Error())
-		return nil, consts.ErrStatusUUIDNotFound
+	if email != "" && loginAttempts.reset(loginEmailKey(email)) {
+		logger.Info("Unlocked logins of:", email)
+	}
+	if ip != "" && loginAttempts.reset(loginIPKey(ip)) {
+		logger.Info("Unlocked logins from:", ip)
 	}
 
-	logger.Info("Retrieved user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
-
-	retrievedUser.Password = ""
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
 		Message: codes.OK.String(),
-		User:    retrievedUser,
 	}, nil
 }
 
-// ShareDocument updates user/s documents shared_to_me field in user DB
-// TODO write return values after implementation
-func (s *Service) ShareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	//TODO
-	logger.RequestService("ShareDocument")
-	return &pbsvc.UserResponse{}, nil
-}
-
-// GetAuthSecret looks up active secret (marked with true boolean) from secrets table.
-// If no active secrets were found, this method will generate and insert a new secret to secrets table.
-// On success, returns retrieved secret if active secret was found or new secret.
-func (s *Service) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	logger.RequestService("GetAuthSecret")
+// EnrollTOTP starts two-factor authentication for the user of the identification token,
+// replacing a secret enrolled before but not confirmed yet.
+// On success, sets the base32 secret in the totp-secret header and its otpauth:// URI in the totp-uri header,
+// codes are only required once ConfirmTOTP confirms the secret.
+func (s *Service) EnrollTOTP(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("EnrollTOTP")
 
 	if ok := serviceStateLocker.isStateAvailable(); !ok {
-		logger.Error(consts.GetAuthSecret, consts.ErrServiceUnavailable.Error())
+		logger.Error(consts.EnrollTOTPTag, consts.ErrServiceUnavailable.Error())
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if req == nil {
+		logger.Error(consts.EnrollTOTPTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	// the chance of creating a new secret is very slim thus the usage of read lock
-	// b/c an admin or a job runner will be responsible for creating new secrets
-	authSecretLocker.RLock()
-	defer authSecretLocker.RUnlock()
-
-	// check for any active secret
-	exists, err := hasActiveAuthSecret()
+	secret, err := generateTOTPSecret()
 	if err != nil {
-		logger.Error(consts.GetAuthSecret, consts.MsgErrLookUpActiveSecret, err.Error())
+		logger.Error(consts.EnrollTOTPTag, err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// no active key was found in DB, create and insert new secret
-	if !exists {
-		if err := insertNewAuthSecret(); err != nil {
-			logger.Error(consts.GetAuthSecret, consts.MsgErrSecret, err.Error())
-			return nil, status.Error(codes.Internal, err.Error())
+	var uri string
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		self := &policyTarget{uuid: auth.ExtractUUID(req.GetIdentification().GetToken())}
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersWrite, self)
+		if err != nil {
+			logger.Error(consts.EnrollTOTPTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		retrievedUser, err := tx.getUserRow(body.UUID)
+		if err != nil {
+			if err == consts.ErrUserNotFound {
+				logger.Error(consts.EnrollTOTPTag, consts.ErrUUIDNotFound.Error())
+				return consts.ErrStatusUUIDNotFound
+			}
+			logger.Error(consts.EnrollTOTPTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		sealed, err := encryptTOTPSecret(body.UUID, secret)
+		if err != nil {
+			logger.Error(consts.EnrollTOTPTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.insertTOTPSecret(body.UUID, sealed); err != nil {
+			logger.Error(consts.EnrollTOTPTag, err.Error())
+			if err == consts.ErrTOTPAlreadyEnrolled {
+				return status.Error(codes.AlreadyExists, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
 		}
-	}
 
-	retrievedSecret, err := getActiveSecretRow()
+		uri = newTOTPURI(retrievedUser.GetEmail(), secret)
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.GetAuthSecret, consts.MsgErrGetActiveSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(
+		totpSecretKey, totpEncoding.EncodeToString(secret),
+		totpURIKey, uri,
+	)); err != nil {
+		logger.Error(consts.EnrollTOTPTag, err.Error())
 	}
 
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
 		Message: codes.OK.String(),
-		Identification: &pblib.Identification{
-			Secret: retrievedSecret,
-		},
 	}, nil
 }
 
-// GetNewAuthToken returns a new auth token and secret based on the following criterias:
-// If current auth token is valid, returns new auth token and matching secret.
-// Else return error code deadline exceeded.
-func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	logger.RequestService("GetNewAuthToken")
+// ConfirmTOTP turns on two-factor authentication for the user of the identification token
+// with the first code of the secret from EnrollTOTP, read from the totp-code incoming metadata.
+// On success, sets the recovery codes in the totp-recovery-codes header, they are only ever shown once.
+func (s *Service) ConfirmTOTP(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ConfirmTOTP")
 
 	if ok := serviceStateLocker.isStateAvailable(); !ok {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrServiceUnavailable.Error())
+		logger.Error(consts.ConfirmTOTPTag, consts.ErrServiceUnavailable.Error())
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
 	if req == nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequest.Error())
+		logger.Error(consts.ConfirmTOTPTag, consts.ErrNilRequest.Error())
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-	// get identification object
-	identity := req.GetIdentification()
-	if identity == nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequestIdentification.Error())
-		return nil, status.Error(codes.DeadlineExceeded, consts.ErrNilRequestIdentification.Error())
+	md, _ := metadata.FromIncomingContext(ctx)
+	code := getMetadataValue(md, totpCodeKey)
+	if code == "" {
+		logger.Error(consts.ConfirmTOTPTag, consts.ErrTOTPRequired.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrTOTPRequired.Error())
 	}
 
-	// verify auth token token against database
-	retrievedIdentity, err := pairTokenWithSecret(identity.GetToken())
+	recoveryCodes, recoveryCodeHashes, err := generateRecoveryCodes()
 	if err != nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingToken, err.Error())
-		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		logger.Error(consts.ConfirmTOTPTag, err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// auth token requires user level permission to use this service
-	authority := auth.NewAuthority(auth.Jwt, auth.User)
-	if err := authority.Authorize(retrievedIdentity); err != nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingIdentity, err.Error())
-		return nil, status.Error(codes.DeadlineExceeded, err.Error())
-	}
-	// invalidate authority for security reasons
-	defer authority.Invalidate()
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		self := &policyTarget{uuid: auth.ExtractUUID(req.GetIdentification().GetToken())}
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersWrite, self)
+		if err != nil {
+			logger.Error(consts.ConfirmTOTPTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
 
-	uuid := auth.ExtractUUID(identity.GetToken())
-	if uuid == "" {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrStatusUUIDInvalid.Error())
-		return nil, consts.ErrStatusUUIDInvalid
-	}
+		row, err := tx.getTOTPRow(body.UUID)
+		if err != nil {
+			logger.Error(consts.ConfirmTOTPTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if row == nil {
+			logger.Error(consts.ConfirmTOTPTag, consts.ErrTOTPNotEnrolled.Error())
+			return status.Error(codes.FailedPrecondition, consts.ErrTOTPNotEnrolled.Error())
+		}
+		if row.isConfirmed {
+			logger.Error(consts.ConfirmTOTPTag, consts.ErrTOTPAlreadyEnrolled.Error())
+			return status.Error(codes.AlreadyExists, consts.ErrTOTPAlreadyEnrolled.Error())
+		}
 
-	// write lock to prevent race condition in making a new auth token
-	lock, _ := uuidMapLocker.LoadOrStore(uuid, &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+		secret, err := decryptTOTPSecret(body.UUID, &row.secret)
+		if err != nil {
+			logger.Error(consts.ConfirmTOTPTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
 
-	newIdentity, err := newAuthIdentification(authority.Header(), authority.Body())
-	if err != nil {
-		logger.Error(consts.GetNewAuthTokenTag, err.Error())
+		step, ok := matchTOTPCode(secret, code, time.Now())
+		if !ok {
+			logger.Error(consts.ConfirmTOTPTag, consts.ErrInvalidTOTPCode.Error())
+			return consts.ErrStatusInvalidTOTPCode
+		}
+
+		if err := tx.confirmTOTP(body.UUID, step, recoveryCodeHashes); err != nil {
+			logger.Error(consts.ConfirmTOTPTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		logger.Info("Enabled two-factor authentication of:", body.UUID)
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.MD{totpRecoveryCodesKey: recoveryCodes}); err != nil {
+		logger.Error(consts.ConfirmTOTPTag, err.Error())
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ResetTOTP turns off two-factor authentication of user.uuid, deleting its secret and recovery codes,
+// requires the users:admin permission over the user, ie for users that lost both their authenticator and recovery codes.
+// Returns NotFound if the user is not enrolled.
+func (s *Service) ResetTOTP(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ResetTOTP")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ResetTOTPTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ResetTOTPTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	user := req.GetUser()
+	if user == nil {
+		logger.Error(consts.ResetTOTPTag, consts.ErrNilRequestUser.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		logger.Error(consts.ResetTOTPTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(user.GetUuid()); err != nil {
+			return err
+		}
+
+		target, err := getPolicyTarget(tx, user.GetUuid())
+		if err != nil {
+			logger.Error(consts.ResetTOTPTag, consts.MsgErrGetUserRow, err.Error())
+			return err
+		}
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersAdmin, target); err != nil {
+			logger.Error(consts.ResetTOTPTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		if err := tx.deleteTOTP(user.GetUuid()); err != nil {
+			logger.Error(consts.ResetTOTPTag, err.Error())
+			if err == consts.ErrTOTPNotEnrolled {
+				return status.Error(codes.NotFound, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Reset two-factor authentication of:", user.GetUuid())
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ListUsers retrieves a page of users from accounts table, requires the users:read permission over every user,
+// or over the organization filter of the query.
+// Filters, sort and page options are read from the incoming metadata (see newListUsersQuery).
+// On success, returns the users in user collection with passwords set to empty,
+// and sets the next-cursor header if there are more users to list.
+func (s *Service) ListUsers(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListUsers")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.ListUsersTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ListUsersTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	query, err := newListUsersQuery(md)
+	if err != nil {
+		logger.Error(consts.ListUsersTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var users []*pblib.User
+	var nextCursor *listUsersCursor
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// a role held over an organization only lists the users filtered by it
+		var target *policyTarget
+		if query.organization != "" {
+			target = &policyTarget{organization: query.organization}
+		}
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersRead, target); err != nil {
+			logger.Error(consts.ListUsersTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		var err error
+		users, nextCursor, err = tx.listUserRows(query)
+		if err != nil {
+			logger.Error(consts.ListUsersTag, consts.MsgErrListUsers, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	for _, user := range users {
+		user.Password = ""
+	}
+
+	if nextCursor != nil {
+		encodedCursor, err := encodeListUsersCursor(nextCursor)
+		if err != nil {
+			logger.Error(consts.ListUsersTag, consts.MsgErrListUsers, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		// do not return error b/c the page is still valid, client can retry for the cursor
+		if err := grpc.SetHeader(ctx, metadata.Pairs(listUsersNextCursorKey, encodedCursor)); err != nil {
+			logger.Error(consts.ListUsersTag, consts.MsgErrListUsers, err.Error())
+		}
+	}
+
+	logger.Info("Listed users:", strconv.Itoa(len(users)))
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		UserCollection: users,
+	}, nil
+}
+
+// GetUser looks up a user by their uuid in accounts table, requires the users:read permission over the user.
+// On success, returns the matched row as user object, setting password to empty.
+func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetUser")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.GetUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	// get User Object
+	user := req.GetUser()
+	if user == nil {
+		logger.Error(consts.ErrNilRequestUser.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		logger.Error(consts.GetUserTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	// retrieve users row from database
+	var retrievedUser *pblib.User
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// read lock, b/c we are only retrieving/reading from the DB
+		if err := tx.lockUUIDShared(user.GetUuid()); err != nil {
+			return err
+		}
+
+		target, err := getPolicyTarget(tx, user.GetUuid())
+		if err != nil {
+			logger.Error(consts.GetUserTag, consts.MsgErrGetUserRow, err.Error())
+			return err
+		}
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersRead, target); err != nil {
+			logger.Error(consts.GetUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		retrievedUser, err = tx.getUserRow(user.GetUuid())
+		if err != nil {
+			logger.Error(consts.GetUserTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Retrieved user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
+
+	retrievedUser.Password = ""
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    retrievedUser,
+	}, nil
+}
+
+// ShareDocument shares a document owned by the token's user with a list of uuids or emails.
+// Recipients must exist and have verified their email.
+// Method is idempotent, sharing with a user that already has the document shared is ignored.
+// On success, returns user object with the document and every uuid it is shared with.
+func (s *Service) ShareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ShareDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ShareDocumentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ShareDocumentTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	if err := validateDUID(req.GetDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, consts.ErrStatusDUIDInvalid
+	}
+
+	if len(req.GetUuidsToShareDuid()) == 0 {
+		logger.Error(consts.ShareDocumentTag, consts.ErrNoShareRecipients.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNoShareRecipients.Error())
+	}
+
+	ownerUUID := auth.ExtractUUID(req.GetIdentification().GetToken())
+
+	var document *documentRow
+	var sharedUUIDs []string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// write lock b/c DeleteUser cascades the owner's documents and shares
+		if err := tx.lockUUID(ownerUUID); err != nil {
+			return err
+		}
+
+		// auth token requires user level permission, and the documents:share permission over the owner
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permDocumentsShare,
+			&policyTarget{uuid: ownerUUID})
+		if err != nil {
+			logger.Error(consts.ShareDocumentTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		document, err = tx.getDocumentRow(req.GetDuid())
+		if err != nil {
+			logger.Error(consts.ShareDocumentTag, consts.MsgErrGetDocumentRow, err.Error())
+			if err == consts.ErrDocumentNotFound {
+				return status.Error(codes.NotFound, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if document.uuid != body.UUID {
+			logger.Error(consts.ShareDocumentTag, consts.ErrDocumentNotOwned.Error())
+			return status.Error(codes.PermissionDenied, consts.ErrDocumentNotOwned.Error())
+		}
+
+		recipientUUIDs, err := resolveShareRecipients(tx, body.UUID, req.GetUuidsToShareDuid())
+		if err != nil {
+			logger.Error(consts.ShareDocumentTag, consts.MsgErrResolveShareRecipients, err.Error())
+			return recipientErrorToStatus(err)
+		}
+
+		if len(recipientUUIDs) > 0 {
+			if err := tx.insertSharedDocumentRows(document.duid, recipientUUIDs); err != nil {
+				logger.Error(consts.ShareDocumentTag, consts.MsgErrShareDocument, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		sharedUUIDs, err = tx.getSharedDocumentUUIDs(document.duid)
+		if err != nil {
+			logger.Error(consts.ShareDocumentTag, consts.MsgErrShareDocument, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	sharedWith := make(map[string]bool)
+	for _, uuid := range sharedUUIDs {
+		sharedWith[uuid] = true
+	}
+
+	logger.Info("Shared document:", document.duid, "owned by:", ownerUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User: &pblib.User{
+			Uuid: ownerUUID,
+			UserDocuments: map[string]*pblib.UserDocumentMetadata{
+				document.duid: {
+					IsPublic:   document.isPublic,
+					SharedWith: sharedWith,
+				},
+			},
+		},
+	}, nil
+}
+
+// UnshareDocument revokes a document owned by the token's user from a list of uuids or emails.
+// Method is idempotent, revoking from a user that the document is not shared with is ignored.
+// On success, returns user object with the document and every uuid it is still shared with.
+func (s *Service) UnshareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnshareDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.UnshareDocumentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.UnshareDocumentTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	if err := validateDUID(req.GetDuid()); err != nil {
+		logger.Error(consts.UnshareDocumentTag, err.Error())
+		return nil, consts.ErrStatusDUIDInvalid
+	}
+
+	if len(req.GetUuidsToShareDuid()) == 0 {
+		logger.Error(consts.UnshareDocumentTag, consts.ErrNoShareRecipients.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNoShareRecipients.Error())
+	}
+
+	ownerUUID := auth.ExtractUUID(req.GetIdentification().GetToken())
+
+	var document *documentRow
+	var sharedUUIDs []string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(ownerUUID); err != nil {
+			return err
+		}
+
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permDocumentsShare,
+			&policyTarget{uuid: ownerUUID})
+		if err != nil {
+			logger.Error(consts.UnshareDocumentTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		document, err = tx.getDocumentRow(req.GetDuid())
+		if err != nil {
+			logger.Error(consts.UnshareDocumentTag, consts.MsgErrGetDocumentRow, err.Error())
+			if err == consts.ErrDocumentNotFound {
+				return status.Error(codes.NotFound, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if document.uuid != body.UUID {
+			logger.Error(consts.UnshareDocumentTag, consts.ErrDocumentNotOwned.Error())
+			return status.Error(codes.PermissionDenied, consts.ErrDocumentNotOwned.Error())
+		}
+
+		recipientUUIDs, err := resolveUnshareRecipients(tx, body.UUID, req.GetUuidsToShareDuid())
+		if err != nil {
+			logger.Error(consts.UnshareDocumentTag, consts.MsgErrResolveShareRecipients, err.Error())
+			return recipientErrorToStatus(err)
+		}
+
+		if len(recipientUUIDs) > 0 {
+			if err := tx.deleteSharedDocumentRows(document.duid, recipientUUIDs); err != nil {
+				logger.Error(consts.UnshareDocumentTag, consts.MsgErrUnshareDocument, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		sharedUUIDs, err = tx.getSharedDocumentUUIDs(document.duid)
+		if err != nil {
+			logger.Error(consts.UnshareDocumentTag, consts.MsgErrUnshareDocument, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	sharedWith := make(map[string]bool)
+	for _, uuid := range sharedUUIDs {
+		sharedWith[uuid] = true
+	}
+
+	logger.Info("Unshared document:", document.duid, "owned by:", ownerUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User: &pblib.User{
+			Uuid: ownerUUID,
+			UserDocuments: map[string]*pblib.UserDocumentMetadata{
+				document.duid: {
+					IsPublic:   document.isPublic,
+					SharedWith: sharedWith,
+				},
+			},
+		},
+	}, nil
+}
+
+// ListDocuments looks up every document owned by a user in documents table.
+// The user is the request user's uuid if set, else the token's user.
+// Requires the documents:read permission over the user, see authorizeDocumentReader.
+// On success, returns user object with its documents and who each document is shared with.
+func (s *Service) ListDocuments(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListDocuments")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.ListDocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ListDocumentsTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	// the token's uuid is read if the request user's uuid is empty
+	uuid := req.GetUser().GetUuid()
+	if uuid == "" {
+		uuid = auth.ExtractUUID(req.GetIdentification().GetToken())
+	}
+
+	var documents map[string]*pblib.UserDocumentMetadata
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// read lock, b/c we are only retrieving/reading from the DB
+		if err := tx.lockUUIDShared(uuid); err != nil {
+			return err
+		}
+
+		var err error
+		uuid, err = authorizeDocumentReader(tx, req.GetIdentification(), req.GetUser().GetUuid())
+		if err != nil {
+			logger.Error(consts.ListDocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		documents, err = tx.getOwnedDocuments(uuid)
+		if err != nil {
+			logger.Error(consts.ListDocumentsTag, consts.MsgErrListDocuments, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User: &pblib.User{
+			Uuid:          uuid,
+			UserDocuments: documents,
+		},
+	}, nil
+}
+
+// ListSharedDocuments looks up every document shared to a user in shared_documents table.
+// The user is the request user's uuid if set, else the token's user.
+// Requires the documents:read permission over the user, see authorizeDocumentReader.
+// On success, returns user object with the shared documents keyed by their owner's uuid.
+func (s *Service) ListSharedDocuments(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListSharedDocuments")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.ListSharedDocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ListSharedDocumentsTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	// the token's uuid is read if the request user's uuid is empty
+	uuid := req.GetUser().GetUuid()
+	if uuid == "" {
+		uuid = auth.ExtractUUID(req.GetIdentification().GetToken())
+	}
+
+	var sharedToMe map[string]*pblib.UserFriendMetadata
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// read lock, b/c we are only retrieving/reading from the DB
+		if err := tx.lockUUIDShared(uuid); err != nil {
+			return err
+		}
+
+		var err error
+		uuid, err = authorizeDocumentReader(tx, req.GetIdentification(), req.GetUser().GetUuid())
+		if err != nil {
+			logger.Error(consts.ListSharedDocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		sharedToMe, err = tx.getDocumentsSharedToUUID(uuid)
+		if err != nil {
+			logger.Error(consts.ListSharedDocumentsTag, consts.MsgErrListDocuments, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User: &pblib.User{
+			Uuid:       uuid,
+			SharedToMe: sharedToMe,
+		},
+	}, nil
+}
+
+// UpdateDocumentVisibility sets is_public of documents owned by the token's user.
+// The documents and their new is_public values are read from the request user's documents map.
+// Method is idempotent, all documents are validated before any is updated.
+// On success, returns user object with the updated documents.
+func (s *Service) UpdateDocumentVisibility(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UpdateDocumentVisibility")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.UpdateDocumentVisibilityTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.UpdateDocumentVisibilityTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	requestedDocuments := req.GetUser().GetUserDocuments()
+	if len(requestedDocuments) == 0 {
+		logger.Error(consts.UpdateDocumentVisibilityTag, consts.ErrNilRequestUserDocuments.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestUserDocuments.Error())
+	}
+
+	for duid, metadata := range requestedDocuments {
+		if err := validateDUID(duid); err != nil || metadata == nil {
+			logger.Error(consts.UpdateDocumentVisibilityTag, consts.ErrInvalidDUID.Error())
+			return nil, consts.ErrStatusDUIDInvalid
+		}
+	}
+
+	ownerUUID := auth.ExtractUUID(req.GetIdentification().GetToken())
+
+	updatedDocuments := make(map[string]*pblib.UserDocumentMetadata)
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(ownerUUID); err != nil {
+			return err
+		}
+
+		body, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permDocumentsShare,
+			&policyTarget{uuid: ownerUUID})
+		if err != nil {
+			logger.Error(consts.UpdateDocumentVisibilityTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		// check ownership of every document before updating any of them
+		for duid := range requestedDocuments {
+			document, err := tx.getDocumentRow(duid)
+			if err != nil {
+				logger.Error(consts.UpdateDocumentVisibilityTag, consts.MsgErrGetDocumentRow, err.Error())
+				if err == consts.ErrDocumentNotFound {
+					return status.Error(codes.NotFound, err.Error())
+				}
+				return status.Error(codes.Internal, err.Error())
+			}
+
+			if document.uuid != body.UUID {
+				logger.Error(consts.UpdateDocumentVisibilityTag, consts.ErrDocumentNotOwned.Error())
+				return status.Error(codes.PermissionDenied, consts.ErrDocumentNotOwned.Error())
+			}
+		}
+
+		for duid, metadata := range requestedDocuments {
+			if err := tx.updateDocumentIsPublic(duid, metadata.GetIsPublic()); err != nil {
+				logger.Error(consts.UpdateDocumentVisibilityTag, consts.MsgErrUpdateDocumentVisibility, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+			updatedDocuments[duid] = &pblib.UserDocumentMetadata{IsPublic: metadata.GetIsPublic()}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Updated document visibility owned by:", ownerUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User: &pblib.User{
+			Uuid:          ownerUUID,
+			UserDocuments: updatedDocuments,
+		},
+	}, nil
+}
+
+// GetAuthSecret looks up active secret (marked with true boolean) from secrets table,
+// requires a service key in the service-key metadata (see authorizeServiceKey), or the service:write permission.
+// If no active secrets were found, this method will generate and insert a new secret to secrets table.
+// On success, returns retrieved secret if active secret was found or new secret.
+func (s *Service) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetAuthSecret")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.GetAuthSecret, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.GetAuthSecret, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	isService := authorizeServiceKey(md)
+
+	// the chance of creating a new secret is very slim thus the usage of read lock
+	// b/c an admin or RotateAuthSecrets will be responsible for creating new secrets
+	authSecretLocker.RLock()
+	defer authSecretLocker.RUnlock()
+
+	var retrievedSecret *pblib.Secret
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if !isService {
+			if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permServiceWrite, nil); err != nil {
+				logger.Error(consts.GetAuthSecret, consts.MsgErrEvaluatePolicy, err.Error())
+				return err
+			}
+		}
+
+		// no active key was found in DB, or it expired before RotateAuthSecrets rotated it,
+		// create and insert new secret
+		var err error
+		retrievedSecret, _, err = rotateAuthSecretIfDue(tx, time.Now().UTC())
+		if err != nil {
+			logger.Error(consts.GetAuthSecret, consts.MsgErrSecret, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		Identification: &pblib.Identification{
+			Secret: retrievedSecret,
+		},
+	}, nil
+}
+
+// GetSigningKeys returns the public keys verifying auth tokens signed with RS256 or EdDSA, in the signing-keys
+// header metadata as a JWKS, ie {"keys":[{"kty":"OKP","kid":"...","alg":"EdDSA","use":"sig","crv":"Ed25519","x":"..."}]}.
+// The active key is first, followed by the previous keys still verifying tokens signed before a rotation.
+// There are no keys while auth tokens are signed with HMAC secrets, see GetAuthSecret.
+func (s *Service) GetSigningKeys(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetSigningKeys")
+
+	if ok := serviceStateLocker.isStateReadable(); !ok {
+		logger.Error(consts.GetSigningKeysTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	var rows []*signingKeyRow
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		var err error
+		rows, err = tx.listSigningKeys()
+		if err != nil {
+			logger.Error(consts.GetSigningKeysTag, consts.MsgErrListSigningKeys, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	keys := make([]*jsonWebKey, 0, len(rows))
+	for _, row := range rows {
+		jwk, err := newJSONWebKey(row)
+		if err != nil {
+			logger.Error(consts.GetSigningKeysTag, consts.MsgErrListSigningKeys, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		keys = append(keys, jwk)
+	}
+
+	jwks, err := json.Marshal(struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{keys})
+	if err != nil {
+		logger.Error(consts.GetSigningKeysTag, consts.MsgErrListSigningKeys, err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := grpc.SetHeader(ctx, metadata.Pairs(signingKeysKey, string(jwks))); err != nil {
+		logger.Error(consts.GetSigningKeysTag, err.Error())
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetNewAuthToken returns a new auth token and secret based on the following criterias:
+// If current auth token is valid, returns new auth token and matching secret.
+// Else return error code deadline exceeded.
+func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetNewAuthToken")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.GetNewAuthTokenTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	// get identification object
+	identity := req.GetIdentification()
+	if identity == nil {
+		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequestIdentification.Error())
+		return nil, status.Error(codes.DeadlineExceeded, consts.ErrNilRequestIdentification.Error())
+	}
+
+	uuid := auth.ExtractUUID(identity.GetToken())
+	var newIdentity *pblib.Identification
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		// write lock to prevent race condition in making a new auth token
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		// verify auth token token against database
+		retrievedIdentity, err := tx.pairTokenWithSecret(identity.GetToken())
+		if err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingToken, err.Error())
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+
+		if _, err := loadSigningKey(tx, retrievedIdentity.GetSecret().GetKey()); err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingIdentity, err.Error())
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+
+		// auth token requires user level permission to use this service
+		header, body, err := authorizeAuthToken(retrievedIdentity, auth.User)
+		if err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingIdentity, err.Error())
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+
+		if uuid == "" {
+			logger.Error(consts.GetNewAuthTokenTag, consts.ErrStatusUUIDInvalid.Error())
+			return consts.ErrStatusUUIDInvalid
+		}
+
+		if err := checkSuspension(tx, uuid); err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, err.Error())
+			return err
+		}
+
+		newIdentity, err = newAuthIdentification(tx, header, body)
+		if err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		Identification: newIdentity,
+	}, nil
+}
+
+// RefreshAuthToken swaps the refresh token in the refresh-token incoming metadata
+// for a new auth token and a new refresh token, so users do not log in again once their auth token expires.
+// Refresh tokens are single use, using one twice revokes every refresh token of its login
+// b/c one of the uses was not the user's. Suspended users are rejected like they are by AuthenticateUser.
+// On success, returns the new identification, and sets the new refresh token in the refresh-token header.
+func (s *Service) RefreshAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RefreshAuthToken")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.RefreshAuthTokenTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.RefreshAuthTokenTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := getMetadataValue(md, refreshTokenKey)
+	if token == "" {
+		logger.Error(consts.RefreshAuthTokenTag, consts.ErrNilRefreshToken.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRefreshToken.Error())
+	}
+
+	var identification *pblib.Identification
+	var refreshToken string
+	var isReused bool
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		row, err := tx.getRefreshTokenRow(hashToken(token))
+		if err != nil {
+			logger.Error(consts.RefreshAuthTokenTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if row == nil {
+			logger.Error(consts.RefreshAuthTokenTag, consts.ErrInvalidRefreshToken.Error())
+			return consts.ErrStatusInvalidRefreshToken
+		}
+		if time.Now().UTC().Unix() >= row.expirationTimestamp {
+			logger.Error(consts.RefreshAuthTokenTag, consts.ErrRefreshTokenExpired.Error())
+			return consts.ErrStatusRefreshTokenExpired
+		}
+
+		used, err := tx.useRefreshToken(row.tokenHash)
+		if err != nil {
+			logger.Error(consts.RefreshAuthTokenTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !used {
+			// commit the revocation, the error is returned once the transaction is done
+			isReused = true
+			if err := tx.deleteRefreshTokenFamily(row.familyID); err != nil {
+				logger.Error(consts.RefreshAuthTokenTag, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+			return nil
+		}
+
+		retrievedUser, err := tx.getUserRow(row.uuid)
+		if err != nil {
+			if err == consts.ErrUserNotFound {
+				logger.Error(consts.RefreshAuthTokenTag, consts.ErrUUIDNotFound.Error())
+				return consts.ErrStatusInvalidRefreshToken
+			}
+			logger.Error(consts.RefreshAuthTokenTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if auth.PermissionEnumMap[retrievedUser.GetPermissionLevel()] < auth.UserRegistration {
+			logger.Error(consts.RefreshAuthTokenTag, consts.MsgErrGeneratingAuthToken)
+			return status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
+		}
+		if err := checkSuspension(tx, row.uuid); err != nil {
+			logger.Error(consts.RefreshAuthTokenTag, err.Error())
+			return err
+		}
+
+		identification, err = renewAuthIdentification(tx, retrievedUser)
+		if err != nil {
+			logger.Error(consts.RefreshAuthTokenTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		refreshToken, err = newRefreshToken(tx, row.uuid, row.familyID)
+		if err != nil {
+			logger.Error(consts.RefreshAuthTokenTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+	if isReused {
+		logger.Error(consts.RefreshAuthTokenTag, consts.ErrRefreshTokenReused.Error())
+		return nil, consts.ErrStatusRefreshTokenReused
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(refreshTokenKey, refreshToken)); err != nil {
+		logger.Error(consts.RefreshAuthTokenTag, err.Error())
+	}
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		Identification: identification,
+	}, nil
+}
+
+// Logout revokes the auth token in the request identification,
+// and every refresh token of its login if the refresh token is in the refresh-token incoming metadata.
+// On success, returns OK, the token is rejected by VerifyAuthToken and GetNewAuthToken from then on.
+func (s *Service) Logout(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("Logout")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.LogoutTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.LogoutTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	identity := req.GetIdentification()
+	if identity == nil {
+		logger.Error(consts.LogoutTag, consts.ErrNilRequestIdentification.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	refreshToken := getMetadataValue(md, refreshTokenKey)
+
+	var uuid string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		body, err := authorizeIdentification(tx, identity, auth.UserRegistration)
+		if err != nil {
+			logger.Error(consts.LogoutTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+		uuid = body.UUID
+
+		if err := tx.revokeAuthToken(identity.GetToken()); err != nil {
+			logger.Error(consts.LogoutTag, consts.MsgErrRevokeAuthTokens, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if refreshToken == "" {
+			return nil
+		}
+
+		// a refresh token of another user is ignored rather than revoked
+		row, err := tx.getRefreshTokenRow(hashToken(refreshToken))
+		if err != nil {
+			logger.Error(consts.LogoutTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if row == nil || row.uuid != uuid {
+			return nil
+		}
+		if err := tx.deleteRefreshTokenFamily(row.familyID); err != nil {
+			logger.Error(consts.LogoutTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	cachedAuthTokens.evict(identity.GetToken())
+	logger.Info("Logged out:", uuid)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// LogoutAll revokes every auth token and refresh token of the user of the request identification,
+// or of user.uuid if it is set, logging out another user requires the users:write permission over them.
+// On success, returns OK with the logged out uuid.
+func (s *Service) LogoutAll(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("LogoutAll")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.LogoutAllTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.LogoutAllTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if uuid != "" {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			logger.Error(consts.LogoutAllTag, err.Error())
+			return nil, consts.ErrStatusUUIDInvalid
+		}
+	}
+
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.UserRegistration)
+		if err != nil {
+			logger.Error(consts.LogoutAllTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		if uuid == "" {
+			uuid = body.UUID
+		} else if uuid != body.UUID {
+			target, err := getPolicyTarget(tx, uuid)
+			if err != nil {
+				logger.Error(consts.LogoutAllTag, consts.MsgErrGetUserRow, err.Error())
+				return err
+			}
+			if err := evaluatePolicy(tx, body, permUsersWrite, target); err != nil {
+				logger.Error(consts.LogoutAllTag, consts.MsgErrEvaluatePolicy, err.Error())
+				return err
+			}
+		}
+
+		if err := tx.revokeAuthTokens(uuid); err != nil {
+			logger.Error(consts.LogoutAllTag, consts.MsgErrRevokeAuthTokens, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	cachedAuthTokens.evictUUID(uuid)
+	logger.Info("Logged out every session of:", uuid)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid},
+	}, nil
+}
+
+// GrantRole grants user.uuid the role read from the role metadata, over the organization read from
+// the role-organization metadata, or over every user if it is empty.
+// Requires the roles:write permission over the organization, and every permission of the role.
+// On success, returns the roles of the user in the roles header metadata.
+func (s *Service) GrantRole(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GrantRole")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.GrantRoleTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.GrantRoleTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.GrantRoleTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	role, organization, err := getRoleGrantMetadata(md)
+	if err != nil {
+		logger.Error(consts.GrantRoleTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var grants []*roleGrant
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.GrantRoleTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+		if err := authorizeRoleGrant(tx, body, role, organization, true); err != nil {
+			logger.Error(consts.GrantRoleTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		if _, err := tx.getUserRow(uuid); err != nil {
+			if err == consts.ErrUserNotFound {
+				logger.Error(consts.GrantRoleTag, consts.ErrUUIDNotFound.Error())
+				return consts.ErrStatusUUIDNotFound
+			}
+			logger.Error(consts.GrantRoleTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.insertRoleGrant(&roleGrant{
+			uuid:             uuid,
+			role:             role,
+			organization:     organization,
+			grantedBy:        body.UUID,
+			grantedTimestamp: time.Now().UTC(),
+		}); err != nil {
+			logger.Error(consts.GrantRoleTag, consts.MsgErrGrantRole, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		grants, err = tx.listRoleGrants(uuid)
+		if err != nil {
+			logger.Error(consts.GrantRoleTag, consts.MsgErrGrantRole, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Granted role:", role, "to:", uuid, "in organization:", organization)
+	setRolesHeader(ctx, consts.GrantRoleTag, grants)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid},
+	}, nil
+}
+
+// RevokeRole revokes the role read from the role metadata from user.uuid, in the organization read from
+// the role-organization metadata, or the role held over every user if it is empty.
+// Requires the roles:write permission over the organization, revoking a role the user does not hold is a no-op.
+// On success, returns the roles of the user in the roles header metadata.
+func (s *Service) RevokeRole(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RevokeRole")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.RevokeRoleTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.RevokeRoleTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.RevokeRoleTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	role, organization, err := getRoleGrantMetadata(md)
+	if err != nil {
+		logger.Error(consts.RevokeRoleTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var grants []*roleGrant
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.RevokeRoleTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+		if err := authorizeRoleGrant(tx, body, role, organization, false); err != nil {
+			logger.Error(consts.RevokeRoleTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		if err := tx.deleteRoleGrant(uuid, role, organization); err != nil {
+			logger.Error(consts.RevokeRoleTag, consts.MsgErrRevokeRole, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		grants, err = tx.listRoleGrants(uuid)
+		if err != nil {
+			logger.Error(consts.RevokeRoleTag, consts.MsgErrRevokeRole, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Revoked role:", role, "from:", uuid, "in organization:", organization)
+	setRolesHeader(ctx, consts.RevokeRoleTag, grants)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid},
+	}, nil
+}
+
+// SetPermissionLevel sets the permission level of user.uuid to user.permission_level.
+// Requires the users:admin permission over the user, and every permission of the admin role
+// to promote to or demote from ADMIN b/c ADMIN holds the admin role over every user.
+// The last ADMIN that is not suspended can not be demoted, every token of the user is revoked so they carry the new level.
+func (s *Service) SetPermissionLevel(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetPermissionLevel")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.SetPermissionLevelTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.SetPermissionLevelTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.SetPermissionLevelTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	level, ok := auth.PermissionEnumMap[req.GetUser().GetPermissionLevel()]
+	if !ok {
+		logger.Error(consts.SetPermissionLevelTag, consts.ErrInvalidPermissionLevel.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidPermissionLevel.Error())
+	}
+	permissionLevel := auth.PermissionStringMap[level]
+	adminLevel := auth.PermissionStringMap[auth.Admin]
+
+	var isRevoked bool
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		retrievedUser, err := tx.getUserRow(uuid)
+		if err != nil && err != consts.ErrUserNotFound {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// evaluated before reporting an unknown uuid, so only users allowed to set levels learn it does not exist
+		target := newPolicyTarget(uuid, retrievedUser)
+		if err := evaluatePolicy(tx, body, permUsersAdmin, target); err != nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+		if retrievedUser == nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.ErrUUIDNotFound.Error())
+			return consts.ErrStatusUUIDNotFound
+		}
+
+		currLevel := retrievedUser.GetPermissionLevel()
+		if currLevel == permissionLevel {
+			return nil
+		}
+
+		// demoting an ADMIN is already authorized over the ADMIN target, promoting takes the same
+		if permissionLevel == adminLevel {
+			if err := authorizeRoleGrant(tx, body, roleAdmin, "", true); err != nil {
+				logger.Error(consts.SetPermissionLevelTag, consts.MsgErrEvaluatePolicy, err.Error())
+				return err
+			}
+		}
+
+		if err := checkLastAdmin(tx, target); err != nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrUpdatePermLevel, err.Error())
+			return err
+		}
+
+		if err := tx.updatePermissionLevel(uuid, permissionLevel); err != nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrUpdatePermLevel, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// tokens issued for the previous permission level are revoked
+		if err := tx.revokeAuthTokens(uuid); err != nil {
+			logger.Error(consts.SetPermissionLevelTag, consts.MsgErrRevokeAuthTokens, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		isRevoked = true
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	if isRevoked {
+		cachedAuthTokens.evictUUID(uuid)
+	}
+	logger.Info("Set permission level of:", uuid, "to:", permissionLevel)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid, PermissionLevel: permissionLevel},
+	}, nil
+}
+
+// SuspendUser suspends user.uuid until reactivated, or for the seconds in the suspension-expires-in metadata.
+// The reason is read from the suspension-reason metadata and emailed to the user.
+// Requires the users:admin permission over the user, and every permission of the admin role to suspend an ADMIN.
+// Every token of the user is revoked, suspending again replaces the previous suspension.
+func (s *Service) SuspendUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SuspendUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.SuspendUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.SuspendUserTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.SuspendUserTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	suspension, err := newSuspensionRow(md, uuid, "", time.Now().UTC())
+	if err != nil {
+		logger.Error(consts.SuspendUserTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var email string
+	err = s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		body, err := authorizeIdentification(tx, req.GetIdentification(), auth.User)
+		if err != nil {
+			logger.Error(consts.SuspendUserTag, consts.MsgErrValidatingIdentity, err.Error())
+			return err
+		}
+
+		retrievedUser, err := tx.getUserRow(uuid)
+		if err != nil && err != consts.ErrUserNotFound {
+			logger.Error(consts.SuspendUserTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		target := newPolicyTarget(uuid, retrievedUser)
+		if err := evaluatePolicy(tx, body, permUsersAdmin, target); err != nil {
+			logger.Error(consts.SuspendUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+		if retrievedUser == nil {
+			logger.Error(consts.SuspendUserTag, consts.ErrUUIDNotFound.Error())
+			return consts.ErrStatusUUIDNotFound
+		}
+		if uuid == body.UUID {
+			logger.Error(consts.SuspendUserTag, consts.ErrSuspendSelf.Error())
+			return status.Error(codes.FailedPrecondition, consts.ErrSuspendSelf.Error())
+		}
+
+		suspension.suspendedBy = body.UUID
+		if err := tx.insertSuspension(suspension); err != nil {
+			logger.Error(consts.SuspendUserTag, consts.MsgErrSuspendUser, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.revokeAuthTokens(uuid); err != nil {
+			logger.Error(consts.SuspendUserTag, consts.MsgErrRevokeAuthTokens, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		email = retrievedUser.GetEmail()
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	cachedAuthTokens.evictUUID(uuid)
+	logger.Info("Suspended user:", uuid, "by:", suspension.suspendedBy)
+	sendSuspensionEmail(email, suspension.reason, suspension.suspendedUntil)
+
 	return &pbsvc.UserResponse{
-		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
-		Message:        codes.OK.String(),
-		Identification: newIdentity,
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid},
+	}, nil
+}
+
+// ReactivateUser lifts the suspension of user.uuid before it expires, and emails the user.
+// Requires the users:admin permission over the user.
+// Returns FailedPrecondition if the user is not suspended.
+func (s *Service) ReactivateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ReactivateUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ReactivateUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil {
+		logger.Error(consts.ReactivateUserTag, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.ReactivateUserTag, err.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	var email string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		target, err := getPolicyTarget(tx, uuid)
+		if err != nil {
+			logger.Error(consts.ReactivateUserTag, consts.MsgErrGetUserRow, err.Error())
+			return err
+		}
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permUsersAdmin, target); err != nil {
+			logger.Error(consts.ReactivateUserTag, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		// expired suspensions are already lifted
+		suspension, err := tx.getSuspensionRow(uuid)
+		if err != nil {
+			logger.Error(consts.ReactivateUserTag, consts.MsgErrReactivateUser, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if suspension == nil {
+			logger.Error(consts.ReactivateUserTag, consts.ErrUserNotSuspended.Error())
+			return status.Error(codes.FailedPrecondition, consts.ErrUserNotSuspended.Error())
+		}
+
+		if err := tx.deleteSuspension(uuid); err != nil {
+			logger.Error(consts.ReactivateUserTag, consts.MsgErrReactivateUser, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		retrievedUser, err := tx.getUserRow(uuid)
+		if err != nil {
+			logger.Error(consts.ReactivateUserTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		email = retrievedUser.GetEmail()
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	logger.Info("Reactivated user:", uuid)
+	sendReactivationEmail(email)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: uuid},
 	}, nil
 }
 
 // VerifyAuthToken checks if received token and retrieved secret is valid.
 // Token is first verified against tokens table, and if token is found, secret is retrieved.
+// Tokens signed with a key pair are verified with the public key of the kid their secret names.
+// While the store is unreachable, only tokens verified before are served from cachedAuthTokens.
 // On success, returns identity object with token and paired secret.
 func (s *Service) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("VerifyAuthToken")
 
-	if ok := serviceStateLocker.isStateAvailable(); !ok {
+	// served in degraded mode b/c other services verify tokens on every request
+	if currState, _, _ := serviceStateLocker.current(); currState == unavailable {
 		logger.Error(consts.VerifyAuthToken, consts.ErrServiceUnavailable.Error())
 		return nil, consts.ErrStatusServiceUnavailable
 	}
@@ -576,33 +2392,63 @@ func (s *Service) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.VerifyAuthToken, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	// get identification object
 	identity := req.GetIdentification()
 	if identity == nil {
 		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
 	}
 
-	// verify token against database
-	retrievedIdentity, err := pairTokenWithSecret(identity.GetToken())
-	if err != nil {
-		logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingToken, err.Error())
-		return nil, status.Error(codes.Unauthenticated, err.Error())
+	var retrievedIdentity *pblib.Identification
+	if !serviceStateLocker.isDegraded() {
+		err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+			// verify token against database
+			var err error
+			retrievedIdentity, err = tx.pairTokenWithSecret(identity.GetToken())
+			if err != nil {
+				return err
+			}
+
+			if err := checkSuspension(tx, auth.ExtractUUID(identity.GetToken())); err != nil {
+				return err
+			}
+
+			// cache the key of the secret, tokens keep verifying from the cache while the store is unreachable
+			_, err = loadSigningKey(tx, retrievedIdentity.GetSecret().GetKey())
+			return err
+		})
+		if err == consts.ErrStatusUserSuspended {
+			logger.Error(consts.VerifyAuthToken, err.Error())
+			cachedAuthTokens.evict(identity.GetToken())
+			return nil, err
+		}
+		if err != nil && !markStoreUnreachable(err) {
+			logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingToken, err.Error())
+			if err == consts.ErrAuthTokenRevoked {
+				cachedAuthTokens.evict(identity.GetToken())
+			}
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
 	}
 
-	// create authority to validate Identity containing token and retrieved secret
-	authority := auth.NewAuthority(auth.Jwt, auth.User)
-	if err := authority.Authorize(retrievedIdentity); err != nil {
+	isCached := false
+	if retrievedIdentity == nil {
+		// the store is unreachable, fall back to the tokens verified before it went down
+		retrievedIdentity, isCached = cachedAuthTokens.get(identity.GetToken())
+		if !isCached {
+			logger.Error(consts.VerifyAuthToken, consts.ErrStoreUnreachable.Error())
+			return nil, consts.ErrStatusServiceUnavailable
+		}
+	}
+
+	// validate Identity containing token and retrieved secret
+	if _, _, err := authorizeAuthToken(retrievedIdentity, auth.User); err != nil {
 		logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingIdentity, err.Error())
 		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
-	// invalidate authority and identity's secret for security reasons
-	authority.Invalidate()
+	if !isCached {
+		cachedAuthTokens.add(retrievedIdentity)
+	}
 
 	return &pbsvc.UserResponse{
 		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -612,7 +2458,7 @@ func (s *Service) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 }
 
 // MakeNewAuthSecret generates and inserts a new secret into DB and
-// thereby update the currAuthSecret with the newly generated secret.
+// thereby update the currAuthSecret with the newly generated secret, requires the service:write permission.
 // On success, returns message and status marked with OK.
 func (s *Service) MakeNewAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("MakeNewAuthSecret")
@@ -622,26 +2468,42 @@ func (s *Service) MakeNewAuthSecret(ctx context.Context, req *pbsvc.UserRequest)
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.MakeNewAuthSecret, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	if req == nil {
+		logger.Error(consts.MakeNewAuthSecret, consts.ErrNilRequest.Error())
+		return nil, consts.ErrStatusNilRequestUser
 	}
 
 	authSecretLocker.Lock()
 	defer authSecretLocker.Unlock()
 
-	// insert new secret
-	if err := insertNewAuthSecret(); err != nil {
-		logger.Error(consts.MakeNewAuthSecret, consts.MsgErrSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
+	var retrievedSecret *pblib.Secret
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if _, err := authorizePolicy(tx, req.GetIdentification(), auth.User, permServiceWrite, nil); err != nil {
+			logger.Error(consts.MakeNewAuthSecret, consts.MsgErrEvaluatePolicy, err.Error())
+			return err
+		}
+
+		// insert new secret
+		if err := tx.insertNewAuthSecret(); err != nil {
+			logger.Error(consts.MakeNewAuthSecret, consts.MsgErrSecret, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
 
-	// retrieve the newly updated active secret and set it as the currAuthSecret
-	retrievedSecret, err := getActiveSecretRow()
+		// retrieve the newly updated active secret
+		var err error
+		retrievedSecret, err = tx.getActiveSecretRow()
+		if err != nil {
+			logger.Error(consts.MakeNewAuthSecret, consts.MsgErrGetActiveSecret, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.MakeNewAuthSecret, consts.MsgErrGetActiveSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
 	}
+
+	// set the currAuthSecret only once the new secret is committed
 	currAuthSecret = retrievedSecret
 
 	return &pbsvc.UserResponse{
@@ -679,63 +2541,451 @@ func (s *Service) VerifyEmailToken(ctx context.Context, req *pbsvc.UserRequest)
 		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
 	}
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
 	uuid := auth.ExtractUUID(emailToken)
 	if uuid == "" {
 		logger.Error(consts.VerifyEmailToken, authconst.ErrInvalidUUID.Error())
 		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(uuid, &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	// the token's row is deleted whether or not it expired, so expired tokens commit their deletions
+	var expiredErr error
+	var oldEmail, newEmail, revokedUUID string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		// find matching email token row
+		retrievedToken, err := tx.getEmailTokenRow(emailToken)
+		if err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrRetrieveEmailTokenRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// password reset tokens can not verify emails
+		if retrievedToken.purpose != emailTokenPurposeVerifyEmail {
+			logger.Error(consts.VerifyEmailToken, consts.ErrMismatchingEmailTokenPurpose.Error())
+			return status.Error(codes.InvalidArgument, consts.ErrMismatchingEmailTokenPurpose.Error())
+		}
+
+		// delete token row
+		if err := tx.deleteEmailTokenRow(retrievedToken.uuid, emailTokenPurposeVerifyEmail); err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrDeletingEmailToken)
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// look up user to determine permission level
+		retrievedUser, err := tx.getUserRow(retrievedToken.uuid)
+		if err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// if token is expired
+		if time.Now().Unix() >= retrievedToken.expirationTimestamp || retrievedToken.expirationTimestamp <= 0 {
+			// delete stale new user
+			if (retrievedUser.GetProspectiveEmail() == "" && retrievedUser.GetIsVerified() == false) &&
+				retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission] {
+				if err := tx.deleteUserRow(retrievedToken.uuid); err != nil {
+					logger.Error(consts.VerifyEmailToken, consts.MsgErrDeleteUser, " && ", consts.ErrExpiredEmailToken.Error())
+					return status.Error(codes.Internal, fmt.Sprintf("%s && %s", err.Error(), consts.ErrExpiredEmailToken.Error()))
+				}
+			}
+
+			logger.Error(consts.VerifyEmailToken, consts.ErrExpiredEmailToken.Error())
+			expiredErr = status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error())
+			return nil
+		}
+
+		// existing user verifying an email change
+		if retrievedUser.GetProspectiveEmail() != "" {
+			oldEmail, err = tx.swapProspectiveEmailRow(retrievedUser.GetUuid())
+			if err != nil {
+				logger.Error(consts.VerifyEmailToken, consts.MsgErrSwapProspectiveEmail, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+			newEmail = retrievedUser.GetProspectiveEmail()
+		} else {
+			// update new user's permission level
+			err := tx.updatePermissionLevel(retrievedUser.GetUuid(), auth.PermissionStringMap[auth.User])
+			if err != nil {
+				logger.Error(consts.VerifyEmailToken, consts.MsgErrUpdatePermLevel, err.Error())
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		// tokens issued for the old email or permission level are revoked
+		revokedUUID = retrievedUser.GetUuid()
+		if err := tx.revokeAuthTokens(revokedUUID); err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrRevokeAuthTokens, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
 
-	// find matching email token row
-	retrievedToken, err := getEmailTokenRow(emailToken)
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrRetrieveEmailTokenRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, txErrorToStatus(err)
+	}
+	if expiredErr != nil {
+		return nil, expiredErr
 	}
+	cachedAuthTokens.evictUUID(revokedUUID)
 
-	// delete token row
-	if err := deleteEmailTokenRow(retrievedToken.uuid); err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrDeletingEmailToken)
-		return nil, status.Error(codes.Internal, err.Error())
+	// notify the old email, do not return an error b/c the email is already changed
+	if oldEmail != "" {
+		emailData := map[string]string{newEmailKey: newEmail}
+		emailReq, err := newEmailRequest(emailData, []string{oldEmail}, conf.EmailHost.Username, subjectEmailChanged)
+		if err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrEmailRequest, err.Error())
+		} else if err := emailReq.sendEmail(templateEmailChanged); err != nil {
+			logger.Error(consts.VerifyEmailToken, consts.MsgErrSendEmail, err.Error())
+		}
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ResendVerificationEmail replaces the email verification token of a user and emails a new verification link.
+// The user is looked up by the request user's uuid, else by its email or prospective email.
+// New users get the new user template, users updating their email get the update template at the prospective email.
+// Emails to the same address are rate limited. Unknown emails, and users with no email waiting for verification,
+// get the same response as pending ones, so the response does not reveal registered emails.
+func (s *Service) ResendVerificationEmail(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ResendVerificationEmail")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ResendVerificationEmailTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil || req.GetUser() == nil {
+		logger.Error(consts.ResendVerificationEmailTag, consts.ErrNilRequestUser.Error())
+		return nil, consts.ErrStatusNilRequestUser
 	}
 
-	// look up user to determine permission level
-	retrievedUser, err := getUserRow(retrievedToken.uuid)
+	uuid := req.GetUser().GetUuid()
+	email := req.GetUser().GetEmail()
+	if uuid != "" {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			logger.Error(consts.ResendVerificationEmailTag, err.Error())
+			return nil, consts.ErrStatusUUIDInvalid
+		}
+	} else if err := validateEmail(email); err != nil {
+		logger.Error(consts.ResendVerificationEmailTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	response := &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}
+
+	var retrievedUser *pblib.User
+	var emailID *pblib.Identification
+	var to, subject, template string
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		var err error
+		if uuid != "" {
+			retrievedUser, err = tx.getUserRow(uuid)
+			if err == consts.ErrUserNotFound {
+				logger.Error(consts.ResendVerificationEmailTag, err.Error())
+				return consts.ErrStatusUUIDNotFound
+			}
+		} else {
+			retrievedUser, err = tx.getUserRowByEmail(email)
+			if err == consts.ErrEmailDoesNotExist {
+				retrievedUser, err = tx.getUserRowByProspectiveEmail(email)
+			}
+			if err == consts.ErrEmailDoesNotExist {
+				// count unknown emails against the limit too, so responses do not reveal registered emails
+				if !resendEmailLimiter.allow(email) {
+					logger.Error(consts.ResendVerificationEmailTag, consts.ErrEmailRateLimited.Error())
+					return status.Error(codes.ResourceExhausted, consts.ErrEmailRateLimited.Error())
+				}
+				logger.Info("Verification email resend requested for unknown email:", email)
+				retrievedUser = nil
+				return nil
+			}
+		}
+		if err != nil {
+			logger.Error(consts.ResendVerificationEmailTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// the user is only known once looked up, so it is locked until the transaction ends
+		if err := tx.lockUUID(retrievedUser.GetUuid()); err != nil {
+			return err
+		}
+
+		// users updating their email verify the prospective email, new users verify the email they signed up with
+		switch {
+		case retrievedUser.GetProspectiveEmail() != "":
+			to, subject, template = retrievedUser.GetProspectiveEmail(), subjectUpdateEmail, templateUpdateEmail
+		case retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission]:
+			to, subject, template = retrievedUser.GetEmail(), subjectVerifyEmail, templateVerifyEmail
+		default:
+			// answered like unknown emails, counted against the limit of the email they asked for
+			if !resendEmailLimiter.allow(retrievedUser.GetEmail()) {
+				logger.Error(consts.ResendVerificationEmailTag, consts.ErrEmailRateLimited.Error())
+				return status.Error(codes.ResourceExhausted, consts.ErrEmailRateLimited.Error())
+			}
+			logger.Info("Verification email resend requested with no pending verification:",
+				retrievedUser.GetUuid())
+			retrievedUser = nil
+			return nil
+		}
+
+		if !resendEmailLimiter.allow(to) {
+			logger.Error(consts.ResendVerificationEmailTag, consts.ErrEmailRateLimited.Error())
+			return status.Error(codes.ResourceExhausted, consts.ErrEmailRateLimited.Error())
+		}
+
+		emailID, err = auth.GenerateEmailIdentification(retrievedUser.GetUuid(), retrievedUser.GetPermissionLevel())
+		if err != nil {
+			logger.Error(consts.ResendVerificationEmailTag, consts.MsgErrGeneratingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// delete the stale token so only the latest verification link is usable
+		if err := tx.deleteEmailTokenRow(retrievedUser.GetUuid(), emailTokenPurposeVerifyEmail); err != nil {
+			logger.Error(consts.ResendVerificationEmailTag, consts.MsgErrDeletingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.insertEmailToken(retrievedUser.GetUuid(), emailID.GetToken(), emailID.GetSecret(),
+			emailTokenPurposeVerifyEmail); err != nil {
+			logger.Error(consts.ResendVerificationEmailTag, consts.MsgErrInsertEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
 	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrGetUserRow, err.Error())
+		return nil, txErrorToStatus(err)
+	}
+
+	if retrievedUser == nil {
+		return response, nil
+	}
+
+	if err := sendVerificationEmail(emailID.GetToken(), to, subject, template); err != nil {
+		logger.Error(consts.ResendVerificationEmailTag, consts.MsgErrSendEmail, err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// if token is expired
-	if time.Now().Unix() >= retrievedToken.expirationTimestamp || retrievedToken.expirationTimestamp <= 0 {
-		// delete stale new user
-		if (retrievedUser.GetProspectiveEmail() == "" && retrievedUser.GetIsVerified() == false) &&
-			retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission] {
-			if err := deleteUserRow(retrievedToken.uuid); err != nil {
-				logger.Error(consts.VerifyEmailToken, consts.MsgErrDeleteUser, " && ", consts.ErrExpiredEmailToken.Error())
-				return nil, status.Error(codes.Internal, fmt.Sprintf("%s && %s", err.Error(), consts.ErrExpiredEmailToken.Error()))
+	logger.Info("Resent verification email to:", retrievedUser.GetUuid())
+
+	return response, nil
+}
+
+// RequestPasswordReset emails a single use password reset link to the request user's email.
+// Any outstanding password reset token of the user is replaced by the new one.
+// To avoid leaking which emails are registered, the response is the same whether or not the email exists.
+func (s *Service) RequestPasswordReset(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RequestPasswordReset")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.RequestPasswordResetTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil || req.GetUser() == nil {
+		logger.Error(consts.RequestPasswordResetTag, consts.ErrNilRequestUser.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	email := req.GetUser().GetEmail()
+	if err := validateEmail(email); err != nil {
+		logger.Error(consts.RequestPasswordResetTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	response := &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}
+
+	var retrievedUser *pblib.User
+	var resetID *pblib.Identification
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		var err error
+		retrievedUser, err = tx.getUserRowByEmail(email)
+		if err != nil {
+			if err == consts.ErrEmailDoesNotExist {
+				logger.Info("Password reset requested for unknown email:", email)
+				retrievedUser = nil
+				return nil
 			}
+			logger.Error(consts.RequestPasswordResetTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
 		}
 
-		logger.Error(consts.VerifyEmailToken, consts.ErrExpiredEmailToken.Error())
-		return nil, status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error())
+		// the user is only known once looked up, so it is locked until the transaction ends
+		if err := tx.lockUUID(retrievedUser.GetUuid()); err != nil {
+			return err
+		}
+
+		resetID, err = newResetPasswordIdentification(retrievedUser.GetUuid(), retrievedUser.GetPermissionLevel())
+		if err != nil {
+			logger.Error(consts.RequestPasswordResetTag, consts.MsgErrGeneratingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// only the latest requested reset link is usable
+		if err := tx.deleteEmailTokenRow(retrievedUser.GetUuid(), emailTokenPurposeResetPassword); err != nil {
+			logger.Error(consts.RequestPasswordResetTag, consts.MsgErrDeletingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.insertEmailToken(retrievedUser.GetUuid(), resetID.GetToken(), resetID.GetSecret(),
+			emailTokenPurposeResetPassword); err != nil {
+			logger.Error(consts.RequestPasswordResetTag, consts.MsgErrInsertEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+
+	if retrievedUser == nil {
+		return response, nil
 	}
 
-	// update user's permission level
-	err = updatePermissionLevel(retrievedUser.GetUuid(), auth.PermissionStringMap[auth.User])
+	// from here on: do not return an error because the user can always request another reset link
+	resetLink, err := generateResetPasswordLink(resetID.GetToken())
 	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrUpdatePermLevel, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		logger.Error(consts.RequestPasswordResetTag, consts.MsgErrGeneratingResetLink, err.Error())
+		return response, nil
+	}
+
+	emailData := map[string]string{resetPasswordLinkKey: resetLink}
+	emailReq, err := newEmailRequest(emailData, []string{retrievedUser.GetEmail()}, conf.EmailHost.Username,
+		subjectResetPassword)
+	if err != nil {
+		logger.Error(consts.RequestPasswordResetTag, consts.MsgErrEmailRequest, err.Error())
+		return response, nil
+	}
+
+	if err := emailReq.sendEmail(templateResetPassword); err != nil {
+		logger.Error(consts.RequestPasswordResetTag, consts.MsgErrSendEmail, err.Error())
+	}
+
+	return response, nil
+}
+
+// ConfirmPasswordReset replaces the password of the user that owns the password reset token in the identification.
+// The token is single use, it is deleted once the password is reset, or once it is found expired.
+// A password rejected by the password policy, or any other error, rolls back the deletion so the token can be retried.
+// On success, every auth token of the user is revoked so existing sessions must authenticate again.
+func (s *Service) ConfirmPasswordReset(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ConfirmPasswordReset")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ConfirmPasswordResetTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req == nil || req.GetUser() == nil {
+		logger.Error(consts.ConfirmPasswordResetTag, consts.ErrNilRequestUser.Error())
+		return nil, consts.ErrStatusNilRequestUser
+	}
+
+	if req.GetIdentification() == nil {
+		logger.Error(consts.ConfirmPasswordResetTag, consts.ErrNilRequestIdentification.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
 	}
 
+	resetToken := req.GetIdentification().GetToken()
+	if resetToken == "" {
+		logger.Error(consts.ConfirmPasswordResetTag, authconst.ErrEmptyToken.Error())
+		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
+	}
+
+	password := req.GetUser().GetPassword()
+	if err := validatePassword(password); err != nil {
+		logger.Error(consts.ConfirmPasswordResetTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	uuid := auth.ExtractUUID(resetToken)
+	if uuid == "" {
+		logger.Error(consts.ConfirmPasswordResetTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	// the token is consumed even if it expired, so expired tokens commit their deletion
+	var expiredErr error
+	err := s.userStore().WithTx(ctx, func(tx UserTx) error {
+		if err := tx.lockUUID(uuid); err != nil {
+			return err
+		}
+
+		retrievedToken, err := tx.getEmailTokenRow(resetToken)
+		if err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.MsgErrRetrieveEmailTokenRow, err.Error())
+			if err == consts.ErrNoMatchingEmailTokenFound {
+				return status.Error(codes.NotFound, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// email verification tokens can not reset passwords
+		if retrievedToken.purpose != emailTokenPurposeResetPassword {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.ErrMismatchingEmailTokenPurpose.Error())
+			return status.Error(codes.InvalidArgument, consts.ErrMismatchingEmailTokenPurpose.Error())
+		}
+
+		// delete token row before anything else so the token can not be reused
+		if err := tx.deleteEmailTokenRow(retrievedToken.uuid, emailTokenPurposeResetPassword); err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.MsgErrDeletingEmailToken, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if time.Now().Unix() >= retrievedToken.expirationTimestamp || retrievedToken.expirationTimestamp <= 0 {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.ErrExpiredEmailToken.Error())
+			expiredErr = status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error())
+			return nil
+		}
+
+		user, err := tx.getUserRow(retrievedToken.uuid)
+		if err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.MsgErrGetUserRow, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := checkPasswordPolicy(password, user); err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, err.Error())
+			return status.Convert(err).Err()
+		}
+
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.resetPasswordRow(retrievedToken.uuid, hashedPassword); err != nil {
+			logger.Error(consts.ConfirmPasswordResetTag, consts.MsgErrResetPassword, err.Error())
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, txErrorToStatus(err)
+	}
+	if expiredErr != nil {
+		return nil, expiredErr
+	}
+
+	// the auth tokens of uuid were revoked with the password
+	cachedAuthTokens.evictUUID(uuid)
+	logger.Info("Reset password of:", uuid)
+
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
 		Message: codes.OK.String(),
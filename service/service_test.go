@@ -1,12 +1,8 @@
 package service
 
 import (
-	"database/sql"
 	"fmt"
 	"github.com/Pallinder/go-randomdata"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
@@ -18,7 +14,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -27,21 +25,38 @@ import (
 const (
 	psqlVersion = "alpine"
 	unitTestTag = "Unit Test -"
+
+	// unitTestSeedFile is the test data seeded after the migrations, it is not embedded in the binary
+	unitTestSeedFile = "test_fixtures/psql/insert_dummy_user.sql"
 )
 
+// unitTestPostgresReady is set once TestMain has migrated and seeded the postgres container,
+// tests of the postgres store are skipped without it, see unitTestRequirePostgres
+var unitTestPostgresReady bool
+
 // spin up docker containers for psql
 // run schema migrations
 // seed test data in db if necessary
 // destroy db container at end of unit test
+// without docker only the memory store and unit tests run
 func TestMain(m *testing.M) {
 	logger.Info(unitTestTag, "Initializing Unit Test Setup")
 
 	templateDirectory = "../tmpl"
 
+	// secrets are sealed with the master key
+	if err := setMasterKeys(unitTestNewMasterKey()); err != nil {
+		logger.Fatal(unitTestTag, "Failed to set master key:", err.Error())
+	}
+
 	// uses a sensible default on windows (tcp/http) and linux/osx (socket)
 	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
 	if err != nil {
-		logger.Fatal(unitTestTag, "Could not connect to docker:", err.Error())
+		logger.Info(unitTestTag, "Skipping the postgres tests, could not connect to docker:", err.Error())
+		os.Exit(m.Run())
 	}
 
 	// pulls an image, creates a container based on it, and runs it
@@ -56,34 +71,20 @@ func TestMain(m *testing.M) {
 
 	// exponential backoff-retry, b/c the app in the container might not be ready to accept connections yet
 	if err = pool.Retry(func() error {
-		var err error
-
 		// recreate connectionString because dockertest port uses special port
 		connectionString = fmt.Sprintf(
 			"host=%s user=%s password=%s dbname=%s sslmode=%s port=%s ",
 			conf.UserDB.Host, conf.UserDB.User, conf.UserDB.Password,
 			conf.UserDB.Name, conf.UserDB.SSLMode, resource.GetPort("5432/tcp"))
 
-		postgresDB, err = sql.Open(dbDriverName, connectionString)
-		if err != nil {
-			return err
-		}
-		return postgresDB.Ping()
+		defaultStore = newPostgresStore(connectionString)
+		return defaultStore.Ping(context.Background())
 	}); err != nil {
 		logger.Fatal(unitTestTag, "Could not connect to docker:", err.Error())
 	}
 
-	// create a postgres driver for migration
-	driver, err := postgres.WithInstance(postgresDB, &postgres.Config{})
-	if err != nil {
-		logger.Fatal(unitTestTag, "Failed to start postgres Instance:", err.Error())
-	}
-
-	// create a migration instance
-	migration, err := migrate.NewWithDatabaseInstance(
-		"file://test_fixtures/psql",
-		"postgres", driver,
-	)
+	// create a migration instance of the embedded migrations
+	migration, err := newMigration(defaultStore.db)
 	if err != nil {
 		logger.Fatal(unitTestTag, "Failed to create a migration instance:", err.Error())
 	}
@@ -92,9 +93,17 @@ func TestMain(m *testing.M) {
 	if err := migration.Up(); err != nil {
 		logger.Fatal(unitTestTag, "Failed to load active migration files:", err.Error())
 	}
-	// seed data if necessary
+	// seed the test data, it is not part of the embedded migrations
+	seed, err := ioutil.ReadFile(unitTestSeedFile)
+	if err != nil {
+		logger.Fatal(unitTestTag, "Failed to read the seed file:", err.Error())
+	}
+	if _, err := defaultStore.db.Exec(string(seed)); err != nil {
+		logger.Fatal(unitTestTag, "Failed to seed the test data:", err.Error())
+	}
 
 	// start the tests
+	unitTestPostgresReady = true
 	code := m.Run()
 
 	// When unit test is done running, kill and remove the container
@@ -107,39 +116,141 @@ func TestMain(m *testing.M) {
 }
 
 func TestGetStatus(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// test service state locker
 	cases := []struct {
 		request     *pbsvc.UserRequest
 		serverState state
+		reason      string
+		expCode     codes.Code
 		expMsg      string
 	}{
-		{&pbsvc.UserRequest{}, available, codes.OK.String()},
-		{&pbsvc.UserRequest{}, unavailable, codes.Unavailable.String()},
+		{&pbsvc.UserRequest{}, available, "", codes.OK, codes.OK.String()},
+		{&pbsvc.UserRequest{}, unavailable, "", codes.Unavailable, codes.Unavailable.String()},
+		{&pbsvc.UserRequest{}, unavailable, "db upgrade", codes.Unavailable, "Unavailable: db upgrade"},
+		{&pbsvc.UserRequest{}, maintenance, "db upgrade", codes.OK, "MAINTENANCE: db upgrade"},
 	}
 
 	for _, c := range cases {
-		serviceStateLocker.currentServiceState = c.serverState
+		serviceStateLocker.setState(c.serverState, c.reason, time.Time{})
 		s := Service{}
 		response, _ := s.GetStatus(context.TODO(), c.request)
 		assert.Equal(t, c.expMsg, response.GetMessage())
+		assert.Equal(t, uint32(c.expCode), response.GetCode())
 	}
 
-	serviceStateLocker.currentServiceState = available
+	serviceStateLocker.setState(available, "", time.Time{})
 	s := Service{}
 
-	// test refreshDBConnection
-	err := postgresDB.Close()
+	// test lost db connection
+	err := defaultStore.db.Close()
 	assert.Nil(t, err)
 
 	response, _ := s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
-	assert.Equal(t, codes.Unavailable.String(), response.GetMessage())
+	assert.Equal(t, "Unavailable: "+consts.ErrStoreUnreachable.Error(), response.GetMessage())
+	assert.True(t, serviceStateLocker.isDegraded())
 
 	// reconnect
-	err = refreshDBConnection()
+	response, _ = s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+	assert.False(t, serviceStateLocker.isDegraded())
+}
+
+func TestDrain(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	s := Service{}
+	Drain()
+
+	response, _ := s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
+	assert.Equal(t, "Unavailable: shutting down", response.GetMessage())
+
+	response, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: unitTestUserGenerator("Drain-One")})
+	assert.Nil(t, response)
+	assert.Equal(t, consts.ErrStatusServiceUnavailable, err)
+
+	serviceStateLocker.setState(available, "", time.Time{})
+	response, _ = s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+}
+
+func TestSetServiceState(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	admin, adminIdentification, err := unitTestInsertAdmin("SetServiceState-Admin")
+	assert.Nil(t, err)
+	_, userIdentification, err := unitTestInsertVerifiedUser("SetServiceState-User")
+	assert.Nil(t, err)
+
+	adminReq := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}}
+	userReq := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userIdentification.GetToken()}}
+
+	cases := []struct {
+		desc   string
+		md     metadata.MD
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", metadata.Pairs(serviceStateKey, "MAINTENANCE"), nil,
+			"rpc error: code = InvalidArgument desc = nil request User",
+		},
+		{"test unknown state", metadata.Pairs(serviceStateKey, "LOCKED"), adminReq,
+			"rpc error: code = InvalidArgument desc = " + consts.ErrInvalidServiceState.Error(),
+		},
+		{"test expiring available", metadata.Pairs(serviceStateKey, "AVAILABLE", serviceStateExpiresInKey, "60"),
+			adminReq, "rpc error: code = InvalidArgument desc = " + consts.ErrInvalidServiceStateExpiry.Error(),
+		},
+		{"test non admin token", metadata.Pairs(serviceStateKey, "MAINTENANCE"), userReq,
+			"rpc error: code = PermissionDenied desc = unauthorized permission",
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.SetServiceState(metadata.NewIncomingContext(context.TODO(), c.md), c.req)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+		assert.True(t, serviceStateLocker.isStateAvailable(), c.desc)
+	}
+
+	s := Service{}
+
+	// maintenance serves reads and rejects writes
+	response, err := s.SetServiceState(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceStateKey, "maintenance", serviceStateReasonKey, "db upgrade")), adminReq)
+	assert.Nil(t, err)
+	assert.Equal(t, "MAINTENANCE: db upgrade", response.GetMessage())
+
+	response, err = s.GetUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: admin.GetUuid()},
+		Identification: adminReq.GetIdentification()})
+	assert.Nil(t, err)
+	assert.Equal(t, admin.GetUuid(), response.GetUser().GetUuid())
+
+	response, err = s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: unitTestUserGenerator("SetServiceState-One")})
+	assert.Nil(t, response)
+	assert.Equal(t, consts.ErrStatusServiceUnavailable, err)
+
+	// unavailable rejects reads, but is left with SetServiceState
+	_, err = s.SetServiceState(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceStateKey, "UNAVAILABLE")), adminReq)
+	assert.Nil(t, err)
+
+	response, err = s.GetUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: admin.GetUuid()},
+		Identification: adminReq.GetIdentification()})
+	assert.Nil(t, response)
+	assert.Equal(t, consts.ErrStatusServiceUnavailable, err)
+
+	response, err = s.SetServiceState(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceStateKey, "AVAILABLE")), adminReq)
 	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+	assert.True(t, serviceStateLocker.isStateAvailable())
 }
 
 func TestCreateUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// valid
 	testUser1 := unitTestUserGenerator("CreateUser-One")
 
@@ -184,6 +295,10 @@ func TestCreateUser(t *testing.T) {
 		Organization: "",
 	}
 
+	// fail: breached password
+	testUser10 := unitTestUserGenerator("CreateUser Fail")
+	testUser10.Password = "password123"
+
 	// fail: blank last name
 	testUser9 := &pblib.User{
 		FirstName: unitTestDefaultUser.GetFirstName(),
@@ -212,6 +327,8 @@ func TestCreateUser(t *testing.T) {
 			"Internal desc = invalid User organization"},
 		{&pbsvc.UserRequest{User: testUser9}, true, "rpc error: code = " +
 			"Internal desc = invalid User last name"},
+		{&pbsvc.UserRequest{User: testUser10}, true, "rpc error: code = InvalidArgument desc = " +
+			consts.ErrPasswordPolicy.Error() + ": " + consts.ErrPasswordBreached.Error()},
 	}
 
 	for _, c := range cases {
@@ -225,7 +342,7 @@ func TestCreateUser(t *testing.T) {
 			assert.Equal(t, c.request.GetUser().GetEmail(), response.GetUser().GetEmail())
 			assert.Equal(t, false, response.GetUser().GetIsVerified())
 
-			retrievedUser, err := getUserRow(response.GetUser().GetUuid())
+			retrievedUser, err := unitTestTx().getUserRow(response.GetUser().GetUuid())
 			assert.Nil(t, err)
 			assert.Equal(t, auth.PermissionStringMap[auth.NoPermission], retrievedUser.GetPermissionLevel())
 		}
@@ -233,6 +350,15 @@ func TestCreateUser(t *testing.T) {
 }
 
 func TestDeleteUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	_, adminIdentification, err := unitTestInsertAdmin("DeleteUser-Admin")
+	assert.Nil(t, err)
+	adminID := &pblib.Identification{Token: adminIdentification.GetToken()}
+	user, userIdentification, err := unitTestInsertVerifiedUser("DeleteUser-User")
+	assert.Nil(t, err)
+	userID := &pblib.Identification{Token: userIdentification.GetToken()}
+
 	// insert valid user
 	response, err := unitTestInsertUser("DeleteUser-One")
 	assert.Nil(t, err)
@@ -266,19 +392,39 @@ func TestDeleteUser(t *testing.T) {
 		isExpErr bool
 		expMsg   string
 	}{
-		{&pbsvc.UserRequest{User: test1}, false, codes.OK.String()},
-		{&pbsvc.UserRequest{User: test2}, false, codes.OK.String()},
-		{&pbsvc.UserRequest{User: test3}, true,
+		{&pbsvc.UserRequest{User: test1, Identification: adminID}, false, codes.OK.String()},
+		{&pbsvc.UserRequest{User: test2, Identification: adminID}, false, codes.OK.String()},
+		{&pbsvc.UserRequest{User: test3, Identification: adminID}, true,
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
-		{&pbsvc.UserRequest{User: test4}, true,
+		{&pbsvc.UserRequest{User: test4, Identification: adminID}, true,
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
-		{&pbsvc.UserRequest{User: nil}, true,
+		{&pbsvc.UserRequest{User: nil, Identification: adminID}, true,
 			"rpc error: code = InvalidArgument desc = nil request User"},
 		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
 	}
 
+	// requires users:admin over the user, or users:write over themself
+	denied := []struct {
+		desc    string
+		request *pbsvc.UserRequest
+		expCode codes.Code
+	}{
+		{"test invalid token", &pbsvc.UserRequest{User: test1,
+			Identification: &pblib.Identification{Token: unitTestFailValue}}, codes.Unauthenticated},
+		{"test user over another user", &pbsvc.UserRequest{User: test1, Identification: userID},
+			codes.PermissionDenied},
+		{"test user over a nonexistent user", &pbsvc.UserRequest{User: test2, Identification: userID},
+			codes.PermissionDenied},
+	}
+
+	s := Service{}
+	for _, c := range denied {
+		response, err := s.DeleteUser(context.TODO(), c.request)
+		assert.Equal(t, c.expCode, status.Code(err), c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
 	for _, c := range cases {
-		s := Service{}
 		response, err := s.DeleteUser(context.TODO(), c.request)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
@@ -288,9 +434,26 @@ func TestDeleteUser(t *testing.T) {
 			assert.Nil(t, err)
 		}
 	}
+
+	// a user deletes themself
+	response, err = s.DeleteUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+		Identification: userID})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+	_, err = unitTestTx().getUserRow(user.GetUuid())
+	assert.Equal(t, consts.ErrUserNotFound, err)
 }
 
 func TestGetUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	_, adminIdentification, err := unitTestInsertAdmin("GetUser-Admin")
+	assert.Nil(t, err)
+	adminID := &pblib.Identification{Token: adminIdentification.GetToken()}
+	user, userIdentification, err := unitTestInsertVerifiedUser("GetUser-User")
+	assert.Nil(t, err)
+	userID := &pblib.Identification{Token: userIdentification.GetToken()}
+
 	// insert valid user
 	response, err := unitTestInsertUser("GetUser-One")
 	assert.Nil(t, err)
@@ -316,9 +479,14 @@ func TestGetUser(t *testing.T) {
 		isExpErr bool
 		expMsg   string
 	}{
-		{&pbsvc.UserRequest{User: test1}, false, ""},
-		{&pbsvc.UserRequest{User: test2}, true,
+		{&pbsvc.UserRequest{User: test1, Identification: adminID}, false, ""},
+		{&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}, Identification: userID}, false, ""},
+		{&pbsvc.UserRequest{User: test2, Identification: adminID}, true,
 			"rpc error: code = Internal desc = user is not found in database"},
+		{&pbsvc.UserRequest{User: test1, Identification: &pblib.Identification{Token: unitTestFailValue}}, true,
+			"rpc error: code = Unauthenticated desc = " + consts.ErrNoMatchingAuthTokenFound.Error()},
+		{&pbsvc.UserRequest{User: test1, Identification: userID}, true,
+			"rpc error: code = PermissionDenied desc = " + authconst.ErrInvalidPermission.Error()},
 		{&pbsvc.UserRequest{User: nil}, true,
 			"rpc error: code = InvalidArgument desc = nil request User"},
 		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
@@ -339,6 +507,15 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestUpdateUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	_, adminIdentification, err := unitTestInsertAdmin("UpdateUser-Admin")
+	assert.Nil(t, err)
+	adminID := &pblib.Identification{Token: adminIdentification.GetToken()}
+	user, userIdentification, err := unitTestInsertVerifiedUser("UpdateUser-User")
+	assert.Nil(t, err)
+	userID := &pblib.Identification{Token: userIdentification.GetToken()}
+
 	// insert valid user 1
 	response1, err := unitTestInsertUser("UpdateUser-One")
 	assert.Nil(t, err)
@@ -349,7 +526,7 @@ func TestUpdateUser(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response2.GetMessage())
 
-	err = deleteEmailTokenRow(response2.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(response2.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	nonExistingUUID, err := generateUUID()
@@ -425,25 +602,34 @@ func TestUpdateUser(t *testing.T) {
 		isExpErr bool
 		expMsg   string
 	}{
-		{&pbsvc.UserRequest{User: updateUser}, false, ""},
-		{&pbsvc.UserRequest{User: updateUser2}, false, ""},
+		{&pbsvc.UserRequest{User: updateUser, Identification: adminID}, false, ""},
+		{&pbsvc.UserRequest{User: updateUser2, Identification: adminID}, false, ""},
 		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
-		{&pbsvc.UserRequest{User: updateUser3}, true,
+		{&pbsvc.UserRequest{User: updateUser3, Identification: adminID}, true,
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
-		{&pbsvc.UserRequest{User: updateUser4}, true,
+		{&pbsvc.UserRequest{User: updateUser4, Identification: adminID}, true,
 			"rpc error: code = Internal desc = user is not found in database"},
-		{&pbsvc.UserRequest{User: updateUser5}, true,
+		{&pbsvc.UserRequest{User: updateUser5, Identification: adminID}, true,
 			"rpc error: code = Internal desc = invalid User email"},
-		{&pbsvc.UserRequest{User: updateUser6}, true,
+		{&pbsvc.UserRequest{User: updateUser6, Identification: adminID}, true,
 			"rpc error: code = Internal desc = invalid User first name"},
-		{&pbsvc.UserRequest{User: updateUser7}, true,
+		{&pbsvc.UserRequest{User: updateUser7, Identification: adminID}, true,
 			"rpc error: code = Internal desc = invalid User last name"},
 		{&pbsvc.UserRequest{User: nil}, true,
 			"rpc error: code = InvalidArgument desc = nil request User"},
-		{&pbsvc.UserRequest{User: updateUser8}, true,
+		{&pbsvc.UserRequest{User: updateUser8, Identification: adminID}, true,
 			"rpc error: code = Internal desc = email already exists"},
-		{&pbsvc.UserRequest{User: updateUser9}, true,
+		{&pbsvc.UserRequest{User: updateUser9, Identification: adminID}, true,
 			"rpc error: code = Internal desc = email already exists"},
+		{&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid(), LastName: "UpdateUser Self"},
+			Identification: userID}, false, ""},
+		{&pbsvc.UserRequest{User: updateUser2, Identification: &pblib.Identification{Token: unitTestFailValue}}, true,
+			"rpc error: code = Unauthenticated desc = " + consts.ErrNoMatchingAuthTokenFound.Error()},
+		{&pbsvc.UserRequest{User: updateUser2, Identification: userID}, true,
+			"rpc error: code = PermissionDenied desc = " + authconst.ErrInvalidPermission.Error()},
+		{&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid(), Organization: "UpdateUser Moved"},
+			Identification: userID}, true,
+			"rpc error: code = PermissionDenied desc = " + authconst.ErrInvalidPermission.Error()},
 	}
 
 	for _, c := range cases {
@@ -461,9 +647,17 @@ func TestUpdateUser(t *testing.T) {
 }
 
 func TestAuthenticateUser(t *testing.T) {
-	validPassword := "AuthenticateUser-One"
+	unitTestRequirePostgres(t)
+
+	// no backoff b/c the cases retry the same email right away
+	defaultLoginAttempts := loginAttempts
+	loginAttempts = newLoginLimiter(conf.LoginLimitConfig{MaxEmailFailures: 5, MaxIPFailures: 20,
+		Lockout: time.Hour, Window: time.Hour})
+	defer func() { loginAttempts = defaultLoginAttempts }()
+
+	validPassword := unitTestPassword("AuthenticateUser-One")
 
-	validResponse, err := unitTestInsertUser(validPassword)
+	validResponse, err := unitTestInsertUser("AuthenticateUser-One")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), validResponse.Message)
 
@@ -521,10 +715,8 @@ func TestAuthenticateUser(t *testing.T) {
 		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
 		{&pbsvc.UserRequest{User: nil}, true,
 			"rpc error: code = InvalidArgument desc = nil request User"},
-		{&pbsvc.UserRequest{User: invalidUser2}, true,
-			"rpc error: code = Unauthenticated desc = email does not exist in db"},
-		{&pbsvc.UserRequest{User: invalidUser3}, true,
-			"rpc error: code = Unauthenticated desc = crypto/bcrypt: hashedPassword is not the hash of the given password"},
+		{&pbsvc.UserRequest{User: invalidUser2}, true, consts.ErrStatusInvalidCredentials.Error()},
+		{&pbsvc.UserRequest{User: invalidUser3}, true, consts.ErrStatusInvalidCredentials.Error()},
 		{&pbsvc.UserRequest{User: invalidUser4}, true,
 			"rpc error: code = InvalidArgument desc = invalid User email"},
 		{&pbsvc.UserRequest{User: invalidUser5}, true,
@@ -565,37 +757,166 @@ func TestAuthenticateUser(t *testing.T) {
 	assert.Equal(t, conf.DummyAccount.Email, response.User.Email, caseDummyUser)
 }
 
+func TestAuthenticateUserLocksUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, _, err := unitTestInsertVerifiedUser("AuthenticateUser-Locked")
+	assert.Nil(t, err)
+	login := &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(),
+		Password: unitTestPassword("AuthenticateUser-Locked")}}
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- defaultStore.WithTx(context.TODO(), func(tx UserTx) error {
+			if err := tx.lockUUID(user.GetUuid()); err != nil {
+				return err
+			}
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	// the login waits for the writes to the user it matched by email
+	s := Service{}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	_, err = s.AuthenticateUser(ctx, login)
+	cancel()
+	assert.NotNil(t, err)
+
+	close(release)
+	assert.Nil(t, <-done)
+	response, err := s.AuthenticateUser(context.TODO(), login)
+	assert.Nil(t, err)
+	assert.Equal(t, user.GetUuid(), response.GetUser().GetUuid())
+}
+
+func TestUnlockUser(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	defaultLoginAttempts := loginAttempts
+	loginAttempts = newLoginLimiter(conf.LoginLimitConfig{MaxEmailFailures: 2, MaxIPFailures: 20,
+		Lockout: time.Hour, Window: time.Hour})
+	defer func() { loginAttempts = defaultLoginAttempts }()
+
+	_, adminIdentification, err := unitTestInsertAdmin("UnlockUser-Admin")
+	assert.Nil(t, err)
+	user, userIdentification, err := unitTestInsertVerifiedUser("UnlockUser-User")
+	assert.Nil(t, err)
+
+	s := Service{}
+	login := &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(), Password: unitTestPassword("UnlockUser-User")}}
+	badLogin := &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(), Password: unitTestFailValue}}
+
+	// lock the user out, even the right password is blocked
+	for i := 0; i < 2; i++ {
+		_, err = s.AuthenticateUser(context.TODO(), badLogin)
+		assert.Equal(t, consts.ErrStatusInvalidCredentials, err)
+	}
+	_, err = s.AuthenticateUser(context.TODO(), login)
+	assert.Equal(t, consts.ErrStatusLoginBlocked, err)
+
+	adminReq := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}}
+	cases := []struct {
+		desc   string
+		md     metadata.MD
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, nil, consts.ErrStatusNilRequestUser.Error()},
+		{"test nothing to unlock", nil, adminReq,
+			status.Error(codes.InvalidArgument, consts.ErrNilUnlockTarget.Error()).Error(),
+		},
+		{"test invalid uuid", nil,
+			&pbsvc.UserRequest{User: &pblib.User{Uuid: unitTestFailValue}, Identification: adminReq.GetIdentification()},
+			consts.ErrStatusUUIDInvalid.Error(),
+		},
+		{"test non admin token", nil,
+			&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+				Identification: &pblib.Identification{Token: userIdentification.GetToken()}},
+			"rpc error: code = PermissionDenied desc = unauthorized permission",
+		},
+		{"test unlock ip", metadata.Pairs(clientIPKey, "127.0.0.1"), adminReq, ""},
+		{"test unlock by uuid", nil,
+			&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}, Identification: adminReq.GetIdentification()},
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		response, err := s.UnlockUser(metadata.NewIncomingContext(context.TODO(), c.md), c.req)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, codes.OK.String(), response.GetMessage(), c.desc)
+		}
+	}
+
+	response, err := s.AuthenticateUser(context.TODO(), login)
+	assert.Nil(t, err)
+	assert.Equal(t, user.GetUuid(), response.GetUser().GetUuid())
+}
+
 func TestMakeAuthNewSecret(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// no need to perform a check in the db here using a DAO,
 	// b/c this func is meant to be called by a client
-
-	err := unitTestDeleteAuthSecretTable()
+	_, adminIdentification, err := unitTestInsertAdmin("MakeAuthNewSecret-Admin")
 	assert.Nil(t, err)
+	_, userIdentification, err := unitTestInsertVerifiedUser("MakeAuthNewSecret-User")
+	assert.Nil(t, err)
+	adminReq := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}}
+
+	s := Service{}
 
-	// test for no active secret
-	retrievedSecret, err := getActiveSecretRow()
+	// requires the service:write permission
+	cases := []struct {
+		desc    string
+		req     *pbsvc.UserRequest
+		expCode codes.Code
+	}{
+		{"test nil request", nil, codes.InvalidArgument},
+		{"test invalid token", &pbsvc.UserRequest{Identification: &pblib.Identification{Token: unitTestFailValue}},
+			codes.Unauthenticated},
+		{"test user token", &pbsvc.UserRequest{Identification: userIdentification}, codes.PermissionDenied},
+	}
+
+	for _, c := range cases {
+		response, err := s.MakeNewAuthSecret(context.TODO(), c.req)
+		assert.Equal(t, c.expCode, status.Code(err), c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	// test for no active secret, tokens signed with the previous secret keep verifying
+	_, err = defaultStore.db.Exec("DELETE FROM user_security.active_secret")
+	assert.Nil(t, err)
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error())
 	assert.Nil(t, retrievedSecret)
 
-	s := Service{}
-
-	// test with no secret in table
-	response, err := s.MakeNewAuthSecret(context.TODO(), nil)
+	// test with no active secret in table
+	response, err := s.MakeNewAuthSecret(context.TODO(), adminReq)
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response.Message)
 
 	// test for the active secret
-	retrievedSecret, err = getActiveSecretRow()
+	retrievedSecret, err = unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 
 	// test with a secret already in table
-	response, err = s.MakeNewAuthSecret(context.TODO(), nil)
+	response, err = s.MakeNewAuthSecret(context.TODO(), adminReq)
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response.Message)
 
 	// retrieve the newest secret
-	retrievedNewestSecret, err := getActiveSecretRow()
+	retrievedNewestSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedNewestSecret)
 
@@ -604,35 +925,62 @@ func TestMakeAuthNewSecret(t *testing.T) {
 }
 
 func TestGetAuthSecret(t *testing.T) {
-	err := unitTestDeleteAuthSecretTable()
+	unitTestRequirePostgres(t)
+
+	_, adminIdentification, err := unitTestInsertAdmin("GetAuthSecret-Admin")
 	assert.Nil(t, err)
+	_, userIdentification, err := unitTestInsertVerifiedUser("GetAuthSecret-User")
+	assert.Nil(t, err)
+	adminReq := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}}
 
 	s := Service{}
 
-	// test secret is generated if no secret present
-	response, err := s.GetAuthSecret(context.TODO(), nil)
+	// requires the service:write permission
+	cases := []struct {
+		desc    string
+		req     *pbsvc.UserRequest
+		expCode codes.Code
+	}{
+		{"test nil request", nil, codes.InvalidArgument},
+		{"test invalid token", &pbsvc.UserRequest{Identification: &pblib.Identification{Token: unitTestFailValue}},
+			codes.Unauthenticated},
+		{"test user token", &pbsvc.UserRequest{Identification: userIdentification}, codes.PermissionDenied},
+	}
+
+	for _, c := range cases {
+		response, err := s.GetAuthSecret(context.TODO(), c.req)
+		assert.Equal(t, c.expCode, status.Code(err), c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	// test secret is generated if no active secret present, tokens signed with the previous secret keep verifying
+	_, err = defaultStore.db.Exec("DELETE FROM user_security.active_secret")
 	assert.Nil(t, err)
-	assert.Equal(t, codes.OK.String(), response.GetMessage())
-	assert.NotEmpty(t, response.GetIdentification().GetSecret())
 
-	// test it got inserted by retrieving the secret key
-	secretKey, err := getLatestSecret(2)
+	response, err := s.GetAuthSecret(context.TODO(), adminReq)
 	assert.Nil(t, err)
-	assert.NotEmpty(t, secretKey)
+	assert.Equal(t, codes.OK.String(), response.GetMessage())
+	assert.NotEmpty(t, response.GetIdentification().GetSecret())
+	assert.NotEqual(t, adminIdentification.GetSecret().GetKey(), response.GetIdentification().GetSecret().GetKey())
 
 	// retrieve the secret from active_secret table
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
-	assert.Equal(t, secretKey, retrievedSecret.GetKey())
+	assert.Equal(t, response.GetIdentification().GetSecret().GetKey(), retrievedSecret.GetKey())
 
 	// get secret by service
-	response, err = s.GetAuthSecret(context.TODO(), nil)
+	defer func(serviceKeys string) { conf.ServiceKeys = serviceKeys }(conf.ServiceKeys)
+	conf.ServiceKeys = "GetAuthSecret-Key"
+	response, err = s.GetAuthSecret(metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(serviceKeyKey, "GetAuthSecret-Key")), &pbsvc.UserRequest{})
 	assert.Nil(t, err)
 	assert.Equal(t, response.Identification.Secret.Key, retrievedSecret.Key)
 	assert.Equal(t, response.Identification.Secret.CreatedTimestamp, retrievedSecret.CreatedTimestamp)
 }
 
 func TestGetNewAuthToken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// test registration -> authenticate -> new auth token -> authenticate
 	// register
 	validCase := "test registration -> authenticate -> new auth token -> authenticate"
@@ -653,7 +1001,7 @@ func TestGetNewAuthToken(t *testing.T) {
 	req := &pbsvc.UserRequest{
 		User: &pblib.User{
 			Email:    validUser.GetEmail(),
-			Password: validUser.GetLastName(),
+			Password: unitTestPassword(validUser.GetLastName()),
 		},
 	}
 	resp, err = s.AuthenticateUser(context.TODO(), req)
@@ -723,6 +1071,8 @@ func TestGetNewAuthToken(t *testing.T) {
 }
 
 func TestVerifyAuthToken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	nonExistingToken := &pblib.Identification{
 		Token: "TestVerifyAuthToken-DoesNotExist",
 	}
@@ -769,9 +1119,31 @@ func TestVerifyAuthToken(t *testing.T) {
 	assert.Equal(t, newSecret.GetKey(), responseSecret.GetKey(), desc)
 	assert.Equal(t, newSecret.GetCreatedTimestamp(), responseSecret.GetCreatedTimestamp(), desc)
 	assert.Equal(t, newSecret.GetExpirationTimestamp(), responseSecret.GetExpirationTimestamp(), desc)
+
+	// degraded mode serves the verified token from cache, and rejects unknown tokens and writes
+	serviceStateLocker.setDegraded(true)
+	defer serviceStateLocker.setDegraded(false)
+
+	desc = "test cached token in degraded mode"
+	response, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identity})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, newToken, response.GetIdentification().GetToken(), desc)
+	assert.Equal(t, newSecret.GetKey(), response.GetIdentification().GetSecret().GetKey(), desc)
+
+	desc = "test uncached token in degraded mode"
+	response, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: nonExistingToken})
+	assert.Nil(t, response, desc)
+	assert.Equal(t, consts.ErrStatusServiceUnavailable, err, desc)
+
+	desc = "test write in degraded mode"
+	response, err = s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: unitTestUserGenerator("VerifyAuthToken-One")})
+	assert.Nil(t, response, desc)
+	assert.Equal(t, consts.ErrStatusServiceUnavailable, err, desc)
 }
 
 func TestVerifyEmailToken(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	// create user 1 to emulate new user
 	user1, err := unitTestInsertUser("VerifyEmailToken-NewUser")
 	assert.Nil(t, err)
@@ -785,16 +1157,16 @@ func TestVerifyEmailToken(t *testing.T) {
 		Email: unitTestEmailGenerator(),
 		Uuid:  user2.GetUser().GetUuid(),
 	}
-	updatedUser2, err := updateUserRow(updateData.GetUuid(), updateData, user2.GetUser())
+	updatedUser2, _, err := unitTestTx().updateUserRow(updateData.GetUuid(), updateData, user2.GetUser())
 	assert.Nil(t, err)
 	assert.Equal(t, user2.GetUser().GetUuid(), updatedUser2.GetUuid())
 	assert.Equal(t, false, updatedUser2.GetIsVerified())
 	assert.NotEmpty(t, updatedUser2.GetProspectiveEmail())
 
 	// remove the existing tokens so we can manually create, insert and reference this token
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(user1.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user2.GetUser().GetUuid())
+	err = unitTestTx().deleteEmailTokenRow(user2.GetUser().GetUuid(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	user1EmailID, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -806,9 +1178,9 @@ func TestVerifyEmailToken(t *testing.T) {
 	assert.NotNil(t, user2EmailID)
 
 	// insert this token to test against
-	err = insertEmailToken(user1.GetUser().GetUuid(), user1EmailID.GetToken(), user1EmailID.GetSecret())
+	err = unitTestTx().insertEmailToken(user1.GetUser().GetUuid(), user1EmailID.GetToken(), user1EmailID.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
-	err = insertEmailToken(user2.GetUser().GetUuid(), user2EmailID.GetToken(), user2EmailID.GetSecret())
+	err = unitTestTx().insertEmailToken(user2.GetUser().GetUuid(), user2EmailID.GetToken(), user2EmailID.GetSecret(), emailTokenPurposeVerifyEmail)
 	assert.Nil(t, err)
 
 	// define test cases to test against non expired tokens
@@ -849,33 +1221,41 @@ func TestVerifyEmailToken(t *testing.T) {
 			var retrievedUser *pblib.User
 			var err error
 			if c.req.Identification.GetToken() == user1EmailID.GetToken() {
-				retrievedUser, err = getUserRow(user1.GetUser().GetUuid())
+				retrievedUser, err = unitTestTx().getUserRow(user1.GetUser().GetUuid())
 			} else {
-				retrievedUser, err = getUserRow(user2.GetUser().GetUuid())
+				retrievedUser, err = unitTestTx().getUserRow(user2.GetUser().GetUuid())
 			}
 			assert.Nil(t, err)
 			assert.Equal(t, auth.PermissionStringMap[auth.User], retrievedUser.GetPermissionLevel())
+
+			// existing user's prospective email replaces the email
+			if c.req.Identification.GetToken() == user2EmailID.GetToken() {
+				assert.Equal(t, updatedUser2.GetProspectiveEmail(), retrievedUser.GetEmail(), c.desc)
+				assert.Empty(t, retrievedUser.GetProspectiveEmail(), c.desc)
+				assert.True(t, retrievedUser.GetIsVerified(), c.desc)
+			}
 		}
 	}
 
 	// force expire the tokens for both new and existing user
 	expiredTimestamp := time.Now().AddDate(0, 0, -5)
 
-	command := `INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid)
-				VALUES($1, $2, $3, $4, $5)
+	// tokens inserted before secrets were sealed have no secret
+	command := `INSERT INTO user_svc.email_tokens(token_hash, created_timestamp, expiration_timestamp, uuid)
+				VALUES($1, $2, $3, $4)
 				`
 
-	_, err = postgresDB.Exec(command, user1EmailID.GetToken(), user1EmailID.GetSecret().GetKey(),
+	_, err = defaultStore.db.Exec(command, hashToken(user1EmailID.GetToken()),
 		time.Now(), expiredTimestamp, user1.GetUser().GetUuid())
 	assert.Nil(t, err)
-	_, err = postgresDB.Exec(command, user2EmailID.GetToken(), user2EmailID.GetSecret().GetKey(),
+	_, err = defaultStore.db.Exec(command, hashToken(user2EmailID.GetToken()),
 		time.Now(), expiredTimestamp, user2.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	// reset permissionLevel
-	err = updatePermissionLevel(user1.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	err = unitTestTx().updatePermissionLevel(user1.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
 	assert.Nil(t, err)
-	err = updatePermissionLevel(user2.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	err = unitTestTx().updatePermissionLevel(user2.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
 	assert.Nil(t, err)
 
 	expiredTestCase := []struct {
@@ -898,13 +1278,621 @@ func TestVerifyEmailToken(t *testing.T) {
 		assert.EqualError(t, err, status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error()).Error(), c.desc)
 
 		if c.deleteUser {
-			retrievedUser, err := getUserRow(user1.GetUser().GetUuid())
+			retrievedUser, err := unitTestTx().getUserRow(user1.GetUser().GetUuid())
 			assert.EqualError(t, err, consts.ErrUserNotFound.Error())
 			assert.Nil(t, retrievedUser, c.desc)
 		} else {
-			retrievedUser, err := getUserRow(user2.GetUser().GetUuid())
+			retrievedUser, err := unitTestTx().getUserRow(user2.GetUser().GetUuid())
 			assert.Nil(t, err)
 			assert.Equal(t, user2.GetUser().GetUuid(), retrievedUser.GetUuid(), c.desc)
 		}
 	}
 }
+
+func TestListUsers(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	organization := "ListUsers Org"
+	var insertedUUIDs []string
+	for _, lastName := range []string{"ListUsers-One", "ListUsers-Two"} {
+		user := unitTestUserGenerator(lastName)
+		user.Organization = organization
+		s := Service{}
+		response, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+		assert.Nil(t, err)
+		insertedUUIDs = append(insertedUUIDs, response.GetUser().GetUuid())
+	}
+
+	_, adminIdentification, err := unitTestInsertAdmin("ListUsers-Admin")
+	assert.Nil(t, err)
+
+	userResponse, err := unitTestInsertUser("ListUsers-User")
+	assert.Nil(t, err)
+	userPassword := unitTestPassword(userResponse.GetUser().GetLastName())
+	userResponse.GetUser().PermissionLevel = auth.PermissionStringMap[auth.User]
+	err = unitTestTx().updatePermissionLevel(userResponse.GetUser().GetUuid(), auth.PermissionStringMap[auth.User])
+	assert.Nil(t, err)
+	userResponse.GetUser().Password = userPassword
+	userIdentification, err := getAuthIdentification(unitTestTx(), userResponse.GetUser())
+	assert.Nil(t, err)
+
+	orgMetadata := metadata.Pairs(listUsersOrganizationKey, organization, listUsersPageSizeKey, "1")
+
+	cases := []struct {
+		desc   string
+		md     metadata.MD
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, nil,
+			"rpc error: code = InvalidArgument desc = nil request User",
+		},
+		{"test nil identification", nil, &pbsvc.UserRequest{},
+			"rpc error: code = InvalidArgument desc = nil request identification",
+		},
+		{"test non-existent token", nil,
+			&pbsvc.UserRequest{Identification: &pblib.Identification{Token: "ListUsers-DoesNotExist"}},
+			"rpc error: code = Unauthenticated desc = no matching auth token were found with given token",
+		},
+		{"test non admin token", nil,
+			&pbsvc.UserRequest{Identification: &pblib.Identification{Token: userIdentification.GetToken()}},
+			"rpc error: code = PermissionDenied desc = unauthorized permission",
+		},
+		{"test invalid options", metadata.Pairs(listUsersSortByKey, "password"),
+			&pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}},
+			"rpc error: code = InvalidArgument desc = invalid sort column for listing users",
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.ListUsers(metadata.NewIncomingContext(context.TODO(), c.md), c.req)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	desc := "test valid admin token"
+	s := Service{}
+	response, err := s.ListUsers(metadata.NewIncomingContext(context.TODO(), orgMetadata),
+		&pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminIdentification.GetToken()}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Len(t, response.GetUserCollection(), 1, desc)
+	assert.Equal(t, insertedUUIDs[0], response.GetUserCollection()[0].GetUuid(), desc)
+	assert.Empty(t, response.GetUserCollection()[0].GetPassword(), desc)
+}
+
+func TestShareDocument(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, ownerIdentification, err := unitTestInsertVerifiedUser("ShareDocument-Owner")
+	assert.Nil(t, err)
+	friend1, _, err := unitTestInsertVerifiedUser("ShareDocument-One")
+	assert.Nil(t, err)
+	friend2, friend2Identification, err := unitTestInsertVerifiedUser("ShareDocument-Two")
+	assert.Nil(t, err)
+	unverifiedUser, err := unitTestInsertUser("ShareDocument-Unverified")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUuid(), false)
+	assert.Nil(t, err)
+
+	ownerToken := &pblib.Identification{Token: ownerIdentification.GetToken()}
+	friend2Token := &pblib.Identification{Token: friend2Identification.GetToken()}
+	recipients := []string{friend1.GetUuid(), friend2.GetEmail()}
+
+	cases := []struct {
+		desc   string
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, "rpc error: code = InvalidArgument desc = nil request User"},
+		{"test invalid duid", &pbsvc.UserRequest{Identification: ownerToken, Duid: "1234", UuidsToShareDuid: recipients},
+			"rpc error: code = InvalidArgument desc = invalid duid",
+		},
+		{"test no recipients", &pbsvc.UserRequest{Identification: ownerToken, Duid: duid},
+			"rpc error: code = InvalidArgument desc = no uuids or emails to share duid with",
+		},
+		{"test nil identification", &pbsvc.UserRequest{Duid: duid, UuidsToShareDuid: recipients},
+			"rpc error: code = InvalidArgument desc = nil request identification",
+		},
+		{"test non-existent duid",
+			&pbsvc.UserRequest{Identification: ownerToken, Duid: unitTestDUIDGenerator(), UuidsToShareDuid: recipients},
+			"rpc error: code = NotFound desc = document is not found in database",
+		},
+		{"test not the owner", &pbsvc.UserRequest{Identification: friend2Token, Duid: duid, UuidsToShareDuid: recipients},
+			"rpc error: code = PermissionDenied desc = document is not owned by user",
+		},
+		{"test unverified recipient",
+			&pbsvc.UserRequest{Identification: ownerToken, Duid: duid,
+				UuidsToShareDuid: []string{unverifiedUser.GetUser().GetUuid()}},
+			"rpc error: code = FailedPrecondition desc = share recipient is not verified",
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.ShareDocument(context.TODO(), c.req)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	// share twice to test idempotency
+	for _, desc := range []string{"test valid share", "test idempotent share"} {
+		s := Service{}
+		response, err := s.ShareDocument(context.TODO(),
+			&pbsvc.UserRequest{Identification: ownerToken, Duid: duid, UuidsToShareDuid: recipients})
+		assert.Nil(t, err, desc)
+		assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+		assert.Equal(t, owner.GetUuid(), response.GetUser().GetUuid(), desc)
+		assert.Equal(t, map[string]bool{friend1.GetUuid(): true, friend2.GetUuid(): true},
+			response.GetUser().GetUserDocuments()[duid].GetSharedWith(), desc)
+	}
+}
+
+func TestUnshareDocument(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, ownerIdentification, err := unitTestInsertVerifiedUser("UnshareDocument-Owner")
+	assert.Nil(t, err)
+	friend1, _, err := unitTestInsertVerifiedUser("UnshareDocument-One")
+	assert.Nil(t, err)
+	friend2, friend2Identification, err := unitTestInsertVerifiedUser("UnshareDocument-Two")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUuid(), false)
+	assert.Nil(t, err)
+	err = unitTestTx().insertSharedDocumentRows(duid, []string{friend1.GetUuid(), friend2.GetUuid()})
+	assert.Nil(t, err)
+
+	ownerToken := &pblib.Identification{Token: ownerIdentification.GetToken()}
+	friend2Token := &pblib.Identification{Token: friend2Identification.GetToken()}
+	recipients := []string{friend1.GetEmail()}
+
+	cases := []struct {
+		desc   string
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, "rpc error: code = InvalidArgument desc = nil request User"},
+		{"test invalid duid", &pbsvc.UserRequest{Identification: ownerToken, Duid: "1234", UuidsToShareDuid: recipients},
+			"rpc error: code = InvalidArgument desc = invalid duid",
+		},
+		{"test no recipients", &pbsvc.UserRequest{Identification: ownerToken, Duid: duid},
+			"rpc error: code = InvalidArgument desc = no uuids or emails to share duid with",
+		},
+		{"test non-existent duid",
+			&pbsvc.UserRequest{Identification: ownerToken, Duid: unitTestDUIDGenerator(), UuidsToShareDuid: recipients},
+			"rpc error: code = NotFound desc = document is not found in database",
+		},
+		{"test not the owner", &pbsvc.UserRequest{Identification: friend2Token, Duid: duid, UuidsToShareDuid: recipients},
+			"rpc error: code = PermissionDenied desc = document is not owned by user",
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.UnshareDocument(context.TODO(), c.req)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	// unshare twice to test idempotency
+	for _, desc := range []string{"test valid unshare", "test idempotent unshare"} {
+		s := Service{}
+		response, err := s.UnshareDocument(context.TODO(),
+			&pbsvc.UserRequest{Identification: ownerToken, Duid: duid, UuidsToShareDuid: recipients})
+		assert.Nil(t, err, desc)
+		assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+		assert.Equal(t, map[string]bool{friend2.GetUuid(): true},
+			response.GetUser().GetUserDocuments()[duid].GetSharedWith(), desc)
+	}
+}
+
+func TestListDocuments(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, ownerIdentification, err := unitTestInsertVerifiedUser("ListDocuments-Owner")
+	assert.Nil(t, err)
+	friend, friendIdentification, err := unitTestInsertVerifiedUser("ListDocuments-One")
+	assert.Nil(t, err)
+	_, adminIdentification, err := unitTestInsertAdmin("ListDocuments-Admin")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUuid(), true)
+	assert.Nil(t, err)
+	err = unitTestTx().insertSharedDocumentRows(duid, []string{friend.GetUuid()})
+	assert.Nil(t, err)
+
+	ownerToken := &pblib.Identification{Token: ownerIdentification.GetToken()}
+	friendToken := &pblib.Identification{Token: friendIdentification.GetToken()}
+	adminToken := &pblib.Identification{Token: adminIdentification.GetToken()}
+	expDocuments := map[string]*pblib.UserDocumentMetadata{
+		duid: {IsPublic: true, SharedWith: map[string]bool{friend.GetUuid(): true}},
+	}
+	expSharedToMe := map[string]*pblib.UserFriendMetadata{
+		owner.GetUuid(): {SharedDuidToMe: map[string]bool{duid: true}},
+	}
+
+	cases := []struct {
+		desc     string
+		req      *pbsvc.UserRequest
+		isExpErr bool
+		expMsg   string
+		expUUID  string
+	}{
+		{"test nil request", nil, true, "rpc error: code = InvalidArgument desc = nil request User", ""},
+		{"test nil identification", &pbsvc.UserRequest{}, true,
+			"rpc error: code = InvalidArgument desc = nil request identification", "",
+		},
+		{"test other user's documents", &pbsvc.UserRequest{Identification: friendToken,
+			User: &pblib.User{Uuid: owner.GetUuid()}}, true,
+			"rpc error: code = PermissionDenied desc = " + authconst.ErrInvalidPermission.Error(), "",
+		},
+		{"test own documents", &pbsvc.UserRequest{Identification: ownerToken}, false, "", owner.GetUuid()},
+		{"test admin lists other user's documents", &pbsvc.UserRequest{Identification: adminToken,
+			User: &pblib.User{Uuid: owner.GetUuid()}}, false, "", owner.GetUuid(),
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.ListDocuments(context.TODO(), c.req)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expUUID, response.GetUser().GetUuid(), c.desc)
+			assert.Equal(t, expDocuments, response.GetUser().GetUserDocuments(), c.desc)
+		}
+	}
+
+	desc := "test list shared documents"
+	s := Service{}
+	response, err := s.ListSharedDocuments(context.TODO(), &pbsvc.UserRequest{Identification: friendToken})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, friend.GetUuid(), response.GetUser().GetUuid(), desc)
+	assert.Equal(t, expSharedToMe, response.GetUser().GetSharedToMe(), desc)
+
+	desc = "test list shared documents of other user"
+	response, err = s.ListSharedDocuments(context.TODO(), &pbsvc.UserRequest{Identification: ownerToken,
+		User: &pblib.User{Uuid: friend.GetUuid()}})
+	assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = "+authconst.ErrInvalidPermission.Error(), desc)
+	assert.Nil(t, response, desc)
+}
+
+func TestUpdateDocumentVisibility(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, ownerIdentification, err := unitTestInsertVerifiedUser("UpdateDocumentVisibility-Owner")
+	assert.Nil(t, err)
+	_, friendIdentification, err := unitTestInsertVerifiedUser("UpdateDocumentVisibility-One")
+	assert.Nil(t, err)
+
+	duid := unitTestDUIDGenerator()
+	err = unitTestTx().insertDocumentRow(duid, owner.GetUuid(), false)
+	assert.Nil(t, err)
+
+	ownerToken := &pblib.Identification{Token: ownerIdentification.GetToken()}
+	friendToken := &pblib.Identification{Token: friendIdentification.GetToken()}
+	toPublic := &pblib.User{UserDocuments: map[string]*pblib.UserDocumentMetadata{duid: {IsPublic: true}}}
+
+	cases := []struct {
+		desc   string
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, "rpc error: code = InvalidArgument desc = nil request User"},
+		{"test nil documents", &pbsvc.UserRequest{Identification: ownerToken},
+			"rpc error: code = InvalidArgument desc = " + consts.ErrNilRequestUserDocuments.Error(),
+		},
+		{"test invalid duid", &pbsvc.UserRequest{Identification: ownerToken,
+			User: &pblib.User{UserDocuments: map[string]*pblib.UserDocumentMetadata{"1234": {IsPublic: true}}}},
+			"rpc error: code = InvalidArgument desc = invalid duid",
+		},
+		{"test non-existent duid", &pbsvc.UserRequest{Identification: ownerToken,
+			User: &pblib.User{UserDocuments: map[string]*pblib.UserDocumentMetadata{
+				unitTestDUIDGenerator(): {IsPublic: true}}}},
+			"rpc error: code = NotFound desc = document is not found in database",
+		},
+		{"test not the owner", &pbsvc.UserRequest{Identification: friendToken, User: toPublic},
+			"rpc error: code = PermissionDenied desc = document is not owned by user",
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.UpdateDocumentVisibility(context.TODO(), c.req)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	desc := "test valid update"
+	s := Service{}
+	response, err := s.UpdateDocumentVisibility(context.TODO(),
+		&pbsvc.UserRequest{Identification: ownerToken, User: toPublic})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.True(t, response.GetUser().GetUserDocuments()[duid].GetIsPublic(), desc)
+	document, err := unitTestTx().getDocumentRow(duid)
+	assert.Nil(t, err, desc)
+	assert.True(t, document.isPublic, desc)
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, _, err := unitTestInsertVerifiedUser("RequestPasswordReset-One")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		req      *pbsvc.UserRequest
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test nil request", nil, true, consts.ErrStatusNilRequestUser.Error()},
+		{"test nil user", &pbsvc.UserRequest{}, true, consts.ErrStatusNilRequestUser.Error()},
+		{"test invalid email", &pbsvc.UserRequest{User: &pblib.User{Email: "@"}}, true,
+			status.Error(codes.InvalidArgument, consts.ErrInvalidUserEmail.Error()).Error(),
+		},
+		{"test non-existent email", &pbsvc.UserRequest{User: &pblib.User{Email: unitTestFailEmail}}, false, ""},
+		{"test valid email", &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail()}}, false, ""},
+		{"test replaces outstanding token", &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail()}}, false, ""},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.RequestPasswordReset(context.TODO(), c.req)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, codes.OK.String(), response.GetMessage(), c.desc)
+		}
+	}
+
+	desc := "test one outstanding reset token"
+	var count int
+	err = defaultStore.db.QueryRow(`SELECT COUNT(*) FROM user_svc.email_tokens WHERE uuid = $1 AND purpose = $2`,
+		user.GetUuid(), emailTokenPurposeResetPassword).Scan(&count)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, count, desc)
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, identification, err := unitTestInsertVerifiedUser("ConfirmPasswordReset-One")
+	assert.Nil(t, err)
+	newPassword := "ConfirmPasswordReset-NewPassword"
+
+	resetID, err := newResetPasswordIdentification(user.GetUuid(), user.GetPermissionLevel())
+	assert.Nil(t, err)
+	err = unitTestTx().insertEmailToken(user.GetUuid(), resetID.GetToken(), resetID.GetSecret(), emailTokenPurposeResetPassword)
+	assert.Nil(t, err)
+
+	// replace the token from creating the user so we can reference it
+	err = unitTestTx().deleteEmailTokenRow(user.GetUuid(), emailTokenPurposeVerifyEmail)
+	assert.Nil(t, err)
+	verifyID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+	assert.Nil(t, err)
+	err = unitTestTx().insertEmailToken(user.GetUuid(), verifyID.GetToken(), verifyID.GetSecret(), emailTokenPurposeVerifyEmail)
+	assert.Nil(t, err)
+
+	resetToken := &pblib.Identification{Token: resetID.GetToken()}
+	cases := []struct {
+		desc     string
+		req      *pbsvc.UserRequest
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test nil request", nil, true, consts.ErrStatusNilRequestUser.Error()},
+		{"test nil identification", &pbsvc.UserRequest{User: &pblib.User{Password: newPassword}}, true,
+			status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error()).Error(),
+		},
+		{"test empty password", &pbsvc.UserRequest{Identification: resetToken, User: &pblib.User{}}, true,
+			status.Error(codes.InvalidArgument, consts.ErrInvalidPassword.Error()).Error(),
+		},
+		{"test email verification token",
+			&pbsvc.UserRequest{Identification: &pblib.Identification{Token: verifyID.GetToken()},
+				User: &pblib.User{Password: newPassword}}, true,
+			status.Error(codes.InvalidArgument, consts.ErrMismatchingEmailTokenPurpose.Error()).Error(),
+		},
+		{"test password policy, token is kept",
+			&pbsvc.UserRequest{Identification: resetToken, User: &pblib.User{Password: "x-ConfirmPasswordReset-One"}},
+			true, status.Convert(&passwordPolicyError{violations: []error{consts.ErrPasswordPersonalInfo}}).Err().Error(),
+		},
+		{"test valid reset", &pbsvc.UserRequest{Identification: resetToken, User: &pblib.User{Password: newPassword}},
+			false, "",
+		},
+		{"test token is single use",
+			&pbsvc.UserRequest{Identification: resetToken, User: &pblib.User{Password: newPassword}}, true,
+			status.Error(codes.NotFound, consts.ErrNoMatchingEmailTokenFound.Error()).Error(),
+		},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.ConfirmPasswordReset(context.TODO(), c.req)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, codes.OK.String(), response.GetMessage(), c.desc)
+		}
+	}
+
+	desc := "test new password authenticates"
+	retrievedUser, err := unitTestTx().matchEmailAndPassword(user.GetEmail(), newPassword)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, user.GetUuid(), retrievedUser.GetUuid(), desc)
+
+	desc = "test auth tokens are revoked"
+	_, err = unitTestTx().pairTokenWithSecret(identification.GetToken())
+	assert.NotNil(t, err, desc)
+
+	desc = "test email verification token is untouched"
+	_, err = unitTestTx().getEmailTokenRow(verifyID.GetToken())
+	assert.Nil(t, err, desc)
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	newUser, err := unitTestInsertUser("ResendVerificationEmail-New")
+	assert.Nil(t, err)
+	verifiedUser, _, err := unitTestInsertVerifiedUser("ResendVerificationEmail-Verified")
+	assert.Nil(t, err)
+	nonExistentUUID, _ := generateUUID()
+
+	oldTokenHash, err := unitTestGetEmailTokenHash(newUser.GetUser().GetUuid())
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		req      *pbsvc.UserRequest
+		isExpErr bool
+		expMsg   string
+	}{
+		{"test nil request", nil, true, consts.ErrStatusNilRequestUser.Error()},
+		{"test nil user", &pbsvc.UserRequest{}, true, consts.ErrStatusNilRequestUser.Error()},
+		{"test invalid uuid", &pbsvc.UserRequest{User: &pblib.User{Uuid: "1234"}}, true,
+			consts.ErrStatusUUIDInvalid.Error(),
+		},
+		{"test invalid email", &pbsvc.UserRequest{User: &pblib.User{Email: "@"}}, true,
+			status.Error(codes.InvalidArgument, consts.ErrInvalidUserEmail.Error()).Error(),
+		},
+		{"test non-existent uuid", &pbsvc.UserRequest{User: &pblib.User{Uuid: nonExistentUUID}}, true,
+			consts.ErrStatusUUIDNotFound.Error(),
+		},
+		{"test verified user", &pbsvc.UserRequest{User: &pblib.User{Uuid: verifiedUser.GetUuid()}}, false, ""},
+		{"test verified email", &pbsvc.UserRequest{User: &pblib.User{Email: verifiedUser.GetEmail()}}, false, ""},
+		{"test non-existent email", &pbsvc.UserRequest{User: &pblib.User{Email: unitTestFailEmail}}, false, ""},
+		{"test new user", &pbsvc.UserRequest{User: &pblib.User{Email: newUser.GetUser().GetEmail()}}, false, ""},
+	}
+
+	for _, c := range cases {
+		s := Service{}
+		response, err := s.ResendVerificationEmail(context.TODO(), c.req)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, codes.OK.String(), response.GetMessage(), c.desc)
+		}
+	}
+
+	desc := "test stale token is replaced"
+	newTokenHash, err := unitTestGetEmailTokenHash(newUser.GetUser().GetUuid())
+	assert.Nil(t, err, desc)
+	assert.NotEqual(t, oldTokenHash, newTokenHash, desc)
+	var oldTokenExists bool
+	err = defaultStore.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_svc.email_tokens WHERE token_hash = $1)`,
+		oldTokenHash).Scan(&oldTokenExists)
+	assert.Nil(t, err, desc)
+	assert.False(t, oldTokenExists, desc)
+
+	desc = "test rate limited address"
+	defaultLimiter := resendEmailLimiter
+	resendEmailLimiter = newEmailRateLimiter(1, time.Hour)
+	s := Service{}
+	req := &pbsvc.UserRequest{User: &pblib.User{Email: unitTestEmailGenerator()}}
+	_, err = s.ResendVerificationEmail(context.TODO(), req)
+	assert.Nil(t, err, desc)
+	response, err := s.ResendVerificationEmail(context.TODO(), req)
+	assert.EqualError(t, err, status.Error(codes.ResourceExhausted, consts.ErrEmailRateLimited.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+	resendEmailLimiter = defaultLimiter
+}
+
+func TestLogout(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	user, identification, err := unitTestInsertVerifiedUser("Logout-One")
+	assert.Nil(t, err)
+
+	s := Service{}
+	cases := []struct {
+		desc   string
+		req    *pbsvc.UserRequest
+		expMsg string
+	}{
+		{"test nil request", nil, consts.ErrStatusNilRequestUser.Error()},
+		{"test nil identification", &pbsvc.UserRequest{},
+			status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error()).Error()},
+		{"test valid logout", &pbsvc.UserRequest{Identification: identification}, ""},
+		{"test revoked token", &pbsvc.UserRequest{Identification: identification},
+			status.Error(codes.Unauthenticated, consts.ErrAuthTokenRevoked.Error()).Error()},
+	}
+
+	for _, c := range cases {
+		response, err := s.Logout(context.TODO(), c.req)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, codes.OK.String(), response.GetMessage(), c.desc)
+		}
+	}
+
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, status.Error(codes.Unauthenticated, consts.ErrAuthTokenRevoked.Error()).Error())
+	_, err = s.GetNewAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+	assert.NotNil(t, err)
+
+	// logging in again within the same second does not bring the revoked token back
+	response, err := s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{
+		Email: user.GetEmail(), Password: unitTestPassword("Logout-One")}})
+	assert.Nil(t, err)
+	assert.NotEqual(t, identification.GetToken(), response.GetIdentification().GetToken())
+}
+
+func TestLogoutAll(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	_, adminIdentification, err := unitTestInsertAdmin("LogoutAll-Admin")
+	assert.Nil(t, err)
+	user, userIdentification, err := unitTestInsertVerifiedUser("LogoutAll-User")
+	assert.Nil(t, err)
+	otherUUID, err := generateUUID()
+	assert.Nil(t, err)
+
+	s := Service{}
+	cases := []struct {
+		desc    string
+		req     *pbsvc.UserRequest
+		expUUID string
+		expMsg  string
+	}{
+		{"test nil request", nil, "", consts.ErrStatusNilRequestUser.Error()},
+		{"test invalid uuid", &pbsvc.UserRequest{User: &pblib.User{Uuid: unitTestFailValue},
+			Identification: adminIdentification}, "", consts.ErrStatusUUIDInvalid.Error()},
+		{"test other user", &pbsvc.UserRequest{User: &pblib.User{Uuid: otherUUID},
+			Identification: userIdentification}, "",
+			"rpc error: code = PermissionDenied desc = unauthorized permission"},
+		{"test admin logs out user", &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+			Identification: adminIdentification}, user.GetUuid(), ""},
+		{"test revoked token", &pbsvc.UserRequest{Identification: userIdentification}, "",
+			status.Error(codes.Unauthenticated, consts.ErrAuthTokenRevoked.Error()).Error()},
+	}
+
+	for _, c := range cases {
+		response, err := s.LogoutAll(context.TODO(), c.req)
+		if c.expMsg != "" {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, response, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expUUID, response.GetUser().GetUuid(), c.desc)
+		}
+	}
+}
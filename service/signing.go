@@ -0,0 +1,430 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signingAlgorithmHMAC signs with the shared secret_key, RS256 and EdDSA sign with the private key of a key pair
+	signingAlgorithmHMAC  = "HMAC"
+	signingAlgorithmRS256 = "RS256"
+	signingAlgorithmEdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+
+	// signingKeyIDByteSize is the random bytes of a kid, the secret_key of key pairs
+	signingKeyIDByteSize = 16
+
+	// GetSigningKeys returns the JWKS in the header metadata b/c UserResponse has no field for it
+	signingKeysKey = "signing-keys"
+)
+
+var (
+	// signingKeys caches the parsed secrets by secret_key, rows are never updated,
+	// VerifyAuthToken verifies tokens from it while the store is unreachable
+	signingKeys sync.Map
+
+	// tokenEncoding is the base64 of asymmetric token segments and JWKS values, RFC 7515 omits padding
+	tokenEncoding = base64.RawURLEncoding
+)
+
+// signingKey is a parsed row of user_security.secrets.
+// publicKey and privateKey are nil for HMAC.
+type signingKey struct {
+	key        string
+	algorithm  string
+	publicKey  crypto.PublicKey
+	privateKey crypto.Signer
+}
+
+// asymmetricHeader is the JOSE header of tokens signed with a key pair, kid names the key verifying it
+type asymmetricHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// asymmetricBody keeps the auth.Body fields other services already read, ie auth.ExtractUUID,
+// alongside the registered claims JWT libraries check.
+type asymmetricBody struct {
+	auth.Body
+	Subject    string `json:"sub"`
+	Expiration int64  `json:"exp"`
+}
+
+// jsonWebKey is a public key of GetSigningKeys, RFC 7517 and RFC 8037
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func init() {
+	switch conf.TokenSigning.Algorithm {
+	case signingAlgorithmHMAC, signingAlgorithmRS256, signingAlgorithmEdDSA:
+	default:
+		logger.Fatal(consts.UserServiceTag, "Failed to initialize token signing:",
+			consts.ErrInvalidSigningAlgorithm.Error())
+	}
+}
+
+// encryptPrivateKey seals the PKCS #8 der in an envelope, bound to the hash of kid keying its row,
+// so it can not be moved to another key.
+// Returns consts.ErrMasterKeyNotConfigured if there is no master key.
+func encryptPrivateKey(kid string, der []byte) (*envelope, error) {
+	return sealEnvelope(der, []byte(hashToken(kid)))
+}
+
+// decryptPrivateKey opens a private key sealed by encryptPrivateKey for kid.
+// Returns consts.ErrUnknownMasterKey if its master key is not configured, or error if sealed was not sealed for kid.
+func decryptPrivateKey(kid string, sealed *envelope) (crypto.Signer, error) {
+	der, err := openEnvelope(sealed, []byte(hashToken(kid)))
+	if err == consts.ErrInvalidCiphertext {
+		return nil, consts.ErrInvalidPrivateKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, consts.ErrInvalidPrivateKey
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, consts.ErrInvalidPrivateKey
+	}
+
+	return signer, nil
+}
+
+// newSigningKeyRow generates a secret of algorithm expiring in authSecretExpirationTime days,
+// a random secret_key for HMAC, else a key pair keyed by a random kid.
+// Returns error if algorithm is unknown, or a private key can not be encrypted.
+func newSigningKeyRow(algorithm string) (*signingKeyRow, error) {
+	createdTimestamp := time.Now().UTC()
+	expirationTimestamp, err := auth.GenerateExpirationTimestamp(createdTimestamp, authSecretExpirationTime)
+	if err != nil {
+		return nil, err
+	}
+
+	row := &signingKeyRow{
+		algorithm:           algorithm,
+		createdTimestamp:    createdTimestamp.Unix(),
+		expirationTimestamp: expirationTimestamp.Unix(),
+	}
+
+	var publicKey crypto.PublicKey
+	var privateKey crypto.Signer
+	switch algorithm {
+	case signingAlgorithmHMAC:
+		row.key, err = auth.GenerateSecretKey(auth.SecretByteSize)
+		return row, err
+	case signingAlgorithmRS256:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, privateKey = rsaKey.Public(), rsaKey
+	case signingAlgorithmEdDSA:
+		edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, privateKey = edPublicKey, edPrivateKey
+	default:
+		return nil, consts.ErrInvalidSigningAlgorithm
+	}
+
+	row.key, err = auth.GenerateSecretKey(signingKeyIDByteSize)
+	if err != nil {
+		return nil, err
+	}
+
+	row.publicKey, err = x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	row.privateKey, err = encryptPrivateKey(row.key, der)
+	if err != nil {
+		return nil, err
+	}
+
+	return row, nil
+}
+
+// parseSigningKeyRow parses the keys of row, the private key is left nil if row has none.
+// Returns error if the keys of row are malformed.
+func parseSigningKeyRow(row *signingKeyRow) (*signingKey, error) {
+	key := &signingKey{
+		key:       row.key,
+		algorithm: row.algorithm,
+	}
+	if row.algorithm == signingAlgorithmHMAC {
+		return key, nil
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(row.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	key.publicKey = publicKey
+
+	if row.privateKey == nil {
+		return key, nil
+	}
+
+	key.privateKey, err = decryptPrivateKey(row.key, row.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// loadSigningKey returns the cached secret of secretKey, else parses and caches its row.
+// Returns consts.ErrSigningKeyNotFound if there is no such secret, or any db or parse error.
+func loadSigningKey(tx UserTx, secretKey string) (*signingKey, error) {
+	if cached, ok := signingKeys.Load(secretKey); ok {
+		return cached.(*signingKey), nil
+	}
+
+	row, err := tx.getSigningKeyRow(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseSigningKeyRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKeys.Store(secretKey, key)
+	return key, nil
+}
+
+// signAuthToken signs header and body with secret, with the HMAC of auth.NewToken,
+// or the private key of the key pair secret names.
+// Returns the token, or error if the secret is unknown, invalid, or its private key can not be opened.
+func signAuthToken(tx UserTx, header *auth.Header, body *auth.Body, secret *pblib.Secret) (string, error) {
+	if err := auth.ValidateSecret(secret); err != nil {
+		return "", err
+	}
+
+	key, err := loadSigningKey(tx, secret.GetKey())
+	if err != nil {
+		return "", err
+	}
+	if key.algorithm == signingAlgorithmHMAC {
+		return auth.NewToken(header, body, secret)
+	}
+
+	if err := auth.ValidateHeader(header); err != nil {
+		return "", err
+	}
+	if err := auth.ValidateBody(body); err != nil {
+		return "", err
+	}
+	if key.privateKey == nil {
+		return "", consts.ErrInvalidPrivateKey
+	}
+
+	encodedHeader, err := encodeTokenSegment(asymmetricHeader{
+		Alg: key.algorithm,
+		Typ: auth.TokenTypeStringMap[header.TokenTyp],
+		Kid: key.key,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encodedBody, err := encodeTokenSegment(asymmetricBody{
+		Body:       *body,
+		Subject:    body.UUID,
+		Expiration: body.ExpirationTimestamp,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodedHeader + "." + encodedBody
+	signature, err := signTokenInput(key, signingInput)
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + tokenEncoding.EncodeToString(signature), nil
+}
+
+// encodeTokenSegment returns the base64 of the json of segment.
+func encodeTokenSegment(segment interface{}) (string, error) {
+	encoded, err := json.Marshal(segment)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenEncoding.EncodeToString(encoded), nil
+}
+
+// signTokenInput signs signingInput with the private key of key.
+func signTokenInput(key *signingKey, signingInput string) ([]byte, error) {
+	if key.algorithm == signingAlgorithmEdDSA {
+		return key.privateKey.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256([]byte(signingInput))
+	return key.privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// verifyTokenSignature checks signature of signingInput against the public key of key.
+func verifyTokenSignature(key *signingKey, signingInput string, signature []byte) bool {
+	switch publicKey := key.publicKey.(type) {
+	case ed25519.PublicKey:
+		return key.algorithm == signingAlgorithmEdDSA && ed25519.Verify(publicKey, []byte(signingInput), signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		return key.algorithm == signingAlgorithmRS256 &&
+			rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+
+	return false
+}
+
+// authorizeAuthToken checks that the token of identity is signed by its secret, unexpired,
+// and carries at least the required permission. The secret must be cached by loadSigningKey,
+// its algorithm, not the one the token claims, picks how the token is verified.
+// Returns the token header and body, with the header HMAC algorithm of the permission for key pairs,
+// or authconst.ErrInvalidPermission if the token is valid but lacks permission.
+func authorizeAuthToken(identity *pblib.Identification, permission auth.Permission) (*auth.Header, *auth.Body, error) {
+	if err := auth.ValidateIdentification(identity); err != nil {
+		return nil, nil, err
+	}
+
+	cached, ok := signingKeys.Load(identity.GetSecret().GetKey())
+	if !ok {
+		return nil, nil, consts.ErrSigningKeyNotFound
+	}
+	key := cached.(*signingKey)
+
+	if key.algorithm == signingAlgorithmHMAC {
+		authority := auth.NewAuthority(auth.Jwt, permission)
+		// invalidate authority for security reasons
+		defer authority.Invalidate()
+
+		if err := authority.Authorize(identity); err != nil {
+			return nil, nil, err
+		}
+
+		return authority.Header(), authority.Body(), nil
+	}
+
+	if err := auth.ValidateSecret(identity.GetSecret()); err != nil {
+		return nil, nil, err
+	}
+
+	segments := strings.Split(identity.GetToken(), ".")
+	if len(segments) != 3 {
+		return nil, nil, authconst.ErrIncompleteToken
+	}
+
+	var header asymmetricHeader
+	if err := decodeTokenSegment(segments[0], &header); err != nil {
+		return nil, nil, err
+	}
+	if header.Alg != key.algorithm || header.Kid != key.key {
+		return nil, nil, authconst.ErrInvalidSignature
+	}
+	if header.Typ != auth.TokenTypeStringMap[auth.Jwt] {
+		return nil, nil, authconst.ErrInvalidRequiredTokenType
+	}
+
+	signature, err := tokenEncoding.DecodeString(segments[2])
+	if err != nil || !verifyTokenSignature(key, segments[0]+"."+segments[1], signature) {
+		return nil, nil, authconst.ErrInvalidSignature
+	}
+
+	var body asymmetricBody
+	if err := decodeTokenSegment(segments[1], &body); err != nil {
+		return nil, nil, err
+	}
+	if err := auth.ValidateBody(&body.Body); err != nil {
+		return nil, nil, err
+	}
+	if body.Permission < permission {
+		return nil, nil, authconst.ErrInvalidPermission
+	}
+
+	return &auth.Header{
+		Alg:      auth.AlgorithmMap[body.Permission],
+		TokenTyp: auth.Jwt,
+	}, &body.Body, nil
+}
+
+// decodeTokenSegment parses the json of the base64 segment into v.
+func decodeTokenSegment(segment string, v interface{}) error {
+	decoded, err := tokenEncoding.DecodeString(segment)
+	if err != nil {
+		return authconst.ErrIncompleteToken
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// newJSONWebKey returns the public key of row as a JWK.
+// Returns error if row is HMAC or its public key is malformed.
+func newJSONWebKey(row *signingKeyRow) (*jsonWebKey, error) {
+	publicKey, err := x509.ParsePKIXPublicKey(row.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := &jsonWebKey{
+		Kid: row.key,
+		Alg: row.algorithm,
+		Use: "sig",
+	}
+
+	switch publicKey := publicKey.(type) {
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = tokenEncoding.EncodeToString(publicKey)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = tokenEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = tokenEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	default:
+		return nil, consts.ErrInvalidSigningAlgorithm
+	}
+
+	return jwk, nil
+}
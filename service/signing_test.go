@@ -0,0 +1,220 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unitTestSigningKey generates and caches a secret of algorithm.
+func unitTestSigningKey(t *testing.T, algorithm string) *pblib.Secret {
+	row, err := newSigningKeyRow(algorithm)
+	assert.Nil(t, err)
+
+	key, err := parseSigningKeyRow(row)
+	assert.Nil(t, err)
+	signingKeys.Store(row.key, key)
+
+	return &pblib.Secret{
+		Key:                 row.key,
+		CreatedTimestamp:    row.createdTimestamp - 1,
+		ExpirationTimestamp: row.expirationTimestamp,
+	}
+}
+
+func TestNewSigningKeyRow(t *testing.T) {
+	cases := []struct {
+		desc      string
+		algorithm string
+		isKeyPair bool
+		expErr    error
+	}{
+		{"test HMAC", signingAlgorithmHMAC, false, nil},
+		{"test RS256", signingAlgorithmRS256, true, nil},
+		{"test EdDSA", signingAlgorithmEdDSA, true, nil},
+		{"test unknown algorithm", "ES256", false, consts.ErrInvalidSigningAlgorithm},
+	}
+
+	for _, c := range cases {
+		row, err := newSigningKeyRow(c.algorithm)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if err != nil {
+			continue
+		}
+
+		assert.NotEmpty(t, row.key, c.desc)
+		assert.Equal(t, c.isKeyPair, row.publicKey != nil, c.desc)
+		assert.Equal(t, c.isKeyPair, row.privateKey != nil, c.desc)
+		if !c.isKeyPair {
+			continue
+		}
+
+		assert.Equal(t, masterKeyID, row.privateKey.masterKeyID, c.desc)
+
+		key, err := parseSigningKeyRow(row)
+		assert.Nil(t, err, c.desc)
+		assert.NotNil(t, key.privateKey, c.desc)
+
+		// the private key is bound to its kid
+		_, err = decryptPrivateKey("another kid", row.privateKey)
+		assert.Equal(t, consts.ErrInvalidPrivateKey, err, c.desc)
+	}
+}
+
+func TestAuthorizeAuthToken(t *testing.T) {
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+
+	for _, algorithm := range []string{signingAlgorithmHMAC, signingAlgorithmRS256, signingAlgorithmEdDSA} {
+		secret := unitTestSigningKey(t, algorithm)
+		otherSecret := unitTestSigningKey(t, algorithm)
+
+		header := &auth.Header{Alg: auth.AlgorithmMap[auth.User], TokenTyp: auth.Jwt}
+		body := &auth.Body{
+			UUID:                uuid,
+			Permission:          auth.User,
+			ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+		}
+		token, err := signAuthToken(nil, header, body, secret)
+		assert.Nil(t, err, algorithm)
+		assert.Equal(t, uuid, auth.ExtractUUID(token), algorithm)
+
+		expiredBody := &auth.Body{UUID: uuid, Permission: auth.User, ExpirationTimestamp: time.Now().Add(-time.Hour).Unix()}
+		_, err = signAuthToken(nil, header, expiredBody, secret)
+		assert.Equal(t, authconst.ErrExpiredBody, err, algorithm)
+
+		segments := strings.Split(token, ".")
+		tampered := segments[0] + "." + segments[1] + "." + tokenEncoding.EncodeToString([]byte("signature"))
+		expiredSecret := &pblib.Secret{Key: secret.GetKey(), CreatedTimestamp: secret.GetCreatedTimestamp(),
+			ExpirationTimestamp: time.Now().Add(-time.Minute).Unix()}
+
+		cases := []struct {
+			desc       string
+			identity   *pblib.Identification
+			permission auth.Permission
+			expErr     error
+		}{
+			{"test valid token", &pblib.Identification{Token: token, Secret: secret}, auth.User, nil},
+			{"test lacking permission", &pblib.Identification{Token: token, Secret: secret}, auth.Admin,
+				authconst.ErrInvalidPermission},
+			{"test other secret", &pblib.Identification{Token: token, Secret: otherSecret}, auth.User,
+				authconst.ErrInvalidSignature},
+			{"test tampered signature", &pblib.Identification{Token: tampered, Secret: secret}, auth.User,
+				authconst.ErrInvalidSignature},
+			{"test incomplete token", &pblib.Identification{Token: segments[0] + "." + segments[1], Secret: secret},
+				auth.User, authconst.ErrIncompleteToken},
+			{"test expired secret", &pblib.Identification{Token: token, Secret: expiredSecret}, auth.User,
+				authconst.ErrExpiredSecret},
+			{"test unknown secret", &pblib.Identification{Token: token, Secret: &pblib.Secret{Key: "unknown",
+				CreatedTimestamp: secret.GetCreatedTimestamp(), ExpirationTimestamp: secret.GetExpirationTimestamp()}},
+				auth.User, consts.ErrSigningKeyNotFound},
+		}
+
+		for _, c := range cases {
+			desc := algorithm + " " + c.desc
+			retrievedHeader, retrievedBody, err := authorizeAuthToken(c.identity, c.permission)
+			assert.Equal(t, c.expErr, err, desc)
+			if c.expErr == nil {
+				assert.Equal(t, header, retrievedHeader, desc)
+				assert.Equal(t, body, retrievedBody, desc)
+			}
+		}
+	}
+}
+
+func TestAuthorizeAuthTokenAlgorithmConfusion(t *testing.T) {
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+
+	// the kid of a key pair is public, an HMAC token keyed with it must not verify
+	secret := unitTestSigningKey(t, signingAlgorithmEdDSA)
+	header := &auth.Header{Alg: auth.AlgorithmMap[auth.User], TokenTyp: auth.Jwt}
+	body := &auth.Body{UUID: uuid, Permission: auth.User, ExpirationTimestamp: time.Now().Add(time.Hour).Unix()}
+	token, err := auth.NewToken(header, body, secret)
+	assert.Nil(t, err)
+
+	_, _, err = authorizeAuthToken(&pblib.Identification{Token: token, Secret: secret}, auth.User)
+	assert.NotNil(t, err)
+}
+
+func TestMemoryStoreSigningKeys(t *testing.T) {
+	defer func() { conf.TokenSigning.Algorithm = signingAlgorithmHMAC }()
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreSigningKeys-One", auth.User)
+
+	// no key pairs while signing with HMAC
+	stream := &unitTestHeaderStream{}
+	_, err := s.GetSigningKeys(grpc.NewContextWithServerTransportStream(context.TODO(), stream), &pbsvc.UserRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`{"keys":[]}`}, stream.header.Get(signingKeysKey))
+
+	var kids []string
+	for _, algorithm := range []string{signingAlgorithmRS256, signingAlgorithmEdDSA} {
+		conf.TokenSigning.Algorithm = algorithm
+		err = unitTestMakeAuthSecret(store)
+		assert.Nil(t, err, algorithm)
+		kids = append([]string{currAuthSecret.GetKey()}, kids...)
+
+		// revoke the token signed with the previous secret so a new one is signed
+		err = store.WithTx(context.TODO(), func(tx UserTx) error {
+			return tx.revokeAuthTokens(user.GetUuid())
+		})
+		assert.Nil(t, err, algorithm)
+
+		response, err := s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+			User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+		})
+		assert.Nil(t, err, algorithm)
+		identification := response.GetIdentification()
+		assert.Equal(t, currAuthSecret.GetKey(), identification.GetSecret().GetKey(), algorithm)
+
+		var header asymmetricHeader
+		assert.Nil(t, decodeTokenSegment(strings.Split(identification.GetToken(), ".")[0], &header), algorithm)
+		assert.Equal(t, asymmetricHeader{Alg: algorithm, Typ: "JWT", Kid: currAuthSecret.GetKey()}, header)
+
+		_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+		assert.Nil(t, err, algorithm)
+
+		response, err = s.GetNewAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: identification})
+		assert.Nil(t, err, algorithm)
+		assert.NotEqual(t, identification.GetToken(), response.GetIdentification().GetToken(), algorithm)
+	}
+
+	// the active key first, followed by the previous key
+	stream = &unitTestHeaderStream{}
+	_, err = s.GetSigningKeys(grpc.NewContextWithServerTransportStream(context.TODO(), stream), &pbsvc.UserRequest{})
+	assert.Nil(t, err)
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(stream.header.Get(signingKeysKey)[0]), &jwks))
+	assert.Equal(t, 2, len(jwks.Keys))
+	if len(jwks.Keys) != 2 {
+		return
+	}
+	assert.Equal(t, kids, []string{jwks.Keys[0].Kid, jwks.Keys[1].Kid})
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "Ed25519", jwks.Keys[0].Crv)
+	assert.Equal(t, "RSA", jwks.Keys[1].Kty)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+
+	// the published key verifies the tokens of its kid
+	segments := strings.Split(unitTestLogin(t, s, user).GetToken(), ".")
+	publicKey, err := tokenEncoding.DecodeString(jwks.Keys[0].X)
+	assert.Nil(t, err)
+	signature, err := tokenEncoding.DecodeString(segments[2])
+	assert.Nil(t, err)
+	assert.True(t, ed25519.Verify(publicKey, []byte(segments[0]+"."+segments[1]), signature))
+}
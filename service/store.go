@@ -0,0 +1,128 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"time"
+)
+
+const (
+	// StoreBackendPostgres keeps data in the postgres db configured by conf.UserDB
+	StoreBackendPostgres = "postgres"
+
+	// StoreBackendMemory keeps data in memory, for tests and local development without postgres
+	StoreBackendMemory = "memory"
+)
+
+// UserStore is the data access layer of the service.
+type UserStore interface {
+	// Ping verifies the store is reachable, reconnecting if necessary.
+	Ping(ctx context.Context) error
+
+	// WithTx runs fn in one transaction that is committed if fn returns nil, else rolled back.
+	// Returns fn's error, or any error beginning or committing the transaction.
+	WithTx(ctx context.Context, fn func(tx UserTx) error) error
+
+	// WatchActiveSecret calls onChange once the active secret may have changed in another replica,
+	// ie whenever a new secret is committed, and once watching (re)starts b/c changes may have been missed.
+	// Blocks until ctx is done, returns error if watching could not start.
+	WatchActiveSecret(ctx context.Context, onChange func()) error
+
+	// Close releases the resources of the store, called once no transaction is running.
+	Close() error
+}
+
+// UserTx is the data access available inside one UserStore transaction.
+// Every method validates its params, and returns the same consts errors regardless of the store.
+type UserTx interface {
+	// locks, held by every replica until the transaction ends
+	lockUUID(uuid string) error
+	lockUUIDShared(uuid string) error
+
+	// accounts
+	insertNewUser(user *pblib.User) error
+	deleteUserRow(uuid string) error
+	getUserRow(uuid string) (*pblib.User, error)
+	getUserRowByEmail(email string) (*pblib.User, error)
+	getUserRowByProspectiveEmail(email string) (*pblib.User, error)
+	updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (*pblib.User, *pblib.Identification, error)
+	updatePermissionLevel(uuid string, permissionLevel string) error
+	countAdmins() (int, error)
+	matchEmailAndPassword(email string, password string) (*pblib.User, error)
+	isEmailTaken(prospectiveEmail string) (bool, error)
+	swapProspectiveEmailRow(uuid string) (string, error)
+	resetPasswordRow(uuid string, hashedPassword string) error
+	listUserRows(query *listUsersQuery) ([]*pblib.User, *listUsersCursor, error)
+
+	// email tokens
+	insertEmailToken(uuid string, token string, secret *pblib.Secret, purpose string) error
+	getEmailTokenRow(token string) (*tokenEmailRow, error)
+	deleteEmailTokenRow(uuid string, purpose string) error
+
+	// secrets and auth tokens
+	getActiveSecretRow() (*pblib.Secret, error)
+	insertNewAuthSecret() error
+	getLatestSecret(seconds int) (string, error)
+	hasActiveAuthSecret() (bool, error)
+	getSigningKeyRow(secretKey string) (*signingKeyRow, error)
+	listSigningKeys() ([]*signingKeyRow, error)
+	insertAuthToken(token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error
+	getAuthTokenRow(uuid string) (*tokenAuthRow, error)
+	pairTokenWithSecret(token string) (*pblib.Identification, error)
+	revokeAuthToken(token string) error
+	revokeAuthTokens(uuid string) error
+
+	// master key rotation
+	listStaleDataKeys(masterKeyID string, limit int) ([]*dataKeyRow, error)
+	updateDataKey(row *dataKeyRow) error
+
+	// refresh tokens
+	insertRefreshToken(tokenHash string, familyID string, uuid string, expirationTimestamp time.Time) error
+	getRefreshTokenRow(tokenHash string) (*refreshTokenRow, error)
+	useRefreshToken(tokenHash string) (bool, error)
+	deleteRefreshTokenFamily(familyID string) error
+
+	// two-factor authentication
+	insertTOTPSecret(uuid string, sealedSecret *envelope) error
+	getTOTPRow(uuid string) (*totpRow, error)
+	confirmTOTP(uuid string, step int64, recoveryCodeHashes []string) error
+	useTOTPStep(uuid string, step int64) (bool, error)
+	useTOTPRecoveryCode(uuid string, codeHash string) (bool, error)
+	deleteTOTP(uuid string) error
+
+	// roles
+	getRolePermissions(role string) ([]string, error)
+	listRoleGrants(uuid string) ([]*roleGrant, error)
+	insertRoleGrant(grant *roleGrant) error
+	deleteRoleGrant(uuid string, role string, organization string) error
+
+	// suspensions
+	getSuspensionRow(uuid string) (*suspensionRow, error)
+	insertSuspension(row *suspensionRow) error
+	deleteSuspension(uuid string) error
+
+	// documents
+	insertDocumentRow(duid string, uuid string, isPublic bool) error
+	getDocumentRow(duid string) (*documentRow, error)
+	updateDocumentIsPublic(duid string, isPublic bool) error
+	getOwnedDocuments(uuid string) (map[string]*pblib.UserDocumentMetadata, error)
+	insertSharedDocumentRows(duid string, uuids []string) error
+	deleteSharedDocumentRows(duid string, uuids []string) error
+	getSharedDocumentUUIDs(duid string) ([]string, error)
+	getDocumentsSharedToUUID(uuid string) (map[string]*pblib.UserFriendMetadata, error)
+}
+
+// NewStore returns the UserStore of backend, StoreBackendPostgres shares one connection pool.
+// Returns error if backend is unknown.
+func NewStore(backend string) (UserStore, error) {
+	switch backend {
+	case StoreBackendPostgres:
+		return defaultStore, nil
+	case StoreBackendMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, consts.ErrInvalidStoreBackend
+	}
+}
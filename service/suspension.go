@@ -0,0 +1,60 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+const (
+	// SuspendUser reads the reason and optional duration of the suspension from the incoming metadata
+	suspensionReasonKey    = "suspension-reason"
+	suspensionExpiresInKey = "suspension-expires-in"
+
+	maxSuspensionReasonLength = 512
+)
+
+// newSuspensionRow reads the suspension of uuid by suspendedBy requested by SuspendUser from md.
+// The expiry is relative to now, a suspension without one lasts until the user is reactivated.
+// Returns error if the reason is missing or too long, or the expiry is not positive seconds.
+func newSuspensionRow(md metadata.MD, uuid string, suspendedBy string, now time.Time) (*suspensionRow, error) {
+	reason := getMetadataValue(md, suspensionReasonKey)
+	if reason == "" || len(reason) > maxSuspensionReasonLength {
+		return nil, consts.ErrInvalidSuspensionReason
+	}
+
+	var suspendedUntil time.Time
+	if value := getMetadataValue(md, suspensionExpiresInKey); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, consts.ErrInvalidSuspensionExpiry
+		}
+		suspendedUntil = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	return &suspensionRow{
+		uuid:               uuid,
+		reason:             reason,
+		suspendedBy:        suspendedBy,
+		suspendedTimestamp: now,
+		suspendedUntil:     suspendedUntil,
+	}, nil
+}
+
+// checkSuspension returns status error PermissionDenied if uuid is suspended.
+// A suspension past its suspended until no longer counts, so users are reactivated without a write.
+// Returns status error Internal for any store error.
+func checkSuspension(tx UserTx, uuid string) error {
+	row, err := tx.getSuspensionRow(uuid)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if row != nil {
+		return consts.ErrStatusUserSuspended
+	}
+
+	return nil
+}
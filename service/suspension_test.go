@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSuspensionRow(t *testing.T) {
+	now := time.Unix(1500000000, 0).UTC()
+
+	cases := []struct {
+		desc       string
+		md         metadata.MD
+		expErr     error
+		expReason  string
+		expExpires time.Time
+	}{
+		{"test nil metadata", nil, consts.ErrInvalidSuspensionReason, "", time.Time{}},
+		{"test missing reason", metadata.Pairs(suspensionExpiresInKey, "60"), consts.ErrInvalidSuspensionReason,
+			"", time.Time{},
+		},
+		{"test long reason", metadata.Pairs(suspensionReasonKey, strings.Repeat("a", maxSuspensionReasonLength+1)),
+			consts.ErrInvalidSuspensionReason, "", time.Time{},
+		},
+		{"test invalid expiry", metadata.Pairs(suspensionReasonKey, "spam", suspensionExpiresInKey, "soon"),
+			consts.ErrInvalidSuspensionExpiry, "", time.Time{},
+		},
+		{"test negative expiry", metadata.Pairs(suspensionReasonKey, "spam", suspensionExpiresInKey, "-60"),
+			consts.ErrInvalidSuspensionExpiry, "", time.Time{},
+		},
+		{"test until reactivated", metadata.Pairs(suspensionReasonKey, "spam"), nil, "spam", time.Time{}},
+		{"test expiring", metadata.Pairs(suspensionReasonKey, "spam", suspensionExpiresInKey, "60"), nil,
+			"spam", now.Add(time.Minute),
+		},
+	}
+
+	for _, c := range cases {
+		row, err := newSuspensionRow(c.md, "uuid", "admin", now)
+		if c.expErr != nil {
+			assert.Equal(t, c.expErr, err, c.desc)
+			assert.Nil(t, row, c.desc)
+			continue
+		}
+
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, &suspensionRow{uuid: "uuid", reason: c.expReason, suspendedBy: "admin",
+			suspendedTimestamp: now, suspendedUntil: c.expExpires}, row, c.desc)
+	}
+}
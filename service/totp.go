@@ -0,0 +1,208 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// RFC 6238 defaults, the only parameters every authenticator app supports
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+
+	// codes of the previous and next period are accepted for clock drift
+	totpSkewSteps = 1
+
+	// totpSecretLength is the RFC 4226 recommended 160 bits
+	totpSecretLength = 20
+
+	totpRecoveryCodeCount  = 10
+	totpRecoveryCodeLength = 10
+
+	// EnrollTOTP and ConfirmTOTP return the secret and recovery codes in the header metadata,
+	// AuthenticateUser reads the code from the incoming metadata b/c UserRequest has no fields for them
+	totpSecretKey        = "totp-secret"
+	totpURIKey           = "totp-uri"
+	totpRecoveryCodesKey = "totp-recovery-codes"
+	totpCodeKey          = "totp-code"
+	totpRecoveryCodeKey  = "totp-recovery-code"
+)
+
+// totpEncoding is the base32 of secrets in otpauth:// URIs and recovery codes
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random TOTP secret.
+func generateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// encryptTOTPSecret seals secret in an envelope, bound to uuid so it can not be moved to another user.
+// Returns consts.ErrMasterKeyNotConfigured if there is no master key.
+func encryptTOTPSecret(uuid string, secret []byte) (*envelope, error) {
+	return sealEnvelope(secret, []byte(uuid))
+}
+
+// decryptTOTPSecret opens a secret sealed by encryptTOTPSecret for uuid.
+// Returns error if the master key of sealed is not configured, or sealed was not sealed for uuid.
+func decryptTOTPSecret(uuid string, sealed *envelope) ([]byte, error) {
+	secret, err := openEnvelope(sealed, []byte(uuid))
+	if err == consts.ErrInvalidCiphertext {
+		return nil, consts.ErrInvalidTOTPSecret
+	}
+
+	return secret, err
+}
+
+// newTOTPURI returns the otpauth:// URI authenticator apps enroll secret from, usually shown as a QR code.
+func newTOTPURI(account string, secret []byte) string {
+	label := url.PathEscape(conf.TOTP.Issuer + ":" + account)
+
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", conf.TOTP.Issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpStep returns the RFC 6238 time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode returns the RFC 4226 HOTP code of secret for step, zero padded to totpDigits.
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// matchTOTPCode compares code against the codes of secret around now, allowing totpSkewSteps of clock drift.
+// Returns the step of the matched code, and false if none matched.
+func matchTOTPCode(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// generateRecoveryCodes returns totpRecoveryCodeCount new recovery codes formatted as "xxxxx-xxxxx",
+// and the hashes stored in their place.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, totpRecoveryCodeCount)
+	hashes := make([]string, 0, totpRecoveryCodeCount)
+
+	for i := 0; i < totpRecoveryCodeCount; i++ {
+		random := make([]byte, totpRecoveryCodeLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(random))[:totpRecoveryCodeLength]
+		code = code[:totpRecoveryCodeLength/2] + "-" + code[totpRecoveryCodeLength/2:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the SHA-256 of code ignoring case, dashes and spaces,
+// a fast hash is enough b/c recovery codes are random with 50 bits of entropy.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor checks the TOTP code, or else the recovery code, of a user enrolled in two-factor authentication.
+// A code is accepted once, a recovery code is deleted once used.
+// Returns nil if uuid is not enrolled or the code is accepted,
+// consts.ErrStatusTOTPRequired if both codes are empty, consts.ErrStatusInvalidTOTPCode if the code is rejected.
+func verifySecondFactor(tx UserTx, uuid string, code string, recoveryCode string, now time.Time) error {
+	row, err := tx.getTOTPRow(uuid)
+	if err != nil {
+		return err
+	}
+	if row == nil || !row.isConfirmed {
+		return nil
+	}
+
+	if code == "" && recoveryCode == "" {
+		return consts.ErrStatusTOTPRequired
+	}
+
+	if code == "" {
+		used, err := tx.useTOTPRecoveryCode(uuid, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !used {
+			return consts.ErrStatusInvalidTOTPCode
+		}
+		return nil
+	}
+
+	secret, err := decryptTOTPSecret(uuid, &row.secret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := matchTOTPCode(secret, code, now)
+	if !ok {
+		return consts.ErrStatusInvalidTOTPCode
+	}
+
+	// a code can not be replayed, nor can an older one be used after it
+	used, err := tx.useTOTPStep(uuid, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return consts.ErrStatusInvalidTOTPCode
+	}
+
+	return nil
+}
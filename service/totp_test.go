@@ -0,0 +1,242 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unitTestHeaderStream collects the headers a handler sets with grpc.SetHeader
+type unitTestHeaderStream struct {
+	header metadata.MD
+}
+
+func (s *unitTestHeaderStream) Method() string { return "" }
+
+func (s *unitTestHeaderStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *unitTestHeaderStream) SendHeader(md metadata.MD) error { return nil }
+
+func (s *unitTestHeaderStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors of the SHA1 secret, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+
+	cases := []struct {
+		desc    string
+		unix    int64
+		expCode string
+	}{
+		{"test 59", 59, "287082"},
+		{"test 1111111109", 1111111109, "081804"},
+		{"test 1111111111", 1111111111, "050471"},
+		{"test 1234567890", 1234567890, "005924"},
+		{"test 2000000000", 2000000000, "279037"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expCode, totpCode(secret, totpStep(time.Unix(c.unix, 0))), c.desc)
+	}
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+
+	cases := []struct {
+		desc    string
+		code    string
+		expStep int64
+		expOK   bool
+	}{
+		{"test current", totpCode(secret, step), step, true},
+		{"test previous", totpCode(secret, step-1), step - 1, true},
+		{"test next", totpCode(secret, step+1), step + 1, true},
+		{"test spaces", " " + totpCode(secret, step) + " ", step, true},
+		{"test too old", totpCode(secret, step-2), 0, false},
+		{"test too new", totpCode(secret, step+2), 0, false},
+		{"test short", "12345", 0, false},
+		{"test empty", "", 0, false},
+	}
+
+	for _, c := range cases {
+		matched, ok := matchTOTPCode(secret, c.code, now)
+		assert.Equal(t, c.expOK, ok, c.desc)
+		assert.Equal(t, c.expStep, matched, c.desc)
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.Nil(t, err)
+	assert.Equal(t, totpSecretLength, len(secret))
+
+	sealed, err := encryptTOTPSecret("uuid-one", secret)
+	assert.Nil(t, err)
+	assert.Equal(t, masterKeyID, sealed.masterKeyID)
+	assert.NotContains(t, string(sealed.ciphertext), string(secret))
+
+	decrypted, err := decryptTOTPSecret("uuid-one", sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, secret, decrypted)
+
+	// a secret can not be moved to another user
+	_, err = decryptTOTPSecret("uuid-two", sealed)
+	assert.Equal(t, consts.ErrInvalidTOTPSecret, err)
+
+	truncated := *sealed
+	truncated.ciphertext = truncated.ciphertext[:4]
+	_, err = decryptTOTPSecret("uuid-one", &truncated)
+	assert.Equal(t, consts.ErrInvalidTOTPSecret, err)
+}
+
+func TestNewTOTPURI(t *testing.T) {
+	uri, err := url.Parse(newTOTPURI("hwsc@test.com", []byte("12345678901234567890")))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/"+conf.TOTP.Issuer+":hwsc@test.com", uri.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	assert.Equal(t, conf.TOTP.Issuer, uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Equal(t, totpRecoveryCodeCount, len(codes))
+	assert.Equal(t, totpRecoveryCodeCount, len(hashes))
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.Equal(t, totpRecoveryCodeLength+1, len(code))
+		assert.Equal(t, "-", code[totpRecoveryCodeLength/2:totpRecoveryCodeLength/2+1])
+		assert.Equal(t, hashes[i], hashRecoveryCode(code))
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+
+	// recovery codes are matched ignoring case, dashes and spaces
+	assert.Equal(t, hashRecoveryCode("abcde-fghij"), hashRecoveryCode(" ABCDE FGHIJ"))
+	assert.NotEqual(t, hashRecoveryCode("abcde-fghij"), hashRecoveryCode("abcde-fghik"))
+}
+
+func TestMemoryStoreTOTP(t *testing.T) {
+	defaultLoginAttempts := loginAttempts
+	loginAttempts = newLoginLimiter(conf.LoginLimitConfig{MaxEmailFailures: 100, MaxIPFailures: 100})
+	defer func() { loginAttempts = defaultLoginAttempts }()
+
+	s, store := unitTestMemoryService(t)
+	user := unitTestInsertMemoryUser(t, store, "MemoryStoreTOTP-User", auth.User)
+	admin := unitTestInsertMemoryUser(t, store, "MemoryStoreTOTP-Admin", auth.Admin)
+
+	login := func(md metadata.MD) (*pbsvc.UserResponse, error) {
+		return s.AuthenticateUser(metadata.NewIncomingContext(context.TODO(), md), &pbsvc.UserRequest{
+			User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+		})
+	}
+
+	response, err := login(nil)
+	assert.Nil(t, err)
+	userReq := &pbsvc.UserRequest{Identification: response.GetIdentification()}
+
+	// enroll, the secret is only required once confirmed
+	_, err = s.ConfirmTOTP(metadata.NewIncomingContext(context.TODO(), metadata.Pairs(totpCodeKey, "123456")),
+		userReq)
+	assert.Equal(t, status.Error(codes.FailedPrecondition, consts.ErrTOTPNotEnrolled.Error()), err)
+
+	stream := &unitTestHeaderStream{}
+	_, err = s.EnrollTOTP(grpc.NewContextWithServerTransportStream(context.TODO(), stream), userReq)
+	assert.Nil(t, err)
+	secret, err := totpEncoding.DecodeString(stream.header.Get(totpSecretKey)[0])
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(stream.header.Get(totpURIKey)[0], "otpauth://totp/"))
+
+	_, err = login(nil)
+	assert.Nil(t, err)
+
+	// confirm with the first code
+	now := time.Now()
+	cases := []struct {
+		desc   string
+		code   string
+		expErr error
+	}{
+		{"test missing code", "", status.Error(codes.InvalidArgument, consts.ErrTOTPRequired.Error())},
+		{"test wrong code", totpCode(secret, totpStep(now)-5), consts.ErrStatusInvalidTOTPCode},
+		{"test valid code", totpCode(secret, totpStep(now)), nil},
+		{"test already confirmed", totpCode(secret, totpStep(now)),
+			status.Error(codes.AlreadyExists, consts.ErrTOTPAlreadyEnrolled.Error())},
+	}
+
+	var recoveryCodes []string
+	for _, c := range cases {
+		stream := &unitTestHeaderStream{}
+		ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(totpCodeKey, c.code))
+		_, err := s.ConfirmTOTP(grpc.NewContextWithServerTransportStream(ctx, stream), userReq)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if c.expErr == nil {
+			recoveryCodes = stream.header.Get(totpRecoveryCodesKey)
+		}
+	}
+	assert.Equal(t, totpRecoveryCodeCount, len(recoveryCodes))
+
+	_, err = s.EnrollTOTP(context.TODO(), userReq)
+	assert.Equal(t, status.Error(codes.AlreadyExists, consts.ErrTOTPAlreadyEnrolled.Error()), err)
+
+	// logins need a code once confirmed, each code is accepted once
+	_, err = login(nil)
+	assert.Equal(t, consts.ErrStatusTOTPRequired, err)
+	_, err = login(metadata.Pairs(totpCodeKey, totpCode(secret, totpStep(now))))
+	assert.Equal(t, consts.ErrStatusInvalidTOTPCode, err)
+	_, err = login(metadata.Pairs(totpCodeKey, totpCode(secret, totpStep(now)+1)))
+	assert.Nil(t, err)
+
+	// or a recovery code, each used once
+	_, err = login(metadata.Pairs(totpRecoveryCodeKey, strings.ToUpper(recoveryCodes[0])))
+	assert.Nil(t, err)
+	_, err = login(metadata.Pairs(totpRecoveryCodeKey, recoveryCodes[0]))
+	assert.Equal(t, consts.ErrStatusInvalidTOTPCode, err)
+
+	// only admins reset
+	_, err = s.ResetTOTP(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()},
+		Identification: userReq.GetIdentification()})
+	assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = unauthorized permission")
+
+	adminReq := &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}, Identification: unitTestLogin(t, s, admin)}
+
+	_, err = s.ResetTOTP(context.TODO(), adminReq)
+	assert.Nil(t, err)
+	_, err = s.ResetTOTP(context.TODO(), adminReq)
+	assert.Equal(t, status.Error(codes.NotFound, consts.ErrTOTPNotEnrolled.Error()), err)
+
+	_, err = login(nil)
+	assert.Nil(t, err)
+
+	// a user deleted while their token is still valid is not found
+	err = store.WithTx(context.TODO(), func(tx UserTx) error {
+		return tx.deleteUserRow(user.GetUuid())
+	})
+	assert.Nil(t, err)
+	_, err = s.EnrollTOTP(context.TODO(), userReq)
+	assert.Equal(t, consts.ErrStatusUUIDNotFound, err)
+}
@@ -1,17 +1,28 @@
 package service
 
 import (
+	"container/list"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-lib/validation"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/oklog/ulid"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"io"
 	"math/rand"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,29 +31,284 @@ import (
 const (
 	maxFirstNameLength  = 32
 	maxLastNameLength   = 32
-	daysInOneWeek       = 7
 	domainName          = "localhost"
 	verifyEmailLinkStub = "verify-email?token"
+	resetPasswordStub   = "reset-password?token"
+
+	// verification emails can be resent at most resendVerificationEmailLimit times per address per window
+	resendVerificationEmailLimit  = 3
+	resendVerificationEmailWindow = time.Hour
+
+	// VerifyAuthToken caches this many verified tokens for degraded mode
+	maxCachedAuthTokens = 10000
+
+	// insertNewAuthToken moves the expiration of a token at most this many seconds to keep it unique
+	maxAuthTokenCollisions = 60
+
+	// emailRateLimiter sweeps every address once it tracks more than this many
+	maxRateLimitedAddresses = 10000
+
+	// password reset tokens are short lived b/c they grant access to the account
+	resetPasswordTokenLifetime = time.Hour
+	resetPasswordTokenByteSize = 32
+
+	// duid is a ksuid, https://github.com/segmentio/ksuid
+	duidLength = 27
+
+	defaultListUsersPageSize = 50
+	maxListUsersPageSize     = 200
+
+	listUsersSortByUUID             = "uuid"
+	listUsersSortByPermissionLevel  = "permission_level"
+	listUsersSortByIsVerified       = "is_verified"
+	listUsersSortByOrganization     = "organization"
+	listUsersSortByCreatedTimestamp = "created_timestamp"
+	listUsersSortOrderAsc           = "asc"
+	listUsersSortOrderDesc          = "desc"
+
+	// SetServiceState options are read from the incoming gRPC metadata b/c UserRequest has no fields for them,
+	// GetStatus and SetServiceState report the state in the header metadata with the same keys
+	serviceStateKey             = "service-state"
+	serviceStateReasonKey       = "service-state-reason"
+	serviceStateExpiresInKey    = "service-state-expires-in"
+	serviceStateExpiresAtKey    = "service-state-expires-at"
+	maxServiceStateReasonLength = 256
+
+	// ListUsers options are read from the incoming gRPC metadata b/c UserRequest has no fields for them
+	listUsersPermissionLevelKey = "permission-level"
+	listUsersIsVerifiedKey      = "is-verified"
+	listUsersOrganizationKey    = "organization"
+	listUsersCreatedAfterKey    = "created-after"
+	listUsersCreatedBeforeKey   = "created-before"
+	listUsersSortByKey          = "sort-by"
+	listUsersSortOrderKey       = "sort-order"
+	listUsersPageSizeKey        = "page-size"
+	listUsersCursorKey          = "cursor"
+	listUsersNextCursorKey      = "next-cursor"
 )
 
+// authTokenCache keeps the most recently verified auth tokens paired with their secret,
+// so VerifyAuthToken keeps serving while the store is unreachable
+type authTokenCache struct {
+	lock     sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+// authTokenCacheEntry is an element of authTokenCache.order, front is the most recently verified
+type authTokenCacheEntry struct {
+	uuid     string
+	identity *pblib.Identification
+}
+
+// emailRateLimiter limits how many emails are sent to an address within a sliding window
+type emailRateLimiter struct {
+	lock   sync.Mutex
+	limit  int
+	window time.Duration
+	sentAt map[string][]time.Time
+}
+
 var (
+	resendEmailLimiter  = newEmailRateLimiter(resendVerificationEmailLimit, resendVerificationEmailWindow)
+	cachedAuthTokens    = newAuthTokenCache(maxCachedAuthTokens)
 	keyGenLocker        sync.Mutex
 	uuidLocker          sync.Mutex
 	multiSpaceRegex     = regexp.MustCompile(`[\s\p{Zs}]{2,}`)
+	duidValidCharsRegex = regexp.MustCompile(`^[0-9A-Za-z]+$`)
 	nameValidCharsRegex = regexp.MustCompile(`^[[:alpha:]]+((['.\s-][[:alpha:]\s])?[[:alpha:]]*)*$`)
+
+	// listUsersSortColumns maps the sortable columns to the expression used in ORDER BY
+	listUsersSortColumns = map[string]string{
+		listUsersSortByUUID:             "uuid",
+		listUsersSortByPermissionLevel:  "permission_level",
+		listUsersSortByIsVerified:       "is_verified",
+		listUsersSortByOrganization:     "COALESCE(organization, '')",
+		listUsersSortByCreatedTimestamp: "created_timestamp",
+	}
+
+	// listUsersSortTypes maps the sortable columns to the type used to cast cursor values
+	listUsersSortTypes = map[string]string{
+		listUsersSortByPermissionLevel:  "permission_level",
+		listUsersSortByIsVerified:       "boolean",
+		listUsersSortByOrganization:     "text",
+		listUsersSortByCreatedTimestamp: "timestamptz",
+	}
+
+	// serviceStateNames maps the states to the names used by GetStatus and SetServiceState
+	serviceStateNames = map[state]string{
+		available:   "AVAILABLE",
+		maintenance: "MAINTENANCE",
+		unavailable: "UNAVAILABLE",
+	}
+
+	// serviceStateValues maps the names back to the states
+	serviceStateValues = map[string]state{
+		"AVAILABLE":   available,
+		"MAINTENANCE": maintenance,
+		"UNAVAILABLE": unavailable,
+	}
 )
 
 func (s *stateLocker) isStateAvailable() bool {
+	currState, _, _ := s.current()
+	return currState == available && !s.isDegraded()
+}
+
+// isStateReadable reports if the service serves reads, which it does while available or in maintenance
+func (s *stateLocker) isStateReadable() bool {
+	currState, _, _ := s.current()
+	return (currState == available || currState == maintenance) && !s.isDegraded()
+}
+
+// isDegraded reports if the store is unreachable
+func (s *stateLocker) isDegraded() bool {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	if s.currentServiceState != available {
+	return s.degraded
+}
+
+// setDegraded marks the store unreachable or reachable again.
+// Returns true if this changed the degraded mode.
+func (s *stateLocker) setDegraded(degraded bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changed := s.degraded != degraded
+	s.degraded = degraded
+	return changed
+}
+
+// current returns the state of the service with its reason and expiry.
+// An expired state is reported as available.
+func (s *stateLocker) current() (state, string, time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.expiresAt.IsZero() && !time.Now().UTC().Before(s.expiresAt) {
+		return available, "", time.Time{}
+	}
+
+	return s.currentServiceState, s.reason, s.expiresAt
+}
+
+// setState replaces the state of the service, a zero expiresAt keeps the state until it is replaced
+func (s *stateLocker) setState(newState state, reason string, expiresAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.currentServiceState = newState
+	s.reason = reason
+	s.expiresAt = expiresAt
+}
+
+// newServiceStateOptions reads the state, reason and expiry requested by SetServiceState from md.
+// The expiry is relative to now, only maintenance and unavailable can expire.
+// Returns error if the state is unknown, the reason is too long or the expiry is not positive seconds.
+func newServiceStateOptions(md metadata.MD, now time.Time) (state, string, time.Time, error) {
+	newState, ok := serviceStateValues[strings.ToUpper(getMetadataValue(md, serviceStateKey))]
+	if !ok {
+		return available, "", time.Time{}, consts.ErrInvalidServiceState
+	}
+
+	reason := getMetadataValue(md, serviceStateReasonKey)
+	if len(reason) > maxServiceStateReasonLength {
+		return available, "", time.Time{}, consts.ErrInvalidServiceStateReason
+	}
+
+	var expiresAt time.Time
+	if value := getMetadataValue(md, serviceStateExpiresInKey); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds <= 0 || newState == available {
+			return available, "", time.Time{}, consts.ErrInvalidServiceStateExpiry
+		}
+		expiresAt = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	return newState, reason, expiresAt, nil
+}
+
+// newServiceStateMetadata describes a state for the response header metadata,
+// expires-at is in unix seconds and omitted if the state does not expire
+func newServiceStateMetadata(currState state, reason string, expiresAt time.Time) metadata.MD {
+	md := metadata.Pairs(serviceStateKey, serviceStateNames[currState])
+	if reason != "" {
+		md.Set(serviceStateReasonKey, reason)
+	}
+	if !expiresAt.IsZero() {
+		md.Set(serviceStateExpiresAtKey, strconv.FormatInt(expiresAt.Unix(), 10))
+	}
+
+	return md
+}
+
+// newServiceStateResponse returns a response with code, naming the state and its reason in the message,
+// ie "OK", "MAINTENANCE: migrating documents" or "Unavailable: shutting down"
+func newServiceStateResponse(code codes.Code, currState state, reason string) *pbsvc.UserResponse {
+	message := code.String()
+	if currState == maintenance {
+		message = serviceStateNames[maintenance]
+	}
+	if reason != "" {
+		message = fmt.Sprintf("%s: %s", message, reason)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(code)},
+		Message: message,
+	}
+}
+
+// newEmailRateLimiter returns an emailRateLimiter allowing limit emails per address within window.
+func newEmailRateLimiter(limit int, window time.Duration) *emailRateLimiter {
+	return &emailRateLimiter{
+		limit:  limit,
+		window: window,
+		sentAt: make(map[string][]time.Time),
+	}
+}
+
+// allow records an email sent to address and returns true if address is under the limit.
+// Addresses are case insensitive. Returns false without recording if address reached the limit.
+func (l *emailRateLimiter) allow(address string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.sentAt) > maxRateLimitedAddresses {
+		for key := range l.sentAt {
+			l.prune(key, now)
+		}
+	}
+
+	address = strings.ToLower(address)
+	l.prune(address, now)
+
+	if len(l.sentAt[address]) >= l.limit {
 		return false
 	}
 
+	l.sentAt[address] = append(l.sentAt[address], now)
 	return true
 }
 
+// prune drops the timestamps of address that are outside of the window, the caller must hold the lock.
+func (l *emailRateLimiter) prune(address string, now time.Time) {
+	sentAt := l.sentAt[address]
+	i := 0
+	for i < len(sentAt) && now.Sub(sentAt[i]) >= l.window {
+		i++
+	}
+
+	if i == len(sentAt) {
+		delete(l.sentAt, address)
+		return
+	}
+	l.sentAt[address] = sentAt[i:]
+}
+
 func validateUser(user *pblib.User) error {
 	if user == nil {
 		return consts.ErrNilRequestUser
@@ -108,6 +374,15 @@ func validateOrganization(name string) error {
 	return nil
 }
 
+// validateDUID checks that duid is a base62 encoded ksuid.
+// Returns error if the length or characters do not match.
+func validateDUID(duid string) error {
+	if len(duid) != duidLength || !duidValidCharsRegex.MatchString(duid) {
+		return consts.ErrInvalidDUID
+	}
+	return nil
+}
+
 // generateUUID generates a unique user ID using ulid package based on currentTime.
 // Returns a lower cased string type of generated ulid.ULID.
 func generateUUID() (string, error) {
@@ -125,46 +400,43 @@ func generateUUID() (string, error) {
 	return strings.ToLower(id.String()), nil
 }
 
-// hashPassword hashes and salts provided password.
-// Returns string hashed password.
+// hashPassword hashes and salts provided password with currentPasswordHasher.
+// Returns the PHC string of the password, or error if password is empty or padded with spaces.
 func hashPassword(password string) (string, error) {
 	if password == "" || strings.TrimSpace(password) != password {
 		return "", consts.ErrInvalidPassword
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
-	if err != nil {
-		return "", err
-	}
-
-	return string(hashedPassword), nil
+	return currentPasswordHasher.hash(password)
 }
 
 // comparePassword compares hashedPassword retrieved from DB and the password from User request.
-// Returns nil if match, error if not match or error from bcrypt.
+// hashedPassword may be of any known hasher, not only currentPasswordHasher.
+// Returns nil if match, consts.ErrPasswordMismatch if not match, or error if hashedPassword is unknown.
 func comparePassword(hashedPassword string, password string) error {
 	if hashedPassword == "" || password == "" {
 		return consts.ErrInvalidPassword
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	hasher, err := passwordHasherOf(hashedPassword)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return hasher.verify(hashedPassword, password)
 }
 
-// setCurrentSecretOnce checks if currAuthSecret is set, if not,
+// setCurrentSecretOnce checks if currAuthSecret is set and unexpired, if not,
 // retrieves the active secret key found in secrets table.
+// RotateAuthSecrets keeps it current otherwise.
 // Returns any db encountered error, or nil if secret is already set or no error.
-func setCurrentSecretOnce() error {
-	if currAuthSecret != nil {
+func setCurrentSecretOnce(tx UserTx) error {
+	if currAuthSecret != nil && auth.ValidateSecret(currAuthSecret) == nil {
 		return nil
 	}
 
 	var err error
-	currAuthSecret, err = getActiveSecretRow()
+	currAuthSecret, err = tx.getActiveSecretRow()
 	if err != nil {
 		return err
 	}
@@ -185,62 +457,162 @@ func generateEmailVerifyLink(token string) (string, error) {
 	return link, nil
 }
 
-// getAuthIdentification gets or generates the latest AuthToken for the User.
-// Returns the identification or error.
-func getAuthIdentification(retrievedUser *pblib.User) (*pblib.Identification, error) {
+// generateResetPasswordLink generates a password reset link sent as part of password reset emails.
+// Returns error if token string is empty.
+func generateResetPasswordLink(token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	link := fmt.Sprintf("%s/%s=%s", domainName, resetPasswordStub, token)
+
+	return link, nil
+}
+
+// validateEmailTokenPurpose checks if purpose is one of the known email token purposes.
+// Returns error if purpose is unknown.
+func validateEmailTokenPurpose(purpose string) error {
+	if purpose != emailTokenPurposeVerifyEmail && purpose != emailTokenPurposeResetPassword {
+		return consts.ErrInvalidEmailTokenPurpose
+	}
+
+	return nil
+}
+
+// newResetPasswordIdentification generates a single use password reset token for the user.
+// Unlike verification email tokens, reset tokens expire after resetPasswordTokenLifetime.
+// Returns error if uuid or permission level is invalid, or any token generation error.
+func newResetPasswordIdentification(uuid string, permissionLevel string) (*pblib.Identification, error) {
+	permission, ok := auth.PermissionEnumMap[permissionLevel]
+	if !ok {
+		return nil, authconst.ErrInvalidPermission
+	}
+
+	key, err := auth.GenerateSecretKey(resetPasswordTokenByteSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// subtract a second b/c secret validation rejects creation timestamps that are not in the past
+	createdTimestamp := time.Now().UTC().Add(-time.Second)
+	expirationTimestamp := createdTimestamp.Add(resetPasswordTokenLifetime)
+
+	header := &auth.Header{
+		Alg:      auth.AlgorithmMap[permission],
+		TokenTyp: auth.Jet,
+	}
+	body := &auth.Body{
+		UUID:                uuid,
+		Permission:          permission,
+		ExpirationTimestamp: expirationTimestamp.Unix(),
+	}
+	secret := &pblib.Secret{
+		Key:                 key,
+		CreatedTimestamp:    createdTimestamp.Unix(),
+		ExpirationTimestamp: expirationTimestamp.Unix(),
+	}
+
+	token, err := auth.NewToken(header, body, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pblib.Identification{
+		Token:  token,
+		Secret: secret,
+	}, nil
+}
+
+// getAuthIdentification generates a new AuthToken for the User, only the hashes of previous tokens are stored.
+// Returns the identification, or error if the unexpired token of the User carries another permission level.
+func getAuthIdentification(tx UserTx, retrievedUser *pblib.User) (*pblib.Identification, error) {
 	if retrievedUser == nil {
 		return nil, consts.ErrStatusNilRequestUser
 	}
-	var identification *pblib.Identification
 
-	existingToken, err := getAuthTokenRow(retrievedUser.GetUuid())
-	if err == nil {
-		if existingToken.permission != retrievedUser.PermissionLevel {
-			return nil, consts.ErrStatusPermissionMismatch
-		}
-		identification = &pblib.Identification{
-			Token:  existingToken.token,
-			Secret: existingToken.secret,
-		}
-	} else {
-		permissionLevel := auth.PermissionEnumMap[retrievedUser.GetPermissionLevel()]
+	existingToken, err := tx.getAuthTokenRow(retrievedUser.GetUuid())
+	if err == nil && existingToken.permission != retrievedUser.PermissionLevel {
+		return nil, consts.ErrStatusPermissionMismatch
+	}
 
-		// build token header, body, secret
-		header := &auth.Header{
-			Alg:      auth.AlgorithmMap[permissionLevel],
-			TokenTyp: auth.Jwt,
-		}
-		body := &auth.Body{
-			UUID:                retrievedUser.GetUuid(),
-			Permission:          permissionLevel,
-			ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
-		}
+	permissionLevel := auth.PermissionEnumMap[retrievedUser.GetPermissionLevel()]
 
-		if err := setCurrentSecretOnce(); err != nil {
-			return nil, status.Error(codes.Unauthenticated, err.Error())
-		}
-		newToken, err := auth.NewToken(header, body, currAuthSecret)
+	// build token header, body, secret
+	header := &auth.Header{
+		Alg:      auth.AlgorithmMap[permissionLevel],
+		TokenTyp: auth.Jwt,
+	}
+	body := &auth.Body{
+		UUID:                retrievedUser.GetUuid(),
+		Permission:          permissionLevel,
+		ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
+	}
+
+	if err := setCurrentSecretOnce(tx); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	newToken, err := insertNewAuthToken(tx, header, body)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pblib.Identification{
+		Token:  newToken,
+		Secret: currAuthSecret,
+	}, nil
+}
+
+// insertNewAuthToken signs body with currAuthSecret, see signAuthToken, and inserts the token into the db for auditing.
+// A token only depends on its header, body and secret, so a body signing to a token that already exists,
+// ie one revoked within the same second, expires a second earlier until its token is new,
+// else a revoked token would be valid again.
+// Returns the new token or error.
+func insertNewAuthToken(tx UserTx, header *auth.Header, body *auth.Body) (string, error) {
+	for i := 0; i < maxAuthTokenCollisions; i++ {
+		newToken, err := signAuthToken(tx, header, body, currAuthSecret)
 		if err != nil {
-			return nil, status.Error(codes.Unauthenticated, err.Error())
+			return "", err
 		}
 
-		// insert token into db for auditing
-		if err := insertAuthToken(newToken, header, body, currAuthSecret); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		_, err = tx.pairTokenWithSecret(newToken)
+		if err == consts.ErrNoMatchingAuthTokenFound {
+			return newToken, tx.insertAuthToken(newToken, header, body, currAuthSecret)
 		}
-
-		identification = &pblib.Identification{
-			Token:  newToken,
-			Secret: currAuthSecret,
+		if err != nil && err != consts.ErrAuthTokenRevoked {
+			return "", err
 		}
+
+		body.ExpirationTimestamp--
 	}
 
-	return identification, nil
+	return "", consts.ErrAuthTokenCollision
+}
+
+// renewAuthIdentification generates a new auth token with the current permission level of user,
+// the unexpired auth token of user can not be returned again b/c only its hash is stored.
+// Returns the identification or error.
+func renewAuthIdentification(tx UserTx, retrievedUser *pblib.User) (*pblib.Identification, error) {
+	if retrievedUser == nil {
+		return nil, consts.ErrNilRequestUser
+	}
+
+	permission := auth.PermissionEnumMap[retrievedUser.GetPermissionLevel()]
+	header := &auth.Header{
+		Alg:      auth.AlgorithmMap[permission],
+		TokenTyp: auth.Jwt,
+	}
+	body := &auth.Body{
+		UUID:                retrievedUser.GetUuid(),
+		Permission:          permission,
+		ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
+	}
+
+	return newAuthIdentification(tx, header, body)
 }
 
 // newAuthIdentification generates a new AuthToken for user.
 // Returns the new identification or error.
-func newAuthIdentification(oldHeader *auth.Header, oldBody *auth.Body) (*pblib.Identification, error) {
+func newAuthIdentification(tx UserTx, oldHeader *auth.Header, oldBody *auth.Body) (*pblib.Identification, error) {
 	if err := auth.ValidateHeader(oldHeader); err != nil {
 		return nil, err
 	}
@@ -259,20 +631,15 @@ func newAuthIdentification(oldHeader *auth.Header, oldBody *auth.Body) (*pblib.I
 		ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
 	}
 
-	if err := setCurrentSecretOnce(); err != nil {
+	if err := setCurrentSecretOnce(tx); err != nil {
 		return nil, err
 	}
 
-	newToken, err := auth.NewToken(header, body, currAuthSecret)
+	newToken, err := insertNewAuthToken(tx, header, body)
 	if err != nil {
 		return nil, err
 	}
 
-	// insert token into db for auditing
-	if err := insertAuthToken(newToken, header, body, currAuthSecret); err != nil {
-		return nil, err
-	}
-
 	identification := &pblib.Identification{
 		Token:  newToken,
 		Secret: currAuthSecret,
@@ -280,3 +647,384 @@ func newAuthIdentification(oldHeader *auth.Header, oldBody *auth.Body) (*pblib.I
 
 	return identification, nil
 }
+
+// authorizeIdentification pairs the token in identity with its secret in the db,
+// and checks that the token carries at least the required permission.
+// Returns a copy of the token body on success, else status error Unauthenticated if the token is unknown or invalid,
+// PermissionDenied if the token is valid but lacks permission.
+func authorizeIdentification(tx UserTx, identity *pblib.Identification, permission auth.Permission) (*auth.Body, error) {
+	if identity == nil {
+		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
+	}
+
+	retrievedIdentity, err := tx.pairTokenWithSecret(identity.GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if _, err := loadSigningKey(tx, retrievedIdentity.GetSecret().GetKey()); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	_, body, err := authorizeAuthToken(retrievedIdentity, permission)
+	if err != nil {
+		if err == authconst.ErrInvalidPermission {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return body, nil
+}
+
+// newListUsersQuery builds a listUsersQuery from the incoming gRPC metadata.
+// Missing keys fall back to no filter, sorting by uuid ascending, and the default page size.
+// Returns error if any of the values are malformed.
+func newListUsersQuery(md metadata.MD) (*listUsersQuery, error) {
+	query := &listUsersQuery{
+		sortBy:   listUsersSortByUUID,
+		pageSize: defaultListUsersPageSize,
+	}
+
+	if value := getMetadataValue(md, listUsersPermissionLevelKey); value != "" {
+		if _, ok := auth.PermissionEnumMap[value]; !ok {
+			return nil, consts.ErrInvalidListUsersFilter
+		}
+		query.permissionLevel = value
+	}
+
+	if value := getMetadataValue(md, listUsersIsVerifiedKey); value != "" {
+		isVerified, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, consts.ErrInvalidListUsersFilter
+		}
+		query.isVerified = &isVerified
+	}
+
+	query.organization = getMetadataValue(md, listUsersOrganizationKey)
+
+	if value := getMetadataValue(md, listUsersCreatedAfterKey); value != "" {
+		createdAfter, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || createdAfter <= 0 {
+			return nil, consts.ErrInvalidListUsersFilter
+		}
+		query.createdAfter = createdAfter
+	}
+
+	if value := getMetadataValue(md, listUsersCreatedBeforeKey); value != "" {
+		createdBefore, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || createdBefore <= 0 {
+			return nil, consts.ErrInvalidListUsersFilter
+		}
+		query.createdBefore = createdBefore
+	}
+
+	if query.createdAfter > 0 && query.createdBefore > 0 && query.createdAfter >= query.createdBefore {
+		return nil, consts.ErrInvalidListUsersFilter
+	}
+
+	if value := getMetadataValue(md, listUsersSortByKey); value != "" {
+		if _, ok := listUsersSortColumns[value]; !ok {
+			return nil, consts.ErrInvalidListUsersSortBy
+		}
+		query.sortBy = value
+	}
+
+	switch getMetadataValue(md, listUsersSortOrderKey) {
+	case "", listUsersSortOrderAsc:
+		query.descending = false
+	case listUsersSortOrderDesc:
+		query.descending = true
+	default:
+		return nil, consts.ErrInvalidListUsersSortOrder
+	}
+
+	if value := getMetadataValue(md, listUsersPageSizeKey); value != "" {
+		pageSize, err := strconv.Atoi(value)
+		if err != nil || pageSize <= 0 || pageSize > maxListUsersPageSize {
+			return nil, consts.ErrInvalidListUsersPageSize
+		}
+		query.pageSize = pageSize
+	}
+
+	if value := getMetadataValue(md, listUsersCursorKey); value != "" {
+		cursor, err := decodeListUsersCursor(value)
+		if err != nil {
+			return nil, err
+		}
+		query.cursor = cursor
+	}
+
+	return query, nil
+}
+
+// getMetadataValue returns the first value of key in md, or empty string if key is not set.
+func getMetadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return strings.TrimSpace(values[0])
+}
+
+// encodeListUsersCursor serializes the cursor into an opaque URL-safe string.
+// Returns error if cursor is nil or fails to serialize.
+func encodeListUsersCursor(cursor *listUsersCursor) (string, error) {
+	if cursor == nil {
+		return "", consts.ErrInvalidListUsersCursor
+	}
+
+	encoded, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// decodeListUsersCursor parses a cursor made by encodeListUsersCursor.
+// Returns error if the cursor is malformed.
+func decodeListUsersCursor(encoded string) (*listUsersCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, consts.ErrInvalidListUsersCursor
+	}
+
+	cursor := &listUsersCursor{}
+	if err := json.Unmarshal(decoded, cursor); err != nil {
+		return nil, consts.ErrInvalidListUsersCursor
+	}
+
+	if _, ok := listUsersSortColumns[cursor.SortBy]; !ok {
+		return nil, consts.ErrInvalidListUsersCursor
+	}
+
+	if err := validation.ValidateUserUUID(cursor.UUID); err != nil {
+		return nil, consts.ErrInvalidListUsersCursor
+	}
+
+	return cursor, nil
+}
+
+// resolveShareRecipients converts each recipient, given as a uuid or an email, to a verified user's uuid.
+// The owner and duplicates are skipped b/c the owner always has access to its documents.
+// Returns the uuids, else error if a recipient is malformed, does not exist or is not verified.
+func resolveShareRecipients(tx UserTx, ownerUUID string, recipients []string) ([]string, error) {
+	return resolveRecipients(tx, ownerUUID, recipients, true)
+}
+
+// resolveUnshareRecipients converts each recipient, given as a uuid or an email, to a user's uuid.
+// Unlike resolveShareRecipients, recipients do not need to be verified to have a share revoked.
+// Returns the uuids, else error if a recipient is malformed or does not exist.
+func resolveUnshareRecipients(tx UserTx, ownerUUID string, recipients []string) ([]string, error) {
+	return resolveRecipients(tx, ownerUUID, recipients, false)
+}
+
+func resolveRecipients(tx UserTx, ownerUUID string, recipients []string, mustBeVerified bool) ([]string, error) {
+	if len(recipients) == 0 {
+		return nil, consts.ErrNoShareRecipients
+	}
+
+	seen := make(map[string]bool)
+	var uuids []string
+	for _, recipient := range recipients {
+		recipient = strings.TrimSpace(recipient)
+
+		var user *pblib.User
+		var err error
+		if validation.ValidateUserUUID(recipient) == nil {
+			user, err = tx.getUserRow(recipient)
+		} else if validateEmail(recipient) == nil {
+			user, err = tx.getUserRowByEmail(recipient)
+		} else {
+			return nil, consts.ErrInvalidShareRecipient
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// users are promoted to USER permission once they verify their email
+		if mustBeVerified && auth.PermissionEnumMap[user.GetPermissionLevel()] < auth.User {
+			return nil, consts.ErrShareRecipientNotVerified
+		}
+
+		if user.GetUuid() == ownerUUID || seen[user.GetUuid()] {
+			continue
+		}
+		seen[user.GetUuid()] = true
+		uuids = append(uuids, user.GetUuid())
+	}
+
+	return uuids, nil
+}
+
+// recipientErrorToStatus maps errors from resolving share recipients to their status codes.
+func recipientErrorToStatus(err error) error {
+	switch err {
+	case consts.ErrInvalidShareRecipient, consts.ErrNoShareRecipients:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case consts.ErrUserNotFound, consts.ErrEmailDoesNotExist:
+		return status.Error(codes.NotFound, err.Error())
+	case consts.ErrShareRecipientNotVerified:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// authorizeDocumentReader authorizes the token in identity to read the documents of uuid.
+// Users can read their own documents, reading the documents of another user requires the documents:read permission over them.
+// If uuid is empty, the token's uuid is used.
+// Returns the uuid to read documents of, else status error.
+func authorizeDocumentReader(tx UserTx, identity *pblib.Identification, uuid string) (string, error) {
+	body, err := authorizeIdentification(tx, identity, auth.User)
+	if err != nil {
+		return "", err
+	}
+
+	if uuid == "" || uuid == body.UUID {
+		return body.UUID, nil
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return "", consts.ErrStatusUUIDInvalid
+	}
+
+	target, err := getPolicyTarget(tx, uuid)
+	if err != nil {
+		return "", err
+	}
+	if err := evaluatePolicy(tx, body, permDocumentsRead, target); err != nil {
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+// txErrorToStatus returns err if it is already a status error,
+// else wraps it as Internal b/c it failed to begin, run or commit a transaction.
+func txErrorToStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if markStoreUnreachable(err) {
+		return consts.ErrStatusServiceUnavailable
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// markStoreUnreachable enters degraded mode if err means the store could not be reached,
+// rather than waiting for MonitorStore to notice, MonitorStore leaves degraded mode once the store is back.
+// Returns true if err means the store is unreachable.
+func markStoreUnreachable(err error) bool {
+	if !isStoreUnreachable(err) {
+		return false
+	}
+
+	if serviceStateLocker.setDegraded(true) {
+		logger.Error(consts.PSQL, consts.ErrStoreUnreachable.Error(), err.Error())
+	}
+	return true
+}
+
+// isStoreUnreachable reports if err means the store could not be reached, rather than a failed query
+func isStoreUnreachable(err error) bool {
+	switch err {
+	case driver.ErrBadConn, sql.ErrConnDone, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// newAuthTokenCache returns an authTokenCache holding at most capacity tokens.
+func newAuthTokenCache(capacity int) *authTokenCache {
+	return &authTokenCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// add caches a copy of identity, a token paired with its secret by pairTokenWithSecret.
+// Evicts the least recently verified token once the cache is full.
+func (c *authTokenCache) add(identity *pblib.Identification) {
+	if identity.GetToken() == "" || identity.GetSecret() == nil {
+		return
+	}
+
+	entry := &authTokenCacheEntry{
+		uuid: auth.ExtractUUID(identity.GetToken()),
+		identity: &pblib.Identification{
+			Token: identity.GetToken(),
+			Secret: &pblib.Secret{
+				Key:                 identity.GetSecret().GetKey(),
+				CreatedTimestamp:    identity.GetSecret().GetCreatedTimestamp(),
+				ExpirationTimestamp: identity.GetSecret().GetExpirationTimestamp(),
+			},
+		},
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[identity.GetToken()]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[identity.GetToken()] = c.order.PushFront(entry)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authTokenCacheEntry).identity.GetToken())
+	}
+}
+
+// get returns a copy of the cached identity of token.
+// Returns false if token is not cached.
+func (c *authTokenCache) get(token string) (*pblib.Identification, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	cached := element.Value.(*authTokenCacheEntry).identity
+	return &pblib.Identification{
+		Token: cached.GetToken(),
+		Secret: &pblib.Secret{
+			Key:                 cached.GetSecret().GetKey(),
+			CreatedTimestamp:    cached.GetSecret().GetCreatedTimestamp(),
+			ExpirationTimestamp: cached.GetSecret().GetExpirationTimestamp(),
+		},
+	}, true
+}
+
+// evict drops token from the cache, called once token is revoked.
+func (c *authTokenCache) evict(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[token]; ok {
+		c.order.Remove(element)
+		delete(c.entries, token)
+	}
+}
+
+// evictUUID drops every cached token of uuid, called once the tokens of uuid are revoked.
+func (c *authTokenCache) evictUUID(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for token, element := range c.entries {
+		if element.Value.(*authTokenCacheEntry).uuid == uuid {
+			c.order.Remove(element)
+			delete(c.entries, token)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package service
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -55,6 +62,98 @@ func TestIsStateAvailable(t *testing.T) {
 	wg.Wait() // wait until all goroutines finish executing
 }
 
+func TestStateLockerCurrent(t *testing.T) {
+	now := time.Now().UTC()
+	cases := []struct {
+		desc        string
+		state       state
+		expiresAt   time.Time
+		expState    state
+		isAvailable bool
+		isReadable  bool
+	}{
+		{"test available", available, time.Time{}, available, true, true},
+		{"test maintenance", maintenance, time.Time{}, maintenance, false, true},
+		{"test unavailable", unavailable, time.Time{}, unavailable, false, false},
+		{"test maintenance before expiry", maintenance, now.Add(time.Hour), maintenance, false, true},
+		{"test unavailable after expiry", unavailable, now.Add(-time.Second), available, true, true},
+	}
+
+	for _, c := range cases {
+		serviceStateLocker.setState(c.state, "reason", c.expiresAt)
+		currState, _, _ := serviceStateLocker.current()
+		assert.Equal(t, c.expState, currState, c.desc)
+		assert.Equal(t, c.isAvailable, serviceStateLocker.isStateAvailable(), c.desc)
+		assert.Equal(t, c.isReadable, serviceStateLocker.isStateReadable(), c.desc)
+	}
+
+	serviceStateLocker.setState(available, "", time.Time{})
+}
+
+func TestStateLockerDegraded(t *testing.T) {
+	cases := []struct {
+		desc        string
+		state       state
+		degraded    bool
+		isAvailable bool
+		isReadable  bool
+	}{
+		{"test available", available, false, true, true},
+		{"test degraded available", available, true, false, false},
+		{"test degraded maintenance", maintenance, true, false, false},
+	}
+
+	for _, c := range cases {
+		serviceStateLocker.setState(c.state, "", time.Time{})
+		serviceStateLocker.setDegraded(c.degraded)
+		assert.Equal(t, c.degraded, serviceStateLocker.isDegraded(), c.desc)
+		assert.Equal(t, c.isAvailable, serviceStateLocker.isStateAvailable(), c.desc)
+		assert.Equal(t, c.isReadable, serviceStateLocker.isStateReadable(), c.desc)
+	}
+
+	assert.True(t, serviceStateLocker.setDegraded(false))
+	assert.False(t, serviceStateLocker.setDegraded(false))
+	serviceStateLocker.setState(available, "", time.Time{})
+}
+
+func TestNewServiceStateOptions(t *testing.T) {
+	now := time.Now().UTC()
+	cases := []struct {
+		desc         string
+		md           metadata.MD
+		expState     state
+		expReason    string
+		expExpiresAt time.Time
+		expErr       error
+	}{
+		{"test available", metadata.Pairs(serviceStateKey, "AVAILABLE"), available, "", time.Time{}, nil},
+		{"test lower case state with reason", metadata.Pairs(serviceStateKey, "maintenance",
+			serviceStateReasonKey, "db upgrade"), maintenance, "db upgrade", time.Time{}, nil},
+		{"test expiring unavailable", metadata.Pairs(serviceStateKey, "UNAVAILABLE",
+			serviceStateExpiresInKey, "60"), unavailable, "", now.Add(time.Minute), nil},
+		{"test missing state", nil, available, "", time.Time{}, consts.ErrInvalidServiceState},
+		{"test unknown state", metadata.Pairs(serviceStateKey, "LOCKED"), available, "", time.Time{},
+			consts.ErrInvalidServiceState},
+		{"test long reason", metadata.Pairs(serviceStateKey, "MAINTENANCE",
+			serviceStateReasonKey, strings.Repeat("a", maxServiceStateReasonLength+1)), available, "", time.Time{},
+			consts.ErrInvalidServiceStateReason},
+		{"test zero expiry", metadata.Pairs(serviceStateKey, "MAINTENANCE", serviceStateExpiresInKey, "0"),
+			available, "", time.Time{}, consts.ErrInvalidServiceStateExpiry},
+		{"test non numeric expiry", metadata.Pairs(serviceStateKey, "MAINTENANCE", serviceStateExpiresInKey, "1h"),
+			available, "", time.Time{}, consts.ErrInvalidServiceStateExpiry},
+		{"test expiring available", metadata.Pairs(serviceStateKey, "AVAILABLE", serviceStateExpiresInKey, "60"),
+			available, "", time.Time{}, consts.ErrInvalidServiceStateExpiry},
+	}
+
+	for _, c := range cases {
+		newState, reason, expiresAt, err := newServiceStateOptions(c.md, now)
+		assert.Equal(t, c.expErr, err, c.desc)
+		assert.Equal(t, c.expState, newState, c.desc)
+		assert.Equal(t, c.expReason, reason, c.desc)
+		assert.Equal(t, c.expExpiresAt, expiresAt, c.desc)
+	}
+}
+
 func TestValidateUser(t *testing.T) {
 	// valid
 	validTest := pblib.User{
@@ -304,7 +403,7 @@ func TestComparePassword(t *testing.T) {
 	assert.Nil(t, err)
 
 	err = comparePassword(pass1Hashed, pass2)
-	assert.EqualError(t, err, "crypto/bcrypt: hashedPassword is not the hash of the given password")
+	assert.EqualError(t, err, consts.ErrPasswordMismatch.Error())
 
 	err = comparePassword("", pass2)
 	assert.EqualError(t, err, consts.ErrInvalidPassword.Error())
@@ -317,11 +416,13 @@ func TestComparePassword(t *testing.T) {
 }
 
 func TestSetCurrentSecretOnce(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	desc := "test no active key in db error"
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(unitTestTx())
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error(), desc)
 
 	desc = "test nil return when currAuthSecret is already set"
@@ -330,16 +431,16 @@ func TestSetCurrentSecretOnce(t *testing.T) {
 		CreatedTimestamp:    time.Now().Unix(),
 		ExpirationTimestamp: time.Now().Unix(), // TODO fix expiration in 1 week
 	}
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(unitTestTx())
 	assert.Nil(t, err, desc)
 
 	desc = "test retrieval and setting of an existing active key in db"
 	currAuthSecret = nil
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err)
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(unitTestTx())
 	assert.Nil(t, err, desc)
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := unitTestTx().getActiveSecretRow()
 	assert.Nil(t, err)
 	assert.Equal(t, currAuthSecret.GetKey(), retrievedSecret.GetKey())
 }
@@ -358,7 +459,54 @@ func TestGenerateEmailVerifyLink(t *testing.T) {
 	assert.Nil(t, err, desc)
 }
 
+func TestGenerateResetPasswordLink(t *testing.T) {
+	desc := "test empty string"
+	link, err := generateResetPasswordLink("")
+	assert.Empty(t, link, desc)
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+
+	desc = "test valid token"
+	token := "someRandomTokenString123"
+	manuallyBuiltLink := fmt.Sprintf("%s/%s=%s", domainName, resetPasswordStub, token)
+	link, err = generateResetPasswordLink(token)
+	assert.Equal(t, manuallyBuiltLink, link, desc)
+	assert.Nil(t, err, desc)
+}
+
+func TestNewResetPasswordIdentification(t *testing.T) {
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc            string
+		uuid            string
+		permissionLevel string
+		isExpErr        bool
+		expMsg          string
+	}{
+		{"test invalid uuid", "1234", auth.PermissionStringMap[auth.User], true, authconst.ErrInvalidUUID.Error()},
+		{"test invalid permission", uuid, "", true, authconst.ErrInvalidPermission.Error()},
+		{"test user", uuid, auth.PermissionStringMap[auth.User], false, ""},
+		{"test admin", uuid, auth.PermissionStringMap[auth.Admin], false, ""},
+	}
+
+	for _, c := range cases {
+		identification, err := newResetPasswordIdentification(c.uuid, c.permissionLevel)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, identification, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.uuid, auth.ExtractUUID(identification.GetToken()), c.desc)
+			assert.True(t, identification.GetSecret().GetExpirationTimestamp() <=
+				time.Now().Add(resetPasswordTokenLifetime).Unix(), c.desc)
+		}
+	}
+}
+
 func TestGetAuthIdentification(t *testing.T) {
+	unitTestRequirePostgres(t)
+
 	lastName1 := "GetToken-One"
 	lastName2 := "GetToken-Two"
 
@@ -392,7 +540,7 @@ func TestGetAuthIdentification(t *testing.T) {
 		{nil, true, consts.ErrStatusNilRequestUser.Error()},
 	}
 	for _, c := range cases {
-		identification, err := getAuthIdentification(c.user)
+		identification, err := getAuthIdentification(unitTestTx(), c.user)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
@@ -405,9 +553,11 @@ func TestGetAuthIdentification(t *testing.T) {
 }
 
 func TestNewAuthIdentification(t *testing.T) {
-	err := insertNewAuthSecret()
+	unitTestRequirePostgres(t)
+
+	err := unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err, "generate auth secret")
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(unitTestTx())
 	assert.Nil(t, err, "set auth secret")
 	cases := []struct {
 		desc     string
@@ -421,7 +571,7 @@ func TestNewAuthIdentification(t *testing.T) {
 		{"test for valid input", validAuthTokenHeader, validAuthTokenBody, false, ""},
 	}
 	for _, c := range cases {
-		identification, err := newAuthIdentification(c.header, c.body)
+		identification, err := newAuthIdentification(unitTestTx(), c.header, c.body)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 			assert.Nil(t, identification, c.desc)
@@ -434,11 +584,11 @@ func TestNewAuthIdentification(t *testing.T) {
 	// sleep is needed to ensure expiration timestamps are different
 	time.Sleep(2 * time.Second)
 	caseNewAuthToken := "test to generate new auth token"
-	validID1, err := newAuthIdentification(validAuthTokenHeader, validAuthTokenBody)
+	validID1, err := newAuthIdentification(unitTestTx(), validAuthTokenHeader, validAuthTokenBody)
 	assert.NotNil(t, validID1, caseNewAuthToken)
 	assert.Nil(t, err, caseNewAuthToken)
 	time.Sleep(2 * time.Second)
-	validID2, err := newAuthIdentification(validAuthTokenHeader, validAuthTokenBody)
+	validID2, err := newAuthIdentification(unitTestTx(), validAuthTokenHeader, validAuthTokenBody)
 	assert.NotNil(t, validID1, caseNewAuthToken)
 	assert.Nil(t, err, caseNewAuthToken)
 
@@ -446,14 +596,319 @@ func TestNewAuthIdentification(t *testing.T) {
 	assert.NotEqual(t, validID1.Token, validID2.Token, caseNewAuthToken)
 
 	// ensure we get the new auth token and not the old auth token
-	retrievedToken, err := getAuthTokenRow(validAuthTokenBody.UUID)
+	retrievedToken, err := unitTestTx().getAuthTokenRow(validAuthTokenBody.UUID)
 	assert.Nil(t, err, caseNewAuthToken)
-	assert.Equal(t, validID2.Token, retrievedToken.token, caseNewAuthToken)
+	assert.Equal(t, hashToken(validID2.Token), retrievedToken.tokenHash, caseNewAuthToken)
 
 	caseNewAuthSecret := "test new auth secret"
-	err = insertNewAuthSecret()
+	err = unitTestTx().insertNewAuthSecret()
 	assert.Nil(t, err, caseNewAuthSecret)
-	retrievedToken, err = getAuthTokenRow(validAuthTokenBody.UUID)
+	retrievedToken, err = unitTestTx().getAuthTokenRow(validAuthTokenBody.UUID)
 	assert.Nil(t, err, caseNewAuthSecret)
-	assert.Equal(t, validID2.Token, retrievedToken.token, caseNewAuthSecret)
+	assert.Equal(t, hashToken(validID2.Token), retrievedToken.tokenHash, caseNewAuthSecret)
+}
+
+func TestNewListUsersQuery(t *testing.T) {
+	validUUID, err := generateUUID()
+	assert.Nil(t, err)
+	validCursor, err := encodeListUsersCursor(&listUsersCursor{
+		SortBy: listUsersSortByCreatedTimestamp,
+		Value:  time.Now().UTC().Format(time.RFC3339Nano),
+		UUID:   validUUID,
+	})
+	assert.Nil(t, err)
+
+	isVerified := true
+
+	cases := []struct {
+		desc     string
+		md       metadata.MD
+		isExpErr bool
+		expMsg   string
+		expQuery *listUsersQuery
+	}{
+		{"test nil metadata", nil, false, "",
+			&listUsersQuery{sortBy: listUsersSortByUUID, pageSize: defaultListUsersPageSize},
+		},
+		{"test all options", metadata.Pairs(
+			listUsersPermissionLevelKey, auth.PermissionStringMap[auth.User],
+			listUsersIsVerifiedKey, "true",
+			listUsersOrganizationKey, "HWSC",
+			listUsersCreatedAfterKey, "100",
+			listUsersCreatedBeforeKey, "200",
+			listUsersSortByKey, listUsersSortByOrganization,
+			listUsersSortOrderKey, listUsersSortOrderDesc,
+			listUsersPageSizeKey, "10",
+		), false, "",
+			&listUsersQuery{
+				permissionLevel: auth.PermissionStringMap[auth.User],
+				isVerified:      &isVerified,
+				organization:    "HWSC",
+				createdAfter:    100,
+				createdBefore:   200,
+				sortBy:          listUsersSortByOrganization,
+				descending:      true,
+				pageSize:        10,
+			},
+		},
+		{"test invalid permission level", metadata.Pairs(listUsersPermissionLevelKey, "GUEST"),
+			true, consts.ErrInvalidListUsersFilter.Error(), nil,
+		},
+		{"test invalid is verified", metadata.Pairs(listUsersIsVerifiedKey, "maybe"),
+			true, consts.ErrInvalidListUsersFilter.Error(), nil,
+		},
+		{"test invalid created range", metadata.Pairs(listUsersCreatedAfterKey, "200", listUsersCreatedBeforeKey, "100"),
+			true, consts.ErrInvalidListUsersFilter.Error(), nil,
+		},
+		{"test invalid sort by", metadata.Pairs(listUsersSortByKey, "password"),
+			true, consts.ErrInvalidListUsersSortBy.Error(), nil,
+		},
+		{"test invalid sort order", metadata.Pairs(listUsersSortOrderKey, "up"),
+			true, consts.ErrInvalidListUsersSortOrder.Error(), nil,
+		},
+		{"test page size too big", metadata.Pairs(listUsersPageSizeKey, "1000"),
+			true, consts.ErrInvalidListUsersPageSize.Error(), nil,
+		},
+		{"test invalid cursor", metadata.Pairs(listUsersCursorKey, "not-a-cursor"),
+			true, consts.ErrInvalidListUsersCursor.Error(), nil,
+		},
+	}
+
+	for _, c := range cases {
+		query, err := newListUsersQuery(c.md)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, query, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expQuery, query, c.desc)
+		}
+	}
+
+	desc := "test valid cursor"
+	query, err := newListUsersQuery(metadata.Pairs(
+		listUsersSortByKey, listUsersSortByCreatedTimestamp, listUsersCursorKey, validCursor))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, validUUID, query.cursor.UUID, desc)
+}
+
+func TestEncodeDecodeListUsersCursor(t *testing.T) {
+	validUUID, err := generateUUID()
+	assert.Nil(t, err)
+
+	desc := "test nil cursor"
+	encoded, err := encodeListUsersCursor(nil)
+	assert.EqualError(t, err, consts.ErrInvalidListUsersCursor.Error(), desc)
+	assert.Empty(t, encoded, desc)
+
+	desc = "test round trip"
+	cursor := &listUsersCursor{
+		SortBy:     listUsersSortByIsVerified,
+		Descending: true,
+		Value:      "true",
+		UUID:       validUUID,
+	}
+	encoded, err = encodeListUsersCursor(cursor)
+	assert.Nil(t, err, desc)
+	decoded, err := decodeListUsersCursor(encoded)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, cursor, decoded, desc)
+
+	desc = "test invalid uuid in cursor"
+	encoded, err = encodeListUsersCursor(&listUsersCursor{SortBy: listUsersSortByUUID, UUID: "1234"})
+	assert.Nil(t, err, desc)
+	decoded, err = decodeListUsersCursor(encoded)
+	assert.EqualError(t, err, consts.ErrInvalidListUsersCursor.Error(), desc)
+	assert.Nil(t, decoded, desc)
+
+	desc = "test invalid sort column in cursor"
+	encoded, err = encodeListUsersCursor(&listUsersCursor{SortBy: "password", UUID: validUUID})
+	assert.Nil(t, err, desc)
+	decoded, err = decodeListUsersCursor(encoded)
+	assert.EqualError(t, err, consts.ErrInvalidListUsersCursor.Error(), desc)
+	assert.Nil(t, decoded, desc)
+}
+
+func TestValidateDUID(t *testing.T) {
+	cases := []struct {
+		desc     string
+		duid     string
+		isExpErr bool
+	}{
+		{"test valid duid", "0ujsswThIGTUYm2K8FjOOfXtY1K", false},
+		{"test empty duid", "", true},
+		{"test short duid", "0ujsswThIGTUYm2K8FjOOfXtY1", true},
+		{"test invalid characters", "0ujsswThIGTUYm2K8FjOOfXtY-K", true},
+	}
+
+	for _, c := range cases {
+		err := validateDUID(c.duid)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDUID.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+}
+
+func TestResolveShareRecipients(t *testing.T) {
+	unitTestRequirePostgres(t)
+
+	owner, _, err := unitTestInsertVerifiedUser("ResolveShareRecipients-Owner")
+	assert.Nil(t, err)
+	verifiedUser, _, err := unitTestInsertVerifiedUser("ResolveShareRecipients-One")
+	assert.Nil(t, err)
+	unverifiedUser, err := unitTestInsertUser("ResolveShareRecipients-Two")
+	assert.Nil(t, err)
+	nonExistentUUID, _ := generateUUID()
+
+	cases := []struct {
+		desc       string
+		recipients []string
+		isExpErr   bool
+		expMsg     string
+		expUUIDs   []string
+	}{
+		{"test no recipients", nil, true, consts.ErrNoShareRecipients.Error(), nil},
+		{"test invalid recipient", []string{"1234"}, true, consts.ErrInvalidShareRecipient.Error(), nil},
+		{"test non-existent uuid", []string{nonExistentUUID}, true, consts.ErrUserNotFound.Error(), nil},
+		{"test non-existent email", []string{unitTestFailEmail}, true, consts.ErrEmailDoesNotExist.Error(), nil},
+		{"test unverified recipient", []string{unverifiedUser.GetUser().GetUuid()}, true,
+			consts.ErrShareRecipientNotVerified.Error(), nil},
+		{"test uuid and email of the same user",
+			[]string{verifiedUser.GetUuid(), verifiedUser.GetEmail()}, false, "",
+			[]string{verifiedUser.GetUuid()},
+		},
+		{"test owner is skipped", []string{owner.GetUuid()}, false, "", nil},
+	}
+
+	for _, c := range cases {
+		uuids, err := resolveShareRecipients(unitTestTx(), owner.GetUuid(), c.recipients)
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expMsg, c.desc)
+			assert.Nil(t, uuids, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expUUIDs, uuids, c.desc)
+		}
+	}
+}
+
+func TestEmailRateLimiter(t *testing.T) {
+	limiter := newEmailRateLimiter(2, time.Hour)
+
+	cases := []struct {
+		desc     string
+		address  string
+		expAllow bool
+	}{
+		{"test first email", "hwsc.test+limiter@gmail.com", true},
+		{"test second email", "hwsc.test+limiter@gmail.com", true},
+		{"test over the limit", "hwsc.test+limiter@gmail.com", false},
+		{"test case insensitive address", "HWSC.test+limiter@gmail.com", false},
+		{"test other address", "hwsc.test+limiter2@gmail.com", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expAllow, limiter.allow(c.address), c.desc)
+	}
+
+	desc := "test window elapsed"
+	limiter = newEmailRateLimiter(1, time.Millisecond)
+	assert.True(t, limiter.allow("hwsc.test+limiter@gmail.com"), desc)
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, limiter.allow("hwsc.test+limiter@gmail.com"), desc)
+	assert.Len(t, limiter.sentAt["hwsc.test+limiter@gmail.com"], 1, desc)
+}
+
+func TestIsStoreUnreachable(t *testing.T) {
+	cases := []struct {
+		desc          string
+		err           error
+		isUnreachable bool
+	}{
+		{"test bad connection", driver.ErrBadConn, true},
+		{"test closed connection", sql.ErrConnDone, true},
+		{"test dropped connection", io.ErrUnexpectedEOF, true},
+		{"test refused connection", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"test no rows", sql.ErrNoRows, false},
+		{"test query error", consts.ErrUUIDNotFound, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.isUnreachable, isStoreUnreachable(c.err), c.desc)
+	}
+}
+
+func TestAuthTokenCache(t *testing.T) {
+	cache := newAuthTokenCache(2)
+	key, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	assert.Nil(t, err)
+	secret := &pblib.Secret{
+		Key:                 key,
+		CreatedTimestamp:    time.Now().UTC().Unix(),
+		ExpirationTimestamp: time.Now().UTC().Add(time.Hour).Unix(),
+	}
+	uuid1, _ := generateUUID()
+	uuid2, _ := generateUUID()
+
+	newIdentity := func(uuid string, expiresIn time.Duration) *pblib.Identification {
+		body := *validNoUUIDAuthTokenBody
+		body.UUID = uuid
+		body.ExpirationTimestamp = time.Now().UTC().Add(expiresIn).Unix()
+		token, err := auth.NewToken(validAuthTokenHeader, &body, secret)
+		assert.Nil(t, err)
+		return &pblib.Identification{Token: token, Secret: secret}
+	}
+	identity1 := newIdentity(uuid1, time.Hour)
+	identity2 := newIdentity(uuid2, time.Hour)
+	identity3 := newIdentity(uuid2, 2*time.Hour)
+
+	// ignores identities without a secret
+	cache.add(&pblib.Identification{Token: identity1.GetToken()})
+	_, ok := cache.get(identity1.GetToken())
+	assert.False(t, ok)
+
+	cache.add(identity1)
+	cache.add(identity2)
+
+	// returns a copy
+	cached, ok := cache.get(identity1.GetToken())
+	assert.True(t, ok)
+	assert.Equal(t, identity1, cached)
+	cached.GetSecret().Key = "modified"
+	cached, _ = cache.get(identity1.GetToken())
+	assert.Equal(t, key, cached.GetSecret().GetKey())
+
+	// evicts the least recently verified, identity2 b/c identity1 was just read
+	cache.add(identity3)
+	_, ok = cache.get(identity2.GetToken())
+	assert.False(t, ok)
+	_, ok = cache.get(identity1.GetToken())
+	assert.True(t, ok)
+	_, ok = cache.get(identity3.GetToken())
+	assert.True(t, ok)
+
+	// evicts every token of a uuid
+	cache.add(identity2)
+	_, ok = cache.get(identity1.GetToken())
+	assert.False(t, ok)
+	cache.evictUUID(uuid2)
+	_, ok = cache.get(identity2.GetToken())
+	assert.False(t, ok)
+	_, ok = cache.get(identity3.GetToken())
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.order.Len())
+	assert.Empty(t, cache.entries)
+
+	// evicts a single revoked token
+	cache.add(identity1)
+	cache.add(identity2)
+	cache.evict(identity1.GetToken())
+	cache.evict(identity1.GetToken())
+	_, ok = cache.get(identity1.GetToken())
+	assert.False(t, ok)
+	_, ok = cache.get(identity2.GetToken())
+	assert.True(t, ok)
+	assert.Equal(t, 1, cache.order.Len())
 }